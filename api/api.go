@@ -0,0 +1,266 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var (
+	ErrMissingToken = errors.New("the api needs a token")
+	ErrUnauthorized = errors.New("invalid or missing token")
+)
+
+// PREFIX is the path all routes of the api are below.
+const PREFIX = "/api/v1"
+
+// UNIX_PREFIX starts addresses of unix sockets, the path follows it.
+const UNIX_PREFIX = "unix:"
+
+const (
+	DEFAULT_MAGNET_TIMEOUT = 2 * time.Minute
+	// requests with larger bodies are refused, an uploaded torrent is the
+	// largest body there is
+	MAX_BODY_SIZE = 32 << 20
+)
+
+type Config struct {
+	// Addr is a tcp address, or UNIX_PREFIX and the path of a socket.
+	Addr string
+	// Token is sent by clients as bearer token, it must not be empty.
+	Token string
+	// MagnetTimeout bounds fetching the torrent of an added magnet link.
+	MagnetTimeout time.Duration
+}
+
+// Server serves the api of a session over http, it does not own the session.
+type Server struct {
+	cfg     Config
+	session *dgotorrent.Session
+
+	listener   net.Listener
+	httpServer *http.Server
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewServer(session *dgotorrent.Session, cfg Config) *Server {
+	if cfg.MagnetTimeout <= 0 {
+		cfg.MagnetTimeout = DEFAULT_MAGNET_TIMEOUT
+	}
+
+	return &Server{cfg: cfg, session: session}
+}
+
+// SplitAddr returns the network and the address of an api address.
+func SplitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UNIX_PREFIX) {
+		return "unix", strings.TrimPrefix(strings.TrimPrefix(addr, UNIX_PREFIX), "//")
+	}
+
+	return "tcp", addr
+}
+
+// listen opens the listener of the address. A socket file that nobody
+// listens on anymore is replaced, the socket is only accessible by its owner.
+func listen(addr string) (net.Listener, error) {
+	network, address := SplitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(address)
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(address, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Start listens on the address and serves requests in the background until
+// Close is called.
+func (s *Server) Start() error {
+	if s.cfg.Token == "" {
+		return ErrMissingToken
+	}
+
+	l, err := listen(s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	s.httpServer = &http.Server{Handler: s}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		err := s.httpServer.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			dlog.Errorf("api server stopped with error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.httpServer != nil {
+			err = s.httpServer.Close()
+		}
+
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// ServeHTTP routes the requests:
+//
+//	GET    /tasks                       list the tasks
+//	POST   /tasks                       add a task, json or multipart upload
+//	GET    /tasks/{id}                  inspect a task
+//	PATCH  /tasks/{id}                  change labels and limits of a task
+//	DELETE /tasks/{id}?delete_data=1    remove a task
+//	POST   /tasks/{id}/pause
+//	POST   /tasks/{id}/resume
+//	GET    /tasks/{id}/files
+//	PUT    /tasks/{id}/files/{index}    set the priority of a file
+//	GET    /tasks/{id}/peers
+//	GET    /tasks/{id}/trackers
+//	GET    /stats
+//	GET    /config
+//	PATCH  /config                      change the limits of the session
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, PREFIX+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "tasks":
+		route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:  s.handleList,
+			http.MethodPost: s.handleAdd,
+		})
+	case len(parts) >= 2 && parts[0] == "tasks":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveTask(w, r, id, parts[2:])
+	case len(parts) == 1 && parts[0] == "stats":
+		route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet: s.handleStats,
+		})
+	case len(parts) == 1 && parts[0] == "config":
+		route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:   s.handleConfig,
+			http.MethodPatch: s.handleUpdateConfig,
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveTask(w http.ResponseWriter, r *http.Request, id int, parts []string) {
+	task := func(fn func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { fn(w, r, id) }
+	}
+
+	switch {
+	case len(parts) == 0:
+		route(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:    task(s.handleTask),
+			http.MethodPatch:  task(s.handleUpdateTask),
+			http.MethodDelete: task(s.handleRemove),
+		})
+	case len(parts) == 1 && parts[0] == "pause":
+		route(w, r, map[string]http.HandlerFunc{http.MethodPost: task(s.handlePause)})
+	case len(parts) == 1 && parts[0] == "resume":
+		route(w, r, map[string]http.HandlerFunc{http.MethodPost: task(s.handleResume)})
+	case len(parts) == 1 && parts[0] == "files":
+		route(w, r, map[string]http.HandlerFunc{http.MethodGet: task(s.handleFiles)})
+	case len(parts) == 2 && parts[0] == "files":
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		route(w, r, map[string]http.HandlerFunc{
+			http.MethodPut: func(w http.ResponseWriter, r *http.Request) { s.handleSetPriority(w, r, id, index) },
+		})
+	case len(parts) == 1 && parts[0] == "peers":
+		route(w, r, map[string]http.HandlerFunc{http.MethodGet: task(s.handlePeers)})
+	case len(parts) == 1 && parts[0] == "trackers":
+		route(w, r, map[string]http.HandlerFunc{http.MethodGet: task(s.handleTrackers)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// route calls the handler of the method of the request.
+func route(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	if handler, ok := handlers[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+
+	allowed := make([]string, 0, len(handlers))
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
@@ -0,0 +1,351 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/Dizzrt/dgo-torrent/db"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testToken = "secret"
+
+// newTorrent creates a torrent of two files that announces to a tracker
+// without peers.
+func newTorrent(t *testing.T) []byte {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	t.Cleanup(tracker.Close)
+
+	dir := filepath.Join(t.TempDir(), "content")
+	os.MkdirAll(dir, 0755)
+	for name, size := range map[string]int{"a.bin": 1000, "b.bin": 2000} {
+		if err := os.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte{1}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, err := dgotorrent.CreateTorrent(dgotorrent.CreateOptions{Path: dir, Trackers: []string{tracker.URL + "/announce"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func newSession(t *testing.T) *dgotorrent.Session {
+	d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "api.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := dgotorrent.NewSession(dgotorrent.SessionConfig{DownloadPath: t.TempDir(), DB: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func startServer(t *testing.T, s *dgotorrent.Session, addr string) *api.Server {
+	server := api.NewServer(s, api.Config{Addr: addr, Token: testToken})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+type client struct {
+	t     *testing.T
+	http  *http.Client
+	base  string
+	token string
+}
+
+func (c *client) do(method, path, contentType string, body io.Reader, out any) int {
+	req, err := http.NewRequest(method, c.base+api.PREFIX+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func (c *client) json(method, path string, in, out any) int {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	return c.do(method, path, "application/json", body, out)
+}
+
+func TestServer(t *testing.T) {
+	s := newSession(t)
+	server := startServer(t, s, "127.0.0.1:0")
+	c := &client{t: t, http: http.DefaultClient, base: "http://" + server.Addr().String(), token: testToken}
+	raw := newTorrent(t)
+
+	// the token is required
+	if code := (&client{t: t, http: http.DefaultClient, base: c.base, token: "wrong"}).json("GET", "/tasks", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", code)
+	}
+
+	// upload the torrent
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	part, _ := w.CreateFormFile("torrent", "content.torrent")
+	part.Write(raw)
+	w.WriteField("paused", "true")
+	w.WriteField("labels", "backup")
+	w.WriteField("labels", "linux")
+	w.Close()
+
+	var task api.TaskDetail
+	if code := c.do("POST", "/tasks", w.FormDataContentType(), &form, &task); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+
+	if task.State != "paused" || len(task.Files) != 2 || len(task.Labels) != 2 || task.Size != 3000 || task.Files[1].Priority != "normal" {
+		t.Fatalf("unexpected task %+v", task)
+	}
+
+	// the same torrent from a path
+	file := filepath.Join(t.TempDir(), "content.torrent")
+	os.WriteFile(file, raw, 0644)
+	if code := c.json("POST", "/tasks", api.AddRequest{File: file}, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate, got %d", code)
+	}
+
+	if code := c.json("POST", "/tasks", api.AddRequest{Magnet: "magnet:?xt=urn:btih:invalid"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid magnet link, got %d", code)
+	}
+
+	if code := c.json("POST", "/tasks", api.AddRequest{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a torrent, got %d", code)
+	}
+
+	var tasks []api.Task
+	if code := c.json("GET", "/tasks", nil, &tasks); code != http.StatusOK || len(tasks) != 1 || tasks[0].ID != task.ID {
+		t.Fatalf("unexpected tasks %d %+v", code, tasks)
+	}
+
+	if code := c.json("GET", "/tasks/999", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown task, got %d", code)
+	}
+
+	if code := c.json("POST", "/tasks", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an empty body, got %d", code)
+	}
+
+	if code := c.json("PUT", "/tasks", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", code)
+	}
+
+	// priorities, labels and limits
+	id := "/tasks/" + strconv.Itoa(task.ID)
+	var files []api.File
+	if code := c.json("PUT", id+"/files/0", api.PriorityRequest{Priority: "skip"}, &files); code != http.StatusOK || files[0].Priority != "skip" {
+		t.Errorf("unexpected files %d %+v", code, files)
+	}
+
+	if code := c.json("PUT", id+"/files/0", api.PriorityRequest{Priority: "urgent"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown priority, got %d", code)
+	}
+
+	if code := c.json("PUT", id+"/files/5", api.PriorityRequest{Priority: "high"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown file, got %d", code)
+	}
+
+	labels := []string{"nightly"}
+	update := api.TaskUpdate{Labels: &labels, Limits: &api.Limits{Download: 1000}}
+	if code := c.json("PATCH", id, update, &task); code != http.StatusOK || task.Labels[0] != "nightly" || task.Limits.Download != 1000 {
+		t.Errorf("unexpected task %d %+v", code, task)
+	}
+
+	// the resumed task announces to its tracker
+	if code := c.json("POST", id+"/resume", nil, &task); code != http.StatusOK || task.State == "paused" {
+		t.Fatalf("unexpected task %d %+v", code, task)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var trackers []api.Tracker
+	for {
+		if code := c.json("GET", id+"/trackers", nil, &trackers); code != http.StatusOK || len(trackers) != 1 {
+			t.Fatalf("unexpected trackers %d %+v", code, trackers)
+		}
+
+		if trackers[0].LastAnnounce != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if trackers[0].LastAnnounce == nil || trackers[0].Event != "started" || trackers[0].Interval != 1800 || trackers[0].Error != "" {
+		t.Errorf("unexpected tracker %+v", trackers[0])
+	}
+
+	var peers []api.Peer
+	if code := c.json("GET", id+"/peers", nil, &peers); code != http.StatusOK || len(peers) != 0 {
+		t.Errorf("unexpected peers %d %+v", code, peers)
+	}
+
+	if code := c.json("POST", id+"/pause", nil, &task); code != http.StatusOK || task.State != "paused" {
+		t.Errorf("unexpected task %d %+v", code, task)
+	}
+
+	var stats api.Stats
+	if code := c.json("GET", "/stats", nil, &stats); code != http.StatusOK || stats.Tasks != 1 || stats.States["paused"] != 1 {
+		t.Errorf("unexpected stats %d %+v", code, stats)
+	}
+
+	// limits of the session
+	var settings api.Settings
+	if code := c.json("PATCH", "/config", api.SettingsUpdate{Limits: &api.Limits{Upload: 5000}}, &settings); code != http.StatusOK ||
+		settings.Limits.Upload != 5000 || s.Limits().Upload != 5000 {
+		t.Errorf("unexpected settings %d %+v", code, settings)
+	}
+
+	if code := c.json("DELETE", id+"?delete_data=true", nil, nil); code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", code)
+	}
+
+	if code := c.json("GET", id, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected the task to be removed, got %d", code)
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// a stale socket of a previous daemon is replaced
+	path := filepath.Join(dir, "api.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	startServer(t, newSession(t), api.UNIX_PREFIX+path)
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket %v %v", info, err)
+	}
+
+	c := &client{t: t, base: "http://daemon", token: testToken, http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+
+	var settings api.Settings
+	if code := c.json("GET", "/config", nil, &settings); code != http.StatusOK || settings.Paused == nil {
+		t.Errorf("unexpected settings %d %+v", code, settings)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	server := api.NewServer(nil, api.Config{Addr: "127.0.0.1:0"})
+	if err := server.Start(); err != api.ErrMissingToken {
+		t.Errorf("expected the server to refuse an empty token, got %v", err)
+	}
+
+	if network, addr := api.SplitAddr("unix:///run/dgo.sock"); network != "unix" || addr != "/run/dgo.sock" {
+		t.Errorf("unexpected address %s %s", network, addr)
+	}
+
+	if network, addr := api.SplitAddr("localhost:6880"); network != "tcp" || !strings.HasSuffix(addr, ":6880") {
+		t.Errorf("unexpected address %s %s", network, addr)
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := startServer(t, newSession(t), "127.0.0.1:0")
+	c := api.NewClient(server.Addr().String(), testToken)
+	ctx := context.Background()
+
+	task, err := c.Add(ctx, api.AddRequest{Torrent: newTorrent(t), Paused: true, Exclude: []string{"b.bin"}})
+	if err != nil || task.State != "paused" {
+		t.Fatalf("unexpected task %+v %v", task, err)
+	}
+
+	if tasks, err := c.Tasks(ctx); err != nil || len(tasks) != 1 || tasks[0].ID != task.ID {
+		t.Fatalf("unexpected tasks %+v %v", tasks, err)
+	}
+
+	files, err := c.SetPriority(ctx, task.ID, 1, "high")
+	if err != nil || len(files) != 2 || files[1].Priority != "high" {
+		t.Fatalf("unexpected files %+v %v", files, err)
+	}
+
+	// errors of the api keep their status
+	var apiErr *api.Error
+	if _, err := c.Task(ctx, 999); !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+
+	if _, err := api.NewClient(server.Addr().String(), "wrong").Tasks(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+
+	if err := c.Remove(ctx, task.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if tasks, err := c.Tasks(ctx); err != nil || len(tasks) != 0 {
+		t.Errorf("unexpected tasks %+v %v", tasks, err)
+	}
+}
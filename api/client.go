@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Error is an error response of the api.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+// Client calls the api of a daemon.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// NewClient returns a client of the daemon at the address, a tcp address or
+// UNIX_PREFIX and the path of a socket.
+func NewClient(addr, token string) *Client {
+	network, address := SplitAddr(addr)
+	if network != "unix" {
+		return &Client{base: "http://" + address + PREFIX, token: token, http: http.DefaultClient}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+
+	// the host is ignored by the dialer
+	return &Client{base: "http://daemon" + PREFIX, token: token, http: &http.Client{Transport: transport}}
+}
+
+// do sends in as json and decodes the response into out if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+
+		return &Error{Status: resp.StatusCode, Message: e.Error}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func taskPath(id int) string {
+	return "/tasks/" + strconv.Itoa(id)
+}
+
+func (c *Client) Tasks(ctx context.Context) ([]Task, error) {
+	var tasks []Task
+	err := c.do(ctx, http.MethodGet, "/tasks", nil, &tasks)
+	return tasks, err
+}
+
+func (c *Client) Add(ctx context.Context, req AddRequest) (TaskDetail, error) {
+	var task TaskDetail
+	err := c.do(ctx, http.MethodPost, "/tasks", req, &task)
+	return task, err
+}
+
+func (c *Client) Task(ctx context.Context, id int) (TaskDetail, error) {
+	var task TaskDetail
+	err := c.do(ctx, http.MethodGet, taskPath(id), nil, &task)
+	return task, err
+}
+
+func (c *Client) UpdateTask(ctx context.Context, id int, update TaskUpdate) (TaskDetail, error) {
+	var task TaskDetail
+	err := c.do(ctx, http.MethodPatch, taskPath(id), update, &task)
+	return task, err
+}
+
+func (c *Client) Remove(ctx context.Context, id int, deleteData bool) error {
+	return c.do(ctx, http.MethodDelete, taskPath(id)+"?delete_data="+strconv.FormatBool(deleteData), nil, nil)
+}
+
+func (c *Client) Pause(ctx context.Context, id int) (TaskDetail, error) {
+	var task TaskDetail
+	err := c.do(ctx, http.MethodPost, taskPath(id)+"/pause", nil, &task)
+	return task, err
+}
+
+func (c *Client) Resume(ctx context.Context, id int) (TaskDetail, error) {
+	var task TaskDetail
+	err := c.do(ctx, http.MethodPost, taskPath(id)+"/resume", nil, &task)
+	return task, err
+}
+
+func (c *Client) Files(ctx context.Context, id int) ([]File, error) {
+	var files []File
+	err := c.do(ctx, http.MethodGet, taskPath(id)+"/files", nil, &files)
+	return files, err
+}
+
+// SetPriority sets the priority of the file with the index and returns the
+// files of the task.
+func (c *Client) SetPriority(ctx context.Context, id, index int, priority string) ([]File, error) {
+	var files []File
+	path := taskPath(id) + "/files/" + strconv.Itoa(index)
+	err := c.do(ctx, http.MethodPut, path, PriorityRequest{Priority: priority}, &files)
+	return files, err
+}
+
+func (c *Client) Peers(ctx context.Context, id int) ([]Peer, error) {
+	var peers []Peer
+	err := c.do(ctx, http.MethodGet, taskPath(id)+"/peers", nil, &peers)
+	return peers, err
+}
+
+func (c *Client) Trackers(ctx context.Context, id int) ([]Tracker, error) {
+	var trackers []Tracker
+	err := c.do(ctx, http.MethodGet, taskPath(id)+"/trackers", nil, &trackers)
+	return trackers, err
+}
+
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
+
+func (c *Client) Settings(ctx context.Context) (Settings, error) {
+	var settings Settings
+	err := c.do(ctx, http.MethodGet, "/config", nil, &settings)
+	return settings, err
+}
+
+func (c *Client) UpdateSettings(ctx context.Context, update SettingsUpdate) (Settings, error) {
+	var settings Settings
+	err := c.do(ctx, http.MethodPatch, "/config", update, &settings)
+	return settings, err
+}
@@ -0,0 +1,427 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+// errBadRequest marks errors of the request, as opposed to ones of the
+// session.
+var errBadRequest = errors.New("bad request")
+
+func badRequest(err error) error {
+	return fmt.Errorf("%w: %v", errBadRequest, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		dlog.Errorf("failed to write api response with error: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// errorStatus maps the errors of the session to http status codes.
+func errorStatus(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, dgotorrent.ErrTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dgotorrent.ErrDuplicateTask):
+		return http.StatusConflict
+	case errors.Is(err, dgotorrent.ErrSessionClosed):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, dgotorrent.ErrInvalidFileIndex),
+		errors.Is(err, dgotorrent.ErrNoFilesSelected),
+		errors.Is(err, dgotorrent.ErrInvalidTorrentFile):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, dgotorrent.ErrNoMetadataPeers):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	writeError(w, errorStatus(err), err)
+}
+
+func readJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return err
+		}
+
+		return badRequest(err)
+	}
+
+	return nil
+}
+
+func (s *Server) taskDetail(id int) (TaskDetail, error) {
+	t, err := s.session.Task(id)
+	if err != nil {
+		return TaskDetail{}, err
+	}
+
+	stats, err := s.session.TaskStats(id)
+	if err != nil {
+		return TaskDetail{}, err
+	}
+
+	limits, err := s.session.TaskLimits(id)
+	if err != nil {
+		return TaskDetail{}, err
+	}
+
+	return TaskDetail{
+		Task:        newTask(t, stats),
+		Comment:     t.Torrent.Comment,
+		Private:     t.Torrent.Info.Private,
+		PieceLength: t.Torrent.Info.PieceLength,
+		Limits:      newLimits(limits),
+		Files:       newFiles(t),
+	}, nil
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	tasks := make([]Task, 0)
+	for _, t := range s.session.Tasks() {
+		// tasks removed in the meantime are left out
+		stats, err := s.session.TaskStats(t.ID)
+		if err != nil {
+			continue
+		}
+
+		tasks = append(tasks, newTask(t, stats))
+	}
+
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// readAddRequest reads a json request or a multipart form with the torrent
+// file in the "torrent" field and the other fields of AddRequest as values.
+func readAddRequest(r *http.Request) (AddRequest, error) {
+	var req AddRequest
+	if err := r.ParseMultipartForm(MAX_BODY_SIZE); err != nil {
+		if !errors.Is(err, http.ErrNotMultipart) {
+			return req, badRequest(err)
+		}
+
+		return req, readJSON(r, &req)
+	}
+
+	if file, _, err := r.FormFile("torrent"); err == nil {
+		defer file.Close()
+
+		if req.Torrent, err = io.ReadAll(file); err != nil {
+			return req, err
+		}
+	}
+
+	form := r.MultipartForm.Value
+	req.File = r.FormValue("file")
+	req.Magnet = r.FormValue("magnet")
+	req.Path = r.FormValue("path")
+	req.Select = form["select"]
+	req.Exclude = form["exclude"]
+	req.Labels = form["labels"]
+
+	if paused := r.FormValue("paused"); paused != "" {
+		var err error
+		if req.Paused, err = strconv.ParseBool(paused); err != nil {
+			return req, badRequest(err)
+		}
+	}
+
+	return req, nil
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	req, err := readAddRequest(r)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	sources := 0
+	for _, set := range []bool{len(req.Torrent) > 0, req.File != "", req.Magnet != ""} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		writeErr(w, badRequest(errors.New("expected exactly one of torrent, file and magnet")))
+		return
+	}
+
+	opts := dgotorrent.AddOptions{
+		Path:    req.Path,
+		Select:  req.Select,
+		Exclude: req.Exclude,
+		Paused:  req.Paused,
+		Labels:  req.Labels,
+	}
+
+	var task dgotorrent.Task
+	switch {
+	case req.Magnet != "":
+		m, err := dgotorrent.ParseMagnet(req.Magnet)
+		if err != nil {
+			writeErr(w, badRequest(err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.MagnetTimeout)
+		defer cancel()
+
+		task, err = s.session.AddMagnet(ctx, m, opts)
+	case req.File != "":
+		var file *os.File
+		if file, err = os.Open(req.File); err != nil {
+			writeErr(w, badRequest(err))
+			return
+		}
+		defer file.Close()
+
+		var tf *dgotorrent.TorrentFile
+		if tf, err = dgotorrent.NewTorrentFile(file); err != nil {
+			writeErr(w, badRequest(err))
+			return
+		}
+
+		task, err = s.session.Add(tf, opts)
+	default:
+		var tf *dgotorrent.TorrentFile
+		if tf, err = dgotorrent.NewTorrentFile(bytes.NewReader(req.Torrent)); err != nil {
+			writeErr(w, badRequest(err))
+			return
+		}
+
+		task, err = s.session.Add(tf, opts)
+	}
+
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	detail, err := s.taskDetail(task.ID)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, detail)
+}
+
+func (s *Server) handleTask(w http.ResponseWriter, r *http.Request, id int) {
+	detail, err := s.taskDetail(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request, id int) {
+	var req TaskUpdate
+	if err := readJSON(r, &req); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	if req.Labels != nil {
+		if err := s.session.SetLabels(id, *req.Labels); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+
+	if req.Limits != nil {
+		if err := s.session.SetTaskLimits(id, req.Limits.rates()); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+
+	s.handleTask(w, r, id)
+}
+
+func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request, id int) {
+	deleteData := false
+	if value := r.URL.Query().Get("delete_data"); value != "" {
+		var err error
+		if deleteData, err = strconv.ParseBool(value); err != nil {
+			writeErr(w, badRequest(err))
+			return
+		}
+	}
+
+	if err := s.session.Remove(id, deleteData); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request, id int) {
+	if err := s.session.Pause(id); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	s.handleTask(w, r, id)
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request, id int) {
+	if err := s.session.Resume(id); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	s.handleTask(w, r, id)
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := s.session.Task(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newFiles(t))
+}
+
+func (s *Server) handleSetPriority(w http.ResponseWriter, r *http.Request, id, index int) {
+	var req PriorityRequest
+	if err := readJSON(r, &req); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	priority, err := dgotorrent.ParseFilePriority(req.Priority)
+	if err != nil {
+		writeErr(w, badRequest(err))
+		return
+	}
+
+	if err := s.session.SetFilePriority(id, index, priority); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	s.handleFiles(w, r, id)
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request, id int) {
+	stats, err := s.session.PeerStats(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	peers := make([]Peer, 0, len(stats))
+	for _, p := range stats {
+		peers = append(peers, Peer{Address: p.Peer.String(), Seed: p.Seed, Transfer: newTransfer(p.TransferStats)})
+	}
+
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (s *Server) handleTrackers(w http.ResponseWriter, r *http.Request, id int) {
+	statuses, err := s.session.Trackers(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	trackers := make([]Tracker, 0, len(statuses))
+	for _, status := range statuses {
+		trackers = append(trackers, newTracker(status))
+	}
+
+	writeJSON(w, http.StatusOK, trackers)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		States:  make(map[string]int),
+		Profile: s.session.ScheduleStatus().Profile,
+		Limits:  newLimits(s.session.Limits()),
+	}
+
+	for _, t := range s.session.Tasks() {
+		ts, err := s.session.TaskStats(t.ID)
+		if err != nil {
+			continue
+		}
+
+		stats.Tasks++
+		stats.States[t.State.String()]++
+		stats.Peers += ts.Peers
+		stats.Downloaded += ts.Downloaded
+		stats.Uploaded += ts.Uploaded
+		stats.Wasted += ts.Wasted
+		stats.DownloadRate += ts.DownloadRate
+		stats.UploadRate += ts.UploadRate
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) settings() Settings {
+	schedule := s.session.ScheduleStatus()
+
+	return Settings{
+		Limits:     newLimits(s.session.Limits()),
+		PeerLimits: newLimits(s.session.PeerLimits()),
+		Profile:    schedule.Profile,
+		Paused:     schedule.Paused,
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.settings())
+}
+
+func (s *Server) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
+	var req SettingsUpdate
+	if err := readJSON(r, &req); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	if req.Limits != nil {
+		s.session.SetLimits(req.Limits.rates())
+	}
+
+	if req.PeerLimits != nil {
+		s.session.SetPeerLimits(req.PeerLimits.rates())
+	}
+
+	writeJSON(w, http.StatusOK, s.settings())
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/hex"
+	"strings"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+// Limits are rates in bytes per second, 0 is unlimited.
+type Limits struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+func newLimits(rates dgotorrent.RateLimits) Limits {
+	return Limits{Download: rates.Download, Upload: rates.Upload}
+}
+
+func (l Limits) rates() dgotorrent.RateLimits {
+	return dgotorrent.RateLimits{Download: l.Download, Upload: l.Upload}
+}
+
+// Transfer are the byte counts and rates of a task or a peer.
+type Transfer struct {
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	Wasted       int64   `json:"wasted"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+func newTransfer(stats dgotorrent.TransferStats) Transfer {
+	return Transfer{
+		Downloaded:   stats.Downloaded,
+		Uploaded:     stats.Uploaded,
+		Wasted:       stats.Wasted,
+		DownloadRate: stats.DownloadRate,
+		UploadRate:   stats.UploadRate,
+	}
+}
+
+// Task is a task in the lists of the api. ETA is in seconds, -1 while it is
+// unknown.
+type Task struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	InfoHash      string    `json:"info_hash"`
+	Path          string    `json:"path"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	Labels        []string  `json:"labels"`
+	QueuePosition int       `json:"queue_position"`
+	CreatedAt     time.Time `json:"created_at"`
+	Size          int64     `json:"size"`
+	Completed     int64     `json:"completed"`
+	Wanted        int64     `json:"wanted"`
+	Progress      float64   `json:"progress"`
+	Pieces        int       `json:"pieces"`
+	TotalPieces   int       `json:"total_pieces"`
+	Peers         int       `json:"peers"`
+	Seeds         int       `json:"seeds"`
+	ETA           int64     `json:"eta"`
+	Ratio         float64   `json:"ratio"`
+	Transfer
+}
+
+func newTask(t dgotorrent.Task, stats dgotorrent.TaskStats) Task {
+	task := Task{
+		ID:            t.ID,
+		Name:          t.Name,
+		InfoHash:      hex.EncodeToString(t.Torrent.Info.Hash[:]),
+		Path:          t.Path,
+		State:         t.State.String(),
+		Labels:        t.Labels,
+		QueuePosition: t.QueuePosition,
+		CreatedAt:     t.CreatedAt,
+		Size:          t.Torrent.Info.Length,
+		Completed:     stats.Completed,
+		Wanted:        stats.Wanted,
+		Pieces:        stats.Pieces,
+		TotalPieces:   stats.TotalPieces,
+		Peers:         stats.Peers,
+		Seeds:         stats.Seeds,
+		ETA:           int64(stats.ETA.Seconds()),
+		Ratio:         stats.Ratio,
+		Transfer:      newTransfer(stats.TransferStats),
+	}
+
+	task.Error, _ = t.Status[dgotorrent.STATUS_ERROR].(string)
+	if task.Labels == nil {
+		task.Labels = []string{}
+	}
+
+	if stats.ETA < 0 {
+		task.ETA = -1
+	}
+
+	if stats.Wanted > 0 {
+		task.Progress = float64(stats.Completed) / float64(stats.Wanted)
+	}
+
+	return task
+}
+
+// TaskDetail is a task with the settings and files it is inspected with.
+type TaskDetail struct {
+	Task
+	Comment     string `json:"comment,omitempty"`
+	Private     bool   `json:"private"`
+	PieceLength int64  `json:"piece_length"`
+	Limits      Limits `json:"limits"`
+	Files       []File `json:"files"`
+}
+
+// File is a file of a task, Index is the one priorities are set with.
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Priority string `json:"priority"`
+}
+
+// newFiles lists the files of the task without the padding files, they keep
+// their indices.
+func newFiles(t dgotorrent.Task) []File {
+	files := make([]File, 0)
+	for i, f := range t.Torrent.Info.FileList() {
+		if f.IsPadding() {
+			continue
+		}
+
+		files = append(files, File{
+			Index:    i,
+			Path:     strings.Join(f.Path, "/"),
+			Length:   f.Length,
+			Priority: t.FilePriority(i).String(),
+		})
+	}
+
+	return files
+}
+
+type Peer struct {
+	Address string `json:"address"`
+	Seed    bool   `json:"seed"`
+	Transfer
+}
+
+// Tracker is a tracker of a task with the result of its last announce, the
+// interval is in seconds.
+type Tracker struct {
+	URL          string     `json:"url"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+	Event        string     `json:"event,omitempty"`
+	Peers        int        `json:"peers"`
+	Interval     int64      `json:"interval"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func newTracker(status dgotorrent.TrackerStatus) Tracker {
+	tracker := Tracker{
+		URL:      status.URL,
+		Peers:    status.Peers,
+		Interval: int64(status.Interval.Seconds()),
+		Error:    status.Error,
+	}
+
+	if !status.Time.IsZero() {
+		tracker.LastAnnounce = &status.Time
+		tracker.Event = status.Event.String()
+	}
+
+	return tracker
+}
+
+// Stats are the totals of all tasks of the session.
+type Stats struct {
+	Tasks   int            `json:"tasks"`
+	States  map[string]int `json:"states"`
+	Peers   int            `json:"peers"`
+	Profile string         `json:"profile"`
+	Limits  Limits         `json:"limits"`
+	Transfer
+}
+
+// Settings are the settings of the session that can be changed at runtime.
+type Settings struct {
+	Limits     Limits `json:"limits"`
+	PeerLimits Limits `json:"peer_limits"`
+	// Profile and Paused are set by the schedule of the session.
+	Profile string `json:"profile"`
+	Paused  []int  `json:"paused"`
+}
+
+// SettingsUpdate changes the settings that are set.
+type SettingsUpdate struct {
+	Limits     *Limits `json:"limits,omitempty"`
+	PeerLimits *Limits `json:"peer_limits,omitempty"`
+}
+
+// AddRequest adds a task from exactly one of Torrent, the content of a
+// torrent file, File, the path of a torrent file on the host of the daemon,
+// or Magnet.
+type AddRequest struct {
+	Torrent []byte   `json:"torrent,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Magnet  string   `json:"magnet,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Select  []string `json:"select,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Paused  bool     `json:"paused,omitempty"`
+	Labels  []string `json:"labels,omitempty"`
+}
+
+// TaskUpdate changes the settings of a task that are set.
+type TaskUpdate struct {
+	Labels *[]string `json:"labels,omitempty"`
+	Limits *Limits   `json:"limits,omitempty"`
+}
+
+type PriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
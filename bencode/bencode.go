@@ -2,8 +2,8 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"reflect"
 	"sort"
@@ -24,6 +24,20 @@ func Unmarshal(r io.Reader) (any, error) {
 	return res, err
 }
 
+// UnmarshalPrefix decodes the value at the start of data and returns the
+// number of bytes it occupies, the remaining bytes are left untouched.
+func UnmarshalPrefix(data []byte) (any, int, error) {
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+
+	res, err := parse(br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return res, len(data) - r.Len() - br.Buffered(), nil
+}
+
 func Marshal(v any) (string, error) {
 	val := reflect.ValueOf(v)
 	if val.Kind() == reflect.Ptr {
@@ -51,7 +65,6 @@ func marshal(v reflect.Value) (string, error) {
 	case reflect.Struct:
 		ret, err = marshalStruct(v)
 	default:
-		fmt.Println("[debug]" + v.Kind().String())
 		err = ErrInvalidType
 	}
 
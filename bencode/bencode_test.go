@@ -62,3 +62,21 @@ func TestMarshal(t *testing.T) {
 	defer out.Close()
 	out.Write([]byte(res))
 }
+
+func TestUnmarshalPrefix(t *testing.T) {
+	data := []byte("d8:msg_typei1e5:piecei0eeRAWDATA")
+
+	res, n, err := bencode.UnmarshalPrefix(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(data)-len("RAWDATA") {
+		t.Errorf("expected prefix length %d, got %d", len(data)-len("RAWDATA"), n)
+	}
+
+	dict, ok := res.(map[string]any)
+	if !ok || dict["msg_type"] != int64(1) || dict["piece"] != int64(0) {
+		t.Errorf("unexpected result: %v", res)
+	}
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	outputPath   string
+	selectFiles  []string
+	excludeFiles []string
+	addLocal     bool
+	addPaused    bool
+	addLabels    []string
+)
+
+var addCmd = &cobra.Command{
+	Use:   "add <torrent file | magnet link>",
+	Short: "Add a torrent file or a magnet link to the daemon",
+	Long: `Add a torrent file or a magnet link to the daemon, which downloads and seeds
+it in the background. With --local the torrent is downloaded in the foreground
+without a daemon instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !addLocal {
+			return addRemote(cmd, args[0])
+		}
+
+		// the task of a local download only lives as long as the command
+		for _, name := range []string{"paused", "label", "host", "token", "json"} {
+			if cmd.Flags().Changed(name) {
+				return fmt.Errorf("--%s can not be used with --local", name)
+			}
+		}
+
+		cfg := config.Instance()
+
+		// an interrupt stops the download gracefully
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		encryption, err := dgotorrent.ParseEncryptionMode(cfg.GetEncryption())
+		if err != nil {
+			return err
+		}
+
+		// a local download does not accept peers
+		socket, sources, closeNetwork, err := openNetwork(0)
+		if err != nil {
+			return err
+		}
+		defer closeNetwork()
+
+		var tf *dgotorrent.TorrentFile
+		if dgotorrent.IsMagnet(args[0]) {
+			m, err := dgotorrent.ParseMagnet(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("fetching metadata of %x\n", m.InfoHash)
+			tf, err = m.Resolve(ctx, cfg.GetPeerID(), sources...)
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			tf, err = readTorrentFile(args[0])
+			if err != nil {
+				return err
+			}
+		}
+
+		task, err := dgotorrent.NewTask(*tf)
+		if err != nil {
+			return err
+		}
+
+		if outputPath != "" {
+			task.Path = outputPath
+		}
+
+		if len(selectFiles) > 0 || len(excludeFiles) > 0 {
+			n, err := task.SelectFiles(selectFiles, excludeFiles)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("downloading %d of %d files\n", n, len(tf.Info.Files))
+		}
+
+		process := dgotorrent.NewProcess(&task)
+		process.Sources = sources
+		process.UTP = socket
+		process.Encryption = encryption
+		process.Limits.Set(dgotorrent.RateLimits{Download: cfg.GetDownloadLimit(), Upload: cfg.GetUploadLimit()})
+		process.SetPeerLimits(dgotorrent.RateLimits{Download: cfg.GetPeerDownloadLimit(), Upload: cfg.GetPeerUploadLimit()})
+		process.LimitOverhead = cfg.GetLimitOverhead()
+
+		defer showProgress(process.Events)()
+
+		return process.Start(ctx)
+	},
+}
+
+// addRemote adds the torrent to the daemon, the torrent file is uploaded so
+// the daemon does not need access to it.
+func addRemote(cmd *cobra.Command, arg string) error {
+	req := api.AddRequest{
+		Path:    outputPath,
+		Select:  selectFiles,
+		Exclude: excludeFiles,
+		Paused:  addPaused,
+		Labels:  addLabels,
+	}
+
+	// the daemon resolves relative paths against its own working directory
+	if req.Path != "" {
+		path, err := filepath.Abs(req.Path)
+		if err != nil {
+			return err
+		}
+		req.Path = path
+	}
+
+	if dgotorrent.IsMagnet(arg) {
+		req.Magnet = arg
+	} else {
+		// parsing the file first reports invalid ones without the daemon
+		if _, err := readTorrentFile(arg); err != nil {
+			return err
+		}
+
+		raw, err := os.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		req.Torrent = raw
+	}
+
+	task, err := newClient(cmd).Add(cmd.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput(cmd) {
+		return printJSON(task)
+	}
+
+	if verbose {
+		printTaskDetail(task)
+		return nil
+	}
+
+	fmt.Printf("added task %d %s: %s\n", task.ID, task.Name, task.State)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(addCmd)
+
+	addCmd.Flags().StringVarP(&outputPath, "output", "o", "", "download directory, defaults to the configured download path")
+	addCmd.Flags().StringSliceVarP(&selectFiles, "select", "s", nil, "glob pattern or index of the files to download, can be repeated")
+	addCmd.Flags().StringSliceVarP(&excludeFiles, "exclude", "x", nil, "glob pattern or index of the files to skip, can be repeated")
+	addCmd.Flags().BoolVar(&addLocal, "local", false, "download in the foreground without the daemon")
+	addCmd.Flags().BoolVar(&addPaused, "paused", false, "add the task paused")
+	addCmd.Flags().StringSliceVarP(&addLabels, "label", "l", nil, "label of the task, can be repeated")
+	remoteCommands(addCmd)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	removeData bool
+)
+
+// controlCmd returns a command that calls the action for each task id and
+// prints the tasks it returns.
+func controlCmd(use, short string, action func(*api.Client, context.Context, int) (api.TaskDetail, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <task id>...",
+		Short: short,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ids, err := parseTaskIDs(args)
+			if err != nil {
+				return err
+			}
+
+			client := newClient(cmd)
+			tasks := make([]api.TaskDetail, 0, len(ids))
+			for _, id := range ids {
+				task, err := action(client, cmd.Context(), id)
+				if err != nil {
+					return fmt.Errorf("task %d: %w", id, err)
+				}
+				tasks = append(tasks, task)
+			}
+
+			if jsonOutput(cmd) {
+				return printJSON(tasks)
+			}
+
+			for _, task := range tasks {
+				fmt.Printf("%d %s: %s\n", task.ID, task.Name, task.State)
+			}
+
+			return nil
+		},
+	}
+}
+
+var pauseCmd = controlCmd("pause", "Pause tasks of the daemon", (*api.Client).Pause)
+
+var resumeCmd = controlCmd("resume", "Resume tasks of the daemon", (*api.Client).Resume)
+
+var removeCmd = &cobra.Command{
+	Use:   "remove <task id>...",
+	Short: "Remove tasks from the daemon",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args)
+		if err != nil {
+			return err
+		}
+
+		client := newClient(cmd)
+		for _, id := range ids {
+			if err := client.Remove(cmd.Context(), id, removeData); err != nil {
+				return fmt.Errorf("task %d: %w", id, err)
+			}
+
+			if !jsonOutput(cmd) {
+				fmt.Printf("removed task %d\n", id)
+			}
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(ids)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(removeCmd)
+
+	remoteCommands(pauseCmd, resumeCmd, removeCmd)
+	removeCmd.Flags().BoolVarP(&removeData, "delete-data", "d", false, "delete the downloaded data of the tasks too")
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	createOutput      string
+	createTrackers    []string
+	createWebSeeds    []string
+	createComment     string
+	createPrivate     bool
+	createPieceLength int64
+	createVersion     string
+)
+
+var createVersions = map[string]int{
+	"v1":     dgotorrent.CREATE_V1,
+	"v2":     dgotorrent.CREATE_V2,
+	"hybrid": dgotorrent.CREATE_HYBRID,
+}
+
+var createCmd = &cobra.Command{
+	Use:   "create <file | directory>",
+	Short: "Create a torrent file from a file or a directory",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		version, ok := createVersions[createVersion]
+		if !ok {
+			return fmt.Errorf("unknown meta version %q, expected v1, v2 or hybrid", createVersion)
+		}
+
+		raw, err := dgotorrent.CreateTorrent(dgotorrent.CreateOptions{
+			Path:        args[0],
+			Trackers:    createTrackers,
+			URLList:     createWebSeeds,
+			Comment:     createComment,
+			Private:     createPrivate,
+			PieceLength: createPieceLength,
+			Version:     version,
+		})
+		if err != nil {
+			return err
+		}
+
+		output := createOutput
+		if output == "" {
+			output = filepath.Base(filepath.Clean(args[0])) + ".torrent"
+		}
+
+		if err := os.WriteFile(output, raw, 0644); err != nil {
+			return err
+		}
+
+		fmt.Printf("created %s\n", output)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(createCmd)
+
+	createCmd.Flags().StringVarP(&createOutput, "output", "o", "", "output torrent file, defaults to the name of the content with a .torrent suffix")
+	createCmd.Flags().StringSliceVarP(&createTrackers, "tracker", "t", nil, "announce url of a tracker, can be repeated")
+	createCmd.Flags().StringSliceVarP(&createWebSeeds, "web-seed", "w", nil, "url of a web seed, can be repeated")
+	createCmd.Flags().StringVarP(&createComment, "comment", "c", "", "comment of the torrent")
+	createCmd.Flags().BoolVar(&createPrivate, "private", false, "mark the torrent as private")
+	createCmd.Flags().Int64VarP(&createPieceLength, "piece-length", "l", 0, "piece length in bytes, chosen from the size of the content by default")
+	createCmd.Flags().StringVarP(&createVersion, "meta-version", "m", "v1", "meta version of the torrent, one of v1, v2 and hybrid")
+}
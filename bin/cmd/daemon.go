@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	daemonAddr string
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the session of the client and serve its HTTP/JSON API",
+	Long: `Run the session of the client until it is interrupted. Tasks added through
+the api are downloaded and seeded in the background and restored on the next
+start. Clients authenticate with the token in the config file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := config.Instance()
+
+		sessionCfg, err := dgotorrent.DefaultSessionConfig()
+		if err != nil {
+			return err
+		}
+
+		// inbound peers reach the session on its listen port
+		socket, sources, closeNetwork, err := openNetwork(cfg.GetListenPort())
+		if err != nil {
+			return err
+		}
+		defer closeNetwork()
+
+		sessionCfg.UTP = socket
+		sessionCfg.Sources = sources
+
+		session, err := dgotorrent.NewSession(sessionCfg)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		addr := daemonAddr
+		if addr == "" {
+			addr = cfg.GetDaemonAddr()
+		}
+
+		server := api.NewServer(session, api.Config{Addr: addr, Token: cfg.GetDaemonToken()})
+		if err = server.Start(); err != nil {
+			return err
+		}
+		defer server.Close()
+
+		fmt.Printf("api listening on %s, %d tasks restored\n", server.Addr(), len(session.Tasks()))
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().StringVar(&daemonAddr, "addr", "", "api address or unix:<path> of a socket, defaults to the configured address")
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/spf13/cobra"
+)
+
+var filesCmd = &cobra.Command{
+	Use:   "files <task id>",
+	Short: "List the files of a task of the daemon with their priorities",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args)
+		if err != nil {
+			return err
+		}
+
+		files, err := newClient(cmd).Files(cmd.Context(), ids[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(files)
+		}
+
+		return printFiles(files)
+	},
+}
+
+var setPriorityCmd = &cobra.Command{
+	Use:   "set-priority <task id> <skip | low | normal | high> <file index>...",
+	Short: "Set the priority of files of a task of the daemon",
+	Long: `Set the priority of files of a task of the daemon. The indices are the ones
+listed by the files command, skipped files are not downloaded.`,
+	Args: cobra.MinimumNArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args[:1])
+		if err != nil {
+			return err
+		}
+
+		indices := make([]int, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			index, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid file index %q", arg)
+			}
+			indices = append(indices, index)
+		}
+
+		client := newClient(cmd)
+		var files []api.File
+		for _, index := range indices {
+			if files, err = client.SetPriority(cmd.Context(), ids[0], index, args[1]); err != nil {
+				return fmt.Errorf("file %d: %w", index, err)
+			}
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(files)
+		}
+
+		if verbose {
+			return printFiles(files)
+		}
+
+		fmt.Printf("set %d files of task %d to %s\n", len(indices), ids[0], args[1])
+		return nil
+	},
+}
+
+func printFiles(files []api.File) error {
+	t := newTable("INDEX", "PRIORITY", "SIZE", "PATH")
+	for _, f := range files {
+		t.row(strconv.Itoa(f.Index), f.Priority, formatSize(f.Length), f.Path)
+	}
+
+	return t.flush()
+}
+
+func init() {
+	rootCmd.AddCommand(filesCmd)
+	rootCmd.AddCommand(setPriorityCmd)
+
+	remoteCommands(filesCmd, setPriorityCmd)
+}
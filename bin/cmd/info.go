@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/spf13/cobra"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info <task id>",
+	Short: "Show the details of a task of the daemon",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args)
+		if err != nil {
+			return err
+		}
+
+		client := newClient(cmd)
+		task, err := client.Task(cmd.Context(), ids[0])
+		if err != nil {
+			return err
+		}
+
+		var trackers []api.Tracker
+		if verbose {
+			if trackers, err = client.Trackers(cmd.Context(), task.ID); err != nil {
+				return err
+			}
+		}
+
+		if jsonOutput(cmd) {
+			if verbose {
+				return printJSON(struct {
+					api.TaskDetail
+					Trackers []api.Tracker `json:"trackers"`
+				}{task, trackers})
+			}
+
+			return printJSON(task)
+		}
+
+		printTaskDetail(task)
+		if !verbose {
+			return nil
+		}
+
+		fmt.Println("\nfiles:")
+		if err := printFiles(task.Files); err != nil {
+			return err
+		}
+
+		fmt.Println("\ntrackers:")
+		return printTrackers(trackers)
+	},
+}
+
+func printTaskDetail(task api.TaskDetail) {
+	field := func(name, format string, a ...any) {
+		fmt.Printf("%-14s "+format+"\n", append([]any{name + ":"}, a...)...)
+	}
+
+	field("id", "%d", task.ID)
+	field("name", "%s", task.Name)
+	field("info hash", "%s", task.InfoHash)
+	field("state", "%s", task.State)
+	if task.Error != "" {
+		field("error", "%s", task.Error)
+	}
+	field("path", "%s", task.Path)
+	field("labels", "%s", formatLabels(task.Labels))
+	field("progress", "%s of %s, %d/%d pieces", formatProgress(task.Progress), formatSize(task.Wanted), task.Pieces, task.TotalPieces)
+	field("size", "%s", formatSize(task.Size))
+	field("peers", "%d (%d seeds)", task.Peers, task.Seeds)
+	field("download", "%s, %s total", formatRate(task.DownloadRate), formatSize(task.Downloaded))
+	field("upload", "%s, %s total", formatRate(task.UploadRate), formatSize(task.Uploaded))
+	field("ratio", "%.2f", task.Ratio)
+	field("eta", "%s", formatETA(task.ETA))
+	field("limits", "down %s, up %s", formatLimit(task.Limits.Download), formatLimit(task.Limits.Upload))
+
+	if verbose {
+		field("queue", "%d", task.QueuePosition)
+		field("wasted", "%s", formatSize(task.Wasted))
+		field("piece length", "%s", formatSize(task.PieceLength))
+		field("private", "%s", strconv.FormatBool(task.Private))
+		field("created", "%s", task.CreatedAt.Local().Format(time.DateTime))
+		if task.Comment != "" {
+			field("comment", "%s", task.Comment)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+
+	remoteCommands(infoCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tasks of the daemon",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tasks, err := newClient(cmd).Tasks(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(tasks)
+		}
+
+		header := []string{"ID", "NAME", "STATE", "PROGRESS", "SIZE", "DOWN", "UP", "ETA"}
+		if verbose {
+			header = append(header, "PEERS", "RATIO", "LABELS", "PATH")
+		}
+
+		t := newTable(header...)
+		for _, task := range tasks {
+			row := []string{
+				strconv.Itoa(task.ID),
+				task.Name,
+				task.State,
+				formatProgress(task.Progress),
+				formatSize(task.Wanted),
+				formatRate(task.DownloadRate),
+				formatRate(task.UploadRate),
+				formatETA(task.ETA),
+			}
+
+			if verbose {
+				row = append(row,
+					strconv.Itoa(task.Peers),
+					strconv.FormatFloat(task.Ratio, 'f', 2, 64),
+					formatLabels(task.Labels),
+					task.Path,
+				)
+			}
+
+			t.row(row...)
+		}
+
+		return t.flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	remoteCommands(listCmd)
+}
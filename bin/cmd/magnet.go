@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var magnetCmd = &cobra.Command{
+	Use:   "magnet <torrent file>",
+	Short: "Print the magnet link of a torrent file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tf, err := readTorrentFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(tf.Magnet().String())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(magnetCmd)
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var peersCmd = &cobra.Command{
+	Use:   "peers <task id>",
+	Short: "List the connected peers of a task of the daemon",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args)
+		if err != nil {
+			return err
+		}
+
+		peers, err := newClient(cmd).Peers(cmd.Context(), ids[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(peers)
+		}
+
+		header := []string{"ADDRESS", "SEED", "DOWN", "UP"}
+		if verbose {
+			header = append(header, "DOWNLOADED", "UPLOADED", "WASTED")
+		}
+
+		t := newTable(header...)
+		for _, p := range peers {
+			row := []string{p.Address, strconv.FormatBool(p.Seed), formatRate(p.DownloadRate), formatRate(p.UploadRate)}
+			if verbose {
+				row = append(row, formatSize(p.Downloaded), formatSize(p.Uploaded), formatSize(p.Wasted))
+			}
+
+			t.row(row...)
+		}
+
+		return t.flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(peersCmd)
+
+	remoteCommands(peersCmd)
+}
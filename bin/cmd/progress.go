@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/schollz/progressbar/v3"
+)
+
+// showProgress draws a progress bar of the download from its events until
+// the returned func is called.
+func showProgress(events *dgotorrent.EventBus) func() {
+	var bar *progressbar.ProgressBar
+	stop := events.Handle(func(e dgotorrent.Event) {
+		switch e := e.(type) {
+		case dgotorrent.StatsEvent:
+			// the first stats know the size, later ones fix dropped pieces
+			if bar == nil {
+				bar = progressbar.DefaultBytes(e.Wanted, "downloading")
+			}
+			bar.Set64(e.Completed)
+		case dgotorrent.PieceVerifiedEvent:
+			if bar != nil {
+				bar.Add(e.Length)
+			}
+		}
+	})
+
+	return stop
+}
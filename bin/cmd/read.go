@@ -49,6 +49,7 @@ var readCmd = &cobra.Command{
 
 		if !withPieces {
 			tf.Info.PieceHashes = make([][20]byte, 0)
+			tf.PieceLayers = nil
 		}
 
 		res, err := json.Marshal(tf)
@@ -68,5 +69,5 @@ var readCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(readCmd)
 
-	readCmd.Flags().BoolVarP(&withPieces, "pieces", "p", false, "read the hash list which is a concatenation of each piece's SHA-1 hash")
+	readCmd.Flags().BoolVarP(&withPieces, "pieces", "p", false, "read the SHA-1 piece hashes and the v2 piece layers")
 }
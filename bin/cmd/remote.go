@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/spf13/cobra"
+)
+
+// remoteCommands adds the flags of the daemon and the output to the commands,
+// every command has values of its own.
+func remoteCommands(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		// errors of the daemon are not usage errors
+		cmd.SilenceUsage = true
+
+		cmd.Flags().String("host", "", "address or unix:<path> of the daemon, defaults to the configured address")
+		cmd.Flags().String("token", "", "api token of the daemon, defaults to the configured token")
+		cmd.Flags().Bool("json", false, "print the response of the daemon as json")
+	}
+}
+
+func newClient(cmd *cobra.Command) *api.Client {
+	cfg := config.Instance()
+
+	host, _ := cmd.Flags().GetString("host")
+	if host == "" {
+		host = cfg.GetDaemonAddr()
+	}
+
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		token = cfg.GetDaemonToken()
+	}
+
+	return api.NewClient(host, token)
+}
+
+func jsonOutput(cmd *cobra.Command) bool {
+	enabled, _ := cmd.Flags().GetBool("json")
+	return enabled
+}
+
+func parseTaskIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid task id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// table writes rows of tab separated cells as aligned columns.
+type table struct {
+	w *tabwriter.Writer
+}
+
+func newTable(header ...string) *table {
+	t := &table{w: tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+	t.row(header...)
+
+	return t
+}
+
+func (t *table) row(cells ...string) {
+	fmt.Fprintln(t.w, strings.Join(cells, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.w.Flush()
+}
+
+func formatRate(rate float64) string {
+	return formatSize(int64(rate)) + "/s"
+}
+
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+
+	return formatSize(limit) + "/s"
+}
+
+func formatETA(eta int64) string {
+	if eta < 0 {
+		return "-"
+	}
+
+	return (time.Duration(eta) * time.Second).String()
+}
+
+func formatProgress(progress float64) string {
+	return fmt.Sprintf("%.1f%%", progress*100)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+
+	return strings.Join(labels, ",")
+}
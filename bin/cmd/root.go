@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 
 	cmdbencode "github.com/Dizzrt/dgo-torrent/bin/cmd/bencode"
+	cmdtracker "github.com/Dizzrt/dgo-torrent/bin/cmd/tracker"
 	"github.com/spf13/cobra"
 )
 
@@ -39,6 +40,7 @@ func Execute() {
 
 func init() {
 	rootCmd.AddCommand(cmdbencode.BencodeCmd)
+	rootCmd.AddCommand(cmdtracker.TrackerCmd)
 
 	// cobra.OnInitialize(initConfig)
 
@@ -0,0 +1,136 @@
+package cmdtracker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/db"
+	"github.com/Dizzrt/dgo-torrent/tracker"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	httpAddr      string
+	udpAddr       string
+	interval      time.Duration
+	minInterval   time.Duration
+	peerTTL       time.Duration
+	storeType     string
+	allowList     []string
+	allowListFile string
+	trustIPParam  bool
+	private       bool
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run an HTTP and UDP tracker",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		allowlist, err := loadAllowlist()
+		if err != nil {
+			return err
+		}
+
+		var store tracker.Store
+		switch storeType {
+		case "memory":
+			store = tracker.NewMemoryStore()
+		case "sqlite":
+			store, err = tracker.NewSQLStore(db.DB())
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown store type: %s", storeType)
+		}
+
+		server := tracker.NewServer(tracker.Config{
+			HTTPAddr:     httpAddr,
+			UDPAddr:      udpAddr,
+			Interval:     interval,
+			MinInterval:  minInterval,
+			PeerTTL:      peerTTL,
+			Allowlist:    allowlist,
+			TrustIPParam: trustIPParam,
+			Private:      private,
+		}, store)
+
+		if err = server.Start(); err != nil {
+			return err
+		}
+		defer server.Close()
+
+		if addr := server.HTTPAddr(); addr != nil {
+			fmt.Printf("http tracker listening on http://%s/announce\n", addr)
+		}
+
+		if addr := server.UDPAddr(); addr != nil {
+			fmt.Printf("udp tracker listening on udp://%s/announce\n", addr)
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		return nil
+	},
+}
+
+func loadAllowlist() ([][tracker.INFO_HASH_LEN]byte, error) {
+	hashes := append([]string{}, allowList...)
+
+	if allowListFile != "" {
+		file, err := os.Open(allowListFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			hashes = append(hashes, line)
+		}
+
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([][tracker.INFO_HASH_LEN]byte, 0, len(hashes))
+	for _, h := range hashes {
+		hash, err := tracker.ParseInfoHash(h)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, h)
+		}
+
+		ret = append(ret, hash)
+	}
+
+	return ret, nil
+}
+
+func init() {
+	TrackerCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(&httpAddr, "http", ":6969", "http listen address, empty to disable")
+	serveCmd.Flags().StringVar(&udpAddr, "udp", ":6969", "udp listen address, empty to disable")
+	serveCmd.Flags().DurationVar(&interval, "interval", tracker.DEFAULT_INTERVAL, "announce interval sent to clients")
+	serveCmd.Flags().DurationVar(&minInterval, "min-interval", tracker.DEFAULT_MIN_INTERVAL, "minimum announce interval sent to clients")
+	serveCmd.Flags().DurationVar(&peerTTL, "peer-ttl", tracker.DEFAULT_PEER_TTL, "time after which peers that stopped announcing are dropped")
+	serveCmd.Flags().StringVar(&storeType, "store", "memory", "swarm state store: memory or sqlite")
+	serveCmd.Flags().StringSliceVar(&allowList, "allow", nil, "hex encoded info hashes allowed on this tracker")
+	serveCmd.Flags().StringVar(&allowListFile, "allow-file", "", "file with one hex encoded info hash per line")
+	serveCmd.Flags().BoolVar(&trustIPParam, "trust-ip", false, "use the ip announce parameter instead of the remote address")
+	serveCmd.Flags().BoolVar(&private, "private", false, "require a key on every announce as private trackers do")
+}
@@ -0,0 +1,10 @@
+package cmdtracker
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var TrackerCmd = &cobra.Command{
+	Use:   "tracker",
+	Short: "Embedded BitTorrent tracker",
+}
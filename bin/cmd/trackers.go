@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/api"
+	"github.com/spf13/cobra"
+)
+
+var trackersCmd = &cobra.Command{
+	Use:   "trackers <task id>",
+	Short: "List the trackers of a task of the daemon with their last announce",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids, err := parseTaskIDs(args)
+		if err != nil {
+			return err
+		}
+
+		trackers, err := newClient(cmd).Trackers(cmd.Context(), ids[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput(cmd) {
+			return printJSON(trackers)
+		}
+
+		return printTrackers(trackers)
+	},
+}
+
+func printTrackers(trackers []api.Tracker) error {
+	header := []string{"URL", "LAST ANNOUNCE", "PEERS", "STATUS"}
+	if verbose {
+		header = append(header, "EVENT", "INTERVAL")
+	}
+
+	t := newTable(header...)
+	for _, tracker := range trackers {
+		last, status := "-", "-"
+		if tracker.LastAnnounce != nil {
+			last = tracker.LastAnnounce.Local().Format(time.DateTime)
+			status = "ok"
+		}
+
+		if tracker.Error != "" {
+			status = tracker.Error
+		}
+
+		row := []string{tracker.URL, last, strconv.Itoa(tracker.Peers), status}
+		if verbose {
+			event := tracker.Event
+			if event == "" {
+				event = "-"
+			}
+
+			row = append(row, event, (time.Duration(tracker.Interval) * time.Second).String())
+		}
+
+		t.row(row...)
+	}
+
+	return t.flush()
+}
+
+func init() {
+	rootCmd.AddCommand(trackersCmd)
+
+	remoteCommands(trackersCmd)
+}
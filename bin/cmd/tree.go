@@ -10,10 +10,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// flags
+var (
+	showPadding bool
+)
+
 // treeCmd represents the tree command
 var treeCmd = &cobra.Command{
 	Use:   "tree",
-	Short: "list all files",
+	Short: "list all files with the indexes used to select them",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return fmt.Errorf("param error, requires a torrent file")
@@ -46,7 +51,7 @@ var treeCmd = &cobra.Command{
 		if tf.Info.IsMutiFile {
 			printTree(tf.Info.MutiFiles, make([]string, 0), 0)
 		} else {
-			fmt.Printf("%s [%s]\n", tf.Info.Name, formatSize(tf.Info.Length))
+			fmt.Printf("[0] %s [%s]\n", tf.Info.Name, formatSize(tf.Info.Length))
 		}
 
 		return nil
@@ -69,14 +74,37 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.2f %s", s, units[index])
 }
 
+// onlyPadding reports whether a directory holds nothing but padding files,
+// such directories are hidden along with the padding.
+func onlyPadding(tmf dgotorrent.TorrentMutiFile) bool {
+	if tmf.Type == dgotorrent.TMF_TYPE_FILE {
+		return tmf.IsPadding()
+	}
+
+	for _, sub := range tmf.Subs {
+		if !onlyPadding(sub) {
+			return false
+		}
+	}
+
+	return len(tmf.Subs) > 0
+}
+
 func printTree(tmf dgotorrent.TorrentMutiFile, prefixs []string, level int) {
 	if level == 0 {
 		fmt.Printf(". %s\n", tmf.Name)
 	}
 
-	l := len(tmf.SubsOrder)
+	subs := make([]string, 0, len(tmf.SubsOrder))
+	for _, subName := range tmf.SubsOrder {
+		if showPadding || !onlyPadding(tmf.Subs[subName]) {
+			subs = append(subs, subName)
+		}
+	}
+
+	l := len(subs)
 	lprefix := strings.Join(prefixs, "")
-	for i, subName := range tmf.SubsOrder {
+	for i, subName := range subs {
 		fmt.Print(lprefix)
 
 		var sprefix string
@@ -90,9 +118,11 @@ func printTree(tmf dgotorrent.TorrentMutiFile, prefixs []string, level int) {
 		sub := tmf.Subs[subName]
 		if sub.Type == dgotorrent.TMF_TYPE_DIRECTORY {
 			fmt.Printf("\033[1;96;40m%s\033[0m\n", sub.Name)
+		} else if sub.IsSymlink() {
+			fmt.Printf("[%d] %s -> %s\n", sub.Index, sub.Name, strings.Join(sub.SymlinkPath, "/"))
 		} else if sub.Type == dgotorrent.TMF_TYPE_FILE {
 
-			fmt.Printf("%s [%s]\n", sub.Name, formatSize(sub.Length))
+			fmt.Printf("[%d] %s [%s]\n", sub.Index, sub.Name, formatSize(sub.Length))
 		} else {
 			dlog.Error(fmt.Errorf(""))
 		}
@@ -105,4 +135,6 @@ func printTree(tmf dgotorrent.TorrentMutiFile, prefixs []string, level int) {
 
 func init() {
 	rootCmd.AddCommand(treeCmd)
+
+	treeCmd.Flags().BoolVar(&showPadding, "padding", false, "show the padding files of the torrent")
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/Dizzrt/dgo-torrent/dht"
+	"github.com/Dizzrt/dgo-torrent/utp"
+)
+
+func readTorrentFile(path string) (*dgotorrent.TorrentFile, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("target file does not exist")
+		} else {
+			return nil, err
+		}
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("the target file is not a valid file")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return dgotorrent.NewTorrentFile(file)
+}
+
+// openNetwork opens the utp socket and starts the dht node that are enabled
+// in the config, the returned func closes them. port is announced to the dht,
+// nothing is announced when it is 0.
+func openNetwork(port int) (*utp.Socket, []dgotorrent.PeerSource, func(), error) {
+	cfg := config.Instance()
+	closers := make([]func() error, 0)
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	// utp and the dht share one udp socket when both are enabled
+	var socket *utp.Socket
+	if cfg.GetUTPEnabled() {
+		var err error
+		socket, err = utp.Listen("udp4", fmt.Sprintf(":%d", cfg.GetDHTPort()))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		closers = append(closers, socket.Close)
+	}
+
+	sources := make([]dgotorrent.PeerSource, 0)
+	if cfg.GetDHTEnabled() {
+		dhtCfg := dht.Config{
+			Addr:      fmt.Sprintf(":%d", cfg.GetDHTPort()),
+			StatePath: cfg.GetDHTStatePath(),
+			Bootstrap: cfg.GetDHTBootstrap(),
+		}
+
+		if socket != nil {
+			dhtCfg.Conn = socket.PacketConn()
+		}
+
+		node, err := dht.NewNode(dhtCfg)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+		closers = append(closers, node.Close)
+
+		if socket != nil {
+			socket.SetFallback(node.HandlePacket)
+		}
+
+		node.Start()
+		sources = append(sources, dgotorrent.NewDHTSource(node, port))
+	}
+
+	return socket, sources, closeAll, nil
+}
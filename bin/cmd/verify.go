@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/spf13/cobra"
+)
+
+// flags
+var (
+	verifyDir string
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <torrent file>",
+	Short: "Check downloaded data against the hashes of a torrent file",
+	Args:  cobra.ExactArgs(1),
+	// a failed verification is not a usage error
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tf, err := readTorrentFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		dir := verifyDir
+		if dir == "" {
+			dir = config.Instance().GetDefaultDonwloadPath()
+		}
+
+		res, err := tf.Verify(dir)
+		if err != nil {
+			return err
+		}
+
+		if res.CheckedV1 {
+			fmt.Printf("v1: %d of %d pieces bad\n", len(res.BadPieces), len(tf.Info.PieceHashes))
+			for _, i := range res.BadPieces {
+				fmt.Printf("  piece %d\n", i)
+			}
+		}
+
+		if res.CheckedV2 {
+			fmt.Printf("v2: %d files bad\n", len(res.BadFiles))
+			for _, f := range res.BadFiles {
+				fmt.Printf("  %s\n", f)
+			}
+		}
+
+		if !res.OK() {
+			return fmt.Errorf("verification failed")
+		}
+
+		fmt.Println("all data is valid")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyDir, "dir", "d", "", "directory containing the downloaded data, defaults to the configured download path")
+}
@@ -1,11 +1,13 @@
 package dgotorrent
 
+import "math/bits"
+
 type Bitfield []byte
 
 func (field Bitfield) Test(index int) bool {
 	offset := index % 8
 	byteOffset := index / 8
-	if byteOffset < 0 || byteOffset > len(field) {
+	if byteOffset < 0 || byteOffset >= len(field) {
 		return false
 	}
 
@@ -21,3 +23,39 @@ func (field Bitfield) Set(index int) {
 
 	field[byteOffset] |= 1 << uint(7-offset)
 }
+
+func (field Bitfield) Clear(index int) {
+	offset := index % 8
+	byteOffset := index / 8
+	if byteOffset < 0 || byteOffset >= len(field) {
+		return
+	}
+
+	field[byteOffset] &^= 1 << uint(7-offset)
+}
+
+// NewBitfield creates an empty bitfield that can hold n pieces.
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// Count returns the number of pieces set in the bitfield.
+func (field Bitfield) Count() int {
+	count := 0
+	for _, b := range field {
+		count += bits.OnesCount8(b)
+	}
+
+	return count
+}
+
+// Contains reports whether the field has all pieces of other.
+func (field Bitfield) Contains(other Bitfield) bool {
+	for i := range other {
+		if i >= len(field) || other[i]&^field[i] != 0 {
+			return false
+		}
+	}
+
+	return true
+}
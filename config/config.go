@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/user"
@@ -8,7 +10,6 @@ import (
 	"sync"
 
 	"github.com/Dizzrt/dgo-torrent/common"
-	"github.com/Dizzrt/dgo-torrent/db"
 	"github.com/Dizzrt/dgo-torrent/dlog"
 	"github.com/spf13/viper"
 )
@@ -28,14 +29,55 @@ const (
 	KEY_PEER_ID = "client.peer_id"
 
 	KEY_DEFAULT_DOWNLOAD_PATH = "client.settings.default_download_path"
+
+	KEY_DHT_ENABLED    = "client.dht.enabled"
+	KEY_DHT_PORT       = "client.dht.port"
+	KEY_DHT_STATE_PATH = "client.dht.state_path"
+	KEY_DHT_BOOTSTRAP  = "client.dht.bootstrap"
+
+	KEY_UTP_ENABLED = "client.utp.enabled"
+
+	// disabled, preferred or required
+	KEY_ENCRYPTION = "client.encryption"
+
+	// tcp port inbound peers connect to
+	KEY_LISTEN_PORT = "client.listen_port"
+
+	KEY_MAX_ACTIVE_DOWNLOADS = "client.queue.max_active_downloads"
+	KEY_MAX_ACTIVE_SEEDS     = "client.queue.max_active_seeds"
+
+	// inbound connections of the session and of every task, the peers a
+	// seeding task uploads to at once
+	KEY_MAX_INBOUND      = "client.peers.max_inbound"
+	KEY_MAX_TASK_INBOUND = "client.peers.max_task_inbound"
+	KEY_UPLOAD_SLOTS     = "client.peers.upload_slots"
+
+	// rate limits in bytes per second, 0 is unlimited
+	KEY_DOWNLOAD_LIMIT      = "client.limits.download"
+	KEY_UPLOAD_LIMIT        = "client.limits.upload"
+	KEY_PEER_DOWNLOAD_LIMIT = "client.limits.peer_download"
+	KEY_PEER_UPLOAD_LIMIT   = "client.limits.peer_upload"
+	// whether the protocol overhead counts toward the limits
+	KEY_LIMIT_OVERHEAD = "client.limits.count_overhead"
+
+	KEY_SCHEDULE_PROFILES = "client.schedule.profiles"
+	KEY_SCHEDULE_RULES    = "client.schedule.rules"
+
+	// the address of the api of the daemon, "unix:" followed by a path is a
+	// unix socket
+	KEY_DAEMON_ADDR  = "client.daemon.addr"
+	KEY_DAEMON_TOKEN = "client.daemon.token"
 )
 
+var defaultDHTBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
 func init() {
 	// init logger
 	dlog.Init()
-
-	// init sqlite
-	db.Init()
 }
 
 func Instance() *config {
@@ -117,3 +159,236 @@ func (cfg *config) GetDefaultDonwloadPath() string {
 	path := cfg.V.GetString(KEY_DEFAULT_DOWNLOAD_PATH)
 	return path
 }
+
+func (cfg *config) GetDHTEnabled() bool {
+	if !cfg.V.IsSet(KEY_DHT_ENABLED) {
+		cfg.V.Set(KEY_DHT_ENABLED, true)
+		cfg.V.WriteConfig()
+
+		return true
+	}
+
+	return cfg.V.GetBool(KEY_DHT_ENABLED)
+}
+
+func (cfg *config) GetDHTPort() int {
+	if !cfg.V.IsSet(KEY_DHT_PORT) {
+		cfg.V.Set(KEY_DHT_PORT, 6881)
+		cfg.V.WriteConfig()
+
+		return 6881
+	}
+
+	return cfg.V.GetInt(KEY_DHT_PORT)
+}
+
+func (cfg *config) GetDHTStatePath() string {
+	if !cfg.V.IsSet(KEY_DHT_STATE_PATH) {
+		path := ".dht"
+
+		cfg.V.Set(KEY_DHT_STATE_PATH, path)
+		cfg.V.WriteConfig()
+
+		return path
+	}
+
+	return cfg.V.GetString(KEY_DHT_STATE_PATH)
+}
+
+func (cfg *config) GetDHTBootstrap() []string {
+	if !cfg.V.IsSet(KEY_DHT_BOOTSTRAP) {
+		cfg.V.Set(KEY_DHT_BOOTSTRAP, defaultDHTBootstrap)
+		cfg.V.WriteConfig()
+
+		return defaultDHTBootstrap
+	}
+
+	return cfg.V.GetStringSlice(KEY_DHT_BOOTSTRAP)
+}
+
+func (cfg *config) GetUTPEnabled() bool {
+	if !cfg.V.IsSet(KEY_UTP_ENABLED) {
+		cfg.V.Set(KEY_UTP_ENABLED, true)
+		cfg.V.WriteConfig()
+
+		return true
+	}
+
+	return cfg.V.GetBool(KEY_UTP_ENABLED)
+}
+
+func (cfg *config) GetEncryption() string {
+	if !cfg.V.IsSet(KEY_ENCRYPTION) {
+		cfg.V.Set(KEY_ENCRYPTION, "preferred")
+		cfg.V.WriteConfig()
+
+		return "preferred"
+	}
+
+	return cfg.V.GetString(KEY_ENCRYPTION)
+}
+
+func (cfg *config) GetListenPort() int {
+	if !cfg.V.IsSet(KEY_LISTEN_PORT) {
+		cfg.V.Set(KEY_LISTEN_PORT, 6881)
+		cfg.V.WriteConfig()
+
+		return 6881
+	}
+
+	return cfg.V.GetInt(KEY_LISTEN_PORT)
+}
+
+func (cfg *config) GetMaxActiveDownloads() int {
+	if !cfg.V.IsSet(KEY_MAX_ACTIVE_DOWNLOADS) {
+		cfg.V.Set(KEY_MAX_ACTIVE_DOWNLOADS, 3)
+		cfg.V.WriteConfig()
+
+		return 3
+	}
+
+	return cfg.V.GetInt(KEY_MAX_ACTIVE_DOWNLOADS)
+}
+
+func (cfg *config) GetMaxActiveSeeds() int {
+	if !cfg.V.IsSet(KEY_MAX_ACTIVE_SEEDS) {
+		cfg.V.Set(KEY_MAX_ACTIVE_SEEDS, 5)
+		cfg.V.WriteConfig()
+
+		return 5
+	}
+
+	return cfg.V.GetInt(KEY_MAX_ACTIVE_SEEDS)
+}
+
+func (cfg *config) getCount(key string, def int) int {
+	if !cfg.V.IsSet(key) {
+		cfg.V.Set(key, def)
+		cfg.V.WriteConfig()
+
+		return def
+	}
+
+	return cfg.V.GetInt(key)
+}
+
+func (cfg *config) GetMaxInbound() int {
+	return cfg.getCount(KEY_MAX_INBOUND, 200)
+}
+
+func (cfg *config) GetMaxTaskInbound() int {
+	return cfg.getCount(KEY_MAX_TASK_INBOUND, 50)
+}
+
+func (cfg *config) GetUploadSlots() int {
+	return cfg.getCount(KEY_UPLOAD_SLOTS, 4)
+}
+
+func (cfg *config) getLimit(key string) int64 {
+	if !cfg.V.IsSet(key) {
+		cfg.V.Set(key, 0)
+		cfg.V.WriteConfig()
+
+		return 0
+	}
+
+	return cfg.V.GetInt64(key)
+}
+
+func (cfg *config) GetDownloadLimit() int64 {
+	return cfg.getLimit(KEY_DOWNLOAD_LIMIT)
+}
+
+func (cfg *config) GetUploadLimit() int64 {
+	return cfg.getLimit(KEY_UPLOAD_LIMIT)
+}
+
+func (cfg *config) GetPeerDownloadLimit() int64 {
+	return cfg.getLimit(KEY_PEER_DOWNLOAD_LIMIT)
+}
+
+func (cfg *config) GetPeerUploadLimit() int64 {
+	return cfg.getLimit(KEY_PEER_UPLOAD_LIMIT)
+}
+
+func (cfg *config) GetLimitOverhead() bool {
+	if !cfg.V.IsSet(KEY_LIMIT_OVERHEAD) {
+		cfg.V.Set(KEY_LIMIT_OVERHEAD, false)
+		cfg.V.WriteConfig()
+
+		return false
+	}
+
+	return cfg.V.GetBool(KEY_LIMIT_OVERHEAD)
+}
+
+func (cfg *config) GetDaemonAddr() string {
+	if !cfg.V.IsSet(KEY_DAEMON_ADDR) {
+		cfg.V.Set(KEY_DAEMON_ADDR, "127.0.0.1:6880")
+		cfg.V.WriteConfig()
+
+		return "127.0.0.1:6880"
+	}
+
+	return cfg.V.GetString(KEY_DAEMON_ADDR)
+}
+
+// GetDaemonToken returns the token clients of the daemon authenticate with, a
+// random one is generated on first use.
+func (cfg *config) GetDaemonToken() string {
+	token := cfg.V.GetString(KEY_DAEMON_TOKEN)
+	if token != "" {
+		return token
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		dlog.Fatalf("failed to generate the daemon token with error: %v", err)
+	}
+	token = hex.EncodeToString(raw)
+
+	cfg.V.Set(KEY_DAEMON_TOKEN, token)
+	cfg.V.WriteConfig()
+
+	return token
+}
+
+// LimitProfile is a set of rate limits in bytes per second that the schedule
+// switches to, 0 is unlimited.
+type LimitProfile struct {
+	Download     int64 `mapstructure:"download"`
+	Upload       int64 `mapstructure:"upload"`
+	PeerDownload int64 `mapstructure:"peer_download"`
+	PeerUpload   int64 `mapstructure:"peer_upload"`
+}
+
+// ScheduleRule is in effect on Days (mon ... sun, all days when empty) from
+// From to To (15:04). A rule that ends before it starts runs past midnight.
+// It switches to Profile and pauses the tasks with the ids or labels.
+type ScheduleRule struct {
+	Days        []string `mapstructure:"days"`
+	From        string   `mapstructure:"from"`
+	To          string   `mapstructure:"to"`
+	Profile     string   `mapstructure:"profile"`
+	PauseTasks  []int    `mapstructure:"pause_tasks"`
+	PauseLabels []string `mapstructure:"pause_labels"`
+}
+
+type Schedule struct {
+	Profiles map[string]LimitProfile
+	Rules    []ScheduleRule
+}
+
+// GetSchedule reads the schedule, there is none unless it is configured.
+func (cfg *config) GetSchedule() (Schedule, error) {
+	var schedule Schedule
+	if err := cfg.V.UnmarshalKey(KEY_SCHEDULE_PROFILES, &schedule.Profiles); err != nil {
+		return Schedule{}, err
+	}
+
+	if err := cfg.V.UnmarshalKey(KEY_SCHEDULE_RULES, &schedule.Rules); err != nil {
+		return Schedule{}, err
+	}
+
+	return schedule, nil
+}
@@ -0,0 +1,344 @@
+package dgotorrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+var (
+	ErrEmptyTorrent       = errors.New("no files to create a torrent from")
+	ErrInvalidPieceLength = errors.New("piece length must be a power of two of at least 16 KiB")
+)
+
+// meta versions a torrent can be created with
+const (
+	CREATE_V1 = iota + 1
+	CREATE_V2
+	CREATE_HYBRID
+)
+
+const (
+	MIN_PIECE_LENGTH = MERKLE_BLOCK_SIZE
+	MAX_PIECE_LENGTH = 16 << 20
+
+	// the piece length is chosen so that a torrent has about that many pieces
+	TARGET_PIECE_COUNT = 1500
+)
+
+type CreateOptions struct {
+	// Path is the file or directory the torrent is created from.
+	Path string
+	// Name defaults to the base name of the path.
+	Name     string
+	Trackers []string
+	URLList  []string
+	Comment  string
+	Private  bool
+	// PieceLength is chosen from the size of the content when it is 0.
+	PieceLength int64
+	// Version is one of CREATE_V1, CREATE_V2 and CREATE_HYBRID, v1 is the
+	// default.
+	Version int
+}
+
+type createFile struct {
+	path   []string
+	disk   string
+	length int64
+	attr   string
+}
+
+func fileAttr(mode fs.FileMode) string {
+	if mode&0111 != 0 {
+		return "x"
+	}
+
+	return ""
+}
+
+func collectFiles(root string) ([]createFile, bool, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !stat.IsDir() {
+		return []createFile{{path: []string{stat.Name()}, disk: root, length: stat.Size(), attr: fileAttr(stat.Mode())}}, false, nil
+	}
+
+	// WalkDir visits the entries in lexical order, which is the order of the
+	// keys of the v2 file tree as well
+	files := make([]createFile, 0)
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createFile{
+			path:   strings.Split(filepath.ToSlash(rel), "/"),
+			disk:   p,
+			length: info.Size(),
+			attr:   fileAttr(info.Mode()),
+		})
+		return nil
+	})
+
+	return files, true, err
+}
+
+func choosePieceLength(total int64) int64 {
+	pl := int64(MIN_PIECE_LENGTH)
+	for pl < MAX_PIECE_LENGTH && total/pl > TARGET_PIECE_COUNT {
+		pl <<= 1
+	}
+
+	return pl
+}
+
+func toList(path []string) []any {
+	list := make([]any, 0, len(path))
+	for _, p := range path {
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// toTiers puts every tracker in a tier of its own.
+func toTiers(trackers []string) []any {
+	tiers := make([]any, 0, len(trackers))
+	for _, t := range trackers {
+		tiers = append(tiers, []any{t})
+	}
+
+	return tiers
+}
+
+// pieceHasher computes the v1 piece hashes of the concatenated content.
+type pieceHasher struct {
+	pieceLength int64
+	buf         []byte
+	pieces      strings.Builder
+}
+
+func (h *pieceHasher) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		take := min(int(h.pieceLength)-len(h.buf), len(b))
+		h.buf = append(h.buf, b[:take]...)
+		b = b[take:]
+
+		if int64(len(h.buf)) == h.pieceLength {
+			h.flush()
+		}
+	}
+
+	return n, nil
+}
+
+func (h *pieceHasher) flush() {
+	if len(h.buf) == 0 {
+		return
+	}
+
+	sum := sha1.Sum(h.buf)
+	h.pieces.Write(sum[:])
+	h.buf = h.buf[:0]
+}
+
+// CreateTorrent builds the bencoded metainfo of a file or directory. Hybrid
+// torrents align every file to a piece boundary with padding files so that
+// v1 and v2 pieces cover the same data.
+func CreateTorrent(opts CreateOptions) ([]byte, error) {
+	files, isDir, err := collectFiles(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, ErrEmptyTorrent
+	}
+
+	version := opts.Version
+	if version == 0 {
+		version = CREATE_V1
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(opts.Path))
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.length
+	}
+
+	pl := opts.PieceLength
+	if pl == 0 {
+		pl = choosePieceLength(total)
+	}
+
+	if pl < MIN_PIECE_LENGTH || pl&(pl-1) != 0 {
+		return nil, ErrInvalidPieceLength
+	}
+
+	withV1 := version == CREATE_V1 || version == CREATE_HYBRID
+	withV2 := version == CREATE_V2 || version == CREATE_HYBRID
+
+	hasher := &pieceHasher{pieceLength: pl}
+	v1Files := make([]any, 0, len(files))
+	tree := make(map[string]any)
+	layers := make(map[string]any)
+	for i, f := range files {
+		var w io.Writer = io.Discard
+		if withV1 {
+			w = hasher
+		}
+
+		root, layer, err := hashFile(f, pl, w)
+		if err != nil {
+			return nil, err
+		}
+
+		v1File := map[string]any{"length": f.length, "path": toList(f.path)}
+		if f.attr != "" {
+			v1File["attr"] = f.attr
+		}
+		v1Files = append(v1Files, v1File)
+
+		// the next file of a hybrid torrent starts at a piece boundary
+		if pad := (pl - f.length%pl) % pl; version == CREATE_HYBRID && pad > 0 && i < len(files)-1 {
+			hasher.Write(make([]byte, pad))
+			v1Files = append(v1Files, map[string]any{
+				"length": pad,
+				"path":   []any{".pad", strconv.FormatInt(pad, 10)},
+				"attr":   "p",
+			})
+		}
+
+		if !withV2 {
+			continue
+		}
+
+		entry := map[string]any{"length": f.length}
+		if f.attr != "" {
+			entry["attr"] = f.attr
+		}
+		if f.length > 0 {
+			entry["pieces root"] = string(root[:])
+		}
+
+		if f.length > pl {
+			raw := make([]byte, 0, len(layer)*MERKLE_HASH_LEN)
+			for _, h := range layer {
+				raw = append(raw, h[:]...)
+			}
+
+			layers[string(root[:])] = string(raw)
+		}
+
+		node := tree
+		path := f.path
+		if !isDir {
+			path = []string{name}
+		}
+
+		for _, p := range path {
+			child, ok := node[p].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[p] = child
+			}
+
+			node = child
+		}
+		node[""] = entry
+	}
+
+	info := map[string]any{
+		"name":         name,
+		"piece length": pl,
+	}
+
+	if opts.Private {
+		info["private"] = int64(1)
+	}
+
+	if withV1 {
+		hasher.flush()
+		info["pieces"] = hasher.pieces.String()
+
+		if isDir {
+			info["files"] = v1Files
+		} else {
+			info["length"] = files[0].length
+		}
+	}
+
+	if withV2 {
+		info["meta version"] = int64(2)
+		info["file tree"] = tree
+	}
+
+	meta := map[string]any{
+		"info":          info,
+		"creation date": time.Now().Unix(),
+		"created by":    "dgo-torrent",
+	}
+
+	if len(opts.Trackers) > 0 {
+		meta["announce"] = opts.Trackers[0]
+		meta["announce-list"] = toTiers(opts.Trackers)
+	}
+
+	if len(opts.URLList) > 0 {
+		meta["url-list"] = toList(opts.URLList)
+	}
+
+	if opts.Comment != "" {
+		meta["comment"] = opts.Comment
+	}
+
+	if withV2 {
+		meta["piece layers"] = layers
+	}
+
+	raw, err := bencode.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(raw), nil
+}
+
+// hashFile computes the merkle tree of a file while passing its content to
+// w for the v1 piece hashes.
+func hashFile(f createFile, pieceLength int64, w io.Writer) (MerkleHash, []MerkleHash, error) {
+	file, err := os.Open(f.disk)
+	if err != nil {
+		return MerkleHash{}, nil, err
+	}
+	defer file.Close()
+
+	return fileMerkle(io.TeeReader(file, w), f.length, pieceLength)
+}
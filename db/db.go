@@ -2,7 +2,6 @@ package db
 
 import (
 	"database/sql"
-	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -15,34 +14,14 @@ const (
 
 var db *sql.DB
 
-func isTableExists(tableName string) bool {
-	sql := fmt.Sprintf("SELECT name FROM sqlite_master WHERE type='table' AND name='%s';", tableName)
-
-	rows, err := db.Query(sql)
-	if err != nil {
+// Init migrates the database of the client and exits when that fails, it is
+// meant for commands, the session migrates through Migrate and returns the
+// error. The database is created on first use so importing the packages does
+// not create it.
+func Init() {
+	if err := Migrate(DB()); err != nil {
 		dlog.Fatal(err)
 	}
-
-	if rows.Next() {
-		return true
-	}
-
-	return false
-}
-
-func initTables() {
-	// tasks
-	if !isTableExists("tasks") {
-		_, err := db.Exec(_SQL_CREATE_TABLE_TASKS)
-		if err != nil {
-			dlog.Fatal(err)
-		}
-	}
-}
-
-func Init() {
-	_ = DB()
-	initTables()
 }
 
 func DB() *sql.DB {
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrNewerSchema = errors.New("the database was written by a newer version")
+
+type migration struct {
+	name string
+	sql  string
+}
+
+// migrations upgrade the schema in order, the schema version stored in
+// PRAGMA user_version is the number of migrations applied. Migrations are
+// only ever appended.
+var migrations = []migration{
+	{"create tasks", _SQL_CREATE_TABLE_TASKS},
+	{"create task files", _SQL_CREATE_TABLE_TASK_FILES},
+	{"unix timestamps of tasks", _SQL_MIGRATE_TASK_TIMESTAMPS},
+	{"queue position of tasks", _SQL_ADD_TASK_QUEUE_POSITION},
+	{"transfer totals of tasks", _SQL_ADD_TASK_TRANSFER_TOTALS},
+	{"labels of tasks", _SQL_ADD_TASK_LABELS},
+	{"create tracker tables", _SQL_CREATE_TABLE_TRACKER_PEERS},
+	{"tasks held by the schedule", _SQL_ADD_TASK_HELD},
+}
+
+// SchemaVersion is the version of the schema this build writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func userVersion(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) (int, error) {
+	var version int
+	err := q.QueryRow("PRAGMA user_version;").Scan(&version)
+
+	return version, err
+}
+
+// Migrate brings the schema of the database up to date, every migration
+// runs in a transaction of its own together with the update of the version.
+func Migrate(db *sql.DB) error {
+	version, err := userVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion() {
+		return fmt.Errorf("%w: schema version %d, supported up to %d", ErrNewerSchema, version, SchemaVersion())
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := migrate(db, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", i+1, migrations[i].name, err)
+		}
+	}
+
+	return nil
+}
+
+func migrate(db *sql.DB, version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a concurrent process may have migrated in the meantime
+	current, err := userVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	if current >= version {
+		return nil
+	}
+
+	if _, err = tx.Exec(m.sql); err != nil {
+		return err
+	}
+
+	// pragmas do not take parameters
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,120 @@
+package db_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/db"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+func schemaVersion(t *testing.T, d *sql.DB) int {
+	var version int
+	if err := d.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+
+	return version
+}
+
+func TestMigrateFresh(t *testing.T) {
+	d := openDB(t)
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := schemaVersion(t, d); v != db.SchemaVersion() {
+		t.Errorf("expected version %d, got %d", db.SchemaVersion(), v)
+	}
+
+	// running it again is a no-op
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Exec(`INSERT INTO tasks ("name", "torrent", "path", "status") VALUES ('a', '', '', '{}');`); err != nil {
+		t.Fatal(err)
+	}
+
+	var kind string
+	if err := d.QueryRow(`SELECT typeof("created_at") FROM tasks;`).Scan(&kind); err != nil || kind != "integer" {
+		t.Errorf("expected an integer timestamp, got %s: %v", kind, err)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	d := openDB(t)
+
+	// a database written before versioning, with the original schema
+	legacy := `
+		CREATE TABLE tasks (
+			"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"name" TEXT NOT NULL,
+			"torrent" TEXT NOT NULL,
+			"path" TEXT NOT NULL,
+			"status" TEXT NOT NULL,
+			"state" integer DEFAULT 0,
+			"created_at" INTEGER DEFAULT (DATETIME(CURRENT_TIMESTAMP, 'localtime')),
+			"updated_at" INTEGER DEFAULT (DATETIME(CURRENT_TIMESTAMP, 'localtime'))
+		);
+		INSERT INTO tasks ("name", "torrent", "path", "status") VALUES ('old', 'd4:infod', '/tmp', '{}');
+	`
+	if _, err := d.Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		name      string
+		createdAt any
+	)
+	if err := d.QueryRow(`SELECT "name", "created_at" FROM tasks;`).Scan(&name, &createdAt); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, ok := createdAt.(int64)
+	if name != "old" || !ok {
+		t.Fatalf("unexpected row %s %v", name, createdAt)
+	}
+
+	if d := time.Since(time.Unix(ts, 0)); d < -time.Minute || d > time.Minute {
+		t.Errorf("the timestamp was converted to %v", time.Unix(ts, 0))
+	}
+
+	// updates keep integer timestamps through the trigger
+	if _, err := d.Exec(`UPDATE tasks SET "state" = 1;`); err != nil {
+		t.Fatal(err)
+	}
+
+	var kind string
+	if err := d.QueryRow(`SELECT typeof("updated_at") FROM tasks;`).Scan(&kind); err != nil || kind != "integer" {
+		t.Errorf("expected an integer timestamp, got %s: %v", kind, err)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	d := openDB(t)
+	if _, err := d.Exec(fmt.Sprintf("PRAGMA user_version = %d;", db.SchemaVersion()+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrate(d); !errors.Is(err, db.ErrNewerSchema) {
+		t.Errorf("expected %v, got %v", db.ErrNewerSchema, err)
+	}
+}
@@ -2,7 +2,7 @@ package db
 
 const (
 	_SQL_CREATE_TABLE_TASKS = `
-		CREATE TABLE tasks (
+		CREATE TABLE IF NOT EXISTS tasks (
 			"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 			"name" TEXT NOT NULL,
 			"torrent" TEXT NOT NULL,
@@ -13,12 +13,12 @@ const (
 			"updated_at" INTEGER DEFAULT (DATETIME(CURRENT_TIMESTAMP, 'localtime'))
 	  	);
 	  
-	  	CREATE INDEX index_name
+	  	CREATE INDEX IF NOT EXISTS index_name
 	  	ON tasks (
 			"name" COLLATE BINARY ASC
 	  	);
 	  
-	  	CREATE TRIGGER updated_trigger AFTER UPDATE 
+	  	CREATE TRIGGER IF NOT EXISTS updated_trigger AFTER UPDATE 
 	  	ON tasks
 	  	FOR EACH ROW
 	  	WHEN NEW.updated_at = OLD.updated_at
@@ -28,3 +28,97 @@ const (
 	  	END;	  
 	`
 )
+
+const (
+	_SQL_CREATE_TABLE_TASK_FILES = `
+		CREATE TABLE IF NOT EXISTS task_files (
+			"task_id" INTEGER NOT NULL,
+			"file_index" INTEGER NOT NULL,
+			"priority" INTEGER NOT NULL,
+			PRIMARY KEY ("task_id", "file_index")
+		);
+	`
+)
+
+const (
+	// the timestamps of the tasks were DATETIME strings in local time in an
+	// INTEGER column, they become unix seconds. sqlite can not change the
+	// default of a column, so the table is rebuilt.
+	_SQL_MIGRATE_TASK_TIMESTAMPS = `
+		CREATE TABLE tasks_new (
+			"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			"name" TEXT NOT NULL,
+			"torrent" TEXT NOT NULL,
+			"path" TEXT NOT NULL,
+			"status" TEXT NOT NULL,
+			"state" INTEGER DEFAULT 0,
+			"created_at" INTEGER DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+			"updated_at" INTEGER DEFAULT (CAST(strftime('%s', 'now') AS INTEGER))
+		);
+
+		INSERT INTO tasks_new ("id", "name", "torrent", "path", "status", "state", "created_at", "updated_at")
+		SELECT "id", "name", "torrent", "path", "status", "state",
+			CASE typeof("created_at") WHEN 'text' THEN CAST(strftime('%s', "created_at", 'utc') AS INTEGER) ELSE "created_at" END,
+			CASE typeof("updated_at") WHEN 'text' THEN CAST(strftime('%s', "updated_at", 'utc') AS INTEGER) ELSE "updated_at" END
+		FROM tasks;
+
+		DROP TABLE tasks;
+		ALTER TABLE tasks_new RENAME TO tasks;
+
+		CREATE INDEX index_name
+		ON tasks (
+			"name" COLLATE BINARY ASC
+		);
+
+		CREATE TRIGGER updated_trigger AFTER UPDATE
+		ON tasks
+		FOR EACH ROW
+		WHEN NEW.updated_at = OLD.updated_at
+		BEGIN
+			UPDATE tasks SET updated_at = CAST(strftime('%s', 'now') AS INTEGER)
+			WHERE id = OLD.id;
+		END;
+	`
+)
+
+const (
+	_SQL_ADD_TASK_QUEUE_POSITION = `
+		ALTER TABLE tasks ADD COLUMN "queue_position" INTEGER NOT NULL DEFAULT 0;
+		UPDATE tasks SET "queue_position" = "id";
+	`
+)
+
+const (
+	_SQL_ADD_TASK_TRANSFER_TOTALS = `
+		ALTER TABLE tasks ADD COLUMN "downloaded" INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE tasks ADD COLUMN "uploaded" INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE tasks ADD COLUMN "wasted" INTEGER NOT NULL DEFAULT 0;
+	`
+
+	_SQL_ADD_TASK_LABELS = `ALTER TABLE tasks ADD COLUMN "labels" TEXT NOT NULL DEFAULT '[]';`
+
+	_SQL_ADD_TASK_HELD = `ALTER TABLE tasks ADD COLUMN "held" INTEGER NOT NULL DEFAULT 0;`
+
+	// the tables of the tracker server
+	_SQL_CREATE_TABLE_TRACKER_PEERS = `
+		CREATE TABLE tracker_peers (
+			"info_hash" BLOB NOT NULL,
+			"peer_id" BLOB NOT NULL,
+			"ip" TEXT NOT NULL,
+			"ipv6" TEXT DEFAULT '',
+			"port" INTEGER NOT NULL,
+			"left" INTEGER DEFAULT 0,
+			"uploaded" INTEGER DEFAULT 0,
+			"downloaded" INTEGER DEFAULT 0,
+			"updated_at" INTEGER NOT NULL,
+			"key" TEXT DEFAULT '',
+			"tracker_id" TEXT DEFAULT '',
+			PRIMARY KEY ("info_hash", "peer_id")
+		);
+
+		CREATE TABLE tracker_swarms (
+			"info_hash" BLOB NOT NULL PRIMARY KEY,
+			"downloaded" INTEGER DEFAULT 0
+		);
+	`
+)
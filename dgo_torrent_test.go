@@ -1,17 +1,24 @@
 package dgotorrent_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	dgotorrent "github.com/Dizzrt/dgo-torrent"
 	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/Dizzrt/dgo-torrent/dht"
 	"github.com/Dizzrt/dgo-torrent/dlog"
+	"github.com/Dizzrt/dgo-torrent/tracker"
+	"github.com/Dizzrt/dgo-torrent/utp"
 )
 
 func TestDownload(t *testing.T) {
@@ -36,9 +43,9 @@ func TestDownload(t *testing.T) {
 	}
 
 	process := dgotorrent.NewProcess(task)
-	process.Start()
+	process.Start(context.Background())
 
-	// peers, err := tf.FindPeers()
+	// peers, err := tf.FindPeers(context.Background())
 	// if err != nil {
 	// 	t.Error(err)
 	// }
@@ -113,7 +120,7 @@ func TestTrackerRequest(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = tf.RequestTrackers()
+	_, err = tf.RequestTrackers(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -139,7 +146,7 @@ func TestFindPeer(t *testing.T) {
 		t.Error(err)
 	}
 
-	peers, err := tf.FindPeers()
+	peers, err := tf.FindPeers(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -157,7 +164,7 @@ func TestPeerConn(t *testing.T) {
 		t.Error(err)
 	}
 
-	peers, err := tf.FindPeers()
+	peers, err := tf.FindPeers(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -190,3 +197,401 @@ func TestPeerConn(t *testing.T) {
 	wg.Wait()
 	dlog.L().Sync()
 }
+
+func TestRequestLocalTracker(t *testing.T) {
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	copy(infoHash[:], "local-tracker-test-h")
+
+	store := tracker.NewMemoryStore()
+	store.Put(infoHash, tracker.PeerInfo{
+		PeerID:    "-TEST00-000000000001",
+		IP:        net.ParseIP("10.1.2.3"),
+		Port:      51413,
+		UpdatedAt: time.Now(),
+	})
+
+	server := tracker.NewServer(tracker.Config{
+		HTTPAddr: "127.0.0.1:0",
+		UDPAddr:  "127.0.0.1:0",
+	}, store)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tf := &dgotorrent.TorrentFile{
+		Announce:     fmt.Sprintf("http://%s/announce", server.HTTPAddr()),
+		AnnounceList: []string{fmt.Sprintf("udp://%s/announce", server.UDPAddr())},
+		Info: dgotorrent.TorrentInfo{
+			Name:   "local",
+			Length: 1024,
+			Hash:   infoHash,
+		},
+	}
+
+	respList, err := tf.RequestTrackers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(respList) != 2 {
+		t.Fatalf("expected responses from both trackers, got %d", len(respList))
+	}
+
+	peers, err := tf.FindPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 1 {
+		t.Fatalf("expected the peers of both trackers to be merged, got %d", len(peers))
+	}
+
+	for _, p := range peers {
+		if !p.IP.Equal(net.ParseIP("10.1.2.3")) || p.Port != 51413 {
+			t.Errorf("unexpected peer: %+v", p)
+		}
+	}
+}
+
+func TestTrackerFailure(t *testing.T) {
+	server := tracker.NewServer(tracker.Config{
+		HTTPAddr:  "127.0.0.1:0",
+		UDPAddr:   "127.0.0.1:0",
+		Allowlist: [][tracker.INFO_HASH_LEN]byte{{0xff}},
+	}, nil)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tf := &dgotorrent.TorrentFile{
+		Announce:     fmt.Sprintf("http://%s/announce", server.HTTPAddr()),
+		AnnounceList: []string{fmt.Sprintf("udp://%s/announce", server.UDPAddr())},
+		Info:         dgotorrent.TorrentInfo{Name: "rejected", Length: 1024},
+	}
+	copy(tf.Info.Hash[:], "not-allowed-info-has")
+
+	// both trackers reject the info hash with their reason
+	var mu sync.Mutex
+	errs := make(map[string]error)
+	respList, err := tf.SendAnnounce(context.Background(), dgotorrent.AnnounceParams{
+		Event: dgotorrent.ANNOUNCE_EVENT_STARTED,
+		Result: func(tracker string, resp *dgotorrent.TrackerResp, err error) {
+			mu.Lock()
+			errs[tracker] = err
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(respList) != 0 {
+		t.Errorf("expected no responses, got %d", len(respList))
+	}
+
+	for _, tr := range tf.Trackers() {
+		err := errs[tr]
+		if !errors.Is(err, dgotorrent.ErrTrackerFailure) || !strings.Contains(err.Error(), tracker.ErrInfoHashNotAllowed.Error()) {
+			t.Errorf("unexpected error of %s: %v", tr, err)
+		}
+	}
+}
+
+func TestFindPeersWithDHT(t *testing.T) {
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	copy(infoHash[:], "find-peers-dht-test!")
+
+	store := tracker.NewMemoryStore()
+	store.Put(infoHash, tracker.PeerInfo{
+		PeerID:    "-TEST00-000000000001",
+		IP:        net.ParseIP("10.1.2.3"),
+		Port:      51413,
+		UpdatedAt: time.Now(),
+	})
+
+	server := tracker.NewServer(tracker.Config{HTTPAddr: "127.0.0.1:0"}, store)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	seed, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Close()
+	seed.Start()
+
+	leech, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leech.Close()
+	leech.Start()
+	leech.Bootstrap(seed.Addr().String())
+
+	if _, err = seed.Announce(infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+
+	tf := &dgotorrent.TorrentFile{
+		Announce: fmt.Sprintf("http://%s/announce", server.HTTPAddr()),
+		Info: dgotorrent.TorrentInfo{
+			Name:   "dht",
+			Length: 1024,
+			Hash:   infoHash,
+		},
+	}
+
+	peers, err := tf.FindPeers(context.Background(), dgotorrent.NewDHTSource(leech, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 2 {
+		t.Fatalf("expected tracker and dht peers, got %+v", peers)
+	}
+
+	if peers[1].Port != 7000 {
+		t.Errorf("expected dht peer on port 7000, got %+v", peers[1])
+	}
+
+	tf.Info.Private = true
+	if peers, _ = tf.FindPeers(context.Background(), dgotorrent.NewDHTSource(leech, 0)); len(peers) != 1 {
+		t.Errorf("expected only tracker peers for a private torrent, got %+v", peers)
+	}
+}
+
+func TestPrivateTorrentTrackers(t *testing.T) {
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	copy(infoHash[:], "private-tracker-test")
+
+	store := tracker.NewMemoryStore()
+	store.Put(infoHash, tracker.PeerInfo{
+		PeerID:    "-TEST00-000000000001",
+		IP:        net.ParseIP("10.1.2.3"),
+		Port:      51413,
+		UpdatedAt: time.Now(),
+	})
+
+	server := tracker.NewServer(tracker.Config{
+		HTTPAddr: "127.0.0.1:0",
+		UDPAddr:  "127.0.0.1:0",
+		Private:  true,
+	}, store)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	httpTracker := fmt.Sprintf("http://%s/announce", server.HTTPAddr())
+	udpTracker := fmt.Sprintf("udp://%s/announce", server.UDPAddr())
+	tf := &dgotorrent.TorrentFile{
+		Announce:     "http://127.0.0.1:1/announce",
+		AnnounceList: []string{httpTracker, udpTracker, httpTracker},
+		Info: dgotorrent.TorrentInfo{
+			Name:    "private",
+			Length:  1024,
+			Hash:    infoHash,
+			Private: true,
+		},
+	}
+
+	if trackers := tf.Trackers(); len(trackers) != 2 || trackers[0] != httpTracker || trackers[1] != udpTracker {
+		t.Errorf("expected only the announce-list of the private torrent, got %v", trackers)
+	}
+
+	if err := tf.AddTrackers("http://example.com/announce"); !errors.Is(err, dgotorrent.ErrPrivateTorrent) {
+		t.Errorf("expected trackers of a private torrent to be fixed, got %v", err)
+	}
+
+	// the second round sends back the tracker id issued by the first one
+	for i := 0; i < 2; i++ {
+		respList, err := tf.RequestTrackers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(respList) != 2 {
+			t.Fatalf("expected both announces to be accepted, got %d", len(respList))
+		}
+	}
+
+	peer, ok, _ := store.Peer(infoHash, config.Instance().GetPeerID())
+	if !ok || peer.Key == "" || peer.TrackerID == "" {
+		t.Errorf("expected key and tracker id to be recorded, got %+v", peer)
+	}
+
+	tf.Info.Private = false
+	if trackers := tf.Trackers(); len(trackers) != 3 {
+		t.Errorf("expected announce and announce-list to be merged, got %v", trackers)
+	}
+}
+
+func TestFindPeersIPv6(t *testing.T) {
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	copy(infoHash[:], "ipv6-tracker-test-h!")
+
+	store := tracker.NewMemoryStore()
+	store.Put(infoHash, tracker.PeerInfo{
+		PeerID:    "-TEST00-000000000001",
+		IP:        net.ParseIP("10.1.2.3").To4(),
+		IPv6:      net.ParseIP("2001:db8::1"),
+		Port:      51413,
+		UpdatedAt: time.Now(),
+	})
+
+	server := tracker.NewServer(tracker.Config{
+		HTTPAddr: "[::1]:0",
+		UDPAddr:  "[::1]:0",
+	}, store)
+	if err := server.Start(); err != nil {
+		t.Skipf("ipv6 loopback is not available: %v", err)
+	}
+	defer server.Close()
+
+	tf := &dgotorrent.TorrentFile{
+		Announce:     fmt.Sprintf("http://%s/announce", server.HTTPAddr()),
+		AnnounceList: []string{fmt.Sprintf("udp://%s/announce", server.UDPAddr())},
+		Info: dgotorrent.TorrentInfo{
+			Name:   "ipv6",
+			Length: 1024,
+			Hash:   infoHash,
+		},
+	}
+
+	peers, err := tf.FindPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 2 {
+		t.Fatalf("expected the ipv4 and ipv6 address of the peer, got %+v", peers)
+	}
+
+	found := false
+	for _, p := range peers {
+		found = found || (p.IP.Equal(net.ParseIP("2001:db8::1")) && p.Port == 51413)
+	}
+
+	if !found {
+		t.Errorf("ipv6 peer is missing: %+v", peers)
+	}
+
+	if ip := dgotorrent.ExternalIP(); !ip.Equal(net.IPv6loopback) {
+		t.Errorf("expected external ip ::1, got %v", ip)
+	}
+}
+
+func TestPeerConnIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 loopback is not available: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err = answerHandshake(conn, [8]byte{}); err != nil {
+			return
+		}
+		writePeerMsg(conn, 5, []byte{0xff})
+
+		io.Copy(io.Discard, conn)
+	}()
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	addr := l.Addr().(*net.TCPAddr)
+	c, err := dgotorrent.NewConn(dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, "-TEST00-000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.HasPiece(0) {
+		t.Error("bitfield of the ipv6 peer was not received")
+	}
+}
+
+// servePeerHandshake answers the handshake of a single peer and sends a
+// bitfield of the first piece.
+func servePeerHandshake(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = answerHandshake(conn, [8]byte{}); err != nil {
+		return
+	}
+	writePeerMsg(conn, 5, []byte{0x80})
+
+	io.Copy(io.Discard, conn)
+}
+
+func TestPeerConnUTP(t *testing.T) {
+	remote, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go servePeerHandshake(remote)
+
+	local, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	addr := remote.Addr().(*net.UDPAddr)
+	c, err := dgotorrent.NewConnWithConfig(dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{UTP: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := c.Conn.(*utp.Conn); !ok {
+		t.Errorf("expected a utp connection, got %T", c.Conn)
+	}
+
+	if !c.HasPiece(0) || c.HasPiece(1) {
+		t.Error("bitfield was not received over utp")
+	}
+}
+
+func TestPeerConnTCPFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go servePeerHandshake(l)
+
+	local, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	addr := l.Addr().(*net.TCPAddr)
+	c, err := dgotorrent.NewConnWithConfig(dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{UTP: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := c.Conn.(*net.TCPConn); !ok {
+		t.Errorf("expected a tcp connection, got %T", c.Conn)
+	}
+}
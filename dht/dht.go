@@ -0,0 +1,672 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var ErrNodeClosed = errors.New("dht node closed")
+
+const (
+	DEFAULT_QUERY_TIMEOUT = 3 * time.Second
+
+	// number of concurrent queries of an iterative lookup
+	alpha = 3
+
+	tokenRotateInterval = 5 * time.Minute
+	maxPacketSize       = 2048
+)
+
+type Config struct {
+	// Addr is the udp listen address, it is ignored when Conn is set.
+	Addr string
+	// Conn allows the node to run on a socket shared with other protocols,
+	// the owner of the socket reads from it and passes the dht packets to
+	// HandlePacket.
+	Conn net.PacketConn
+	// StatePath is the file the routing table is loaded from and saved to,
+	// persistence is disabled when it is empty.
+	StatePath string
+	// Bootstrap nodes in host:port form.
+	Bootstrap    []string
+	QueryTimeout time.Duration
+}
+
+type pendingQuery struct {
+	addr *net.UDPAddr
+	resp chan *krpcMsg
+}
+
+type Node struct {
+	cfg   Config
+	conn  net.PacketConn
+	table *table
+	peers *peerStore
+
+	mu      sync.Mutex
+	tid     uint16
+	pending map[string]*pendingQuery
+	secrets [2][]byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type getPeersResult struct {
+	contact *contact
+	token   string
+}
+
+func init() {
+	dlog.Init()
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return secret
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = DEFAULT_QUERY_TIMEOUT
+	}
+
+	var t *table
+	if cfg.StatePath != "" {
+		loaded, err := loadTable(cfg.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			dlog.Warnf("failed to load dht routing table with error: %v", err)
+		}
+
+		t = loaded
+	}
+
+	if t == nil {
+		t = newTable(RandomID())
+	}
+
+	conn := cfg.Conn
+	if conn == nil {
+		c, err := net.ListenPacket("udp4", cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn = c
+	}
+
+	n := &Node{
+		cfg:     cfg,
+		conn:    conn,
+		table:   t,
+		peers:   newPeerStore(),
+		pending: make(map[string]*pendingQuery),
+		secrets: [2][]byte{newSecret(), newSecret()},
+		closed:  make(chan struct{}),
+	}
+
+	return n, nil
+}
+
+func (n *Node) ID() ID {
+	return n.table.self
+}
+
+func (n *Node) Addr() net.Addr {
+	return n.conn.LocalAddr()
+}
+
+// Len returns the number of contacts in the routing table.
+func (n *Node) Len() int {
+	return n.table.len()
+}
+
+// Start serves incoming messages in the background and bootstraps the
+// routing table.
+func (n *Node) Start() {
+	if n.cfg.Conn == nil {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.readRoutine()
+		}()
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.maintainRoutine()
+	}()
+
+	if len(n.cfg.Bootstrap) > 0 || n.table.len() > 0 {
+		go n.Bootstrap(n.cfg.Bootstrap...)
+	}
+}
+
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed)
+
+		if n.cfg.StatePath != "" {
+			if e := n.table.save(n.cfg.StatePath); e != nil {
+				dlog.Errorf("failed to save dht routing table with error: %v", e)
+			}
+		}
+
+		if n.cfg.Conn == nil {
+			err = n.conn.Close()
+		}
+
+		n.wg.Wait()
+	})
+
+	return err
+}
+
+// SaveTable writes the routing table to the configured state path.
+func (n *Node) SaveTable() error {
+	if n.cfg.StatePath == "" {
+		return nil
+	}
+
+	return n.table.save(n.cfg.StatePath)
+}
+
+func (n *Node) maintainRoutine() {
+	ticker := time.NewTicker(tokenRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			n.secrets[1] = n.secrets[0]
+			n.secrets[0] = newSecret()
+			n.mu.Unlock()
+
+			if err := n.SaveTable(); err != nil {
+				dlog.Errorf("failed to save dht routing table with error: %v", err)
+			}
+		}
+	}
+}
+
+func (n *Node) readRoutine() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		cnt, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			dlog.Errorf("failed to read dht packet with error: %v", err)
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := unmarshalKRPC(buf[:cnt])
+		if err != nil {
+			continue
+		}
+
+		n.handleMsg(msg, udpAddr)
+	}
+}
+
+// HandlePacket processes a packet received on a socket shared with another
+// protocol.
+func (n *Node) HandlePacket(packet []byte, addr *net.UDPAddr) {
+	msg, err := unmarshalKRPC(packet)
+	if err != nil {
+		return
+	}
+
+	n.handleMsg(msg, addr)
+}
+
+func (n *Node) handleMsg(msg *krpcMsg, addr *net.UDPAddr) {
+	switch msg.Y {
+	case KRPC_TYPE_QUERY:
+		n.handleQuery(msg, addr)
+	case KRPC_TYPE_RESPONSE, KRPC_TYPE_ERROR:
+		n.mu.Lock()
+		pq, ok := n.pending[msg.T]
+		if ok && pq.addr.IP.Equal(addr.IP) && pq.addr.Port == addr.Port {
+			delete(n.pending, msg.T)
+		} else {
+			ok = false
+		}
+		n.mu.Unlock()
+
+		if ok {
+			pq.resp <- msg
+		}
+	}
+}
+
+func (n *Node) send(msg *krpcMsg, addr *net.UDPAddr) error {
+	data, err := msg.marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = n.conn.WriteTo(data, addr)
+	return err
+}
+
+func (n *Node) nextTransactionID() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.tid++
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, n.tid)
+
+	return string(buf)
+}
+
+func (n *Node) query(addr *net.UDPAddr, method string, args map[string]any) (map[string]any, error) {
+	args["id"] = string(n.table.self[:])
+	msg := &krpcMsg{
+		T: n.nextTransactionID(),
+		Y: KRPC_TYPE_QUERY,
+		Q: method,
+		A: args,
+	}
+
+	pq := &pendingQuery{addr: addr, resp: make(chan *krpcMsg, 1)}
+	n.mu.Lock()
+	n.pending[msg.T] = pq
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, msg.T)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(msg, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.cfg.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-n.closed:
+		return nil, ErrNodeClosed
+	case <-timer.C:
+		return nil, ErrTimeout
+	case resp := <-pq.resp:
+		if resp.Y == KRPC_TYPE_ERROR {
+			return nil, resp.E
+		}
+
+		id, ok := getID(resp.R)
+		if !ok {
+			return nil, ErrInvalidMessage
+		}
+
+		n.table.seen(id, addr)
+		return resp.R, nil
+	}
+}
+
+func (n *Node) queryContact(c *contact, method string, args map[string]any) (map[string]any, error) {
+	resp, err := n.query(c.Addr, method, args)
+	if err != nil {
+		n.table.failed(c.ID)
+	}
+
+	return resp, err
+}
+
+func (n *Node) Ping(addr *net.UDPAddr) (ID, error) {
+	resp, err := n.query(addr, METHOD_PING, map[string]any{})
+	if err != nil {
+		return ID{}, err
+	}
+
+	id, _ := getID(resp)
+	return id, nil
+}
+
+// Bootstrap pings the given nodes and fills the routing table with a lookup
+// of the local id.
+func (n *Node) Bootstrap(addrs ...string) {
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp4", a)
+		if err != nil {
+			dlog.Warnf("failed to resolve dht bootstrap node %s with error: %v", a, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			n.Ping(addr)
+		}(addr)
+	}
+
+	wg.Wait()
+	n.lookup(n.table.self, METHOD_FIND_NODE)
+}
+
+// lookup runs an iterative find_node or get_peers lookup of target and
+// returns the closest responding contacts along with the peers found.
+func (n *Node) lookup(target ID, method string) ([]getPeersResult, []Peer) {
+	var mu sync.Mutex
+	shortlist := n.table.closest(target, K)
+	queried := make(map[ID]bool)
+	responded := make([]getPeersResult, 0)
+	peers := make([]Peer, 0)
+	seenPeers := make(map[string]bool)
+
+	// peers announced to this node are part of the result as well
+	if method == METHOD_GET_PEERS {
+		for _, v := range n.peers.get(target) {
+			s := v.(string)
+			if p, ok := decodeCompactPeer(s); ok {
+				seenPeers[s] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	for {
+		mu.Lock()
+		candidates := make([]*contact, 0, alpha)
+		for i, c := range shortlist {
+			if i >= K || len(candidates) >= alpha {
+				break
+			}
+
+			if !queried[c.ID] {
+				queried[c.ID] = true
+				candidates = append(candidates, c)
+			}
+		}
+		mu.Unlock()
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range candidates {
+			wg.Add(1)
+			go func(c *contact) {
+				defer wg.Done()
+
+				args := map[string]any{}
+				if method == METHOD_GET_PEERS {
+					args["info_hash"] = string(target[:])
+				} else {
+					args["target"] = string(target[:])
+				}
+
+				resp, err := n.queryContact(c, method, args)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				token, _ := resp["token"].(string)
+				responded = append(responded, getPeersResult{contact: c, token: token})
+
+				if values, ok := resp["values"].([]any); ok {
+					for _, v := range values {
+						s, _ := v.(string)
+						if p, ok := decodeCompactPeer(s); ok && !seenPeers[s] {
+							seenPeers[s] = true
+							peers = append(peers, p)
+						}
+					}
+				}
+
+				nodes, _ := resp["nodes"].(string)
+				for _, nc := range decodeCompactNodes(nodes) {
+					if nc.ID == n.table.self || queried[nc.ID] || containsContact(shortlist, nc.ID) {
+						continue
+					}
+
+					shortlist = append(shortlist, nc)
+				}
+
+				sortContacts(shortlist, target)
+			}(c)
+		}
+
+		wg.Wait()
+	}
+
+	sortResults(responded, target)
+	if len(responded) > K {
+		responded = responded[:K]
+	}
+
+	return responded, peers
+}
+
+// GetPeers looks up the peers of an info hash in the DHT.
+func (n *Node) GetPeers(infoHash [ID_LEN]byte) ([]Peer, error) {
+	select {
+	case <-n.closed:
+		return nil, ErrNodeClosed
+	default:
+	}
+
+	_, peers := n.lookup(ID(infoHash), METHOD_GET_PEERS)
+	return peers, nil
+}
+
+// Announce looks up an info hash and announces the local peer listening on
+// port to the closest nodes, it returns the peers found during the lookup.
+func (n *Node) Announce(infoHash [ID_LEN]byte, port int) ([]Peer, error) {
+	select {
+	case <-n.closed:
+		return nil, ErrNodeClosed
+	default:
+	}
+
+	results, peers := n.lookup(ID(infoHash), METHOD_GET_PEERS)
+
+	var wg sync.WaitGroup
+	for _, r := range results {
+		if r.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(r getPeersResult) {
+			defer wg.Done()
+
+			_, err := n.queryContact(r.contact, METHOD_ANNOUNCE_PEER, map[string]any{
+				"info_hash": string(infoHash[:]),
+				"port":      int64(port),
+				"token":     r.token,
+			})
+			if err != nil {
+				dlog.Infof("dht announce to %s failed with error: %v", r.contact.Addr, err)
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	return peers, nil
+}
+
+func containsContact(contacts []*contact, id ID) bool {
+	for _, c := range contacts {
+		if c.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortContacts(contacts []*contact, target ID) {
+	for i := 1; i < len(contacts); i++ {
+		for j := i; j > 0 && contacts[j].ID.Less(contacts[j-1].ID, target); j-- {
+			contacts[j], contacts[j-1] = contacts[j-1], contacts[j]
+		}
+	}
+}
+
+func sortResults(results []getPeersResult, target ID) {
+	for i := 1; i < len(results); i++ {
+		for j := i; j > 0 && results[j].contact.ID.Less(results[j-1].contact.ID, target); j-- {
+			results[j], results[j-1] = results[j-1], results[j]
+		}
+	}
+}
+
+// region incoming queries
+
+func (n *Node) token(ip net.IP, secret []byte) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.To16())
+
+	return string(h.Sum(nil)[:8])
+}
+
+func (n *Node) validToken(token string, ip net.IP) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, secret := range n.secrets {
+		if token == n.token(ip, secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Node) replyError(msg *krpcMsg, addr *net.UDPAddr, code int64, message string) {
+	n.send(&krpcMsg{
+		T: msg.T,
+		Y: KRPC_TYPE_ERROR,
+		E: &KRPCError{Code: code, Message: message},
+	}, addr)
+}
+
+func getTarget(args map[string]any, key string) (ID, bool) {
+	var target ID
+
+	s, ok := args[key].(string)
+	if !ok || len(s) != ID_LEN {
+		return target, false
+	}
+
+	copy(target[:], s)
+	return target, true
+}
+
+func (n *Node) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	id, ok := getID(msg.A)
+	if !ok {
+		n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "invalid id")
+		return
+	}
+
+	n.table.seen(id, addr)
+
+	resp := map[string]any{
+		"id": string(n.table.self[:]),
+	}
+
+	switch msg.Q {
+	case METHOD_PING:
+	case METHOD_FIND_NODE:
+		target, ok := getTarget(msg.A, "target")
+		if !ok {
+			n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "invalid target")
+			return
+		}
+
+		resp["nodes"] = encodeCompactNodes(n.table.closest(target, K))
+	case METHOD_GET_PEERS:
+		infoHash, ok := getTarget(msg.A, "info_hash")
+		if !ok {
+			n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "invalid info_hash")
+			return
+		}
+
+		n.mu.Lock()
+		resp["token"] = n.token(addr.IP, n.secrets[0])
+		n.mu.Unlock()
+
+		if values := n.peers.get(infoHash); len(values) > 0 {
+			resp["values"] = values
+		}
+		resp["nodes"] = encodeCompactNodes(n.table.closest(infoHash, K))
+	case METHOD_ANNOUNCE_PEER:
+		infoHash, ok := getTarget(msg.A, "info_hash")
+		if !ok {
+			n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "invalid info_hash")
+			return
+		}
+
+		token, _ := msg.A["token"].(string)
+		if !n.validToken(token, addr.IP) {
+			n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "bad token")
+			return
+		}
+
+		port, _ := msg.A["port"].(int64)
+		if implied, _ := msg.A["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+
+		if port <= 0 || port > 0xffff {
+			n.replyError(msg, addr, KRPC_ERROR_PROTOCOL, "invalid port")
+			return
+		}
+
+		if peer := encodeCompactPeer(addr.IP, uint16(port)); peer != "" {
+			n.peers.add(infoHash, peer)
+		}
+	default:
+		n.replyError(msg, addr, KRPC_ERROR_METHOD, "method unknown")
+		return
+	}
+
+	n.send(&krpcMsg{
+		T: msg.T,
+		Y: KRPC_TYPE_RESPONSE,
+		R: resp,
+	}, addr)
+}
+
+// endregion
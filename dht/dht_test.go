@@ -0,0 +1,141 @@
+package dht_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dht"
+)
+
+func newCluster(t *testing.T, size int) []*dht.Node {
+	nodes := make([]*dht.Node, 0, size)
+	for i := 0; i < size; i++ {
+		cfg := dht.Config{
+			Addr:         "127.0.0.1:0",
+			QueryTimeout: 500 * time.Millisecond,
+		}
+
+		if i > 0 {
+			cfg.Bootstrap = []string{nodes[0].Addr().String()}
+		}
+
+		node, err := dht.NewNode(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+
+		node.Start()
+		if i > 0 {
+			node.Bootstrap(cfg.Bootstrap...)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	// a second round lets the early nodes learn about the later ones
+	for _, node := range nodes[1:] {
+		node.Bootstrap(nodes[0].Addr().String())
+	}
+
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	nodes := newCluster(t, 2)
+
+	id, err := nodes[0].Ping(nodes[1].Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != nodes[1].ID() {
+		t.Errorf("expected id %s, got %s", nodes[1].ID(), id)
+	}
+
+	if nodes[0].Len() == 0 || nodes[1].Len() == 0 {
+		t.Errorf("nodes did not learn about each other")
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newCluster(t, 12)
+
+	var infoHash [dht.ID_LEN]byte
+	copy(infoHash[:], "dht-cluster-infohash")
+
+	if _, err := nodes[3].Announce(infoHash, 51413); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[9].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 1 {
+		t.Fatalf("expected one peer, got %+v", peers)
+	}
+
+	if !peers[0].IP.Equal(net.ParseIP("127.0.0.1")) || peers[0].Port != 51413 {
+		t.Errorf("unexpected peer: %+v", peers[0])
+	}
+}
+
+func TestGetPeersUnknownInfoHash(t *testing.T) {
+	nodes := newCluster(t, 4)
+
+	var infoHash [dht.ID_LEN]byte
+	copy(infoHash[:], "dht-unknown-infohash")
+
+	peers, err := nodes[1].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 0 {
+		t.Errorf("expected no peers, got %+v", peers)
+	}
+}
+
+func TestRoutingTablePersistence(t *testing.T) {
+	nodes := newCluster(t, 4)
+	statePath := filepath.Join(t.TempDir(), "dht.dat")
+
+	node, err := dht.NewNode(dht.Config{
+		Addr:         "127.0.0.1:0",
+		StatePath:    statePath,
+		QueryTimeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node.Start()
+	node.Bootstrap(nodes[0].Addr().String())
+	id, count := node.ID(), node.Len()
+	node.Close()
+
+	if count == 0 {
+		t.Fatal("node did not bootstrap")
+	}
+
+	restored, err := dht.NewNode(dht.Config{
+		Addr:      "127.0.0.1:0",
+		StatePath: statePath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if restored.ID() != id {
+		t.Errorf("expected id %s to be restored, got %s", id, restored.ID())
+	}
+
+	if restored.Len() != count {
+		t.Errorf("expected %d contacts to be restored, got %d", count, restored.Len())
+	}
+}
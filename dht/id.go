@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+)
+
+const ID_LEN = 20
+
+// compact node info: id(20) + ip(4) + port(2)
+const COMPACT_NODE_LEN = ID_LEN + 6
+
+// compact peer info: ip(4) + port(2)
+const COMPACT_PEER_LEN = 6
+
+type ID [ID_LEN]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) Xor(other ID) ID {
+	var ret ID
+	for i := 0; i < ID_LEN; i++ {
+		ret[i] = id[i] ^ other[i]
+	}
+
+	return ret
+}
+
+// Less reports whether id is closer to target than other.
+func (id ID) Less(other ID, target ID) bool {
+	for i := 0; i < ID_LEN; i++ {
+		a := id[i] ^ target[i]
+		b := other[i] ^ target[i]
+		if a != b {
+			return a < b
+		}
+	}
+
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits shared by two ids.
+func commonPrefixLen(a, b ID) int {
+	for i := 0; i < ID_LEN; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return ID_LEN * 8
+}
+
+type Peer struct {
+	IP   net.IP
+	Port uint16
+}
+
+func encodeCompactPeer(ip net.IP, port uint16) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+
+	buf := make([]byte, COMPACT_PEER_LEN)
+	copy(buf, ip4)
+	binary.BigEndian.PutUint16(buf[4:], port)
+
+	return string(buf)
+}
+
+func decodeCompactPeer(s string) (Peer, bool) {
+	if len(s) != COMPACT_PEER_LEN {
+		return Peer{}, false
+	}
+
+	ip := make(net.IP, 4)
+	copy(ip, s[:4])
+
+	return Peer{
+		IP:   ip,
+		Port: binary.BigEndian.Uint16([]byte(s[4:])),
+	}, true
+}
+
+func encodeCompactNodes(contacts []*contact) string {
+	buf := make([]byte, 0, len(contacts)*COMPACT_NODE_LEN)
+	for _, c := range contacts {
+		peer := encodeCompactPeer(c.Addr.IP, uint16(c.Addr.Port))
+		if peer == "" {
+			continue
+		}
+
+		buf = append(buf, c.ID[:]...)
+		buf = append(buf, peer...)
+	}
+
+	return string(buf)
+}
+
+func decodeCompactNodes(s string) []*contact {
+	count := len(s) / COMPACT_NODE_LEN
+	ret := make([]*contact, 0, count)
+
+	for i := 0; i < count; i++ {
+		raw := s[i*COMPACT_NODE_LEN : (i+1)*COMPACT_NODE_LEN]
+
+		peer, ok := decodeCompactPeer(raw[ID_LEN:])
+		if !ok || peer.Port == 0 {
+			continue
+		}
+
+		c := &contact{
+			Addr: &net.UDPAddr{IP: peer.IP, Port: int(peer.Port)},
+		}
+		copy(c.ID[:], raw[:ID_LEN])
+
+		ret = append(ret, c)
+	}
+
+	return ret
+}
@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid krpc message")
+	ErrTimeout        = errors.New("krpc query timeout")
+)
+
+const (
+	KRPC_TYPE_QUERY    = "q"
+	KRPC_TYPE_RESPONSE = "r"
+	KRPC_TYPE_ERROR    = "e"
+)
+
+const (
+	METHOD_PING          = "ping"
+	METHOD_FIND_NODE     = "find_node"
+	METHOD_GET_PEERS     = "get_peers"
+	METHOD_ANNOUNCE_PEER = "announce_peer"
+)
+
+const (
+	KRPC_ERROR_GENERIC  = 201
+	KRPC_ERROR_SERVER   = 202
+	KRPC_ERROR_PROTOCOL = 203
+	KRPC_ERROR_METHOD   = 204
+)
+
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+type krpcMsg struct {
+	T string
+	Y string
+	Q string
+	A map[string]any
+	R map[string]any
+	E *KRPCError
+}
+
+func (m *krpcMsg) marshal() ([]byte, error) {
+	v := map[string]any{
+		"t": m.T,
+		"y": m.Y,
+	}
+
+	switch m.Y {
+	case KRPC_TYPE_QUERY:
+		v["q"] = m.Q
+		v["a"] = m.A
+	case KRPC_TYPE_RESPONSE:
+		v["r"] = m.R
+	case KRPC_TYPE_ERROR:
+		v["e"] = []any{m.E.Code, m.E.Message}
+	}
+
+	res, err := bencode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(res), nil
+}
+
+func unmarshalKRPC(data []byte) (*krpcMsg, error) {
+	res, err := bencode.Unmarshal(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	m := &krpcMsg{}
+	if m.T, ok = v["t"].(string); !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	if m.Y, ok = v["y"].(string); !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	switch m.Y {
+	case KRPC_TYPE_QUERY:
+		m.Q, _ = v["q"].(string)
+		if m.A, ok = v["a"].(map[string]any); !ok {
+			return nil, ErrInvalidMessage
+		}
+	case KRPC_TYPE_RESPONSE:
+		if m.R, ok = v["r"].(map[string]any); !ok {
+			return nil, ErrInvalidMessage
+		}
+	case KRPC_TYPE_ERROR:
+		m.E = &KRPCError{Code: KRPC_ERROR_GENERIC}
+		if e, ok := v["e"].([]any); ok && len(e) == 2 {
+			m.E.Code, _ = e[0].(int64)
+			m.E.Message, _ = e[1].(string)
+		}
+	default:
+		return nil, ErrInvalidMessage
+	}
+
+	return m, nil
+}
+
+func getID(args map[string]any) (ID, bool) {
+	var id ID
+
+	s, ok := args["id"].(string)
+	if !ok || len(s) != ID_LEN {
+		return id, false
+	}
+
+	copy(id[:], s)
+	return id, true
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL          = 30 * time.Minute
+	maxPeersPerHash  = 200
+	maxValuesPerResp = 50
+)
+
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[string]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		peers: make(map[ID]map[string]time.Time),
+	}
+}
+
+func (s *peerStore) add(infoHash ID, compactPeer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		s.peers[infoHash] = peers
+	}
+
+	if _, ok := peers[compactPeer]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+
+	peers[compactPeer] = time.Now()
+}
+
+func (s *peerStore) get(infoHash ID) []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]any, 0)
+	for p, t := range s.peers[infoHash] {
+		if time.Since(t) > peerTTL {
+			delete(s.peers[infoHash], p)
+			continue
+		}
+
+		if len(ret) < maxValuesPerResp {
+			ret = append(ret, p)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+const (
+	// K is the size of a bucket and of the result set of lookups.
+	K = 8
+
+	maxFailures = 2
+)
+
+type contact struct {
+	ID       ID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	Failures int
+}
+
+type bucket struct {
+	contacts []*contact
+}
+
+// table is a Kademlia routing table, bucket i holds the contacts that share
+// exactly i leading bits with the local id.
+type table struct {
+	mu      sync.RWMutex
+	self    ID
+	buckets [ID_LEN*8 + 1]bucket
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucketIndex(id ID) int {
+	return commonPrefixLen(t.self, id)
+}
+
+// seen inserts or refreshes a contact that has just talked to us.
+func (t *table) seen(id ID, addr *net.UDPAddr) {
+	if id == t.self || addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[t.bucketIndex(id)]
+	for i, c := range b.contacts {
+		if c.ID == id {
+			c.Addr = addr
+			c.LastSeen = time.Now()
+			c.Failures = 0
+
+			// move to the tail, the head is the least recently seen contact
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), c)
+			return
+		}
+	}
+
+	c := &contact{ID: id, Addr: addr, LastSeen: time.Now()}
+	if len(b.contacts) < K {
+		b.contacts = append(b.contacts, c)
+		return
+	}
+
+	for i, old := range b.contacts {
+		if old.Failures >= maxFailures {
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), c)
+			return
+		}
+	}
+}
+
+func (t *table) failed(id ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[t.bucketIndex(id)]
+	for _, c := range b.contacts {
+		if c.ID == id {
+			c.Failures++
+			return
+		}
+	}
+}
+
+// closest returns copies of the count contacts closest to target.
+func (t *table) closest(target ID, count int) []*contact {
+	t.mu.RLock()
+	ret := make([]*contact, 0)
+	for i := range t.buckets {
+		for _, c := range t.buckets[i].contacts {
+			if c.Failures < maxFailures {
+				cp := *c
+				ret = append(ret, &cp)
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID.Less(ret[j].ID, target)
+	})
+
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+
+	return ret
+}
+
+func (t *table) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	count := 0
+	for i := range t.buckets {
+		count += len(t.buckets[i].contacts)
+	}
+
+	return count
+}
+
+func (t *table) save(path string) error {
+	nodes := encodeCompactNodes(t.closest(t.self, len(t.buckets)*K))
+	res, err := bencode.Marshal(map[string]any{
+		"id":    string(t.self[:]),
+		"nodes": nodes,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(res), 0644)
+}
+
+// loadTable reads a routing table written by save, the stored id is reused so
+// that the node keeps its place in the DHT between runs.
+func loadTable(path string) (*table, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := bencode.Unmarshal(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	self, ok := getID(v)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	t := newTable(self)
+	nodes, _ := v["nodes"].(string)
+	for _, c := range decodeCompactNodes(nodes) {
+		t.seen(c.ID, c.Addr)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,193 @@
+package dgotorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+	"github.com/Dizzrt/dgo-torrent/mse"
+)
+
+var (
+	ErrEncryptionRequired = errors.New("peer connection is not encrypted")
+	ErrUnknownInfoHash    = errors.New("handshake for an unknown info hash")
+)
+
+// EncryptionMode is the message stream encryption policy of peer connections.
+type EncryptionMode uint8
+
+const (
+	// plain connections only, encrypted inbound connections are refused
+	ENCRYPTION_DISABLED EncryptionMode = iota
+	// encrypt when the peer supports it, plain connections are accepted
+	ENCRYPTION_PREFERRED
+	// only rc4 encrypted connections are used
+	ENCRYPTION_REQUIRED
+)
+
+func (m EncryptionMode) String() string {
+	switch m {
+	case ENCRYPTION_DISABLED:
+		return "disabled"
+	case ENCRYPTION_PREFERRED:
+		return "preferred"
+	case ENCRYPTION_REQUIRED:
+		return "required"
+	}
+
+	return fmt.Sprintf("EncryptionMode(%d)", m)
+}
+
+func ParseEncryptionMode(s string) (EncryptionMode, error) {
+	switch s {
+	case "disabled":
+		return ENCRYPTION_DISABLED, nil
+	case "preferred":
+		return ENCRYPTION_PREFERRED, nil
+	case "required":
+		return ENCRYPTION_REQUIRED, nil
+	}
+
+	return ENCRYPTION_DISABLED, fmt.Errorf("invalid encryption mode: %q", s)
+}
+
+func (m EncryptionMode) provide() mse.CryptoMethod {
+	if m == ENCRYPTION_REQUIRED {
+		return mse.CRYPTO_RC4
+	}
+
+	return mse.CRYPTO_RC4 | mse.CRYPTO_PLAINTEXT
+}
+
+// choose selects the crypto method of an inbound connection, rc4 is used
+// whenever the initiator provides it.
+func (m EncryptionMode) choose(provided mse.CryptoMethod) mse.CryptoMethod {
+	if provided&mse.CRYPTO_RC4 != 0 {
+		return mse.CRYPTO_RC4
+	}
+
+	if m == ENCRYPTION_PREFERRED {
+		return provided & mse.CRYPTO_PLAINTEXT
+	}
+
+	return 0
+}
+
+// Encrypted reports whether the stream of the connection is rc4 encrypted.
+func (c *PeerConn) Encrypted() bool {
+	ec, ok := c.Conn.(*mse.Conn)
+	return ok && ec.Encrypted()
+}
+
+// dialEncrypted connects to a peer and runs the encryption handshake if the
+// config asks for it. With encryption preferred, peers that fail the
+// handshake are dialed again in plain.
+func dialEncrypted(ctx context.Context, peer Peer, infoHash [INFO_HASH_LEN]byte, cfg *ConnConfig) (net.Conn, error) {
+	conn, err := dialTransport(ctx, peer, cfg.UTP)
+	if err != nil || cfg.Encryption == ENCRYPTION_DISABLED {
+		return conn, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	ec, err := mse.Initiate(conn, infoHash[:], cfg.Encryption.provide())
+	stop()
+	if err == nil {
+		return ec, nil
+	}
+
+	conn.Close()
+	if cfg.Encryption == ENCRYPTION_REQUIRED {
+		return nil, err
+	}
+
+	dlog.Infof("encrypted handshake with %s failed, retrying in plain: %v", peer.String(), err)
+	return dialTransport(ctx, peer, cfg.UTP)
+}
+
+func peerFromAddr(addr net.Addr) Peer {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return Peer{IP: a.IP, Port: uint16(a.Port)}
+	case *net.UDPAddr:
+		return Peer{IP: a.IP, Port: uint16(a.Port)}
+	}
+
+	return Peer{}
+}
+
+// AcceptConn sets up an inbound connection for one of the given torrents,
+// the encryption handshake is answered according to the config and a plain
+// handshake is detected on the fly.
+func AcceptConn(conn net.Conn, peerID string, infoHashes [][INFO_HASH_LEN]byte, cfg *ConnConfig) (*PeerConn, error) {
+	if cfg == nil {
+		cfg = DefaultConnConfig()
+	}
+
+	if cfg.Extensions == nil {
+		cfg.Extensions = NewExtensionRegistry()
+	}
+
+	stream := conn
+	if cfg.Encryption != ENCRYPTION_DISABLED {
+		skeys := make([][]byte, 0, len(infoHashes))
+		for i := range infoHashes {
+			skeys = append(skeys, infoHashes[i][:])
+		}
+
+		ec, _, err := mse.Receive(conn, skeys, cfg.Encryption.choose)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if cfg.Encryption == ENCRYPTION_REQUIRED && !ec.Encrypted() {
+			conn.Close()
+			return nil, ErrEncryptionRequired
+		}
+
+		stream = ec
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reserved, infoHash, err := readHandshakeMsg(stream)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	known := false
+	for _, h := range infoHashes {
+		known = known || h == infoHash
+	}
+
+	if known && cfg.ForInfoHash != nil {
+		if cfg = cfg.ForInfoHash(infoHash); cfg != nil && cfg.Extensions == nil {
+			cfg.Extensions = NewExtensionRegistry()
+		}
+	}
+
+	if !known || cfg == nil {
+		conn.Close()
+		return nil, ErrUnknownInfoHash
+	}
+
+	if err = handshake(stream, infoHash, peerID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c, err := newPeerConn(stream, peerFromAddr(conn.RemoteAddr()), infoHash, peerID, reserved, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fillBitfield(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
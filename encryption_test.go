@@ -0,0 +1,195 @@
+package dgotorrent_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+var encryptionInfoHash = [dgotorrent.INFO_HASH_LEN]byte{'m', 's', 'e'}
+
+type acceptResult struct {
+	conn *dgotorrent.PeerConn
+	err  error
+}
+
+// startAcceptor accepts inbound connections the way a second client would,
+// it seeds all 4 pieces of the torrent.
+func startAcceptor(t *testing.T, mode dgotorrent.EncryptionMode) (dgotorrent.Peer, chan acceptResult) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	results := make(chan acceptResult, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c, err := dgotorrent.AcceptConn(conn, "-TEST00-000000000002", [][dgotorrent.INFO_HASH_LEN]byte{encryptionInfoHash}, &dgotorrent.ConnConfig{
+				NumPieces:  4,
+				Have:       dgotorrent.Bitfield{0xf0},
+				Encryption: mode,
+			})
+			results <- acceptResult{c, err}
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, results
+}
+
+func dialEncrypted(peer dgotorrent.Peer, mode dgotorrent.EncryptionMode) (*dgotorrent.PeerConn, error) {
+	return dgotorrent.NewConnWithConfig(peer, encryptionInfoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{
+		NumPieces:  4,
+		Encryption: mode,
+	})
+}
+
+// readUntil skips messages until one of the given type arrives.
+func readUntil(t *testing.T, c *dgotorrent.PeerConn, typ dgotorrent.PeerMsgTyep) *dgotorrent.PeerMsg {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg != nil && msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func TestEncryptedConn(t *testing.T) {
+	peer, results := startAcceptor(t, dgotorrent.ENCRYPTION_PREFERRED)
+
+	c, err := dialEncrypted(peer, dgotorrent.ENCRYPTION_REQUIRED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	if !c.Encrypted() || !r.conn.Encrypted() {
+		t.Fatal("expected both ends to be encrypted")
+	}
+
+	if !c.HasPiece(3) {
+		t.Error("bitfield was not received over the encrypted stream")
+	}
+
+	// messages pass the encrypted stream in both directions
+	c.WriteMsg(&dgotorrent.PeerMsg{Type: dgotorrent.PEER_MSG_TYPE_INTERESTED})
+	readUntil(t, r.conn, dgotorrent.PEER_MSG_TYPE_INTERESTED)
+
+	r.conn.WriteMsg(&dgotorrent.PeerMsg{Type: dgotorrent.PEER_MSG_TYPE_HAVE, Payload: []byte{0, 0, 0, 2}})
+	if msg := readUntil(t, c, dgotorrent.PEER_MSG_TYPE_HAVE); msg.Payload[3] != 2 {
+		t.Errorf("unexpected have message %v", msg.Payload)
+	}
+}
+
+func TestEncryptionPlainAccepted(t *testing.T) {
+	peer, results := startAcceptor(t, dgotorrent.ENCRYPTION_PREFERRED)
+
+	c, err := dialEncrypted(peer, dgotorrent.ENCRYPTION_DISABLED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	if c.Encrypted() || r.conn.Encrypted() {
+		t.Error("expected a plain connection")
+	}
+}
+
+func TestEncryptionRequiredRefusesPlain(t *testing.T) {
+	peer, results := startAcceptor(t, dgotorrent.ENCRYPTION_REQUIRED)
+
+	if c, err := dialEncrypted(peer, dgotorrent.ENCRYPTION_DISABLED); err == nil {
+		c.Close()
+		t.Error("expected the plain connection to be refused")
+	}
+
+	if r := <-results; r.err != dgotorrent.ErrEncryptionRequired {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrEncryptionRequired, r.err)
+	}
+}
+
+func TestEncryptionPreferredFallback(t *testing.T) {
+	peer, results := startAcceptor(t, dgotorrent.ENCRYPTION_DISABLED)
+
+	c, err := dialEncrypted(peer, dgotorrent.ENCRYPTION_PREFERRED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the encrypted attempt fails before the plain connection succeeds
+	if r := <-results; r.err == nil {
+		t.Fatal("expected the encrypted handshake to be refused")
+	}
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	if c.Encrypted() {
+		t.Error("expected a plain connection")
+	}
+}
+
+func TestOversizedMsgRejected(t *testing.T) {
+	peer, results := startAcceptor(t, dgotorrent.ENCRYPTION_DISABLED)
+
+	c, err := dialEncrypted(peer, dgotorrent.ENCRYPTION_DISABLED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	// a length of 4 GiB is refused before the message is allocated
+	c.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var readErr error
+	for readErr == nil {
+		_, readErr = r.conn.ReadMsg()
+	}
+
+	if !strings.Contains(readErr.Error(), "too large") {
+		t.Fatalf("expected the oversized message to be rejected, got %v", readErr)
+	}
+
+	// the connection is closed
+	if _, err := r.conn.ReadMsg(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
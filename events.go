@@ -0,0 +1,213 @@
+package dgotorrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	EVENT_TYPE_PIECE_VERIFIED EventType = iota
+	EVENT_TYPE_PIECE_FAILED
+	EVENT_TYPE_PEER_CONNECTED
+	EVENT_TYPE_PEER_DISCONNECTED
+	EVENT_TYPE_ANNOUNCE
+	EVENT_TYPE_STATE_CHANGED
+	EVENT_TYPE_STATS
+)
+
+var eventTypeNames = map[EventType]string{
+	EVENT_TYPE_PIECE_VERIFIED:    "piece_verified",
+	EVENT_TYPE_PIECE_FAILED:      "piece_failed",
+	EVENT_TYPE_PEER_CONNECTED:    "peer_connected",
+	EVENT_TYPE_PEER_DISCONNECTED: "peer_disconnected",
+	EVENT_TYPE_ANNOUNCE:          "announce",
+	EVENT_TYPE_STATE_CHANGED:     "state_changed",
+	EVENT_TYPE_STATS:             "stats",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("EventType(%d)", t)
+}
+
+// interval of the stats events of a running download
+const STATS_INTERVAL = time.Second
+
+// buffer of the channels created by EventBus.Handle
+const EVENT_BUFFER_SIZE = 256
+
+// Event is one of the *Event types below, subscribers tell them apart with a
+// type switch or by Type.
+type Event interface {
+	Type() EventType
+	Header() EventHeader
+}
+
+// EventHeader is the part that all events share. TaskID is 0 for tasks that
+// are not stored.
+type EventHeader struct {
+	TaskID   int
+	InfoHash [INFO_HASH_LEN]byte
+	Time     time.Time
+}
+
+func (h EventHeader) Header() EventHeader {
+	return h
+}
+
+func newEventHeader(t *Task) EventHeader {
+	return EventHeader{
+		TaskID:   t.ID,
+		InfoHash: t.Torrent.Info.Hash,
+		Time:     time.Now(),
+	}
+}
+
+// PieceVerifiedEvent is sent for every downloaded piece that matched its
+// hash. Source is the address of the peer or the url of the web seed.
+type PieceVerifiedEvent struct {
+	EventHeader
+	Index  int
+	Length int
+	Source string
+}
+
+func (PieceVerifiedEvent) Type() EventType { return EVENT_TYPE_PIECE_VERIFIED }
+
+// PieceFailedEvent is sent for a downloaded piece that did not match its
+// hash, the piece is downloaded again.
+type PieceFailedEvent struct {
+	EventHeader
+	Index  int
+	Source string
+}
+
+func (PieceFailedEvent) Type() EventType { return EVENT_TYPE_PIECE_FAILED }
+
+type PeerConnectedEvent struct {
+	EventHeader
+	Peer Peer
+}
+
+func (PeerConnectedEvent) Type() EventType { return EVENT_TYPE_PEER_CONNECTED }
+
+// PeerDisconnectedEvent is sent when a connection of a PeerConnectedEvent is
+// closed, Err is the reason if it was not closed by us.
+type PeerDisconnectedEvent struct {
+	EventHeader
+	Peer Peer
+	Err  error
+}
+
+func (PeerDisconnectedEvent) Type() EventType { return EVENT_TYPE_PEER_DISCONNECTED }
+
+// AnnounceResultEvent is sent for every tracker an announce went to.
+type AnnounceResultEvent struct {
+	EventHeader
+	Tracker  string
+	Event    AnnounceEvent
+	Peers    int
+	Interval time.Duration
+	Err      error
+}
+
+func (AnnounceResultEvent) Type() EventType { return EVENT_TYPE_ANNOUNCE }
+
+// StateChangedEvent is sent by a session for every state change of its
+// tasks, Error is the reason of TASK_STATE_ERROR.
+type StateChangedEvent struct {
+	EventHeader
+	From  TaskState
+	To    TaskState
+	Error string
+}
+
+func (StateChangedEvent) Type() EventType { return EVENT_TYPE_STATE_CHANGED }
+
+// StatsEvent is a snapshot of a running download, it is sent when the
+// download starts, every STATS_INTERVAL and when it ends. Sessions send them
+// for their seeding tasks too.
+type StatsEvent struct {
+	EventHeader
+	TaskStats
+}
+
+func (StatsEvent) Type() EventType { return EVENT_TYPE_STATS }
+
+// EventBus passes the events of downloads and sessions to its subscribers.
+// Every subscriber has a buffered channel, events are dropped for a
+// subscriber that does not keep up so that it never stalls a download. A nil
+// bus drops all events.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel with room for size events that receives all
+// events published from now on. The returned func ends the subscription and
+// closes the channel.
+func (b *EventBus) Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			close(ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Handle calls fn with every event on a goroutine of its own. The returned
+// func ends the subscription, it returns after fn got the events that were
+// published before.
+func (b *EventBus) Handle(fn func(Event)) func() {
+	ch, unsubscribe := b.Subscribe(EVENT_BUFFER_SIZE)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for e := range ch {
+			fn(e)
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
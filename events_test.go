@@ -0,0 +1,193 @@
+package dgotorrent_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+// corruptWriter flips the first byte written.
+type corruptWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *corruptWriter) Write(b []byte) (int, error) {
+	if !w.done && len(b) > 0 {
+		w.done = true
+		b = append([]byte{b[0] ^ 0xff}, b[1:]...)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// corruptOnce replaces the web seeds of the torrent with one that corrupts
+// the first piece it serves.
+func corruptOnce(t *testing.T, tf *dgotorrent.TorrentFile, content []byte) string {
+	root := t.TempDir()
+	if err := tf.Info.WriteContent(root, content); err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	files := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { w = &corruptWriter{ResponseWriter: w} })
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	tf.URLList = []string{server.URL + "/"}
+	return tf.URLList[0]
+}
+
+func TestProcessEvents(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(40000)},
+	})
+	newEventTracker(t, tf)
+	seedURL := corruptOnce(t, tf, content)
+
+	task := &dgotorrent.Task{Name: tf.Info.Name, Path: t.TempDir(), Torrent: *tf}
+	process := dgotorrent.NewProcess(task)
+	events, unsubscribe := process.Events.Subscribe(1024)
+
+	if err := process.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+
+	verified := make(map[int]bool)
+	failed, announces := 0, make([]string, 0)
+	stats := make([]dgotorrent.StatsEvent, 0)
+	for e := range events {
+		if e.Header().InfoHash != tf.Info.Hash || e.Header().Time.IsZero() {
+			t.Fatalf("unexpected header %+v", e.Header())
+		}
+
+		switch e := e.(type) {
+		case dgotorrent.PieceVerifiedEvent:
+			verified[e.Index] = true
+			if e.Source != seedURL {
+				t.Errorf("unexpected source %s", e.Source)
+			}
+		case dgotorrent.PieceFailedEvent:
+			failed++
+		case dgotorrent.AnnounceResultEvent:
+			if e.Err != nil || e.Interval.Seconds() != 1800 {
+				t.Errorf("unexpected announce result %+v", e)
+			}
+			announces = append(announces, e.Event.String())
+		case dgotorrent.StatsEvent:
+			stats = append(stats, e)
+		}
+	}
+
+	if len(verified) != 3 || failed != 1 {
+		t.Errorf("expected 3 verified and 1 failed piece, got %d and %d", len(verified), failed)
+	}
+
+	if len(announces) != 2 || announces[0] != "started" || announces[1] != "completed" {
+		t.Errorf("unexpected announces %v", announces)
+	}
+
+	if len(stats) < 2 || stats[0].Completed != 0 || stats[0].Wanted != 40000 || stats[0].TotalPieces != 3 {
+		t.Fatalf("unexpected first stats %+v", stats)
+	}
+
+	// the corrupted piece was downloaded twice
+	if last := stats[len(stats)-1]; last.Completed != 40000 || last.Pieces != 3 ||
+		last.Wasted == 0 || last.Downloaded != 40000+last.Wasted {
+		t.Errorf("unexpected last stats %+v", last)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := dgotorrent.NewEventBus()
+
+	// a full subscriber misses events instead of blocking
+	slow, unsubscribe := bus.Subscribe(1)
+	var got []int
+	stop := bus.Handle(func(e dgotorrent.Event) {
+		got = append(got, e.(dgotorrent.PieceVerifiedEvent).Index)
+	})
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(dgotorrent.PieceVerifiedEvent{Index: i})
+	}
+
+	stop()
+	if len(got) != 3 {
+		t.Errorf("expected the handler to get all events, got %v", got)
+	}
+
+	unsubscribe()
+	n := 0
+	for range slow {
+		n++
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 buffered event, got %d", n)
+	}
+
+	// events of a nil bus are dropped
+	var none *dgotorrent.EventBus
+	none.Publish(dgotorrent.StatsEvent{})
+}
+
+func TestSessionEvents(t *testing.T) {
+	tf, _ := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(20000)},
+	})
+
+	s := newSession(t, dgotorrent.SessionConfig{DownloadPath: t.TempDir(), DB: sessionDB(t)})
+	events, unsubscribe := s.Events().Subscribe(1024)
+
+	task, err := s.Add(tf, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+	unsubscribe()
+
+	changes := make([]string, 0)
+	verified := 0
+	for e := range events {
+		if e.Header().TaskID != task.ID {
+			t.Fatalf("unexpected task id %d", e.Header().TaskID)
+		}
+
+		switch e := e.(type) {
+		case dgotorrent.StateChangedEvent:
+			changes = append(changes, e.From.String()+">"+e.To.String())
+		case dgotorrent.PieceVerifiedEvent:
+			verified++
+		}
+	}
+
+	if verified != 2 {
+		t.Errorf("expected the pieces of the download, got %d", verified)
+	}
+
+	want := []string{
+		dgotorrent.TASK_STATE_QUEUED.String() + ">" + dgotorrent.TASK_STATE_DOWNLOADING.String(),
+		dgotorrent.TASK_STATE_DOWNLOADING.String() + ">" + dgotorrent.TASK_STATE_COMPLETE.String(),
+		dgotorrent.TASK_STATE_COMPLETE.String() + ">" + dgotorrent.TASK_STATE_SEEDING.String(),
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("unexpected state changes %v", changes)
+	}
+
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("unexpected state changes %v", changes)
+			break
+		}
+	}
+}
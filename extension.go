@@ -0,0 +1,329 @@
+package dgotorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+var (
+	ErrExtensionNotSupported = errors.New("extension not supported by peer")
+	ErrExtensionRegistered   = errors.New("extension already registered")
+	ErrTooManyExtensions     = errors.New("too many extensions")
+)
+
+// reserved bit of the extension protocol (BEP 10)
+const EXTENSION_BIT_BYTE = 5
+const EXTENSION_BIT = 0x10
+
+const EXT_HANDSHAKE_ID = 0
+
+const CLIENT_VERSION = "dgo-torrent 0.0.1"
+
+// number of outstanding requests we accept from a peer
+const DEFAULT_REQQ = 250
+
+const (
+	EXT_UT_METADATA  = "ut_metadata"
+	EXT_LT_DONTHAVE  = "lt_donthave"
+	maxExtensionsLen = 255
+)
+
+// Extension is a message handler plugged into the extension protocol. The
+// registry assigns the local message id, HandleMsg receives the payload of
+// the messages the remote peer sends with that id.
+type Extension interface {
+	Name() string
+	HandleMsg(c *PeerConn, payload []byte) error
+}
+
+// ExtHandshakeWriter is implemented by extensions that add keys to the
+// extended handshake we send, e.g. metadata_size.
+type ExtHandshakeWriter interface {
+	WriteHandshake(c *PeerConn, hs map[string]any)
+}
+
+// ExtHandshakeHandler is implemented by extensions that want to be notified
+// when the extended handshake of the remote peer arrives.
+type ExtHandshakeHandler interface {
+	HandleHandshake(c *PeerConn, hs *ExtHandshake) error
+}
+
+type ExtensionRegistry struct {
+	mu     sync.RWMutex
+	exts   []Extension
+	byName map[string]int64
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		exts:   make([]Extension, 0),
+		byName: make(map[string]int64),
+	}
+}
+
+// DefaultExtensions returns a registry with the built-in extensions.
+func DefaultExtensions() *ExtensionRegistry {
+	r := NewExtensionRegistry()
+	r.Register(NewMetadataExtension(nil))
+	r.Register(&DontHaveExtension{})
+
+	return r
+}
+
+// Register adds an extension and returns the message id assigned to it.
+func (r *ExtensionRegistry) Register(ext Extension) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byName[ext.Name()]; ok {
+		return 0, fmt.Errorf("%w: %s", ErrExtensionRegistered, ext.Name())
+	}
+
+	if len(r.exts) >= maxExtensionsLen {
+		return 0, ErrTooManyExtensions
+	}
+
+	r.exts = append(r.exts, ext)
+	id := int64(len(r.exts))
+	r.byName[ext.Name()] = id
+
+	return id, nil
+}
+
+func (r *ExtensionRegistry) Get(name string) (Extension, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byName[name]
+	if !ok {
+		return nil, false
+	}
+
+	return r.exts[id-1], true
+}
+
+// ID returns the local message id of an extension.
+func (r *ExtensionRegistry) ID(name string) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byName[name]
+	return id, ok
+}
+
+func (r *ExtensionRegistry) byID(id int64) (Extension, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > int64(len(r.exts)) {
+		return nil, false
+	}
+
+	return r.exts[id-1], true
+}
+
+func (r *ExtensionRegistry) all() []Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Extension{}, r.exts...)
+}
+
+type ExtHandshake struct {
+	M            map[string]int64
+	V            string
+	P            int64
+	Reqq         int64
+	YourIP       net.IP
+	MetadataSize int64
+	// Raw holds every key of the handshake, including the ones of custom
+	// extensions.
+	Raw map[string]any
+}
+
+func (c *PeerConn) SupportsExtensions() bool {
+	return c.reserved[EXTENSION_BIT_BYTE]&EXTENSION_BIT != 0
+}
+
+// RemoteExtID returns the message id the remote peer assigned to an extension.
+func (c *PeerConn) RemoteExtID(name string) (int64, bool) {
+	if c.ExtHandshake == nil {
+		return 0, false
+	}
+
+	id, ok := c.ExtHandshake.M[name]
+	return id, ok && id != 0
+}
+
+func compactIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+
+	return string(ip.To16())
+}
+
+func (c *PeerConn) sendExtHandshake() error {
+	m := make(map[string]any)
+	exts := c.cfg.Extensions.all()
+	for _, ext := range exts {
+		id, _ := c.cfg.Extensions.ID(ext.Name())
+		m[ext.Name()] = id
+	}
+
+	v := map[string]any{
+		"m":    m,
+		"v":    CLIENT_VERSION,
+		"reqq": int64(DEFAULT_REQQ),
+	}
+
+	if c.cfg.ListenPort > 0 {
+		v["p"] = int64(c.cfg.ListenPort)
+	}
+
+	// tcp and uTP connections both tell the peer its address
+	if peer := peerFromAddr(c.RemoteAddr()); peer.IP != nil {
+		v["yourip"] = compactIP(peer.IP)
+	}
+
+	for _, ext := range exts {
+		if w, ok := ext.(ExtHandshakeWriter); ok {
+			w.WriteHandshake(c, v)
+		}
+	}
+
+	payload, err := bencode.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteExtended(EXT_HANDSHAKE_ID, []byte(payload))
+}
+
+func (c *PeerConn) WriteExtended(id int64, payload []byte) error {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = byte(id)
+	copy(buf[1:], payload)
+
+	_, err := c.WriteMsg(&PeerMsg{
+		Type:    PEER_MSG_TYPE_EXTENDED,
+		Payload: buf,
+	})
+
+	return err
+}
+
+// SendExtended sends an extension message with the id the remote peer
+// assigned to the extension.
+func (c *PeerConn) SendExtended(name string, payload []byte) error {
+	id, ok := c.RemoteExtID(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrExtensionNotSupported, name)
+	}
+
+	return c.WriteExtended(id, payload)
+}
+
+func parseExtHandshake(payload []byte) (*ExtHandshake, error) {
+	res, _, err := bencode.UnmarshalPrefix(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid extension handshake")
+	}
+
+	hs := &ExtHandshake{
+		M:   make(map[string]int64),
+		Raw: v,
+	}
+
+	if m, ok := v["m"].(map[string]any); ok {
+		for name, id := range m {
+			if value, ok := id.(int64); ok {
+				hs.M[name] = value
+			}
+		}
+	}
+
+	hs.V, _ = v["v"].(string)
+	hs.P, _ = v["p"].(int64)
+	hs.Reqq, _ = v["reqq"].(int64)
+	hs.MetadataSize, _ = v["metadata_size"].(int64)
+
+	if ip, ok := v["yourip"].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		hs.YourIP = net.IP(ip)
+	}
+
+	return hs, nil
+}
+
+// handleExtendedMsg processes an extension protocol message, the handshake is
+// consumed here and every other message is routed to its extension.
+func (c *PeerConn) handleExtendedMsg(msg *PeerMsg) error {
+	if len(msg.Payload) < 1 {
+		return fmt.Errorf("extended message too short")
+	}
+
+	id := int64(msg.Payload[0])
+	if id != EXT_HANDSHAKE_ID {
+		ext, ok := c.cfg.Extensions.byID(id)
+		if !ok {
+			return nil
+		}
+
+		return ext.HandleMsg(c, msg.Payload[1:])
+	}
+
+	hs, err := parseExtHandshake(msg.Payload[1:])
+	if err != nil {
+		return err
+	}
+
+	c.ExtHandshake = hs
+	for _, ext := range c.cfg.Extensions.all() {
+		if h, ok := ext.(ExtHandshakeHandler); ok {
+			if err = h.HandleHandshake(c, hs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// region lt_donthave
+
+// DontHaveExtension handles lt_donthave (BEP 54) messages, a peer uses them
+// to tell us it no longer has a piece.
+type DontHaveExtension struct{}
+
+func (e *DontHaveExtension) Name() string {
+	return EXT_LT_DONTHAVE
+}
+
+func (e *DontHaveExtension) HandleMsg(c *PeerConn, payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("expected lt_donthave payload length 4, got %d", len(payload))
+	}
+
+	c.PiecesMap.Clear(int(binary.BigEndian.Uint32(payload)))
+	c.updateSeed()
+	return nil
+}
+
+func SendDontHave(c *PeerConn, index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return c.SendExtended(EXT_LT_DONTHAVE, payload)
+}
+
+// endregion
@@ -0,0 +1,371 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+	"github.com/Dizzrt/dgo-torrent/utp"
+)
+
+type provenanceExt struct {
+	received chan []byte
+}
+
+func (e *provenanceExt) Name() string {
+	return "x_provenance"
+}
+
+func (e *provenanceExt) WriteHandshake(c *dgotorrent.PeerConn, hs map[string]any) {
+	hs["x_build"] = "build-42"
+}
+
+func (e *provenanceExt) HandleMsg(c *dgotorrent.PeerConn, payload []byte) error {
+	e.received <- payload
+	return c.SendExtended(e.Name(), []byte("ack"))
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	r := dgotorrent.NewExtensionRegistry()
+
+	id, err := r.Register(dgotorrent.NewMetadataExtension(nil))
+	if err != nil || id != 1 {
+		t.Fatalf("expected id 1, got %d (%v)", id, err)
+	}
+
+	id, err = r.Register(&provenanceExt{})
+	if err != nil || id != 2 {
+		t.Fatalf("expected id 2, got %d (%v)", id, err)
+	}
+
+	if _, err = r.Register(&provenanceExt{}); !errors.Is(err, dgotorrent.ErrExtensionRegistered) {
+		t.Errorf("expected duplicate registration to fail, got %v", err)
+	}
+
+	if ext, ok := r.Get("x_provenance"); !ok || ext.Name() != "x_provenance" {
+		t.Errorf("failed to look up extension by name")
+	}
+}
+
+// extPeer is a fake remote peer driven by the test through its connection.
+type extPeer struct {
+	conn      net.Conn
+	handshake map[string]any
+}
+
+func startExtPeer(t *testing.T, reserved byte, script func(p *extPeer)) dgotorrent.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return startExtPeerOn(t, l, reserved, script)
+}
+
+// startExtPeerOn runs the fake peer on the listener, tcp or uTP.
+func startExtPeerOn(t *testing.T, l net.Listener, reserved byte, script func(p *extPeer)) dgotorrent.Peer {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		if _, err = answerHandshake(conn, [8]byte{5: reserved}); err != nil {
+			return
+		}
+
+		p := &extPeer{conn: conn}
+		if reserved&0x10 != 0 {
+			id, payload, err := readPeerMsg(conn)
+			if err != nil || id != 20 || payload[0] != 0 {
+				return
+			}
+
+			res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+			p.handshake, _ = res.(map[string]any)
+		}
+
+		script(p)
+	}()
+
+	if addr, ok := l.Addr().(*net.UDPAddr); ok {
+		return dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	addr := l.Addr().(*net.TCPAddr)
+	return dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (p *extPeer) localID(name string) byte {
+	m, _ := p.handshake["m"].(map[string]any)
+	id, _ := m[name].(int64)
+
+	return byte(id)
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	ext := &provenanceExt{received: make(chan []byte, 1)}
+	registry := dgotorrent.DefaultExtensions()
+	registry.Register(ext)
+
+	handshakes := make(chan map[string]any, 1)
+	acks := make(chan []byte, 1)
+	peer := startExtPeer(t, 0x10, func(p *extPeer) {
+		handshakes <- p.handshake
+
+		exths, _ := bencode.Marshal(map[string]any{
+			"m":       map[string]any{"x_provenance": int64(7), "ut_pex": int64(2)},
+			"v":       "fake 1.0",
+			"p":       int64(51413),
+			"reqq":    int64(500),
+			"yourip":  string(net.ParseIP("192.0.2.1").To4()),
+			"x_build": "remote-build",
+		})
+		writePeerMsg(p.conn, 20, append([]byte{0}, exths...))
+		writePeerMsg(p.conn, 20, append([]byte{p.localID("x_provenance")}, "hello"...))
+
+		id, payload, err := readPeerMsg(p.conn)
+		if err == nil && id == 20 && payload[0] == 7 {
+			acks <- payload[1:]
+		}
+
+		writePeerMsg(p.conn, 5, []byte{0xff})
+	})
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConnWithConfig(peer, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{
+		Extensions: registry,
+		ListenPort: 6881,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	local := <-handshakes
+	m, _ := local["m"].(map[string]any)
+	for _, name := range []string{dgotorrent.EXT_UT_METADATA, dgotorrent.EXT_LT_DONTHAVE, "x_provenance"} {
+		if id, _ := m[name].(int64); id == 0 {
+			t.Errorf("extension %s missing from handshake: %v", name, m)
+		}
+	}
+
+	if local["v"] != dgotorrent.CLIENT_VERSION || local["p"] != int64(6881) || local["reqq"] != int64(dgotorrent.DEFAULT_REQQ) {
+		t.Errorf("unexpected handshake: %v", local)
+	}
+
+	if local["yourip"] != string(net.ParseIP("127.0.0.1").To4()) || local["x_build"] != "build-42" {
+		t.Errorf("unexpected handshake: %v", local)
+	}
+
+	if !c.SupportsExtensions() || c.ExtHandshake == nil {
+		t.Fatal("remote extension handshake was not received")
+	}
+
+	hs := c.ExtHandshake
+	if hs.V != "fake 1.0" || hs.P != 51413 || hs.Reqq != 500 || !hs.YourIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("unexpected remote handshake: %+v", hs)
+	}
+
+	if hs.Raw["x_build"] != "remote-build" {
+		t.Errorf("custom handshake key is missing: %v", hs.Raw)
+	}
+
+	if got := <-ext.received; string(got) != "hello" {
+		t.Errorf("unexpected custom message: %q", got)
+	}
+
+	if got := <-acks; string(got) != "ack" {
+		t.Errorf("unexpected reply: %q", got)
+	}
+}
+
+func TestExtensionsNotNegotiated(t *testing.T) {
+	peer := startExtPeer(t, 0, func(p *extPeer) {
+		writePeerMsg(p.conn, 5, []byte{0xff})
+		io.Copy(io.Discard, p.conn)
+	})
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConn(peer, infoHash, "-TEST00-000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.SupportsExtensions() {
+		t.Error("peer without the reserved bit must not be treated as extension capable")
+	}
+
+	if err = c.SendExtended(dgotorrent.EXT_UT_METADATA, nil); !errors.Is(err, dgotorrent.ErrExtensionNotSupported) {
+		t.Errorf("expected ErrExtensionNotSupported, got %v", err)
+	}
+}
+
+func TestServeMetadata(t *testing.T) {
+	info := []byte("d4:name4:test12:piece lengthi16384e6:pieces0:6:lengthi0ee")
+	registry := dgotorrent.NewExtensionRegistry()
+	registry.Register(dgotorrent.NewMetadataExtension(info))
+
+	results := make(chan []byte, 1)
+	peer := startExtPeer(t, 0x10, func(p *extPeer) {
+		if p.handshake["metadata_size"] != int64(len(info)) {
+			results <- nil
+			return
+		}
+
+		exths, _ := bencode.Marshal(map[string]any{
+			"m": map[string]any{"ut_metadata": int64(4)},
+		})
+		writePeerMsg(p.conn, 20, append([]byte{0}, exths...))
+
+		req, _ := bencode.Marshal(map[string]any{"msg_type": int64(0), "piece": int64(0)})
+		writePeerMsg(p.conn, 20, append([]byte{p.localID("ut_metadata")}, req...))
+
+		id, payload, err := readPeerMsg(p.conn)
+		if err != nil || id != 20 || payload[0] != 4 {
+			results <- nil
+			return
+		}
+
+		_, n, _ := bencode.UnmarshalPrefix(payload[1:])
+		results <- payload[1+n:]
+
+		writePeerMsg(p.conn, 5, []byte{0xff})
+	})
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConnWithConfig(peer, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{
+		Extensions: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := <-results; !bytes.Equal(got, info) {
+		t.Errorf("unexpected metadata: %q", got)
+	}
+}
+
+func TestExtendedHandshakeUTP(t *testing.T) {
+	remote, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakes := make(chan map[string]any, 1)
+	peer := startExtPeerOn(t, remote, 0x10, func(p *extPeer) {
+		handshakes <- p.handshake
+		writePeerMsg(p.conn, 5, []byte{0xff})
+	})
+
+	local, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConnWithConfig(peer, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{UTP: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// peers on uTP are told their address as well
+	if hs := <-handshakes; hs["yourip"] != string(net.ParseIP("127.0.0.1").To4()) {
+		t.Errorf("expected yourip in the handshake, got %v", hs)
+	}
+}
+
+func TestHandshakeListenPort(t *testing.T) {
+	handshakes := make(chan map[string]any, 1)
+	peer := startExtPeer(t, 0x10, func(p *extPeer) {
+		handshakes <- p.handshake
+	})
+
+	data := randomData(dgotorrent.BLOCKSIZE)
+	task := &dgotorrent.Task{
+		Name:    "port.bin",
+		Path:    t.TempDir(),
+		PeerID:  "-TEST00-000000000001",
+		Torrent: *peerTorrent(t, "port.bin", data, dgotorrent.BLOCKSIZE),
+	}
+
+	process := dgotorrent.NewProcess(task)
+	process.Port = 6881
+	process.Pool.Add([]dgotorrent.Peer{peer}, dgotorrent.PEER_SOURCE_TRACKER)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- process.Start(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the download tells its peers the port they may connect to
+	select {
+	case hs := <-handshakes:
+		if hs["p"] != int64(6881) {
+			t.Errorf("expected port 6881 in the handshake, got %v", hs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no extended handshake received")
+	}
+}
+
+func TestSeedHandshakeListenPort(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t)})
+	task, err := s.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	conn, err := dialHandshake(t, s.Addr().String(), [8]byte{5: 0x10}, tf.Info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePeerMsg(conn, 5, make([]byte, (tf.Info.NumPieces()+7)/8))
+
+	for {
+		id, payload, err := readPeerMsg(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id != 20 || payload[0] != 0 {
+			continue
+		}
+
+		// the seed tells the peer the port of the session
+		res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+		port := int64(s.Addr().(*net.TCPAddr).Port)
+		if got := res.(map[string]any)["p"]; got != port {
+			t.Errorf("expected port %d in the handshake, got %v", port, got)
+		}
+
+		return
+	}
+}
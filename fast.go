@@ -0,0 +1,291 @@
+package dgotorrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrFastNotSupported = errors.New("fast extension not supported by peer")
+)
+
+// reserved bit of the fast extension (BEP 6)
+const FAST_BIT_BYTE = 7
+const FAST_BIT = 0x04
+
+// fast extension messages (BEP 6)
+const (
+	PEER_MSG_TYPE_SUGGEST      PeerMsgTyep = 0x0D
+	PEER_MSG_TYPE_HAVE_ALL     PeerMsgTyep = 0x0E
+	PEER_MSG_TYPE_HAVE_NONE    PeerMsgTyep = 0x0F
+	PEER_MSG_TYPE_REJECT       PeerMsgTyep = 0x10
+	PEER_MSG_TYPE_ALLOWED_FAST PeerMsgTyep = 0x11
+)
+
+// size of the allowed fast set we grant, as recommended by BEP 6
+const DEFAULT_ALLOWED_FAST = 10
+
+// the number of suggestions kept per peer
+const MAX_SUGGESTED = 32
+
+// BlockRequest identifies a block of a piece, it is the payload of the
+// request, cancel and reject messages.
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func parseBlockRequest(msg *PeerMsg) (BlockRequest, error) {
+	if len(msg.Payload) != 12 {
+		return BlockRequest{}, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+
+	return BlockRequest{
+		Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+	}, nil
+}
+
+func newBlockMsg(t PeerMsgTyep, index, begin, length int) *PeerMsg {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return &PeerMsg{
+		Type:    t,
+		Payload: payload,
+	}
+}
+
+func newIndexMsg(t PeerMsgTyep, index int) *PeerMsg {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return &PeerMsg{
+		Type:    t,
+		Payload: payload,
+	}
+}
+
+func parseIndexMsg(msg *PeerMsg) (int, error) {
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
+	}
+
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func NewRejectMsg(index, begin, length int) *PeerMsg {
+	return newBlockMsg(PEER_MSG_TYPE_REJECT, index, begin, length)
+}
+
+func NewSuggestMsg(index int) *PeerMsg {
+	return newIndexMsg(PEER_MSG_TYPE_SUGGEST, index)
+}
+
+func NewAllowedFastMsg(index int) *PeerMsg {
+	return newIndexMsg(PEER_MSG_TYPE_ALLOWED_FAST, index)
+}
+
+// AllowedFastSet computes the k pieces a peer with the given ip may request
+// while it is choked, following the canonical algorithm of BEP 6.
+func AllowedFastSet(ip net.IP, infoHash [INFO_HASH_LEN]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 4+INFO_HASH_LEN)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(numPieces))
+
+			if !containsPiece(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+func containsPiece(list []int, index int) bool {
+	for _, v := range list {
+		if v == index {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *PeerConn) SupportsFast() bool {
+	return c.reserved[FAST_BIT_BYTE]&FAST_BIT != 0
+}
+
+// sendAvailability announces the pieces we have right after the handshake.
+// With the fast extension HAVE_ALL and HAVE_NONE replace the bitfield,
+// without it an empty bitfield may simply be omitted.
+func (c *PeerConn) sendAvailability() error {
+	have := c.cfg.Have
+	numPieces := c.cfg.NumPieces
+
+	var msg *PeerMsg
+	switch {
+	case c.SupportsFast() && numPieces > 0 && have.Count() == numPieces:
+		msg = &PeerMsg{Type: PEER_MSG_TYPE_HAVE_ALL}
+	case have.Count() == 0:
+		if c.SupportsFast() {
+			msg = &PeerMsg{Type: PEER_MSG_TYPE_HAVE_NONE}
+		}
+	default:
+		msg = &PeerMsg{Type: PEER_MSG_TYPE_BITFIELED, Payload: have}
+	}
+
+	_, err := c.WriteMsg(msg)
+	return err
+}
+
+// SendAllowedFast grants the remote peer the pieces of its allowed fast set
+// of size k that we have, it may request them while it is choked.
+func (c *PeerConn) SendAllowedFast(k int) error {
+	if !c.SupportsFast() {
+		return ErrFastNotSupported
+	}
+
+	if c.granted == nil {
+		c.granted = make(map[int]bool)
+	}
+
+	for _, index := range AllowedFastSet(c.peer.IP, c.infoHash, c.cfg.NumPieces, k) {
+		if !c.cfg.Have.Test(index) {
+			continue
+		}
+
+		c.granted[index] = true
+		if _, err := c.WriteMsg(NewAllowedFastMsg(index)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendSuggest suggests a piece to the remote peer.
+func (c *PeerConn) SendSuggest(index int) error {
+	if !c.SupportsFast() {
+		return ErrFastNotSupported
+	}
+
+	_, err := c.WriteMsg(NewSuggestMsg(index))
+	return err
+}
+
+// Choke chokes the remote peer. Its pending requests of allowed fast pieces
+// are kept, with the fast extension the others are rejected explicitly,
+// without it they are dropped silently.
+func (c *PeerConn) Choke() error {
+	c.AmChoking = true
+	if _, err := c.WriteMsg(&PeerMsg{Type: PEER_MSG_TYPE_CHOKE}); err != nil {
+		return err
+	}
+
+	requests := c.peerRequests
+	c.peerRequests = nil
+	for _, r := range requests {
+		if c.granted[r.Index] {
+			c.peerRequests = append(c.peerRequests, r)
+			continue
+		}
+
+		if !c.SupportsFast() {
+			continue
+		}
+
+		if _, err := c.WriteMsg(NewRejectMsg(r.Index, r.Begin, r.Length)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *PeerConn) Unchoke() error {
+	c.AmChoking = false
+	_, err := c.WriteMsg(&PeerMsg{Type: PEER_MSG_TYPE_UNCHOKE})
+	return err
+}
+
+// PeerRequests returns the requests of the remote peer that are waiting to be
+// served.
+func (c *PeerConn) PeerRequests() []BlockRequest {
+	return c.peerRequests
+}
+
+// handleRequest queues a request of the remote peer, a choked peer may only
+// request the pieces of its allowed fast set.
+func (c *PeerConn) handleRequest(r BlockRequest) error {
+	allowed := !c.AmChoking || c.granted[r.Index]
+	if allowed && len(c.peerRequests) < DEFAULT_REQQ {
+		c.peerRequests = append(c.peerRequests, r)
+		return nil
+	}
+
+	// the peer learns right away that its request is dropped
+	if c.SupportsFast() {
+		_, err := c.WriteMsg(NewRejectMsg(r.Index, r.Begin, r.Length))
+		return err
+	}
+
+	return nil
+}
+
+func (c *PeerConn) handleCancel(r BlockRequest) error {
+	for i, pr := range c.peerRequests {
+		if pr != r {
+			continue
+		}
+
+		c.peerRequests = append(c.peerRequests[:i], c.peerRequests[i+1:]...)
+
+		// every request must be answered by a piece or a reject
+		if c.SupportsFast() {
+			_, err := c.WriteMsg(NewRejectMsg(r.Index, r.Begin, r.Length))
+			return err
+		}
+
+		break
+	}
+
+	return nil
+}
+
+func (c *PeerConn) addSuggested(index int) {
+	if containsPiece(c.Suggested, index) {
+		return
+	}
+
+	if len(c.Suggested) >= MAX_SUGGESTED {
+		c.Suggested = c.Suggested[1:]
+	}
+
+	c.Suggested = append(c.Suggested, index)
+}
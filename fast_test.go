@@ -0,0 +1,233 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	ip := net.ParseIP("80.4.4.200")
+
+	set := dgotorrent.AllowedFastSet(ip, infoHash, 1313, 7)
+	if want := []int{1059, 431, 808, 1217, 287, 376, 1188}; !reflect.DeepEqual(set, want) {
+		t.Errorf("expected %v, got %v", want, set)
+	}
+
+	set = dgotorrent.AllowedFastSet(ip, infoHash, 1313, 9)
+	if want := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}; !reflect.DeepEqual(set, want) {
+		t.Errorf("expected %v, got %v", want, set)
+	}
+
+	if set = dgotorrent.AllowedFastSet(ip, infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("expected the set to be capped to the number of pieces, got %v", set)
+	}
+}
+
+type fastSeeder struct {
+	data        []byte
+	pieceLength int
+
+	// requests records every request the seeder received
+	requests [][3]int
+	first    byte
+}
+
+// serve acts as a seeder supporting the fast extension: it sends HAVE_ALL,
+// allows piece 2 while choking, suggests piece 1, rejects the first block
+// request once and unchokes after piece 2 was downloaded.
+func (s *fastSeeder) serve(t *testing.T, l net.Listener, done chan struct{}) {
+	defer close(done)
+
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hs, err := answerHandshake(conn, [8]byte{7: 0x04})
+	if err != nil {
+		return
+	}
+
+	if hs[27]&0x04 == 0 {
+		t.Error("fast extension bit is not set in the handshake")
+	}
+
+	// HAVE_NONE replaces the empty bitfield
+	if s.first, _, err = readPeerMsg(conn); err != nil {
+		return
+	}
+
+	writePeerMsg(conn, 0x0e, nil)
+	writePeerMsg(conn, 0x11, indexMsg(2))
+	writePeerMsg(conn, 0x0d, indexMsg(1))
+
+	rejected := false
+	served := make(map[int]int)
+	for {
+		id, payload, err := readPeerMsg(conn)
+		if err != nil {
+			return
+		}
+
+		if id != 6 {
+			continue
+		}
+
+		index, begin, length := parseBlockMsg(payload)
+		s.requests = append(s.requests, [3]int{index, begin, length})
+
+		if index == 2 && !rejected {
+			rejected = true
+			writePeerMsg(conn, 0x10, blockMsg(index, begin, length))
+			continue
+		}
+
+		offset := index*s.pieceLength + begin
+		writePeerMsg(conn, 7, pieceMsg(index, begin, s.data[offset:offset+length]))
+
+		served[index] += length
+		if index == 2 && served[index] == s.pieceLength {
+			writePeerMsg(conn, 1, nil)
+		}
+	}
+}
+
+func TestFastExtensionDownload(t *testing.T) {
+	const pieceLength = 2 * dgotorrent.BLOCKSIZE
+
+	data := randomData(3 * pieceLength)
+	tf := peerTorrent(t, "fast.bin", data, pieceLength)
+
+	seeder := &fastSeeder{data: data, pieceLength: pieceLength}
+	done := make(chan struct{})
+	process, task := peerProcess(t, tf, func(l net.Listener) { seeder.serve(t, l, done) })
+
+	if err := process.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if seeder.first != 0x0f {
+		t.Errorf("expected HAVE_NONE as first message, got %d", seeder.first)
+	}
+
+	got, err := os.ReadFile(filepath.Join(task.Path, task.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+
+	// allowed fast piece while choked, then the suggested one, then in order
+	order := make([]int, 0, 3)
+	for _, r := range seeder.requests {
+		if len(order) == 0 || order[len(order)-1] != r[0] {
+			order = append(order, r[0])
+		}
+	}
+
+	if want := []int{2, 1, 0}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected pieces to be requested in order %v, got %v", want, order)
+	}
+
+	retried := 0
+	for _, r := range seeder.requests {
+		if r == seeder.requests[0] {
+			retried++
+		}
+	}
+
+	if retried != 2 {
+		t.Errorf("expected the rejected block to be requested again, got %d requests", retried)
+	}
+}
+
+func TestSeedAllowedFast(t *testing.T) {
+	const numPieces = 20
+
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(numPieces * dgotorrent.BLOCKSIZE)},
+	})
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t)})
+	task, err := seeder.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seeder, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	conn, err := dialHandshake(t, seeder.Addr().String(), [8]byte{7: 0x04}, tf.Info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePeerMsg(conn, 0x0f, nil)
+
+	// next reads the next message that is not a keep-alive
+	next := func() (byte, []byte) {
+		for {
+			id, payload, err := readPeerMsg(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id != 0xff {
+				return id, payload
+			}
+		}
+	}
+
+	want := dgotorrent.AllowedFastSet(net.ParseIP("127.0.0.1"), tf.Info.Hash, numPieces, dgotorrent.DEFAULT_ALLOWED_FAST)
+	allowed := make([]int, 0)
+	for len(allowed) < len(want) {
+		id, payload := next()
+		if id == 0x11 {
+			allowed = append(allowed, int(binary.BigEndian.Uint32(payload)))
+		}
+	}
+
+	if !reflect.DeepEqual(allowed, want) {
+		t.Fatalf("expected allowed fast set %v, got %v", want, allowed)
+	}
+
+	notAllowed := 0
+	for slices.Contains(allowed, notAllowed) {
+		notAllowed++
+	}
+
+	// the peer is not interested and stays choked, it still gets the allowed
+	// fast pieces and the other requests are rejected
+	writePeerMsg(conn, 6, blockMsg(allowed[0], 0, dgotorrent.BLOCKSIZE))
+	if id, payload := next(); id != 7 || int(binary.BigEndian.Uint32(payload)) != allowed[0] ||
+		!bytes.Equal(payload[8:], content[allowed[0]*dgotorrent.BLOCKSIZE:][:dgotorrent.BLOCKSIZE]) {
+		t.Fatalf("expected piece %d, got message %d", allowed[0], id)
+	}
+
+	writePeerMsg(conn, 6, blockMsg(notAllowed, 0, dgotorrent.BLOCKSIZE))
+	if id, payload := next(); id != 0x10 || !bytes.Equal(payload, blockMsg(notAllowed, 0, dgotorrent.BLOCKSIZE)) {
+		t.Fatalf("expected the request of piece %d to be rejected, got message %d", notAllowed, id)
+	}
+}
@@ -0,0 +1,300 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidMagnet = errors.New("invalid magnet link")
+)
+
+const MAGNET_SCHEME = "magnet"
+const BTIH_PREFIX = "urn:btih:"
+
+// BTMH_PREFIX is followed by the v2 info hash as sha2-256 multihash (BEP 52).
+const BTMH_PREFIX = "urn:btmh:"
+const BTMH_SHA256 = "1220"
+
+type Magnet struct {
+	InfoHash [INFO_HASH_LEN]byte
+	// InfoHashV2 is set by links of v2 and hybrid torrents, the InfoHash of
+	// v2 only torrents is its truncated form.
+	InfoHashV2  MerkleHash
+	DisplayName string
+	Trackers    []string
+	WebSeeds    []string
+	// Peers holds the host:port addresses of the "x.pe" parameter, host
+	// names are resolved when the link is resolved.
+	Peers []string
+	// SelectOnly holds the file ranges of the "so" parameter (BEP 53).
+	SelectOnly []FileRange
+}
+
+// FileRange is an inclusive range of file indices, the ranges of a magnet
+// are kept as they are since the number of files is not known before the
+// metadata arrived.
+type FileRange struct {
+	Begin int
+	End   int
+}
+
+// SelectedFiles returns the indices of the "so" parameter that are below n,
+// the number of files of the torrent.
+func (m *Magnet) SelectedFiles(n int) []int {
+	ret := make([]int, 0)
+	for _, r := range m.SelectOnly {
+		for i := r.Begin; i <= min(r.End, n-1); i++ {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), MAGNET_SCHEME+":")
+}
+
+func parseBTIH(s string) ([INFO_HASH_LEN]byte, error) {
+	var hash [INFO_HASH_LEN]byte
+
+	var raw []byte
+	var err error
+	switch len(s) {
+	case 40:
+		raw, err = hex.DecodeString(s)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = ErrInvalidMagnet
+	}
+
+	if err != nil || len(raw) != INFO_HASH_LEN {
+		return hash, fmt.Errorf("%w: bad btih %q", ErrInvalidMagnet, s)
+	}
+
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+func parseBTMH(s string) (MerkleHash, error) {
+	var hash MerkleHash
+
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), BTMH_SHA256))
+	if err != nil || !strings.HasPrefix(strings.ToLower(s), BTMH_SHA256) || len(raw) != MERKLE_HASH_LEN {
+		return hash, fmt.Errorf("%w: bad btmh %q", ErrInvalidMagnet, s)
+	}
+
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+// hasV1 reports whether the link has a v1 info hash, v2 only torrents are
+// identified by the truncated v2 hash instead.
+func (m *Magnet) hasV1() bool {
+	return m.InfoHashV2.IsZero() || !bytes.Equal(m.InfoHash[:], m.InfoHashV2[:INFO_HASH_LEN])
+}
+
+func parseSelectOnly(s string) ([]FileRange, error) {
+	ret := make([]FileRange, 0)
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		begin, err := strconv.Atoi(first)
+		if err != nil || begin < 0 {
+			return nil, fmt.Errorf("%w: bad so %q", ErrInvalidMagnet, s)
+		}
+
+		end := begin
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < begin {
+				return nil, fmt.Errorf("%w: bad so %q", ErrInvalidMagnet, s)
+			}
+		}
+
+		ret = append(ret, FileRange{Begin: begin, End: end})
+	}
+
+	return ret, nil
+}
+
+func parsePeerAddr(s string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, uint16(p), nil
+}
+
+// resolvePeerAddr looks up the host of a peer address of the link.
+func resolvePeerAddr(ctx context.Context, s string) (Peer, error) {
+	host, port, err := parsePeerAddr(s)
+	if err != nil {
+		return Peer{}, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil || len(ips) == 0 {
+			return Peer{}, fmt.Errorf("failed to resolve peer %s", s)
+		}
+
+		ip = ips[0]
+	}
+
+	return Peer{IP: ip, Port: port}, nil
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(u.Scheme, MAGNET_SCHEME) {
+		return nil, fmt.Errorf("%w: unexpected scheme %q", ErrInvalidMagnet, u.Scheme)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		DisplayName: query.Get("dn"),
+		Trackers:    query["tr"],
+		WebSeeds:    query["ws"],
+		Peers:       make([]string, 0),
+	}
+
+	foundV1, foundV2 := false, false
+	for _, xt := range query["xt"] {
+		switch urn := strings.ToLower(xt); {
+		case !foundV1 && strings.HasPrefix(urn, BTIH_PREFIX):
+			if m.InfoHash, err = parseBTIH(xt[len(BTIH_PREFIX):]); err != nil {
+				return nil, err
+			}
+			foundV1 = true
+		case !foundV2 && strings.HasPrefix(urn, BTMH_PREFIX):
+			if m.InfoHashV2, err = parseBTMH(xt[len(BTMH_PREFIX):]); err != nil {
+				return nil, err
+			}
+			foundV2 = true
+		}
+	}
+
+	if !foundV1 && !foundV2 {
+		return nil, fmt.Errorf("%w: missing xt=%s", ErrInvalidMagnet, BTIH_PREFIX)
+	}
+
+	if !foundV1 {
+		copy(m.InfoHash[:], m.InfoHashV2[:])
+	}
+
+	for _, pe := range query["x.pe"] {
+		if _, _, err := parsePeerAddr(pe); err != nil {
+			continue
+		}
+
+		m.Peers = append(m.Peers, pe)
+	}
+
+	if so := query.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Magnet) String() string {
+	// xt must not be escaped
+	xts := make([]string, 0, 2)
+	if m.hasV1() {
+		xts = append(xts, "xt="+BTIH_PREFIX+hex.EncodeToString(m.InfoHash[:]))
+	}
+
+	if !m.InfoHashV2.IsZero() {
+		xts = append(xts, "xt="+BTMH_PREFIX+BTMH_SHA256+m.InfoHashV2.String())
+	}
+	ret := "magnet:?" + strings.Join(xts, "&")
+
+	params := url.Values{}
+	if m.DisplayName != "" {
+		params.Set("dn", m.DisplayName)
+	}
+
+	for _, tr := range m.Trackers {
+		params.Add("tr", tr)
+	}
+
+	for _, ws := range m.WebSeeds {
+		params.Add("ws", ws)
+	}
+
+	for _, p := range m.Peers {
+		params.Add("x.pe", p)
+	}
+
+	if len(params) > 0 {
+		ret += "&" + params.Encode()
+	}
+
+	return ret
+}
+
+// Magnet builds a magnet link that points at the torrent.
+func (tf *TorrentFile) Magnet() *Magnet {
+	m := &Magnet{
+		InfoHash:    tf.Info.Hash,
+		DisplayName: tf.Info.Name,
+		Trackers:    tf.Trackers(),
+		WebSeeds:    append([]string(nil), tf.URLList...),
+	}
+
+	if tf.Info.HasV2() {
+		m.InfoHashV2 = tf.Info.HashV2
+	}
+
+	return m
+}
+
+// torrentFile returns a torrent file without info dictionary that can be used
+// to ask the trackers of the magnet link for peers.
+func (m *Magnet) torrentFile() *TorrentFile {
+	tf := &TorrentFile{
+		AnnounceList: make([]string, 0),
+		Info: TorrentInfo{
+			Name: m.DisplayName,
+			Hash: m.InfoHash,
+		},
+	}
+
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+		tf.AnnounceList = append(tf.AnnounceList, m.Trackers[1:]...)
+	}
+
+	return tf
+}
@@ -0,0 +1,296 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+func TestParseMagnet(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a" +
+		"&dn=debian.iso" +
+		"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A6969" +
+		"&ws=http%3A%2F%2Fmirror.example.com%2Fdebian.iso" +
+		"&x.pe=10.0.0.1%3A6881" +
+		"&x.pe=peer.invalid%3A6881" +
+		"&x.pe=no-port" +
+		"&so=0,2,4-6"
+
+	m, err := dgotorrent.ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(m.InfoHash[:]) != "c12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+		t.Errorf("unexpected info hash: %x", m.InfoHash)
+	}
+
+	if m.DisplayName != "debian.iso" {
+		t.Errorf("unexpected display name: %s", m.DisplayName)
+	}
+
+	if len(m.Trackers) != 2 || m.Trackers[1] != "udp://tracker.example.com:6969" {
+		t.Errorf("unexpected trackers: %v", m.Trackers)
+	}
+
+	if len(m.WebSeeds) != 1 || m.WebSeeds[0] != "http://mirror.example.com/debian.iso" {
+		t.Errorf("unexpected web seeds: %v", m.WebSeeds)
+	}
+
+	// host names are kept as they are, they are only looked up on resolve
+	if want := []string{"10.0.0.1:6881", "peer.invalid:6881"}; !reflect.DeepEqual(m.Peers, want) {
+		t.Errorf("unexpected peers: %v", m.Peers)
+	}
+
+	if want := []dgotorrent.FileRange{{0, 0}, {2, 2}, {4, 6}}; !reflect.DeepEqual(m.SelectOnly, want) {
+		t.Errorf("unexpected select only: %v", m.SelectOnly)
+	}
+
+	if selected := m.SelectedFiles(7); !reflect.DeepEqual(selected, []int{0, 2, 4, 5, 6}) {
+		t.Errorf("unexpected selected files: %v", selected)
+	}
+}
+
+func TestParseMagnetHugeSelectOnly(t *testing.T) {
+	m, err := dgotorrent.ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=1-4000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the range is clamped to the files of the torrent
+	if selected := m.SelectedFiles(3); !reflect.DeepEqual(selected, []int{1, 2}) {
+		t.Errorf("unexpected selected files: %v", selected)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	m, err := dgotorrent.ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(m.InfoHash[:]) != "c12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+		t.Errorf("unexpected info hash: %x", m.InfoHash)
+	}
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	invalid := []string{
+		"http://example.com",
+		"magnet:?dn=missing-xt",
+		"magnet:?xt=urn:btih:abc",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1",
+	}
+
+	for _, uri := range invalid {
+		if _, err := dgotorrent.ParseMagnet(uri); err == nil {
+			t.Errorf("expected error for %s", uri)
+		}
+	}
+}
+
+func TestTorrentFileMagnet(t *testing.T) {
+	tf := &dgotorrent.TorrentFile{
+		Announce:     "http://tracker.example.com/announce",
+		AnnounceList: []string{"http://tracker.example.com/announce", "udp://tracker.example.com:6969"},
+		URLList:      []string{"http://mirror.example.com/a%20b.iso"},
+		Info:         dgotorrent.TorrentInfo{Name: "a b.iso"},
+	}
+	copy(tf.Info.Hash[:], "magnet-round-trip!!!")
+
+	link := tf.Magnet().String()
+	if !strings.HasPrefix(link, "magnet:?xt=urn:btih:"+hex.EncodeToString(tf.Info.Hash[:])) {
+		t.Errorf("unexpected link: %s", link)
+	}
+
+	m, err := dgotorrent.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != tf.Info.Hash || m.DisplayName != "a b.iso" || len(m.Trackers) != 2 {
+		t.Errorf("magnet link did not round trip: %+v", m)
+	}
+
+	if !reflect.DeepEqual(m.WebSeeds, tf.URLList) {
+		t.Errorf("unexpected web seeds: %v", m.WebSeeds)
+	}
+}
+
+func TestTorrentFileMagnetV2(t *testing.T) {
+	dir := createContent(t)
+
+	// v2 only torrents have no v1 info hash to link to
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: dir, Version: dgotorrent.CREATE_V2})
+	link := tf.Magnet().String()
+	if want := "magnet:?xt=urn:btmh:1220" + tf.Info.HashV2.String() + "&"; !strings.HasPrefix(link, want) || strings.Contains(link, "btih") {
+		t.Errorf("unexpected link: %s", link)
+	}
+
+	m, err := dgotorrent.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.InfoHash != tf.Info.Hash || m.InfoHashV2 != tf.Info.HashV2 {
+		t.Errorf("magnet link did not round trip: %+v", m)
+	}
+
+	tf = createTorrent(t, dgotorrent.CreateOptions{Path: dir, Version: dgotorrent.CREATE_HYBRID})
+	link = tf.Magnet().String()
+	if want := "magnet:?xt=urn:btih:" + hex.EncodeToString(tf.Info.Hash[:]) + "&xt=urn:btmh:1220" + tf.Info.HashV2.String(); !strings.HasPrefix(link, want) {
+		t.Errorf("unexpected link: %s", link)
+	}
+
+	if m, err = dgotorrent.ParseMagnet(link); err != nil || m.InfoHash != tf.Info.Hash || m.InfoHashV2 != tf.Info.HashV2 {
+		t.Errorf("magnet link did not round trip: %+v, %v", m, err)
+	}
+}
+
+// testInfo returns a bencoded single file info dictionary that is larger than
+// one metadata piece.
+func testInfo(t *testing.T) []byte {
+	info, err := bencode.Marshal(map[string]any{
+		"name":         "metadata.bin",
+		"length":       int64(1000 * 32768),
+		"piece length": int64(32768),
+		"pieces":       strings.Repeat("0123456789abcdefghij", 1000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(info)
+}
+
+// serveMetadata runs a fake peer that answers ut_metadata requests.
+func serveMetadata(t *testing.T, info []byte) dgotorrent.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err = answerHandshake(conn, [8]byte{5: 0x10}); err != nil {
+			return
+		}
+
+		exths, _ := bencode.Marshal(map[string]any{
+			"m":             map[string]any{"ut_metadata": int64(3)},
+			"metadata_size": int64(len(info)),
+		})
+		writePeerMsg(conn, 20, append([]byte{0}, exths...))
+
+		remoteID := byte(0)
+		for {
+			id, payload, err := readPeerMsg(conn)
+			if err != nil {
+				return
+			}
+
+			if id != 20 || len(payload) == 0 {
+				continue
+			}
+
+			if payload[0] == 0 {
+				res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+				m := res.(map[string]any)["m"].(map[string]any)
+				remoteID = byte(m["ut_metadata"].(int64))
+				continue
+			}
+
+			if payload[0] != 3 {
+				continue
+			}
+
+			res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+			piece := int(res.(map[string]any)["piece"].(int64))
+
+			begin := piece * dgotorrent.METADATA_PIECE_LEN
+			end := begin + dgotorrent.METADATA_PIECE_LEN
+			if end > len(info) {
+				end = len(info)
+			}
+
+			header, _ := bencode.Marshal(map[string]any{
+				"msg_type":   int64(1),
+				"piece":      int64(piece),
+				"total_size": int64(len(info)),
+			})
+
+			msg := append([]byte{remoteID}, header...)
+			msg = append(msg, info[begin:end]...)
+			writePeerMsg(conn, 20, msg)
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return dgotorrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info := testInfo(t)
+	peer := serveMetadata(t, info)
+
+	metadata, err := dgotorrent.FetchMetadata(context.Background(), peer, sha1.Sum(info), "-TEST00-000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(metadata, info) {
+		t.Errorf("metadata mismatch")
+	}
+}
+
+func TestFetchMetadataHashMismatch(t *testing.T) {
+	info := testInfo(t)
+	peer := serveMetadata(t, info)
+
+	// the fake peer accepts any info hash, the data it sends does not match this one
+	var wrong [dgotorrent.INFO_HASH_LEN]byte
+	_, err := dgotorrent.FetchMetadata(context.Background(), peer, wrong, "-TEST00-000000000001")
+	if !errors.Is(err, dgotorrent.ErrMetadataHashMismatch) {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+}
+
+func TestMagnetResolve(t *testing.T) {
+	info := testInfo(t)
+	peer := serveMetadata(t, info)
+
+	m := &dgotorrent.Magnet{
+		InfoHash: sha1.Sum(info),
+		Trackers: []string{"http://127.0.0.1:1/announce"},
+		Peers:    []string{peer.String()},
+	}
+
+	tf, err := m.Resolve(context.Background(), "-TEST00-000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.Info.Hash != m.InfoHash || tf.Info.Name != "metadata.bin" || tf.Info.Length != 1000*32768 {
+		t.Errorf("unexpected torrent file: %+v", tf.Info.Name)
+	}
+
+	if len(tf.Info.PieceHashes) != 1000 || tf.Announce != m.Trackers[0] {
+		t.Errorf("unexpected torrent file: %d pieces, announce %s", len(tf.Info.PieceHashes), tf.Announce)
+	}
+}
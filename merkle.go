@@ -0,0 +1,122 @@
+package dgotorrent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// v2 torrents hash files in blocks of 16 KiB, the leaves of the merkle tree
+// of every file (BEP 52)
+const MERKLE_BLOCK_SIZE = 16384
+
+const MERKLE_HASH_LEN = sha256.Size
+
+// MerkleHash is a SHA-256 node of a merkle tree, it is printed in hex.
+type MerkleHash [MERKLE_HASH_LEN]byte
+
+func (h MerkleHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h MerkleHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h MerkleHash) IsZero() bool {
+	return h == MerkleHash{}
+}
+
+func hashPair(a, b MerkleHash) MerkleHash {
+	return sha256.Sum256(append(a[:], b[:]...))
+}
+
+// padHash returns the root of a subtree of the given height whose leaves are
+// all zero.
+func padHash(height int) MerkleHash {
+	var h MerkleHash
+	for i := 0; i < height; i++ {
+		h = hashPair(h, h)
+	}
+
+	return h
+}
+
+// merkleRoot computes the root of the tree over nodes of the given height,
+// the layer is padded to width nodes with the hash of zero subtrees.
+func merkleRoot(layer []MerkleHash, height, width int) MerkleHash {
+	if width == 0 {
+		return MerkleHash{}
+	}
+
+	nodes := append(make([]MerkleHash, 0, width), layer...)
+	pad := padHash(height)
+	for len(nodes) < width {
+		nodes = append(nodes, pad)
+	}
+
+	for len(nodes) > 1 {
+		for i := 0; i < len(nodes)/2; i++ {
+			nodes[i] = hashPair(nodes[2*i], nodes[2*i+1])
+		}
+
+		nodes = nodes[:len(nodes)/2]
+	}
+
+	return nodes[0]
+}
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+
+	return p
+}
+
+func log2(n int64) int {
+	h := 0
+	for n > 1 {
+		n >>= 1
+		h++
+	}
+
+	return h
+}
+
+// fileMerkle hashes the content of a file and returns its pieces root and
+// the piece layer, i.e. the nodes covering pieceLength bytes each.
+func fileMerkle(r io.Reader, length, pieceLength int64) (MerkleHash, []MerkleHash, error) {
+	if length == 0 {
+		return MerkleHash{}, nil, nil
+	}
+
+	leaves := make([]MerkleHash, 0, (length+MERKLE_BLOCK_SIZE-1)/MERKLE_BLOCK_SIZE)
+	buf := make([]byte, MERKLE_BLOCK_SIZE)
+	for remaining := length; remaining > 0; {
+		n := min(remaining, MERKLE_BLOCK_SIZE)
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return MerkleHash{}, nil, err
+		}
+
+		leaves = append(leaves, sha256.Sum256(buf[:n]))
+		remaining -= n
+	}
+
+	root := merkleRoot(leaves, 0, nextPowerOfTwo(len(leaves)))
+
+	leavesPerPiece := int(pieceLength / MERKLE_BLOCK_SIZE)
+	layer := make([]MerkleHash, 0, (len(leaves)+leavesPerPiece-1)/leavesPerPiece)
+	for i := 0; i < len(leaves); i += leavesPerPiece {
+		end := min(i+leavesPerPiece, len(leaves))
+		layer = append(layer, merkleRoot(leaves[i:end], 0, leavesPerPiece))
+	}
+
+	return root, layer, nil
+}
+
+// layerRoot computes the pieces root of a file from its piece layer.
+func layerRoot(layer []MerkleHash, pieceLength int64) MerkleHash {
+	return merkleRoot(layer, log2(pieceLength/MERKLE_BLOCK_SIZE), nextPowerOfTwo(len(layer)))
+}
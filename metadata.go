@@ -0,0 +1,393 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var (
+	ErrMetadataRejected     = errors.New("metadata request rejected")
+	ErrInvalidMetadata      = errors.New("invalid metadata")
+	ErrMetadataHashMismatch = errors.New("metadata does not match info hash")
+	ErrNoMetadataPeers      = errors.New("no peer could provide the metadata")
+)
+
+// ut_metadata (BEP 9)
+const METADATA_PIECE_LEN = 16384
+const MAX_METADATA_SIZE = 16 * 1024 * 1024
+
+const (
+	METADATA_MSG_REQUEST = iota
+	METADATA_MSG_DATA
+	METADATA_MSG_REJECT
+)
+
+const maxMetadataWorkers = 8
+
+func newMetadataMsg(msgType int, piece int, totalSize int) ([]byte, error) {
+	v := map[string]any{
+		"msg_type": int64(msgType),
+		"piece":    int64(piece),
+	}
+
+	if msgType == METADATA_MSG_DATA {
+		v["total_size"] = int64(totalSize)
+	}
+
+	res, err := bencode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(res), nil
+}
+
+func parseMetadataMsg(payload []byte) (msgType int, piece int, data []byte, err error) {
+	res, n, err := bencode.UnmarshalPrefix(payload)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return 0, 0, nil, ErrInvalidMetadata
+	}
+
+	t, ok1 := v["msg_type"].(int64)
+	p, ok2 := v["piece"].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, nil, ErrInvalidMetadata
+	}
+
+	return int(t), int(p), payload[n:], nil
+}
+
+// MetadataExtension implements ut_metadata (BEP 9), it serves the info
+// dictionary to peers once it is known.
+type MetadataExtension struct {
+	mu       sync.RWMutex
+	metadata []byte
+}
+
+func NewMetadataExtension(metadata []byte) *MetadataExtension {
+	return &MetadataExtension{
+		metadata: metadata,
+	}
+}
+
+func (e *MetadataExtension) SetMetadata(metadata []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.metadata = metadata
+}
+
+func (e *MetadataExtension) Name() string {
+	return EXT_UT_METADATA
+}
+
+func (e *MetadataExtension) WriteHandshake(c *PeerConn, hs map[string]any) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if len(e.metadata) > 0 {
+		hs["metadata_size"] = int64(len(e.metadata))
+	}
+}
+
+func (e *MetadataExtension) HandleMsg(c *PeerConn, payload []byte) error {
+	msgType, piece, _, err := parseMetadataMsg(payload)
+	if err != nil {
+		return err
+	}
+
+	if msgType != METADATA_MSG_REQUEST {
+		return nil
+	}
+
+	e.mu.RLock()
+	metadata := e.metadata
+	e.mu.RUnlock()
+
+	begin := piece * METADATA_PIECE_LEN
+	if len(metadata) == 0 || piece < 0 || begin >= len(metadata) {
+		reject, err := newMetadataMsg(METADATA_MSG_REJECT, piece, 0)
+		if err != nil {
+			return err
+		}
+
+		return c.SendExtended(EXT_UT_METADATA, reject)
+	}
+
+	end := begin + METADATA_PIECE_LEN
+	if end > len(metadata) {
+		end = len(metadata)
+	}
+
+	data, err := newMetadataMsg(METADATA_MSG_DATA, piece, len(metadata))
+	if err != nil {
+		return err
+	}
+
+	return c.SendExtended(EXT_UT_METADATA, append(data, metadata[begin:end]...))
+}
+
+// FetchMetadata downloads the info dictionary of a torrent from a peer with
+// the ut_metadata extension and verifies it against the info hash.
+func FetchMetadata(ctx context.Context, peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string) ([]byte, error) {
+	c, err := dialPeer(ctx, peer, infoHash, peerID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	localID, _ := c.cfg.Extensions.ID(EXT_UT_METADATA)
+
+	if !c.SupportsExtensions() {
+		return nil, ErrExtensionNotSupported
+	}
+
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.SetDeadline(time.Time{})
+
+	for c.ExtHandshake == nil {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg != nil && msg.Type == PEER_MSG_TYPE_EXTENDED {
+			if err = c.handleExtendedMsg(msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	remoteID, ok := c.RemoteExtID(EXT_UT_METADATA)
+	if !ok {
+		return nil, ErrExtensionNotSupported
+	}
+
+	size := int(c.ExtHandshake.MetadataSize)
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return nil, fmt.Errorf("%w: size %d", ErrInvalidMetadata, size)
+	}
+
+	count := (size + METADATA_PIECE_LEN - 1) / METADATA_PIECE_LEN
+	for i := 0; i < count; i++ {
+		req, err := newMetadataMsg(METADATA_MSG_REQUEST, i, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = c.WriteExtended(remoteID, req); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := make([]byte, size)
+	received := make([]bool, count)
+	for remaining := count; remaining > 0; {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil || msg.Type != PEER_MSG_TYPE_EXTENDED || len(msg.Payload) < 1 {
+			continue
+		}
+
+		if int64(msg.Payload[0]) != localID {
+			if err = c.handleExtendedMsg(msg); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		msgType, piece, data, err := parseMetadataMsg(msg.Payload[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		switch msgType {
+		case METADATA_MSG_REQUEST:
+			reject, err := newMetadataMsg(METADATA_MSG_REJECT, piece, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			c.WriteExtended(remoteID, reject)
+		case METADATA_MSG_REJECT:
+			return nil, ErrMetadataRejected
+		case METADATA_MSG_DATA:
+			if piece < 0 || piece >= count || received[piece] {
+				continue
+			}
+
+			offset := piece * METADATA_PIECE_LEN
+			expected := size - offset
+			if expected > METADATA_PIECE_LEN {
+				expected = METADATA_PIECE_LEN
+			}
+
+			if len(data) != expected {
+				return nil, fmt.Errorf("%w: piece %d has %d bytes, expected %d", ErrInvalidMetadata, piece, len(data), expected)
+			}
+
+			copy(metadata[offset:], data)
+			received[piece] = true
+			remaining--
+		}
+	}
+
+	// v2 torrents are identified by their truncated SHA-256 hash
+	hash, hashV2 := sha1.Sum(metadata), sha256.Sum256(metadata)
+	if !bytes.Equal(hash[:], infoHash[:]) && !bytes.Equal(hashV2[:INFO_HASH_LEN], infoHash[:]) {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	return metadata, nil
+}
+
+// NewTorrentFileFromMetadata builds a torrent file from a raw info dictionary,
+// the trackers it should announce to and its web seeds.
+func NewTorrentFileFromMetadata(metadata []byte, trackers, webSeeds []string) (*TorrentFile, error) {
+	res, err := bencode.Unmarshal(bytes.NewReader(metadata))
+	if err != nil {
+		return nil, err
+	}
+
+	infoMap, ok := res.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidMetadata
+	}
+
+	tf := &TorrentFile{
+		AnnounceList: make([]string, 0),
+		URLList:      append([]string(nil), webSeeds...),
+	}
+
+	if len(trackers) > 0 {
+		tf.Announce = trackers[0]
+		tf.AnnounceList = append(tf.AnnounceList, trackers[1:]...)
+	}
+
+	if err = parseInfo(tf, infoMap); err != nil {
+		return nil, err
+	}
+
+	tf.Info.setHashes(metadata)
+
+	// the metainfo of a resolved magnet link holds the info dictionary, its
+	// trackers and web seeds
+	meta := map[string]any{"info": infoMap}
+	if len(trackers) > 0 {
+		meta["announce"] = trackers[0]
+		meta["announce-list"] = toTiers(trackers)
+	}
+
+	if len(webSeeds) > 0 {
+		meta["url-list"] = toList(webSeeds)
+	}
+
+	raw, err := bencode.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	tf.Raw = []byte(raw)
+
+	return tf, nil
+}
+
+// Resolve finds peers of the magnet link and fetches the info dictionary from
+// them, the result is a complete torrent file.
+func (m *Magnet) Resolve(ctx context.Context, peerID string, sources ...PeerSource) (*TorrentFile, error) {
+	peers, err := m.torrentFile().FindPeers(ctx, sources...)
+	if err != nil {
+		dlog.Warnf("failed to find peers of magnet link with error: %v", err)
+	}
+
+	linked := make([]Peer, 0, len(m.Peers))
+	for _, addr := range m.Peers {
+		peer, err := resolvePeerAddr(ctx, addr)
+		if err != nil {
+			dlog.Infof("ignoring peer of magnet link: %v", err)
+			continue
+		}
+
+		linked = append(linked, peer)
+	}
+
+	peers = mergePeers(linked, peers, make(map[string]bool))
+	if len(peers) == 0 {
+		return nil, ErrNoMetadataPeers
+	}
+
+	jobs := make(chan Peer, len(peers))
+	for _, p := range peers {
+		jobs <- p
+	}
+	close(jobs)
+
+	// the first success cancels the fetches still in flight
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var wg sync.WaitGroup
+	var metadata []byte
+
+	workers := maxMetadataWorkers
+	if len(peers) < workers {
+		workers = len(peers)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for p := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+
+				res, err := FetchMetadata(ctx, p, m.InfoHash, peerID)
+				if err != nil {
+					dlog.Infof("failed to fetch metadata from %s with error: %v", p, err)
+					continue
+				}
+
+				once.Do(func() {
+					metadata = res
+					cancel()
+				})
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+	if metadata == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrNoMetadataPeers
+	}
+
+	return NewTorrentFileFromMetadata(metadata, m.Trackers, m.WebSeeds)
+}
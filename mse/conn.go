@@ -0,0 +1,72 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"net"
+)
+
+// Conn is a connection after the handshake, it encrypts and decrypts the
+// stream when rc4 was negotiated and passes it through otherwise.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	method CryptoMethod
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+
+	// initial payload sent along with the handshake, already decrypted
+	pending []byte
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, method CryptoMethod, enc, dec *rc4.Cipher, ia []byte) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		r:       r,
+		method:  method,
+		pending: ia,
+	}
+
+	if method == CRYPTO_RC4 {
+		c.enc, c.dec = enc, dec
+	}
+
+	return c
+}
+
+// Method returns the negotiated crypto method, it is 0 for connections that
+// did not use the encrypted handshake at all.
+func (c *Conn) Method() CryptoMethod {
+	return c.method
+}
+
+// Encrypted reports whether the stream is rc4 encrypted.
+func (c *Conn) Encrypted() bool {
+	return c.method == CRYPTO_RC4
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+
+	return c.Conn.Write(buf)
+}
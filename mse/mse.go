@@ -0,0 +1,337 @@
+// Package mse implements the message stream encryption (MSE/PE) handshake
+// used by bittorrent clients to obfuscate their connections: a Diffie-Hellman
+// key exchange followed by RC4 encryption of the stream.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+var (
+	ErrSyncFailed      = errors.New("mse synchronization failed")
+	ErrUnknownSKey     = errors.New("mse unknown stream key")
+	ErrInvalidVC       = errors.New("mse invalid verification constant")
+	ErrNoCryptoMethod  = errors.New("mse no common crypto method")
+	ErrPadTooLong      = errors.New("mse padding too long")
+	ErrInvalidProvided = errors.New("mse invalid crypto provide")
+)
+
+type CryptoMethod uint32
+
+const (
+	CRYPTO_PLAINTEXT CryptoMethod = 0x01
+	CRYPTO_RC4       CryptoMethod = 0x02
+)
+
+const (
+	KEY_LEN     = 96
+	MAX_PAD_LEN = 512
+	VC_LEN      = 8
+	MAX_IA_LEN  = 0xffff
+
+	// the handshake has to complete within this timeout
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// the first bytes of the rc4 keystream are dropped
+	rc4Discard = 1024
+)
+
+// plaintextHeader starts every unencrypted bittorrent handshake.
+var plaintextHeader = append([]byte{19}, "BitTorrent protocol"...)
+
+var (
+	dhPrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	res := make([]byte, len(a))
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+
+	return res
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(dhGenerator, private, dhPrime)
+
+	return &keyPair{private: private, public: public.FillBytes(make([]byte, KEY_LEN))}, nil
+}
+
+func (k *keyPair) secret(remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(y, k.private, dhPrime).FillBytes(make([]byte, KEY_LEN))
+}
+
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(MAX_PAD_LEN+1))
+	_, err := rand.Read(pad)
+
+	return pad, err
+}
+
+// synchronize discards bytes until pattern was read, at most limit bytes are
+// searched.
+func synchronize(r io.ByteReader, pattern []byte, limit int) error {
+	window := make([]byte, 0, len(pattern))
+	for i := 0; i < limit; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if len(window) == len(pattern) {
+			copy(window, window[1:])
+			window = window[:len(pattern)-1]
+		}
+
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+
+	return ErrSyncFailed
+}
+
+// readEncrypted reads n bytes and decrypts them.
+func readEncrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	c.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// readField reads a length prefixed field, e.g. a padding or the initial
+// payload.
+func readField(r io.Reader, c *rc4.Cipher, limit int) ([]byte, error) {
+	lenBuf, err := readEncrypted(r, c, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(lenBuf))
+	if n > limit {
+		return nil, ErrPadTooLong
+	}
+
+	return readEncrypted(r, c, n)
+}
+
+// Initiate performs the handshake on an outgoing connection, skey is the info
+// hash of the torrent. The returned connection encrypts the stream when rc4
+// was selected by the remote peer.
+func Initiate(conn net.Conn, skey []byte, provide CryptoMethod) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(append(keys.public, padA...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	remote := make([]byte, KEY_LEN)
+	if _, err = io.ReadFull(r, remote); err != nil {
+		return nil, err
+	}
+
+	s := keys.secret(remote)
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	// VC, crypto_provide, len(PadC), len(IA)
+	payload := make([]byte, VC_LEN+8)
+	binary.BigEndian.PutUint32(payload[VC_LEN:], uint32(provide))
+	enc.XORKeyStream(payload, payload)
+
+	msg := append(hash([]byte("req1"), s), xor(hash([]byte("req2"), skey), hash([]byte("req3"), s))...)
+	if _, err = conn.Write(append(msg, payload...)); err != nil {
+		return nil, err
+	}
+
+	// the encrypted VC marks the end of PadB
+	vc := make([]byte, VC_LEN)
+	dec.XORKeyStream(vc, vc)
+	if err = synchronize(r, vc, MAX_PAD_LEN+VC_LEN); err != nil {
+		return nil, err
+	}
+
+	buf, err := readEncrypted(r, dec, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := CryptoMethod(binary.BigEndian.Uint32(buf))
+	if selected&provide == 0 || (selected != CRYPTO_PLAINTEXT && selected != CRYPTO_RC4) {
+		return nil, ErrNoCryptoMethod
+	}
+
+	if _, err = readField(r, dec, MAX_PAD_LEN); err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, r, selected, enc, dec, nil), nil
+}
+
+// Receive performs the handshake on an incoming connection, skeys are the
+// info hashes we serve and choose selects one of the methods the initiator
+// provides, it returns 0 to refuse all of them.
+//
+// A plain bittorrent handshake is detected and the connection is returned
+// unchanged with method 0, it is up to the caller to accept it.
+func Receive(conn net.Conn, skeys [][]byte, choose func(provided CryptoMethod) CryptoMethod) (*Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	header, err := r.Peek(len(plaintextHeader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(header, plaintextHeader) {
+		return newConn(conn, r, 0, nil, nil, nil), nil, nil
+	}
+
+	remote := make([]byte, KEY_LEN)
+	if _, err = io.ReadFull(r, remote); err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = conn.Write(append(keys.public, padB...)); err != nil {
+		return nil, nil, err
+	}
+
+	// HASH('req1', S) marks the end of PadA
+	s := keys.secret(remote)
+	if err = synchronize(r, hash([]byte("req1"), s), MAX_PAD_LEN+sha1.Size); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+
+	req2 := xor(buf, hash([]byte("req3"), s))
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(hash([]byte("req2"), k), req2) {
+			skey = k
+			break
+		}
+	}
+
+	if skey == nil {
+		return nil, nil, ErrUnknownSKey
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	buf, err = readEncrypted(r, dec, VC_LEN+4)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(buf[:VC_LEN], make([]byte, VC_LEN)) {
+		return nil, nil, ErrInvalidVC
+	}
+
+	provided := CryptoMethod(binary.BigEndian.Uint32(buf[VC_LEN:]))
+	if provided == 0 {
+		return nil, nil, ErrInvalidProvided
+	}
+
+	if _, err = readField(r, dec, MAX_PAD_LEN); err != nil {
+		return nil, nil, err
+	}
+
+	ia, err := readField(r, dec, MAX_IA_LEN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := choose(provided)
+	if selected&provided == 0 || (selected != CRYPTO_PLAINTEXT && selected != CRYPTO_RC4) {
+		return nil, nil, ErrNoCryptoMethod
+	}
+
+	// VC, crypto_select, len(PadD)
+	reply := make([]byte, VC_LEN+6)
+	binary.BigEndian.PutUint32(reply[VC_LEN:], uint32(selected))
+	enc.XORKeyStream(reply, reply)
+	if _, err = conn.Write(reply); err != nil {
+		return nil, nil, err
+	}
+
+	return newConn(conn, r, selected, enc, dec, ia), skey, nil
+}
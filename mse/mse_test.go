@@ -0,0 +1,186 @@
+package mse_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Dizzrt/dgo-torrent/mse"
+)
+
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+type receiveResult struct {
+	conn *mse.Conn
+	skey []byte
+	err  error
+}
+
+func receive(server net.Conn, skeys [][]byte, choose func(mse.CryptoMethod) mse.CryptoMethod) chan receiveResult {
+	res := make(chan receiveResult, 1)
+	go func() {
+		conn, skey, err := mse.Receive(server, skeys, choose)
+		res <- receiveResult{conn, skey, err}
+	}()
+
+	return res
+}
+
+func preferRC4(provided mse.CryptoMethod) mse.CryptoMethod {
+	if provided&mse.CRYPTO_RC4 != 0 {
+		return mse.CRYPTO_RC4
+	}
+
+	return mse.CRYPTO_PLAINTEXT
+}
+
+func exchange(t *testing.T, a, b net.Conn) {
+	msg := bytes.Repeat([]byte("encrypted bittorrent "), 100)
+	go a.Write(msg)
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, msg) {
+		t.Error("stream was not decrypted correctly")
+	}
+}
+
+func TestHandshakeRC4(t *testing.T) {
+	client, server := pipe(t)
+	skey := []byte("01234567890123456789")
+
+	res := receive(server, [][]byte{[]byte("other info hash....."), skey}, preferRC4)
+	conn, err := mse.Initiate(client, skey, mse.CRYPTO_RC4|mse.CRYPTO_PLAINTEXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-res
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if !bytes.Equal(r.skey, skey) {
+		t.Errorf("expected skey %q, got %q", skey, r.skey)
+	}
+
+	if !conn.Encrypted() || !r.conn.Encrypted() {
+		t.Errorf("expected rc4, got %d and %d", conn.Method(), r.conn.Method())
+	}
+
+	exchange(t, conn, r.conn)
+	exchange(t, r.conn, conn)
+}
+
+func TestHandshakePlaintextSelected(t *testing.T) {
+	client, server := pipe(t)
+	skey := []byte("01234567890123456789")
+
+	res := receive(server, [][]byte{skey}, func(mse.CryptoMethod) mse.CryptoMethod { return mse.CRYPTO_PLAINTEXT })
+	conn, err := mse.Initiate(client, skey, mse.CRYPTO_RC4|mse.CRYPTO_PLAINTEXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-res
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if conn.Method() != mse.CRYPTO_PLAINTEXT || r.conn.Method() != mse.CRYPTO_PLAINTEXT {
+		t.Errorf("expected plaintext, got %d and %d", conn.Method(), r.conn.Method())
+	}
+
+	// after the handshake the stream is not obfuscated
+	go conn.Write([]byte("plain"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(server, buf); err != nil || string(buf) != "plain" {
+		t.Errorf("expected the plain stream, got %q %v", buf, err)
+	}
+}
+
+func TestPlaintextHandshakeDetected(t *testing.T) {
+	client, server := pipe(t)
+
+	res := receive(server, nil, preferRC4)
+	hs := append([]byte{19}, "BitTorrent protocol"...)
+	client.Write(hs)
+
+	r := <-res
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if r.conn.Method() != 0 || r.skey != nil {
+		t.Errorf("expected a plain connection, got method %d", r.conn.Method())
+	}
+
+	got := make([]byte, len(hs))
+	if _, err := io.ReadFull(r.conn, got); err != nil || !bytes.Equal(got, hs) {
+		t.Errorf("expected the peeked handshake to be readable, got %q %v", got, err)
+	}
+}
+
+func TestHandshakeUnknownSKey(t *testing.T) {
+	client, server := pipe(t)
+
+	res := receive(server, [][]byte{[]byte("other info hash.....")}, preferRC4)
+	go func() {
+		mse.Initiate(client, []byte("01234567890123456789"), mse.CRYPTO_RC4)
+		client.Close()
+	}()
+
+	if r := <-res; r.err != mse.ErrUnknownSKey {
+		t.Errorf("expected %v, got %v", mse.ErrUnknownSKey, r.err)
+	}
+}
+
+func TestHandshakeNoCommonMethod(t *testing.T) {
+	client, server := pipe(t)
+	skey := []byte("01234567890123456789")
+
+	res := receive(server, [][]byte{skey}, func(provided mse.CryptoMethod) mse.CryptoMethod {
+		return provided & mse.CRYPTO_PLAINTEXT
+	})
+	go func() {
+		mse.Initiate(client, skey, mse.CRYPTO_RC4)
+		client.Close()
+	}()
+
+	if r := <-res; r.err != mse.ErrNoCryptoMethod {
+		t.Errorf("expected %v, got %v", mse.ErrNoCryptoMethod, r.err)
+	}
+}
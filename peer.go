@@ -2,12 +2,18 @@ package dgotorrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+	"github.com/Dizzrt/dgo-torrent/utp"
 )
 
 // ip_len:4 port_len:2
@@ -15,8 +21,15 @@ const IP_LEN = 4
 const PORT_LEN = 2
 const PEER_LEN = IP_LEN + PORT_LEN
 
+// compact ipv6 peers (BEP 7)
+const IPV6_LEN = 16
+const PEER6_LEN = IPV6_LEN + PORT_LEN
+
 const PEER_ID_LEN = 20
 
+// peers that do not speak utp are tried over tcp after this timeout
+const UTP_DIAL_TIMEOUT = 3 * time.Second
+
 type PeerMsgTyep uint8
 
 const (
@@ -41,6 +54,14 @@ const (
 	PEER_MSG_INVALID
 )
 
+// extension protocol message (BEP 10)
+const PEER_MSG_TYPE_EXTENDED PeerMsgTyep = 20
+
+func isValidMsgType(t PeerMsgTyep) bool {
+	return t < PEER_MSG_INVALID || t == PEER_MSG_TYPE_EXTENDED ||
+		(t >= PEER_MSG_TYPE_SUGGEST && t <= PEER_MSG_TYPE_ALLOWED_FAST)
+}
+
 type Peer struct {
 	IP   net.IP
 	Port uint16
@@ -51,44 +72,178 @@ type PeerMsg struct {
 	Payload []byte
 }
 
+type ConnConfig struct {
+	Extensions *ExtensionRegistry
+	// ListenPort is advertised to peers in the extended handshake.
+	ListenPort int
+	// NumPieces is the number of pieces of the torrent, it is unknown while
+	// the metadata is being fetched.
+	NumPieces int
+	// Have are the pieces we announce to the peer after the handshake.
+	Have Bitfield
+	// UTP is the socket peers are dialed on first, connections fall back to
+	// tcp when it is nil or the peer does not answer.
+	UTP *utp.Socket
+	// Encryption is the message stream encryption policy of the connection.
+	Encryption EncryptionMode
+	// ForInfoHash replaces the config of an inbound connection once the
+	// torrent it asks for is known, the connection is refused when it
+	// returns nil.
+	ForInfoHash func(infoHash [INFO_HASH_LEN]byte) *ConnConfig
+	// Counter is the parent of the counter of the connection.
+	Counter *TransferCounter
+	// Limits are the limits above the ones of the connection, which start
+	// at PeerLimits. LimitOverhead counts the headers of the blocks toward
+	// the limits.
+	Limits        *Limits
+	PeerLimits    RateLimits
+	LimitOverhead bool
+}
+
+func DefaultConnConfig() *ConnConfig {
+	return &ConnConfig{
+		Extensions: DefaultExtensions(),
+	}
+}
+
 type PeerConn struct {
 	net.Conn
-	Choked    bool
-	PiecesMap Bitfield
-	peer      Peer
-	peerID    string
-	infoHash  [INFO_HASH_LEN]byte
+	Choked       bool
+	PiecesMap    Bitfield
+	ExtHandshake *ExtHandshake
+
+	// AmChoking and PeerInterested are the states of the remote peer from
+	// our point of view.
+	AmChoking      bool
+	PeerInterested bool
+	// AllowedFast are the pieces we may request while choked, Suggested the
+	// pieces the peer suggested to download first, oldest first.
+	AllowedFast map[int]bool
+	Suggested   []int
+	// Counter counts the bytes of the connection, see ConnConfig.Counter.
+	Counter *TransferCounter
+	// Limits are the rate limits of the connection, see ConnConfig.Limits.
+	Limits *Limits
+
+	peer         Peer
+	peerID       string
+	infoHash     [INFO_HASH_LEN]byte
+	reserved     [8]byte
+	cfg          *ConnConfig
+	haveAll      bool
+	seed         atomic.Bool
+	peerRequests []BlockRequest
+	// granted is the allowed fast set sent to the remote peer
+	granted map[int]bool
+	wmu     sync.Mutex
 }
 
-func (tf *TorrentFile) FindPeers() ([]Peer, error) {
-	trackerRespList, err := tf.RequestTrackers()
+// FindPeers asks the trackers of the torrent and the given extra sources for
+// peers, the results are merged into a single list without duplicates.
+func (tf *TorrentFile) FindPeers(ctx context.Context, sources ...PeerSource) ([]Peer, error) {
+	return tf.findPeers(ctx, AnnounceParams{Event: ANNOUNCE_EVENT_STARTED, Left: tf.Info.Length}, sources)
+}
+
+func (tf *TorrentFile) findPeers(ctx context.Context, announce AnnounceParams, sources []PeerSource) ([]Peer, error) {
+	// peers of a private torrent must only be learned from its trackers
+	if tf.Info.Private && len(sources) > 0 {
+		dlog.Infof("ignoring %d peer sources for private torrent %s", len(sources), tf.Info.Name)
+		sources = nil
+	}
+
+	var sourcePeers [][]Peer
+	var wg sync.WaitGroup
+	if len(sources) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sourcePeers = findSourcePeers(ctx, tf, sources)
+		}()
+	}
+
+	trackerRespList, err := tf.SendAnnounce(ctx, announce)
+	wg.Wait()
 	if err != nil {
 		return nil, err
 	}
 
 	peers := make([]Peer, 0)
+	seen := make(map[string]bool)
 	for _, tr := range trackerRespList {
-		rawPeers := tr.Peers
-
-		rawPeerLen := len(rawPeers)
-		if rawPeerLen%PEER_LEN != 0 {
-			fmt.Println("received malformed peers")
+		if len(tr.Peers)%PEER_LEN != 0 || len(tr.Peers6)%PEER6_LEN != 0 {
+			dlog.Infof("received malformed peers for %s", tf.Info.Name)
 			continue
 		}
 
-		peerCount := rawPeerLen / PEER_LEN
+		peers = mergePeers(peers, parseCompactPeers(tr.Peers), seen)
+		peers = mergePeers(peers, parseCompactPeers6(tr.Peers6), seen)
+	}
+
+	for _, sp := range sourcePeers {
+		peers = mergePeers(peers, sp, seen)
+	}
+
+	return peers, nil
+}
+
+// parseCompactPeers parses a list of compact ipv4 peers, trailing bytes that
+// do not form a whole peer are ignored.
+func parseCompactPeers(raw []byte) []Peer {
+	return parseCompact(raw, IP_LEN)
+}
+
+// parseCompactPeers6 parses a list of compact ipv6 peers.
+func parseCompactPeers6(raw []byte) []Peer {
+	return parseCompact(raw, IPV6_LEN)
+}
+
+func parseCompact(raw []byte, ipLen int) []Peer {
+	peerLen := ipLen + PORT_LEN
+	count := len(raw) / peerLen
+	peers := make([]Peer, count)
+	for i := 0; i < count; i++ {
+		offset := i * peerLen
+		peers[i].IP = net.IP(append([]byte{}, raw[offset:offset+ipLen]...))
+		peers[i].Port = binary.BigEndian.Uint16(raw[offset+ipLen : offset+peerLen])
+	}
+
+	return peers
+}
 
-		peerList := make([]Peer, peerCount)
-		for i := 0; i < peerCount; i++ {
-			offset := i * PEER_LEN
-			peerList[i].IP = net.IP(rawPeers[offset : offset+IP_LEN])
-			peerList[i].Port = binary.BigEndian.Uint16(rawPeers[offset+IP_LEN : offset+PEER_LEN])
+// encodeCompactPeers encodes the ipv4 peers of the list, the others are
+// skipped.
+func encodeCompactPeers(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*PEER_LEN)
+	for _, p := range peers {
+		if ip := p.IP.To4(); ip != nil {
+			buf = append(buf, ip...)
+			buf = binary.BigEndian.AppendUint16(buf, p.Port)
 		}
+	}
+
+	return buf
+}
 
-		peers = append(peers, peerList...)
+// encodeCompactPeers6 encodes the ipv6 peers of the list.
+func encodeCompactPeers6(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*PEER6_LEN)
+	for _, p := range peers {
+		if p.IP.To4() == nil && p.IP.To16() != nil {
+			buf = append(buf, p.IP.To16()...)
+			buf = binary.BigEndian.AppendUint16(buf, p.Port)
+		}
 	}
 
-	return peers, nil
+	return buf
+}
+
+func (c *PeerConn) Peer() Peer {
+	return c.peer
+}
+
+// HasPiece reports whether the remote peer has the piece.
+func (c *PeerConn) HasPiece(index int) bool {
+	return c.haveAll || c.PiecesMap.Test(index)
 }
 
 func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
@@ -103,16 +258,59 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 		return nil, nil
 	}
 
+	// the length comes from the wire, refuse it before allocating
+	if length > c.maxMsgLen() {
+		c.Close()
+		return nil, fmt.Errorf("message too large: %d > %d", length, c.maxMsgLen())
+	}
+
 	msgBuf := make([]byte, length)
 	_, err = io.ReadFull(c, msgBuf)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PeerMsg{
+	msg := &PeerMsg{
 		Type:    PeerMsgTyep(msgBuf[0]),
 		Payload: msgBuf[1:],
-	}, nil
+	}
+
+	payload := msg.blockLen()
+	c.Counter.AddDownloaded(payload, int64(4+length)-payload)
+	return msg, nil
+}
+
+// maxMsgLen is the largest message a peer may send, a piece message with
+// the largest block we request or serve, or the bitfield of the torrent.
+// Extended messages carry at most one metadata piece and fit as well.
+func (c *PeerConn) maxMsgLen() uint32 {
+	n := uint32(MAX_REQUEST_LEN + 9)
+	if bf := uint32((c.cfg.NumPieces+7)/8 + 1); bf > n {
+		return bf
+	}
+
+	return n
+}
+
+// blockLen returns the length of the block of a piece message, the payload
+// of the transfer, 0 for other messages.
+func (msg *PeerMsg) blockLen() int64 {
+	if msg.Type != PEER_MSG_TYPE_PIECE || len(msg.Payload) < 8 {
+		return 0
+	}
+
+	return int64(len(msg.Payload) - 8)
+}
+
+// IsSeed reports whether the peer has all pieces, it is safe to call from
+// other goroutines than the one reading the connection.
+func (c *PeerConn) IsSeed() bool {
+	return c.seed.Load()
+}
+
+func (c *PeerConn) updateSeed() {
+	n := c.cfg.NumPieces
+	c.seed.Store(c.haveAll || (n > 0 && c.PiecesMap.Count() >= n))
 }
 
 func (c *PeerConn) WriteMsg(msg *PeerMsg) (int, error) {
@@ -120,7 +318,7 @@ func (c *PeerConn) WriteMsg(msg *PeerMsg) (int, error) {
 		return 0, nil
 	}
 
-	if msg.Type >= PEER_MSG_INVALID {
+	if !isValidMsgType(msg.Type) {
 		return 0, fmt.Errorf("peer msg type out of range")
 	}
 
@@ -131,46 +329,143 @@ func (c *PeerConn) WriteMsg(msg *PeerMsg) (int, error) {
 	buf[4] = byte(msg.Type)
 
 	copy(buf[4+1:], msg.Payload)
-	return c.Write(buf)
+
+	// extensions may write from their own goroutines
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	n, err := c.Write(buf)
+	payload := min(msg.blockLen(), int64(n))
+	c.Counter.AddUploaded(payload, int64(n)-payload)
+
+	return n, err
 }
 
 // region new peer conn
 
 func NewConn(peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string) (*PeerConn, error) {
+	return NewConnWithConfig(peer, infoHash, peerID, nil)
+}
+
+func NewConnWithConfig(peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string, cfg *ConnConfig) (*PeerConn, error) {
+	return NewConnContext(context.Background(), peer, infoHash, peerID, cfg)
+}
+
+// NewConnContext connects to a peer like NewConnWithConfig, the setup of the
+// connection is aborted when the context is done.
+func NewConnContext(ctx context.Context, peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string, cfg *ConnConfig) (*PeerConn, error) {
+	c, err := dialPeer(ctx, peer, infoHash, peerID, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	err = fillBitfield(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// dialTransport prefers utp and falls back to tcp.
+func dialTransport(ctx context.Context, peer Peer, socket *utp.Socket) (net.Conn, error) {
 	addr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if socket != nil {
+		conn, err := socket.DialTimeout(addr, UTP_DIAL_TIMEOUT)
+		if err == nil {
+			return conn, nil
+		}
+
+		dlog.Infof("utp connection to %s failed, falling back to tcp: %v", addr, err)
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// dialPeer connects to a peer and exchanges the protocol handshake, the
+// extension handshake is sent as well when both sides support it.
+func dialPeer(ctx context.Context, peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string, cfg *ConnConfig) (*PeerConn, error) {
+	if cfg == nil {
+		cfg = DefaultConnConfig()
+	}
+
+	if cfg.Extensions == nil {
+		cfg.Extensions = NewExtensionRegistry()
+	}
+
+	conn, err := dialEncrypted(ctx, peer, infoHash, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// the handshakes are aborted by closing the connection
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
 	err = handshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	err = checkHandshakeMsg(conn, infoHash)
+	reserved, err := checkHandshakeMsg(conn, infoHash)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
+	return newPeerConn(conn, peer, infoHash, peerID, reserved, cfg)
+}
+
+// newPeerConn sets up a connection after the handshakes were exchanged, our
+// pieces and the extension handshake are sent to the peer.
+func newPeerConn(conn net.Conn, peer Peer, infoHash [INFO_HASH_LEN]byte, peerID string, reserved [8]byte, cfg *ConnConfig) (*PeerConn, error) {
 	c := &PeerConn{
-		Conn:     conn,
-		Choked:   true,
-		peer:     peer,
-		peerID:   peerID,
-		infoHash: infoHash,
+		Conn:        conn,
+		Choked:      true,
+		AmChoking:   true,
+		AllowedFast: make(map[int]bool),
+		peer:        peer,
+		peerID:      peerID,
+		infoHash:    infoHash,
+		reserved:    reserved,
+		cfg:         cfg,
+		Counter:     NewTransferCounter(cfg.Counter),
+		Limits:      NewLimits(cfg.Limits, nil, cfg.PeerLimits),
 	}
 
-	err = fillBitfield(c)
-	if err != nil {
+	// the handshakes are exchanged already
+	c.Counter.AddDownloaded(0, HANDSHAKE_LEN)
+	c.Counter.AddUploaded(0, HANDSHAKE_LEN)
+
+	if err := c.sendAvailability(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	if c.SupportsExtensions() {
+		if err := c.sendExtHandshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
+func reservedBits() [8]byte {
+	var reserved [8]byte
+	reserved[EXTENSION_BIT_BYTE] |= EXTENSION_BIT
+	reserved[FAST_BIT_BYTE] |= FAST_BIT
+
+	return reserved
+}
+
 func handshake(conn net.Conn, infoHash [INFO_HASH_LEN]byte, peerID string) error {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
@@ -186,7 +481,8 @@ func handshake(conn net.Conn, infoHash [INFO_HASH_LEN]byte, peerID string) error
 
 	cur := 1
 	cur += copy(buf[cur:], []byte(msg.PreStr))
-	cur += copy(buf[cur:], make([]byte, 8))
+	reserved := reservedBits()
+	cur += copy(buf[cur:], reserved[:])
 	cur += copy(buf[cur:], msg.InfoHash[:])
 	cur += copy(buf[cur:], msg.PeerID[:])
 	_, err := conn.Write(buf)
@@ -194,58 +490,163 @@ func handshake(conn net.Conn, infoHash [INFO_HASH_LEN]byte, peerID string) error
 	return err
 }
 
-func checkHandshakeMsg(r io.Reader, targetInfoHash [INFO_HASH_LEN]byte) error {
+func checkHandshakeMsg(r io.Reader, targetInfoHash [INFO_HASH_LEN]byte) ([8]byte, error) {
+	reserved, infoHash, err := readHandshakeMsg(r)
+	if err != nil {
+		return reserved, err
+	}
+
+	if !bytes.Equal(infoHash[:], targetInfoHash[:]) {
+		return reserved, fmt.Errorf("handshake msg error: %x", infoHash[:])
+	}
+
+	return reserved, nil
+}
+
+func readHandshakeMsg(r io.Reader) ([8]byte, [INFO_HASH_LEN]byte, error) {
+	var reserved [8]byte
+	var infoHash [INFO_HASH_LEN]byte
+
 	lenBuf := make([]byte, 1)
 	_, err := io.ReadFull(r, lenBuf)
 	if err != nil {
-		return err
+		return reserved, infoHash, err
 	}
 
 	preLen := int(lenBuf[0])
 	if preLen == 0 {
 		err := fmt.Errorf("prelen can not be 0")
-		return err
+		return reserved, infoHash, err
 	}
 
 	msgBuf := make([]byte, 48+preLen)
 	_, err = io.ReadFull(r, msgBuf)
 	if err != nil {
-		return err
+		return reserved, infoHash, err
 	}
 
 	// var peerID [PEER_ID_LEN]byte
-	var infoHash [INFO_HASH_LEN]byte
 
+	copy(reserved[:], msgBuf[preLen:preLen+8])
 	copy(infoHash[:], msgBuf[preLen+8:preLen+8+INFO_HASH_LEN])
 	// copy(peerID[:], msgBuf[preLen+8+INFO_HASH_LEN:])
 
 	// preStr := string(msgBuf[0:preLen])
 
-	if !bytes.Equal(infoHash[:], targetInfoHash[:]) {
-		return fmt.Errorf("handshake msg error: " + string(infoHash[:]))
-	}
-
-	return nil
+	return reserved, infoHash, nil
 }
 
 func fillBitfield(c *PeerConn) error {
 	c.SetDeadline(time.Now().Add(5 * time.Second))
 	defer c.SetDeadline(time.Time{})
 
-	msg, err := c.ReadMsg()
-	if err != nil {
-		return err
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.Type {
+		case PEER_MSG_TYPE_EXTENDED:
+			// the extension handshake may arrive before the bitfield
+			if err = c.handleExtendedMsg(msg); err != nil {
+				return err
+			}
+
+			continue
+		case PEER_MSG_TYPE_BITFIELED, PEER_MSG_TYPE_HAVE_ALL, PEER_MSG_TYPE_HAVE_NONE:
+			return c.handleMsg(msg)
+		}
+
+		// with the fast extension the peer has to tell what it has first,
+		// without it a peer that has no pieces may omit the bitfield
+		if c.SupportsFast() {
+			return fmt.Errorf("expected bitfield, have all or have none, got %d", msg.Type)
+		}
+
+		c.PiecesMap = NewBitfield(c.cfg.NumPieces)
+		return c.handleMsg(msg)
 	}
+}
 
+// handleMsg updates the connection state from a message of the remote peer,
+// piece and reject messages are left to the download that requested them.
+func (c *PeerConn) handleMsg(msg *PeerMsg) error {
 	if msg == nil {
-		return fmt.Errorf("expected bitfield")
+		return nil
 	}
 
-	if msg.Type != PEER_MSG_TYPE_BITFIELED {
-		return fmt.Errorf("type error")
+	isFastMsg := msg.Type >= PEER_MSG_TYPE_SUGGEST && msg.Type <= PEER_MSG_TYPE_ALLOWED_FAST
+	if isFastMsg && !c.SupportsFast() {
+		return fmt.Errorf("unexpected message %d without fast extension", msg.Type)
+	}
+
+	switch msg.Type {
+	case PEER_MSG_TYPE_CHOKE:
+		c.Choked = true
+	case PEER_MSG_TYPE_UNCHOKE:
+		c.Choked = false
+	case PEER_MSG_TYPE_INTERESTED:
+		c.PeerInterested = true
+	case PEER_MSG_TYPE_NOT_INTEREST:
+		c.PeerInterested = false
+	case PEER_MSG_TYPE_HAVE:
+		index, err := GetHaveIndex(msg)
+		if err != nil {
+			return err
+		}
+
+		c.PiecesMap.Set(index)
+		c.updateSeed()
+	case PEER_MSG_TYPE_BITFIELED:
+		c.PiecesMap = msg.Payload
+		c.updateSeed()
+	case PEER_MSG_TYPE_HAVE_ALL:
+		c.haveAll = c.cfg.NumPieces == 0
+		c.PiecesMap = NewBitfield(c.cfg.NumPieces)
+		for i := 0; i < c.cfg.NumPieces; i++ {
+			c.PiecesMap.Set(i)
+		}
+		c.updateSeed()
+	case PEER_MSG_TYPE_HAVE_NONE:
+		c.PiecesMap = NewBitfield(c.cfg.NumPieces)
+		c.updateSeed()
+	case PEER_MSG_TYPE_REQUEST:
+		r, err := parseBlockRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.handleRequest(r)
+	case PEER_MSG_TYPE_CANCEL:
+		r, err := parseBlockRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		return c.handleCancel(r)
+	case PEER_MSG_TYPE_SUGGEST:
+		index, err := parseIndexMsg(msg)
+		if err != nil {
+			return err
+		}
+
+		c.addSuggested(index)
+	case PEER_MSG_TYPE_ALLOWED_FAST:
+		index, err := parseIndexMsg(msg)
+		if err != nil {
+			return err
+		}
+
+		c.AllowedFast[index] = true
+	case PEER_MSG_TYPE_EXTENDED:
+		return c.handleExtendedMsg(msg)
 	}
 
-	c.PiecesMap = msg.Payload
 	return nil
 }
 
@@ -293,13 +694,5 @@ func GetHaveIndex(msg *PeerMsg) (int, error) {
 }
 
 func NewRequestMsg(index, offset, length int) *PeerMsg {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-
-	return &PeerMsg{
-		Type:    PEER_MSG_TYPE_REQUEST,
-		Payload: payload,
-	}
+	return newBlockMsg(PEER_MSG_TYPE_REQUEST, index, offset, length)
 }
@@ -0,0 +1,162 @@
+package dgotorrent
+
+import (
+	"sync"
+	"time"
+)
+
+const DEFAULT_MAX_PEERS = 500
+
+type PeerSourceType uint8
+
+const (
+	PEER_SOURCE_TRACKER PeerSourceType = iota
+	PEER_SOURCE_DHT
+	PEER_SOURCE_PEX
+	PEER_SOURCE_MAGNET
+	PEER_SOURCE_INCOMING
+)
+
+// flags of a peer as defined by ut_pex (BEP 11)
+const (
+	PEER_FLAG_ENCRYPTION byte = 1 << iota
+	PEER_FLAG_SEED
+	PEER_FLAG_UTP
+	PEER_FLAG_HOLEPUNCH
+	PEER_FLAG_REACHABLE
+)
+
+type PoolPeer struct {
+	Peer
+	Source  PeerSourceType
+	Flags   byte
+	AddedAt time.Time
+}
+
+// PeerPool is the set of known peers of a task, it removes duplicates and
+// caps the number of peers coming from all sources.
+type PeerPool struct {
+	mu    sync.RWMutex
+	max   int
+	peers map[string]*PoolPeer
+	order []string
+	added chan Peer
+}
+
+func NewPeerPool(max int) *PeerPool {
+	if max <= 0 {
+		max = DEFAULT_MAX_PEERS
+	}
+
+	return &PeerPool{
+		max:   max,
+		peers: make(map[string]*PoolPeer),
+		order: make([]string, 0),
+		added: make(chan Peer, max),
+	}
+}
+
+// Added delivers peers as they are added to the pool, peers are dropped from
+// the channel (but kept in the pool) when nobody consumes it.
+func (p *PeerPool) Added() <-chan Peer {
+	return p.added
+}
+
+func (p *PeerPool) AddWithFlags(peer Peer, source PeerSourceType, flags byte) bool {
+	if peer.IP == nil || peer.Port == 0 || peer.IP.IsUnspecified() {
+		return false
+	}
+
+	key := peer.String()
+
+	p.mu.Lock()
+	if existing, ok := p.peers[key]; ok {
+		existing.Flags |= flags
+		p.mu.Unlock()
+		return false
+	}
+
+	if len(p.peers) >= p.max {
+		p.mu.Unlock()
+		return false
+	}
+
+	p.peers[key] = &PoolPeer{
+		Peer:    peer,
+		Source:  source,
+		Flags:   flags,
+		AddedAt: time.Now(),
+	}
+	p.order = append(p.order, key)
+	p.mu.Unlock()
+
+	select {
+	case p.added <- peer:
+	default:
+	}
+
+	return true
+}
+
+// Add adds peers from a source and returns how many of them were new.
+func (p *PeerPool) Add(peers []Peer, source PeerSourceType) int {
+	count := 0
+	for _, peer := range peers {
+		if p.AddWithFlags(peer, source, 0) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (p *PeerPool) Get(peer Peer) (PoolPeer, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	pp, ok := p.peers[peer.String()]
+	if !ok {
+		return PoolPeer{}, false
+	}
+
+	return *pp, true
+}
+
+func (p *PeerPool) Remove(peer Peer) {
+	key := peer.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.peers[key]; !ok {
+		return
+	}
+
+	delete(p.peers, key)
+	for i, k := range p.order {
+		if k == key {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Peers returns the peers in the order they were added.
+func (p *PeerPool) Peers() []Peer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ret := make([]Peer, 0, len(p.order))
+	for _, key := range p.order {
+		ret = append(ret, p.peers[key].Peer)
+	}
+
+	return ret
+}
+
+func (p *PeerPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.peers)
+}
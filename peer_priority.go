@@ -0,0 +1,91 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sort"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// masks of the canonical peer priority (BEP 40), the more of the address two
+// peers share the more of it is taken into account
+var (
+	v4Mask   = []byte{0xff, 0xff, 0x55, 0x55}
+	v4Mask16 = []byte{0xff, 0xff, 0xff, 0x55}
+	v4Mask24 = []byte{0xff, 0xff, 0xff, 0xff}
+
+	v6Mask   = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}
+	v6Mask48 = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}
+	v6Mask56 = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}
+)
+
+// PeerPriority computes the canonical priority of the connection between
+// two peers (BEP 40), both ends of a connection compute the same value.
+// Peers of different address families have no priority.
+func PeerPriority(self, peer Peer) uint32 {
+	if self.IP.Equal(peer.IP) {
+		buf := make([]byte, 4)
+		p1, p2 := self.Port, peer.Port
+		if p1 > p2 {
+			p1, p2 = p2, p1
+		}
+
+		binary.BigEndian.PutUint16(buf[0:2], p1)
+		binary.BigEndian.PutUint16(buf[2:4], p2)
+		return crc32.Checksum(buf, castagnoli)
+	}
+
+	var a, b, mask []byte
+	if a4, b4 := self.IP.To4(), peer.IP.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+		switch {
+		case bytes.Equal(a[:3], b[:3]):
+			mask = v4Mask24
+		case bytes.Equal(a[:2], b[:2]):
+			mask = v4Mask16
+		default:
+			mask = v4Mask
+		}
+	} else if a4 == nil && b4 == nil && self.IP.To16() != nil && peer.IP.To16() != nil {
+		a, b = self.IP.To16(), peer.IP.To16()
+		switch {
+		case bytes.Equal(a[:7], b[:7]):
+			mask = v6Mask56
+		case bytes.Equal(a[:6], b[:6]):
+			mask = v6Mask48
+		default:
+			mask = v6Mask
+		}
+	} else {
+		return 0
+	}
+
+	ma := make([]byte, len(a))
+	mb := make([]byte, len(b))
+	for i := range mask {
+		ma[i] = a[i] & mask[i]
+		mb[i] = b[i] & mask[i]
+	}
+
+	if bytes.Compare(ma, mb) > 0 {
+		ma, mb = mb, ma
+	}
+
+	return crc32.Checksum(append(ma, mb...), castagnoli)
+}
+
+// SortPeersByPriority orders the peers by their canonical priority relative
+// to our own address, the peers to connect to first come first.
+func SortPeersByPriority(peers []Peer, self net.IP) {
+	if self == nil {
+		return
+	}
+
+	me := Peer{IP: self}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return PeerPriority(me, peers[i]) > PeerPriority(me, peers[j])
+	})
+}
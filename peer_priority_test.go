@@ -0,0 +1,47 @@
+package dgotorrent_test
+
+import (
+	"net"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+func TestPeerPriority(t *testing.T) {
+	peer := func(ip string, port uint16) dgotorrent.Peer {
+		return dgotorrent.Peer{IP: net.ParseIP(ip), Port: port}
+	}
+
+	tests := []struct {
+		a, b dgotorrent.Peer
+		want uint32
+	}{
+		{peer("123.213.32.10", 0), peer("98.76.54.32", 0), 0xec2d7224},
+		{peer("123.213.32.10", 0), peer("123.213.32.234", 0), 0x99568189},
+	}
+
+	for _, tt := range tests {
+		if got := dgotorrent.PeerPriority(tt.a, tt.b); got != tt.want {
+			t.Errorf("priority of %s and %s: expected %#x, got %#x", tt.a, tt.b, tt.want, got)
+		}
+
+		if got := dgotorrent.PeerPriority(tt.b, tt.a); got != tt.want {
+			t.Errorf("priority of %s and %s is not symmetric", tt.b, tt.a)
+		}
+	}
+
+	if dgotorrent.PeerPriority(peer("10.0.0.1", 1), peer("2001:db8::1", 1)) != 0 {
+		t.Error("peers of different families must not have a priority")
+	}
+
+	a, b := peer("2001:db8::1", 1), peer("2001:db8:1::2", 2)
+	if dgotorrent.PeerPriority(a, b) != dgotorrent.PeerPriority(b, a) {
+		t.Error("ipv6 priority is not symmetric")
+	}
+
+	peers := []dgotorrent.Peer{peer("98.76.54.32", 1), peer("123.213.32.234", 2)}
+	dgotorrent.SortPeersByPriority(peers, net.ParseIP("123.213.32.10"))
+	if peers[0].Port != 1 {
+		t.Errorf("expected the peer with the higher priority first, got %v", peers)
+	}
+}
@@ -0,0 +1,107 @@
+package dgotorrent
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/Dizzrt/dgo-torrent/dht"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+// PeerSource provides peers in addition to the trackers of a torrent.
+type PeerSource interface {
+	Name() string
+	FindPeers(ctx context.Context, tf *TorrentFile) ([]Peer, error)
+}
+
+type DHTSource struct {
+	Node *dht.Node
+	// Port is announced to the DHT, announcing is disabled when it is 0.
+	Port int
+}
+
+func NewDHTSource(node *dht.Node, port int) *DHTSource {
+	return &DHTSource{
+		Node: node,
+		Port: port,
+	}
+}
+
+func (s *DHTSource) Name() string {
+	return "dht"
+}
+
+// FindPeers returns once the context is done, the lookup itself runs on
+// until its queries time out.
+func (s *DHTSource) FindPeers(ctx context.Context, tf *TorrentFile) ([]Peer, error) {
+	type result struct {
+		peers []dht.Peer
+		err   error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		var res result
+		if s.Port > 0 {
+			res.peers, res.err = s.Node.Announce(tf.Info.Hash, s.Port)
+		} else {
+			res.peers, res.err = s.Node.GetPeers(tf.Info.Hash)
+		}
+
+		results <- res
+	}()
+
+	var res result
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+	dhtPeers := res.peers
+
+	peers := make([]Peer, 0, len(dhtPeers))
+	for _, p := range dhtPeers {
+		peers = append(peers, Peer{IP: p.IP, Port: p.Port})
+	}
+
+	return peers, nil
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// mergePeers appends the peers of src that are not in dst yet.
+func mergePeers(dst []Peer, src []Peer, seen map[string]bool) []Peer {
+	for _, p := range src {
+		key := p.String()
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		dst = append(dst, p)
+	}
+
+	return dst
+}
+
+func findSourcePeers(ctx context.Context, tf *TorrentFile, sources []PeerSource) [][]Peer {
+	ret := make([][]Peer, 0, len(sources))
+	for _, s := range sources {
+		peers, err := s.FindPeers(ctx, tf)
+		if err != nil {
+			dlog.Warnf("failed to find peers from %s with error: %v", s.Name(), err)
+			continue
+		}
+
+		ret = append(ret, peers)
+	}
+
+	return ret
+}
@@ -0,0 +1,240 @@
+package dgotorrent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+const EXT_UT_PEX = "ut_pex"
+
+const (
+	PEX_INTERVAL = time.Minute
+	// maximum number of added and dropped peers in a single message
+	PEX_MAX_PEERS = 50
+)
+
+type pexState struct {
+	sent     map[string]Peer
+	lastSent time.Time
+}
+
+// PexExtension implements peer exchange (BEP 11). It advertises the peers we
+// are connected to and merges the peers other clients advertise into the
+// peer pool of the task.
+type PexExtension struct {
+	Interval time.Duration
+
+	pool *PeerPool
+
+	mu        sync.Mutex
+	conns     map[*PeerConn]*pexState
+	connected map[string]Peer
+}
+
+func NewPexExtension(pool *PeerPool) *PexExtension {
+	return &PexExtension{
+		Interval:  PEX_INTERVAL,
+		pool:      pool,
+		conns:     make(map[*PeerConn]*pexState),
+		connected: make(map[string]Peer),
+	}
+}
+
+func (e *PexExtension) Name() string {
+	return EXT_UT_PEX
+}
+
+func (e *PexExtension) HandleHandshake(c *PeerConn, hs *ExtHandshake) error {
+	if _, ok := c.RemoteExtID(EXT_UT_PEX); !ok {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.conns[c]; !ok {
+		e.conns[c] = &pexState{sent: make(map[string]Peer)}
+	}
+
+	return nil
+}
+
+func (e *PexExtension) HandleMsg(c *PeerConn, payload []byte) error {
+	res, _, err := bencode.UnmarshalPrefix(payload)
+	if err != nil {
+		return err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid ut_pex message")
+	}
+
+	added, _ := v["added"].(string)
+	flags, _ := v["added.f"].(string)
+	e.addPeers(parseCompactPeers([]byte(added)), flags)
+
+	added6, _ := v["added6"].(string)
+	flags6, _ := v["added6.f"].(string)
+	e.addPeers(parseCompactPeers6([]byte(added6)), flags6)
+
+	return nil
+}
+
+func (e *PexExtension) addPeers(peers []Peer, flags string) {
+	if len(peers) > PEX_MAX_PEERS {
+		peers = peers[:PEX_MAX_PEERS]
+	}
+
+	for i, p := range peers {
+		var f byte
+		if i < len(flags) {
+			f = flags[i]
+		}
+
+		e.pool.AddWithFlags(p, PEER_SOURCE_PEX, f)
+	}
+}
+
+// Connected marks a peer as connected, it is advertised to the other peers
+// from the next round on.
+func (e *PexExtension) Connected(peer Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.connected[peer.String()] = peer
+}
+
+func (e *PexExtension) Disconnected(peer Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := peer.String()
+	delete(e.connected, key)
+	for c := range e.conns {
+		if c.Peer().String() == key {
+			delete(e.conns, c)
+		}
+	}
+}
+
+// Run sends the peer deltas until the context is done, every peer receives
+// at most one message per interval.
+func (e *PexExtension) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.sendAll()
+		}
+	}
+}
+
+type pexMsg struct {
+	conn    *PeerConn
+	payload []byte
+}
+
+func (e *PexExtension) sendAll() {
+	msgs := make([]pexMsg, 0)
+
+	e.mu.Lock()
+	now := time.Now()
+	for c, state := range e.conns {
+		if now.Sub(state.lastSent) < e.Interval {
+			continue
+		}
+
+		payload, ok := e.delta(c, state)
+		if !ok {
+			continue
+		}
+
+		state.lastSent = now
+		msgs = append(msgs, pexMsg{conn: c, payload: payload})
+	}
+	e.mu.Unlock()
+
+	for _, m := range msgs {
+		if err := m.conn.SendExtended(EXT_UT_PEX, m.payload); err != nil {
+			dlog.Infof("failed to send ut_pex to %s with error: %v", m.conn.Peer(), err)
+		}
+	}
+}
+
+// delta builds the message that brings the view of a peer up to date and
+// records it as sent, it must be called with e.mu held.
+func (e *PexExtension) delta(c *PeerConn, state *pexState) ([]byte, bool) {
+	self := c.Peer().String()
+
+	added := make([]Peer, 0)
+	flags, flags6 := make([]byte, 0), make([]byte, 0)
+	for key, p := range e.connected {
+		if key == self || len(added) >= PEX_MAX_PEERS {
+			continue
+		}
+
+		if _, ok := state.sent[key]; ok {
+			continue
+		}
+
+		// flags follow the order of the compact lists of both families
+		if p.IP.To4() != nil {
+			flags = append(flags, e.flags(p))
+		} else {
+			flags6 = append(flags6, e.flags(p))
+		}
+
+		added = append(added, p)
+		state.sent[key] = p
+	}
+
+	dropped := make([]Peer, 0)
+	for key, p := range state.sent {
+		if len(dropped) >= PEX_MAX_PEERS {
+			break
+		}
+
+		if _, ok := e.connected[key]; !ok {
+			dropped = append(dropped, p)
+			delete(state.sent, key)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil, false
+	}
+
+	res, err := bencode.Marshal(map[string]any{
+		"added":    string(encodeCompactPeers(added)),
+		"added.f":  string(flags),
+		"dropped":  string(encodeCompactPeers(dropped)),
+		"added6":   string(encodeCompactPeers6(added)),
+		"added6.f": string(flags6),
+		"dropped6": string(encodeCompactPeers6(dropped)),
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	return []byte(res), true
+}
+
+func (e *PexExtension) flags(p Peer) byte {
+	// we only advertise peers we connected to, so they are reachable
+	flags := PEER_FLAG_REACHABLE
+	if pp, ok := e.pool.Get(p); ok {
+		flags |= pp.Flags & (PEER_FLAG_ENCRYPTION | PEER_FLAG_SEED | PEER_FLAG_UTP)
+	}
+
+	return flags
+}
@@ -0,0 +1,306 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+func testPeer(ip string, port uint16) dgotorrent.Peer {
+	return dgotorrent.Peer{IP: net.ParseIP(ip).To4(), Port: port}
+}
+
+func TestPeerPool(t *testing.T) {
+	pool := dgotorrent.NewPeerPool(2)
+
+	added := pool.Add([]dgotorrent.Peer{
+		testPeer("10.0.0.1", 1),
+		testPeer("10.0.0.1", 1),
+		testPeer("0.0.0.0", 2),
+		testPeer("10.0.0.2", 0),
+		testPeer("10.0.0.3", 3),
+		testPeer("10.0.0.4", 4),
+	}, dgotorrent.PEER_SOURCE_TRACKER)
+
+	if added != 2 || pool.Len() != 2 {
+		t.Fatalf("expected 2 peers to be added, got %d (len %d)", added, pool.Len())
+	}
+
+	peers := pool.Peers()
+	if peers[0].String() != "10.0.0.1:1" || peers[1].String() != "10.0.0.3:3" {
+		t.Errorf("unexpected peers: %v", peers)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pool.Added():
+		default:
+			t.Fatal("expected added peers on the channel")
+		}
+	}
+
+	pool.Remove(peers[0])
+	if !pool.AddWithFlags(testPeer("10.0.0.4", 4), dgotorrent.PEER_SOURCE_PEX, dgotorrent.PEER_FLAG_SEED) {
+		t.Error("expected room for a new peer after removal")
+	}
+
+	pp, ok := pool.Get(testPeer("10.0.0.4", 4))
+	if !ok || pp.Source != dgotorrent.PEER_SOURCE_PEX || pp.Flags != dgotorrent.PEER_FLAG_SEED {
+		t.Errorf("unexpected pool peer: %+v", pp)
+	}
+}
+
+func TestPexReceive(t *testing.T) {
+	pool := dgotorrent.NewPeerPool(0)
+	registry := dgotorrent.NewExtensionRegistry()
+	registry.Register(dgotorrent.NewPexExtension(pool))
+
+	peer := startExtPeer(t, 0x10, func(p *extPeer) {
+		exths, _ := bencode.Marshal(map[string]any{
+			"m": map[string]any{"ut_pex": int64(1)},
+		})
+		writePeerMsg(p.conn, 20, append([]byte{0}, exths...))
+
+		pex, _ := bencode.Marshal(map[string]any{
+			"added":    "\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2\x0a\x00\x00\x01\x1a\xe1",
+			"added.f":  "\x12\x10\x12",
+			"dropped":  "",
+			"added6":   "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1",
+			"added6.f": "\x10",
+		})
+		writePeerMsg(p.conn, 20, append([]byte{p.localID("ut_pex")}, pex...))
+		writePeerMsg(p.conn, 5, []byte{0xff})
+	})
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConnWithConfig(peer, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{
+		Extensions: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if pool.Len() != 3 {
+		t.Fatalf("expected 3 deduplicated peers, got %v", pool.Peers())
+	}
+
+	if _, ok := pool.Get(dgotorrent.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}); !ok {
+		t.Error("ipv6 peer of added6 is missing")
+	}
+
+	pp, ok := pool.Get(testPeer("10.0.0.1", 6881))
+	if !ok || pp.Source != dgotorrent.PEER_SOURCE_PEX || pp.Flags&dgotorrent.PEER_FLAG_SEED == 0 {
+		t.Errorf("unexpected pool peer: %+v", pp)
+	}
+}
+
+func TestPexSend(t *testing.T) {
+	pool := dgotorrent.NewPeerPool(0)
+	pex := dgotorrent.NewPexExtension(pool)
+	pex.Interval = 100 * time.Millisecond
+
+	registry := dgotorrent.NewExtensionRegistry()
+	registry.Register(pex)
+
+	msgs := make(chan map[string]any, 2)
+	peer := startExtPeer(t, 0x10, func(p *extPeer) {
+		exths, _ := bencode.Marshal(map[string]any{
+			"m": map[string]any{"ut_pex": int64(9)},
+		})
+		writePeerMsg(p.conn, 20, append([]byte{0}, exths...))
+		writePeerMsg(p.conn, 5, []byte{0xff})
+
+		for len(msgs) < cap(msgs) {
+			id, payload, err := readPeerMsg(p.conn)
+			if err != nil {
+				return
+			}
+
+			if id == 20 && payload[0] == 9 {
+				res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+				msgs <- res.(map[string]any)
+			}
+		}
+	})
+
+	var infoHash [dgotorrent.INFO_HASH_LEN]byte
+	c, err := dgotorrent.NewConnWithConfig(peer, infoHash, "-TEST00-000000000001", &dgotorrent.ConnConfig{
+		Extensions: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pex.Connected(c.Peer())
+	pex.Connected(testPeer("10.0.0.1", 1))
+	pex.Connected(testPeer("10.0.0.2", 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pex.Run(ctx)
+
+	start := time.Now()
+	first := <-msgs
+	if added, _ := first["added"].(string); len(added) != 12 {
+		t.Errorf("expected the two other peers to be added, got %x", added)
+	}
+
+	if flags, _ := first["added.f"].(string); flags != "\x10\x10" {
+		t.Errorf("unexpected flags: %x", flags)
+	}
+
+	pex.Disconnected(testPeer("10.0.0.1", 1))
+
+	second := <-msgs
+	if dropped, _ := second["dropped"].(string); dropped != "\x0a\x00\x00\x01\x00\x01" {
+		t.Errorf("expected 10.0.0.1:1 to be dropped, got %x", dropped)
+	}
+
+	if added, _ := second["added"].(string); len(added) != 0 {
+		t.Errorf("expected no added peers, got %x", added)
+	}
+
+	if elapsed := time.Since(start); elapsed < pex.Interval {
+		t.Errorf("deltas were sent %v apart, expected at least %v", elapsed, pex.Interval)
+	}
+}
+
+func TestPrivateTorrentDisablesPex(t *testing.T) {
+	info, _ := bencode.Marshal(map[string]any{
+		"name":         "private.bin",
+		"length":       int64(16384),
+		"piece length": int64(16384),
+		"pieces":       "01234567890123456789",
+		"private":      int64(1),
+	})
+
+	tf, err := dgotorrent.NewTorrentFileFromMetadata([]byte(info), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tf.Info.Private {
+		t.Fatal("expected private flag to be parsed")
+	}
+
+	process := dgotorrent.NewProcess(&dgotorrent.Task{Torrent: *tf})
+	if _, ok := process.Extensions.Get(dgotorrent.EXT_UT_PEX); ok {
+		t.Error("ut_pex must be disabled for private torrents")
+	}
+
+	tf.Info.Private = false
+	process = dgotorrent.NewProcess(&dgotorrent.Task{Torrent: *tf})
+	if _, ok := process.Extensions.Get(dgotorrent.EXT_UT_PEX); !ok {
+		t.Error("ut_pex should be enabled for public torrents")
+	}
+}
+
+// compactPeers reports whether the compact peer list contains the address.
+func compactPeers(list string, addr *net.TCPAddr) bool {
+	want := string(append(addr.IP.To4(), byte(addr.Port>>8), byte(addr.Port)))
+	for i := 0; i+6 <= len(list); i += 6 {
+		if list[i:i+6] == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestPexInboundPeer(t *testing.T) {
+	data := randomData(dgotorrent.BLOCKSIZE)
+	tf := peerTorrent(t, "pex.bin", data, dgotorrent.BLOCKSIZE)
+
+	ready := make(chan struct{})
+	msgs := make(chan map[string]any, 16)
+	process, _ := peerProcess(t, tf, func(l net.Listener) {
+		startExtPeerOn(t, l, 0x10, func(p *extPeer) {
+			exths, _ := bencode.Marshal(map[string]any{
+				"m": map[string]any{"ut_pex": int64(9)},
+			})
+			writePeerMsg(p.conn, 20, append([]byte{0}, exths...))
+			writePeerMsg(p.conn, 5, []byte{0})
+			close(ready)
+
+			for {
+				id, payload, err := readPeerMsg(p.conn)
+				if err != nil {
+					return
+				}
+
+				if id == 20 && payload[0] == 9 {
+					res, _ := bencode.Unmarshal(bytes.NewReader(payload[1:]))
+					msgs <- res.(map[string]any)
+				}
+			}
+		})
+	})
+
+	ext, _ := process.Extensions.Get(dgotorrent.EXT_UT_PEX)
+	ext.(*dgotorrent.PexExtension).Interval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- process.Start(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download did not connect to its peer")
+	}
+
+	// the inbound peer joins the running download
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		pc, err := dgotorrent.AcceptConn(conn, "-TEST00-000000000001", [][dgotorrent.INFO_HASH_LEN]byte{tf.Info.Hash}, nil)
+		if err == nil && !process.AddConn(pc) {
+			pc.Close()
+		}
+	}()
+
+	conn, err := dialHandshake(t, l.Addr().String(), [8]byte{}, tf.Info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePeerMsg(conn, 5, []byte{0})
+
+	inbound := conn.LocalAddr().(*net.TCPAddr)
+	waitPex := func(key string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-msgs:
+				if list, _ := msg[key].(string); compactPeers(list, inbound) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("inbound peer %s was not %s", inbound, key)
+			}
+		}
+	}
+
+	waitPex("added")
+	conn.Close()
+	waitPex("dropped")
+}
@@ -0,0 +1,114 @@
+package dgotorrent
+
+import "sync"
+
+// piecePicker hands out the pieces that still have to be downloaded. Choked
+// peers only get the pieces they allow us to download while choked, unchoked
+// peers the pieces they suggested first and otherwise the pieces in order.
+type piecePicker struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*pJob
+	closed  bool
+}
+
+func newPiecePicker(jobs []*pJob) *piecePicker {
+	p := &piecePicker{pending: jobs}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// pick removes and returns the next piece for the connection, the job is nil
+// while the connection has none of the pending pieces. ok is false once the
+// picker is closed.
+func (p *piecePicker) pick(conn *PeerConn) (job *pJob, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, false
+	}
+
+	if i := p.choose(conn); i >= 0 {
+		job = p.pending[i]
+		p.pending = append(p.pending[:i], p.pending[i+1:]...)
+	}
+
+	return job, true
+}
+
+// next removes and returns the first pending piece, it is used by sources
+// that have every piece such as web seeds.
+func (p *piecePicker) next() (*pJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return nil, false
+		}
+
+		if len(p.pending) > 0 {
+			job := p.pending[0]
+			p.pending = p.pending[1:]
+			return job, true
+		}
+
+		p.cond.Wait()
+	}
+}
+
+func (p *piecePicker) choose(conn *PeerConn) int {
+	// a choking peer only serves the pieces it allows while choked
+	if conn.Choked {
+		for i, job := range p.pending {
+			if conn.AllowedFast[job.index] && conn.HasPiece(job.index) {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	for _, index := range conn.Suggested {
+		if i := p.find(index); i >= 0 && conn.HasPiece(index) {
+			return i
+		}
+	}
+
+	for i, job := range p.pending {
+		if conn.HasPiece(job.index) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (p *piecePicker) find(index int) int {
+	for i, job := range p.pending {
+		if job.index == index {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// put gives a piece back, e.g. after the download from a peer failed.
+func (p *piecePicker) put(job *pJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, job)
+	p.cond.Broadcast()
+}
+
+func (p *piecePicker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
@@ -0,0 +1,205 @@
+package dgotorrent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var (
+	ErrInvalidFileIndex = errors.New("file index out of range")
+	ErrNoFilesSelected  = errors.New("no files selected")
+)
+
+// FilePriority decides whether and how early the pieces of a file are
+// downloaded, skipped files are not downloaded at all.
+type FilePriority uint8
+
+const (
+	FILE_PRIORITY_SKIP FilePriority = iota
+	FILE_PRIORITY_LOW
+	FILE_PRIORITY_NORMAL
+	FILE_PRIORITY_HIGH
+)
+
+var filePriorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p FilePriority) String() string {
+	if int(p) < len(filePriorityNames) {
+		return filePriorityNames[p]
+	}
+
+	return fmt.Sprintf("FilePriority(%d)", p)
+}
+
+func ParseFilePriority(s string) (FilePriority, error) {
+	for i, name := range filePriorityNames {
+		if strings.EqualFold(s, name) {
+			return FilePriority(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown file priority %q, expected skip, low, normal or high", s)
+}
+
+// FilePriority returns the priority of a file, files are downloaded with the
+// normal priority unless another one was set.
+func (t *Task) FilePriority(index int) FilePriority {
+	if index < 0 || index >= len(t.FilePriorities) {
+		return FILE_PRIORITY_NORMAL
+	}
+
+	return t.FilePriorities[index]
+}
+
+func (t *Task) SetFilePriority(index int, priority FilePriority) error {
+	files := t.Torrent.Info.FileList()
+	if index < 0 || index >= len(files) {
+		return ErrInvalidFileIndex
+	}
+
+	if len(t.FilePriorities) != len(files) {
+		priorities := make([]FilePriority, len(files))
+		for i := range priorities {
+			priorities[i] = t.FilePriority(i)
+		}
+		t.FilePriorities = priorities
+	}
+
+	t.FilePriorities[index] = priority
+	return nil
+}
+
+// matchFile reports whether a pattern selects a file. A number selects the
+// file with that index, a glob pattern matches the path of the file or its
+// base name so that "*.mkv" selects files in subdirectories too.
+func matchFile(pattern string, index int, f FileEntry) (bool, error) {
+	if n, err := strconv.Atoi(pattern); err == nil {
+		return n == index, nil
+	}
+
+	full := strings.Join(f.Path, "/")
+	ok, err := path.Match(pattern, full)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	return path.Match(pattern, f.Path[len(f.Path)-1])
+}
+
+// SelectFiles skips the files that match none of the include patterns or
+// any of the exclude patterns, see matchFile, all files are included when there are no
+// include patterns. It returns the number of selected files.
+func (t *Task) SelectFiles(include, exclude []string) (int, error) {
+	selected := 0
+	for i, f := range t.Torrent.Info.FileList() {
+		if f.IsPadding() {
+			continue
+		}
+
+		want := len(include) == 0
+		for _, pattern := range include {
+			ok, err := matchFile(pattern, i, f)
+			if err != nil {
+				return 0, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			want = want || ok
+		}
+
+		for _, pattern := range exclude {
+			ok, err := matchFile(pattern, i, f)
+			if err != nil {
+				return 0, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			want = want && !ok
+		}
+
+		priority := t.FilePriority(i)
+		if !want {
+			priority = FILE_PRIORITY_SKIP
+		} else if priority == FILE_PRIORITY_SKIP {
+			priority = FILE_PRIORITY_NORMAL
+		}
+
+		if err := t.SetFilePriority(i, priority); err != nil {
+			return 0, err
+		}
+
+		if want {
+			selected++
+		}
+	}
+
+	if selected == 0 {
+		return 0, ErrNoFilesSelected
+	}
+
+	return selected, nil
+}
+
+// pieceFiles returns the files a piece overlaps, padding is left out.
+func (t *Task) pieceFiles(index int) []int {
+	info := &t.Torrent.Info
+	begin, end := info.PieceBounds(index)
+
+	files := make([]int, 0, 1)
+	for _, seg := range info.fileSegments(begin, end-begin) {
+		if !seg.padding {
+			files = append(files, seg.file)
+		}
+	}
+
+	return files
+}
+
+// PiecePriority is the highest priority of the files the piece overlaps, it
+// is skipped only if all of them are.
+func (t *Task) PiecePriority(index int) FilePriority {
+	if t.FilePriorities == nil {
+		return FILE_PRIORITY_NORMAL
+	}
+
+	priority := FILE_PRIORITY_SKIP
+	for _, f := range t.pieceFiles(index) {
+		priority = max(priority, t.FilePriority(f))
+	}
+
+	return priority
+}
+
+// isBoundaryPiece reports whether a wanted piece also holds data of skipped
+// files, such pieces are kept in the parts file.
+func (t *Task) isBoundaryPiece(index int) bool {
+	for _, f := range t.pieceFiles(index) {
+		if t.FilePriority(f) == FILE_PRIORITY_SKIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finishContent completes the wanted files of a download whose pieces were
+// written as they were verified.
+func (t *Task) finishContent() error {
+	skip := func(i int) bool { return t.FilePriority(i) == FILE_PRIORITY_SKIP }
+	if err := t.Torrent.Info.finishFiles(t.Path, skip); err != nil {
+		dlog.Errorf("failed to write %s: %v", t.Name, err)
+		return err
+	}
+
+	return nil
+}
+
+// sortByPriority orders the jobs so that pieces of more important files are
+// picked first, pieces of the same priority stay in order.
+func (t *Task) sortByPriority(jobs []*pJob) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return t.PiecePriority(jobs[i].index) > t.PiecePriority(jobs[j].index)
+	})
+}
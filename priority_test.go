@@ -0,0 +1,147 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+func TestSelectFiles(t *testing.T) {
+	tf, _ := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"video", "a.mkv"}, randomData(20000)},
+		{[]string{"video", "b.mkv"}, randomData(40000)},
+		{[]string{"readme.txt"}, randomData(100)},
+	})
+
+	task := &dgotorrent.Task{Torrent: *tf}
+	n, err := task.SelectFiles([]string{"*.mkv", "2"}, []string{"video/b.mkv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dgotorrent.FilePriority{dgotorrent.FILE_PRIORITY_NORMAL, dgotorrent.FILE_PRIORITY_SKIP, dgotorrent.FILE_PRIORITY_NORMAL}
+	if n != 2 {
+		t.Errorf("expected 2 selected files, got %d", n)
+	}
+
+	for i, e := range expected {
+		if got := task.FilePriority(i); got != e {
+			t.Errorf("file %d: expected %v, got %v", i, e, got)
+		}
+	}
+
+	// piece 1 holds the end of a.mkv and the start of b.mkv
+	task.SetFilePriority(0, dgotorrent.FILE_PRIORITY_HIGH)
+	if got := task.PiecePriority(1); got != dgotorrent.FILE_PRIORITY_HIGH {
+		t.Errorf("expected the boundary piece to be high, got %v", got)
+	}
+
+	if got := task.PiecePriority(2); got != dgotorrent.FILE_PRIORITY_SKIP {
+		t.Errorf("expected a piece of b.mkv only to be skipped, got %v", got)
+	}
+
+	if _, err := task.SelectFiles([]string{"*.iso"}, nil); err != dgotorrent.ErrNoFilesSelected {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrNoFilesSelected, err)
+	}
+
+	if err := task.SetFilePriority(3, dgotorrent.FILE_PRIORITY_LOW); err != dgotorrent.ErrInvalidFileIndex {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrInvalidFileIndex, err)
+	}
+
+	if p, err := dgotorrent.ParseFilePriority("High"); err != nil || p != dgotorrent.FILE_PRIORITY_HIGH {
+		t.Errorf("unexpected parsed priority %v: %v", p, err)
+	}
+}
+
+func TestSelectedDownload(t *testing.T) {
+	second := randomData(30000)
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"first.bin"}, randomData(20000)},
+		{[]string{"second.bin"}, second},
+		{[]string{"third.bin"}, randomData(40000)},
+	})
+
+	task := &dgotorrent.Task{
+		Name:    tf.Info.Name,
+		Path:    t.TempDir(),
+		PeerID:  "-TEST00-000000000001",
+		Torrent: *tf,
+	}
+
+	if _, err := task.SelectFiles([]string{"second.bin"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dgotorrent.NewProcess(task).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(task.Path, tf.Info.DiskName)
+	got, err := os.ReadFile(filepath.Join(root, "second.bin"))
+	if err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("second.bin was not downloaded: %v", err)
+	}
+
+	for _, name := range []string{"first.bin", "third.bin"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("skipped file %s must not be created", name)
+		}
+	}
+
+	// the pieces shared with first.bin and third.bin are in the parts file
+	partsPath, _ := tf.Info.PartsPath(task.Path)
+	parts, err := os.ReadFile(partsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, index := range []int{1, 3} {
+		begin, end := tf.Info.PieceBounds(index)
+		if !bytes.Equal(parts[begin:end], content[begin:end]) {
+			t.Errorf("piece %d is missing in the parts file", index)
+		}
+	}
+}
+
+func TestSavePriorities(t *testing.T) {
+	store := newTaskStore(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: createContent(t)})
+
+	task := &dgotorrent.Task{Name: tf.Info.Name, Path: t.TempDir(), Torrent: *tf}
+	if err := store.Insert(task); err != nil {
+		t.Fatal(err)
+	}
+
+	priorities := []dgotorrent.FilePriority{dgotorrent.FILE_PRIORITY_HIGH, dgotorrent.FILE_PRIORITY_SKIP, dgotorrent.FILE_PRIORITY_LOW}
+	if err := store.UpdatePriorities(task.ID, priorities); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Get(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.FilePriorities) != len(priorities) {
+		t.Fatalf("unexpected priorities %v", loaded.FilePriorities)
+	}
+
+	for i, p := range priorities {
+		if loaded.FilePriority(i) != p {
+			t.Errorf("expected priority %s of file %d, got %s", p, i, loaded.FilePriority(i))
+		}
+	}
+
+	// saving replaces the previous priorities
+	if err := store.UpdatePriorities(task.ID, priorities[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded, err = store.Get(task.ID); err != nil || len(loaded.FilePriorities) != 1 {
+		t.Errorf("unexpected priorities %v %v", loaded.FilePriorities, err)
+	}
+}
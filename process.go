@@ -2,15 +2,14 @@ package dgotorrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"io"
-	"os"
-	"path"
+	"encoding/binary"
 	"sync"
 	"time"
 
 	"github.com/Dizzrt/dgo-torrent/dlog"
-	"github.com/schollz/progressbar/v3"
+	"github.com/Dizzrt/dgo-torrent/utp"
 )
 
 const (
@@ -18,9 +17,19 @@ const (
 	MAXBACKLOG = 5
 )
 
+// time a peer has to unchoke us or grant allowed fast pieces
+const UNCHOKE_TIMEOUT = 30 * time.Second
+
+// time a peer has to send the requested blocks, it starts over once the
+// rate limits let another request through
+const PIECE_TIMEOUT = 15 * time.Second
+
+// time the trackers have to answer the announce of a finished or stopped
+// download
+const EVENT_ANNOUNCE_TIMEOUT = 5 * time.Second
+
 type pJob struct {
 	index  int
-	hash   [20]byte
 	length int
 }
 
@@ -29,165 +38,605 @@ type pJobState struct {
 	conn       *PeerConn
 	requested  int
 	downloaded int
-	backlog    int
 	data       []byte
+	// pending maps the offset of every requested block to its length,
+	// rejected blocks are moved to retry and requested again.
+	pending map[int]int
+	retry   []int
 }
 
 type pJobResult struct {
-	index int
-	data  []byte
+	index  int
+	data   []byte
+	source string
 }
 
 type Process struct {
-	Task  *Task
-	Peers []Peer
+	Task       *Task
+	Peers      []Peer
+	Pool       *PeerPool
+	Sources    []PeerSource
+	Extensions *ExtensionRegistry
+	// UTP is the socket peers are dialed on before tcp is tried, uTP is not
+	// used when it is nil.
+	UTP *utp.Socket
+	// Encryption is the message stream encryption policy of the peer
+	// connections.
+	Encryption EncryptionMode
+	// Port is the port peers connect to, it is announced to the trackers.
+	Port int
+	// Events receives the events of the download, nothing is printed.
+	Events *EventBus
+	// Counter counts the bytes of the download, the counters of the
+	// connections count into it.
+	Counter *TransferCounter
+	// Limits are the rate limits of the download, the ones of every
+	// connection start at the peer limits. LimitOverhead counts the headers
+	// of the blocks toward the limits.
+	Limits        *Limits
+	LimitOverhead bool
+	peerLimits    RateLimits
+	pex           *PexExtension
+	have          Bitfield
+	conns         connSet
+	// base are the counts when the download started, announces report the
+	// bytes transferred since.
+	base TransferStats
+
+	mu          sync.Mutex
+	completed   int64
+	wanted      int64
+	pieces      int
+	totalPieces int
+	// run is set while Start runs, inbound connections join it
+	run *processRun
+}
+
+// processRun is what the peer routines of a running download share.
+type processRun struct {
+	ctx      context.Context
+	picker   *piecePicker
+	results  chan *pJobResult
+	routines *sync.WaitGroup
 }
 
 func NewProcess(task *Task) *Process {
 	p := &Process{
-		Task:  task,
-		Peers: make([]Peer, 0),
+		Task:       task,
+		Peers:      make([]Peer, 0),
+		Pool:       NewPeerPool(DEFAULT_MAX_PEERS),
+		Extensions: DefaultExtensions(),
+		Events:     NewEventBus(),
+		Counter:    NewTransferCounter(nil),
+		Limits:     NewLimits(nil, nil, RateLimits{}),
+	}
+
+	// peer exchange must not be used for private torrents (BEP 27)
+	if !task.Torrent.Info.Private {
+		p.pex = NewPexExtension(p.Pool)
+		p.Extensions.Register(p.pex)
 	}
 
 	return p
 }
 
-func (p *Process) Start() error {
-	jobs := make(chan *pJob, len(p.Task.Torrent.Info.PieceHashes))
-	results := make(chan *pJobResult)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
+// Start downloads the task until it is complete or the context is done.
+// Verified pieces are written to disk right away, a stopped download leaves
+// them in Have and they are resumed by a later Start through the resume
+// pieces of the task.
+// All routines of the download have returned when Start returns.
+func (p *Process) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	info := &p.Task.Torrent.Info
+	piece := make([]byte, info.PieceLength)
+	resume := p.Task.ResumePieces()
+	p.have = NewBitfield(info.NumPieces())
+
+	jobs := make([]*pJob, 0, info.NumPieces())
+	var wanted, resumed int64
+	for index := 0; index < info.NumPieces(); index++ {
+		// pieces of skipped files only are not downloaded
+		if p.Task.PiecePriority(index) == FILE_PRIORITY_SKIP {
+			continue
+		}
 
-	// search peers
-	go func() {
-		defer wg.Done()
+		begin, end := p.Task.GetPieceBounds(index)
+		job := &pJob{
+			index:  index,
+			length: end - begin,
+		}
+		wanted += int64(job.length)
 
-		peers, err := p.Task.Torrent.FindPeers()
-		if err != nil {
-			dlog.Errorf("search peer failed with error: %v", err)
+		if resume.Test(index) && p.Task.readPiece(index, piece[:job.length]) == nil &&
+			p.checkPiece(job, &pJobResult{index: index, data: piece[:job.length]}) {
+			p.have.Set(index)
+			resumed += int64(job.length)
+			continue
 		}
 
-		p.Peers = peers
+		jobs = append(jobs, job)
+	}
+
+	p.Task.sortByPriority(jobs)
+	total := len(jobs)
+
+	p.mu.Lock()
+	p.completed, p.wanted = resumed, wanted
+	p.pieces, p.totalPieces = p.have.Count(), p.have.Count()+total
+	p.mu.Unlock()
+
+	p.base = p.Counter.Stats()
+	p.publishStats()
+	defer p.publishStats()
+
+	picker := newPiecePicker(jobs)
+	results := make(chan *pJobResult)
+
+	// every routine of the download is waited for on return
+	var routines sync.WaitGroup
+	defer func() {
+		cancel()
+		picker.close()
+
+		p.mu.Lock()
+		p.run = nil
+		p.mu.Unlock()
+		routines.Wait()
 	}()
 
-	// init jobs
-	go func() {
-		wg.Done()
+	p.mu.Lock()
+	p.run = &processRun{ctx: ctx, picker: picker, results: results, routines: &routines}
+	p.mu.Unlock()
 
-		for index, hash := range p.Task.Torrent.Info.PieceHashes {
-			begin, end := p.Task.GetPieceBounds(index)
-			jobs <- &pJob{
-				index:  index,
-				hash:   hash,
-				length: end - begin,
+	// search peers
+	peers, err := p.Task.Torrent.findPeers(ctx, p.announceParams(ANNOUNCE_EVENT_STARTED), p.Sources)
+	if err != nil {
+		dlog.Errorf("search peer failed with error: %v", err)
+	}
+
+	// connect in the canonical order so that both ends agree (BEP 40)
+	SortPeersByPriority(peers, ExternalIP())
+	p.Pool.Add(peers, PEER_SOURCE_TRACKER)
+	p.Peers = p.Pool.Peers()
+
+	// every peer of the pool gets a routine, including the ones that are
+	// learned later on through peer exchange
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case peer := <-p.Pool.Added():
+				routines.Add(1)
+				go func() {
+					defer routines.Done()
+					p.peerRoutine(ctx, peer, picker, results)
+				}()
 			}
 		}
 	}()
 
-	wg.Wait()
+	if p.pex != nil {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			p.pex.Run(ctx)
+		}()
+	}
+
+	for _, u := range p.Task.Torrent.URLList {
+		seed, err := NewWebSeed(u, info)
+		if err != nil {
+			dlog.Infof("ignoring web seed %s: %v", u, err)
+			continue
+		}
 
-	for _, peer := range p.Peers {
-		go p.peerRoutine(peer, jobs, results)
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			p.webSeedRoutine(ctx, seed, picker, results)
+		}()
 	}
 
-	bar := progressbar.DefaultBytes(p.Task.Torrent.Info.Length, "downloading")
+	ticker := time.NewTicker(STATS_INTERVAL)
+	defer ticker.Stop()
 
-	// copy data
+	// verified pieces are written as they arrive, the content is never held
+	// in memory as a whole
 	count := 0
-	buf := make([]byte, p.Task.Torrent.Info.Length)
-	for count < len(p.Task.Torrent.Info.PieceHashes) {
-		res := <-results
-		begin, end := p.Task.GetPieceBounds(res.index)
-		copy(buf[begin:end], res.data)
+	for count < total {
+		var res *pJobResult
+		select {
+		case res = <-results:
+		case now := <-ticker.C:
+			p.Counter.Tick(now)
+			p.conns.tick(now)
+			p.publishStats()
+			continue
+		case <-ctx.Done():
+			return p.stop(ctx.Err())
+		}
+
+		if err := p.Task.writePiece(res.index, res.data); err != nil {
+			dlog.Errorf("failed to write piece %d of %s: %v", res.index, p.Task.Name, err)
+			return err
+		}
+		p.have.Set(res.index)
 		count++
 
-		io.Copy(bar, bytes.NewReader(res.data))
-		// io.Copy(io.MultiWriter(bar), bytes.NewReader(res.data))
-		// percent := float64(count) / float64(len(p.Task.Torrent.Info.PieceHashes)) * 100
-		// fmt.Printf("downloading progress: %0.2f%%\n", percent)
+		p.mu.Lock()
+		p.completed += int64(len(res.data))
+		p.pieces++
+		p.mu.Unlock()
+
+		p.Events.Publish(PieceVerifiedEvent{
+			EventHeader: newEventHeader(p.Task),
+			Index:       res.index,
+			Length:      len(res.data),
+			Source:      res.source,
+		})
 	}
 
-	close(jobs)
-	close(results)
-
-	file, err := os.Create(path.Join(p.Task.Path, p.Task.Name))
-	if err != nil {
-		dlog.Errorf("failed to create file: %v", p.Task.Name)
+	if err := p.Task.finishContent(); err != nil {
 		return err
 	}
 
-	_, err = file.Write(buf)
-	if err != nil {
-		dlog.Error("failed to write data")
-		return err
+	p.announce(ANNOUNCE_EVENT_COMPLETED)
+	return nil
+}
+
+// Stats returns the numbers of the download, they stay once Start returned.
+func (p *Process) Stats() TaskStats {
+	stats := newTaskStats(p.Counter.Stats(), p.conns.stats())
+
+	p.mu.Lock()
+	stats.Completed, stats.Wanted = p.completed, p.wanted
+	stats.Pieces, stats.TotalPieces = p.pieces, p.totalPieces
+	p.mu.Unlock()
+
+	stats.finish()
+	return stats
+}
+
+// SetPeerLimits changes the limits of every connection of the download.
+func (p *Process) SetPeerLimits(rates RateLimits) {
+	p.mu.Lock()
+	p.peerLimits = rates
+	p.mu.Unlock()
+
+	p.conns.setLimits(rates)
+}
+
+func (p *Process) PeerLimits() RateLimits {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.peerLimits
+}
+
+// PeerStats returns the numbers of the connected peers.
+func (p *Process) PeerStats() []PeerStats {
+	return p.conns.stats()
+}
+
+func (p *Process) publishStats() {
+	p.Events.Publish(StatsEvent{EventHeader: newEventHeader(p.Task), TaskStats: p.Stats()})
+}
+
+// stop tells the trackers that we are gone, the pieces downloaded so far are
+// on disk already.
+func (p *Process) stop(cause error) error {
+	p.announce(ANNOUNCE_EVENT_STOPPED)
+	return cause
+}
+
+// announce sends an event to the trackers, the download context may be done
+// already so it gets a context of its own.
+func (p *Process) announce(event AnnounceEvent) {
+	if len(p.Task.Torrent.Trackers()) == 0 {
+		return
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), EVENT_ANNOUNCE_TIMEOUT)
+	defer cancel()
+
+	p.Task.Torrent.SendAnnounce(ctx, p.announceParams(event))
+}
+
+// announceParams reports the wanted bytes that are missing as left, the
+// result of every tracker is published.
+func (p *Process) announceParams(event AnnounceEvent) AnnounceParams {
+	var left int64
+	for index := 0; index < p.Task.Torrent.Info.NumPieces(); index++ {
+		if !p.have.Test(index) && p.Task.PiecePriority(index) != FILE_PRIORITY_SKIP {
+			begin, end := p.Task.GetPieceBounds(index)
+			left += int64(end - begin)
+		}
+	}
+
+	transfer := p.Counter.Stats()
+	return AnnounceParams{
+		Event:      event,
+		Uploaded:   transfer.Uploaded - p.base.Uploaded,
+		Downloaded: transfer.Downloaded - p.base.Downloaded,
+		Left:       left,
+		Port:       p.Port,
+		PeerID:     p.Task.PeerID,
+		Result:     announceResult(p.Events, p.Task, event),
+	}
+}
+
+// announceResult returns the Result of the announces of a task, it publishes
+// the outcome of every tracker.
+func announceResult(events *EventBus, task *Task, event AnnounceEvent) func(string, *TrackerResp, error) {
+	return func(tracker string, resp *TrackerResp, err error) {
+		e := AnnounceResultEvent{
+			EventHeader: newEventHeader(task),
+			Tracker:     tracker,
+			Event:       event,
+			Err:         err,
+		}
+
+		if resp != nil {
+			e.Peers = len(resp.Peers)/PEER_LEN + len(resp.Peers6)/PEER6_LEN
+			e.Interval = time.Duration(resp.Interval) * time.Second
+		}
+
+		events.Publish(e)
+	}
 }
 
-func (p *Process) peerRoutine(peer Peer, jobs chan *pJob, results chan *pJobResult) {
-	conn, err := NewConn(peer, p.Task.Torrent.Info.Hash, p.Task.PeerID)
+// Have returns the verified pieces of the task, after Start returned they
+// are all stored on disk.
+func (p *Process) Have() Bitfield {
+	return p.have
+}
+
+// connConfig is the config of the connections of the download.
+func (p *Process) connConfig() *ConnConfig {
+	return &ConnConfig{
+		Extensions:    p.Extensions,
+		ListenPort:    p.Port,
+		NumPieces:     p.Task.Torrent.Info.NumPieces(),
+		UTP:           p.UTP,
+		Encryption:    p.Encryption,
+		Counter:       p.Counter,
+		Limits:        p.Limits,
+		PeerLimits:    p.PeerLimits(),
+		LimitOverhead: p.LimitOverhead,
+	}
+}
+
+// AddConn downloads from an inbound connection of the torrent, it returns
+// once the connection is done. It returns false and leaves the connection
+// open when the download is not running.
+func (p *Process) AddConn(conn *PeerConn) bool {
+	p.mu.Lock()
+	run := p.run
+	if run != nil {
+		run.routines.Add(1)
+	}
+	p.mu.Unlock()
+
+	if run == nil {
+		return false
+	}
+	defer run.routines.Done()
+
+	if p.pex != nil {
+		p.pex.Connected(conn.Peer())
+		defer p.pex.Disconnected(conn.Peer())
+	}
+
+	p.connRoutine(run.ctx, conn, run.picker, run.results)
+	return true
+}
+
+func (p *Process) peerRoutine(ctx context.Context, peer Peer, picker *piecePicker, results chan *pJobResult) {
+	conn, err := NewConnContext(ctx, peer, p.Task.Torrent.Info.Hash, p.Task.PeerID, p.connConfig())
 	if err != nil {
 		dlog.Infof("fail to connect peer: %s:%d", peer.IP.String(), peer.Port)
 		return
 	}
+
+	if p.pex != nil {
+		p.pex.Connected(peer)
+		defer p.pex.Disconnected(peer)
+	}
+
+	p.connRoutine(ctx, conn, picker, results)
+}
+
+// connRoutine downloads the pieces the peer has until the download is done,
+// the connection is closed on return.
+func (p *Process) connRoutine(ctx context.Context, conn *PeerConn, picker *piecePicker, results chan *pJobResult) {
 	defer conn.Close()
+	peer := conn.Peer()
+
+	// blocked reads and writes fail once the connection is closed
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var err error
+	p.conns.add(conn)
+	p.Events.Publish(PeerConnectedEvent{EventHeader: newEventHeader(p.Task), Peer: peer})
+	defer func() {
+		p.conns.remove(conn)
+
+		// closing the connection on stop is not an error of the peer
+		if ctx.Err() != nil {
+			err = nil
+		}
+		p.Events.Publish(PeerDisconnectedEvent{EventHeader: newEventHeader(p.Task), Peer: peer, Err: err})
+	}()
 
 	conn.WriteMsg(&PeerMsg{
 		Type:    PEER_MSG_TYPE_INTERESTED,
 		Payload: nil,
 	})
 
-	for job := range jobs {
-		if !conn.PiecesMap.Test(job.index) {
-			jobs <- job
+	// a piece is only taken from the picker once the peer lets us download
+	if err = waitUnchoke(conn); err != nil {
+		dlog.Infof("peer %s did not unchoke: %v", peer.String(), err)
+		return
+	}
+
+	for {
+		job, ok := picker.pick(conn)
+		if !ok {
+			return
+		}
+
+		// the messages of the peer are handled until it has one of the
+		// pending pieces, it announces them with HAVE
+		if job == nil {
+			var msg *PeerMsg
+			if msg, err = conn.ReadMsg(); err != nil {
+				return
+			}
+
+			if err = conn.handleMsg(msg); err != nil {
+				return
+			}
 			continue
 		}
 
-		res, err := downloadPiece(conn, job)
+		var res *pJobResult
+		res, err = downloadPiece(ctx, conn, job)
 		if err != nil {
-			jobs <- job
-			dlog.Error("failed to download piece with error: %v", err)
+			picker.put(job)
+			dlog.Errorf("failed to download piece with error: %v", err)
 			return
 		}
 
-		if !checkPiece(job, res) {
-			jobs <- job
+		res.source = peer.String()
+		if !p.checkPiece(job, res) {
+			picker.put(job)
+			conn.Counter.AddWasted(int64(len(res.data)))
+			p.Events.Publish(PieceFailedEvent{EventHeader: newEventHeader(p.Task), Index: job.index, Source: res.source})
 			continue
 		}
 
-		results <- res
+		select {
+		case results <- res:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// webSeedRoutine downloads pieces from a web seed until the download is
+// complete or the seed failed too often.
+func (p *Process) webSeedRoutine(ctx context.Context, seed *WebSeed, picker *piecePicker, results chan *pJobResult) {
+	defer seed.Client.CloseIdleConnections()
+
+	failures := 0
+	for {
+		job, ok := picker.next()
+		if !ok {
+			return
+		}
+
+		if err := p.Limits.Download().Wait(ctx, job.length); err != nil {
+			picker.put(job)
+			return
+		}
+
+		data, err := seed.FetchPiece(ctx, job.index)
+		res := &pJobResult{index: job.index, data: data, source: seed.URL}
+		if err == nil {
+			p.Counter.AddDownloaded(int64(len(data)), 0)
+			if p.checkPiece(job, res) {
+				failures = 0
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			p.Counter.AddWasted(int64(len(data)))
+			p.Events.Publish(PieceFailedEvent{EventHeader: newEventHeader(p.Task), Index: job.index, Source: seed.URL})
+		}
+
+		picker.put(job)
+		failures++
+		if failures >= WEBSEED_MAX_FAILURES {
+			dlog.Infof("giving up web seed %s: %v", seed.URL, err)
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(failures) * WEBSEED_RETRY_DELAY):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func waitUnchoke(conn *PeerConn) error {
+	conn.SetDeadline(time.Now().Add(UNCHOKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	for conn.Choked && len(conn.AllowedFast) == 0 {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			return err
+		}
+
+		if err = conn.handleMsg(msg); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func downloadPiece(conn *PeerConn, job *pJob) (*pJobResult, error) {
+func downloadPiece(ctx context.Context, conn *PeerConn, job *pJob) (*pJobResult, error) {
 	state := pJobState{
 		index:   job.index,
 		conn:    conn,
 		data:    make([]byte, job.length),
-		backlog: 0,
+		pending: make(map[int]int),
 	}
 
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	conn.SetDeadline(time.Now().Add(PIECE_TIMEOUT))
 	defer conn.SetDeadline(time.Time{})
 
 	for state.downloaded < job.length {
-		if !conn.Choked {
-			for state.backlog < MAXBACKLOG && state.requested < job.length {
+		// allowed fast pieces may be requested while choked
+		if !conn.Choked || conn.AllowedFast[job.index] {
+			for len(state.pending) < MAXBACKLOG {
+				offset, ok := state.nextBlock(job.length)
+				if !ok {
+					break
+				}
+
 				length := BLOCKSIZE
-				if job.length-state.requested < length {
-					length = job.length - state.requested
+				if job.length-offset < length {
+					length = job.length - offset
+				}
+
+				// blocks are only requested once the limits allow them, the
+				// wait does not count into the timeout
+				if err := conn.waitBlock(ctx, conn.Limits.Download(), length); err != nil {
+					return nil, err
 				}
+				conn.SetDeadline(time.Now().Add(PIECE_TIMEOUT))
 
-				msg := NewRequestMsg(state.index, state.requested, length)
+				msg := NewRequestMsg(state.index, offset, length)
 				_, err := state.conn.WriteMsg(msg)
 				if err != nil {
 					return nil, err
 				}
 
-				state.backlog++
-				state.requested += length
+				state.pending[offset] = length
 			}
 		}
 
@@ -203,10 +652,28 @@ func downloadPiece(conn *PeerConn, job *pJob) (*pJobResult, error) {
 	}, nil
 }
 
+// nextBlock returns the offset of the next block to request, rejected blocks
+// come first.
+func (s *pJobState) nextBlock(length int) (int, bool) {
+	if len(s.retry) > 0 {
+		offset := s.retry[0]
+		s.retry = s.retry[1:]
+		return offset, true
+	}
+
+	if s.requested >= length {
+		return 0, false
+	}
+
+	offset := s.requested
+	s.requested += BLOCKSIZE
+	return offset, true
+}
+
 func (s *pJobState) handleMsg() error {
 	msg, err := s.conn.ReadMsg()
 	if err != nil {
-		return nil
+		return err
 	}
 
 	if msg == nil {
@@ -215,35 +682,64 @@ func (s *pJobState) handleMsg() error {
 
 	switch msg.Type {
 	case PEER_MSG_TYPE_CHOKE:
-		s.conn.Choked = true
-	case PEER_MSG_TYPE_UNCHOKE:
-		s.conn.Choked = false
-	case PEER_MSG_TYPE_HAVE:
-		index, err := GetHaveIndex(msg)
+		// without the fast extension a choke drops all requests, with it
+		// every dropped request is rejected explicitly
+		if !s.conn.SupportsFast() {
+			for offset := range s.pending {
+				s.retry = append(s.retry, offset)
+			}
+			s.pending = make(map[int]int)
+		}
+
+		return s.conn.handleMsg(msg)
+	case PEER_MSG_TYPE_REJECT:
+		r, err := parseBlockRequest(msg)
 		if err != nil {
 			return err
 		}
 
-		s.conn.PiecesMap.Set(index)
+		if _, ok := s.pending[r.Begin]; ok && r.Index == s.index {
+			delete(s.pending, r.Begin)
+			s.retry = append(s.retry, r.Begin)
+		}
 	case PEER_MSG_TYPE_PIECE:
 		n, err := CopyPieceData(s.index, s.data, msg)
 		if err != nil {
 			return err
 		}
 
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		if _, ok := s.pending[begin]; !ok {
+			// a block we no longer wait for, e.g. requested before a choke
+			return nil
+		}
+
+		delete(s.pending, begin)
 		s.downloaded += n
-		s.backlog--
+	default:
+		return s.conn.handleMsg(msg)
 	}
 
 	return nil
 }
 
-func checkPiece(job *pJob, res *pJobResult) bool {
-	hash := sha1.Sum(res.data)
-	if !bytes.Equal(job.hash[:], hash[:]) {
+// checkPiece verifies a piece against its SHA-1 hash and the merkle trees of
+// its files, hybrid torrents must match both.
+func (p *Process) checkPiece(job *pJob, res *pJobResult) bool {
+	tf := &p.Task.Torrent
+	ok := true
+	if tf.Info.HasV1() {
+		hash := sha1.Sum(res.data)
+		ok = bytes.Equal(tf.Info.PieceHashes[job.index][:], hash[:])
+	}
+
+	if ok && tf.Info.HasV2() {
+		ok = tf.verifyPieceV2(job.index, res.data)
+	}
+
+	if !ok {
 		dlog.Infof("check integrity failed, index: %v", res.index)
-		return false
 	}
 
-	return true
+	return ok
 }
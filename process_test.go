@@ -0,0 +1,358 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+// checkGoroutines fails the test when goroutines started after the call are
+// still running once the test and its other cleanups are done.
+func checkGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				n := runtime.Stack(buf, true)
+				t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:n])
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// eventTracker is a http tracker without peers that records the queries of
+// the announces.
+type eventTracker struct {
+	mu        sync.Mutex
+	announces []url.Values
+}
+
+func newEventTracker(t *testing.T, tf *dgotorrent.TorrentFile) *eventTracker {
+	tr := &eventTracker{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		tr.announces = append(tr.announces, r.URL.Query())
+		tr.mu.Unlock()
+
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	t.Cleanup(server.Close)
+
+	tf.Announce = server.URL + "/announce"
+	return tr
+}
+
+func (tr *eventTracker) Events() string {
+	events := make([]string, 0)
+	for _, q := range tr.Announces() {
+		events = append(events, q.Get("event"))
+	}
+
+	return strings.Join(events, ",")
+}
+
+func (tr *eventTracker) Announces() []url.Values {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return slices.Clone(tr.announces)
+}
+
+// stallingAfter serves the content of the torrent as web seed until a file is
+// requested at or after the offset, that request never finishes. stalled is
+// closed when it arrives, requests counts all requests.
+func stallingAfter(t *testing.T, tf *dgotorrent.TorrentFile, content []byte, file string, offset int64) (stalled chan struct{}, requests *atomic.Int32) {
+	root := t.TempDir()
+	if err := tf.Info.WriteContent(root, content); err != nil {
+		t.Fatal(err)
+	}
+
+	stalled = make(chan struct{})
+	requests = &atomic.Int32{}
+	var once sync.Once
+	files := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		var begin, end int64
+		if strings.HasSuffix(r.URL.Path, "/"+file) && offset >= 0 {
+			if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &begin, &end); n == 2 && begin >= offset {
+				once.Do(func() { close(stalled) })
+				<-r.Context().Done()
+				return
+			}
+		}
+
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	tf.URLList = []string{server.URL + "/"}
+	return stalled, requests
+}
+
+func TestProcessStopAndResume(t *testing.T) {
+	checkGoroutines(t)
+
+	// piece 3 lies within b.bin from offset 19152 on
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(30000)},
+		{[]string{"b.bin"}, randomData(35536)},
+	})
+	tracker := newEventTracker(t, tf)
+	stalled, _ := stallingAfter(t, tf, content, "b.bin", 19152)
+
+	task := &dgotorrent.Task{
+		Name:    tf.Info.Name,
+		Path:    t.TempDir(),
+		PeerID:  "-TEST00-000000000001",
+		Torrent: *tf,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	process := dgotorrent.NewProcess(task)
+	errs := make(chan error, 1)
+	go func() { errs <- process.Start(ctx) }()
+
+	select {
+	case <-stalled:
+	case err := <-errs:
+		t.Fatalf("the download ended early: %v", err)
+	}
+	cancel()
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the download to be canceled, got %v", err)
+	}
+
+	if n := process.Have().Count(); n != 3 {
+		t.Fatalf("expected 3 pieces, got %d", n)
+	}
+
+	// the pieces are flushed to their files
+	got, err := os.ReadFile(filepath.Join(task.Path, tf.Info.DiskName, "a.bin"))
+	if err != nil || !bytes.Equal(got, content[:30000]) {
+		t.Fatalf("a.bin was not flushed: %v", err)
+	}
+
+	// the next start only downloads the missing piece
+	task.SetResumePieces(process.Have())
+	_, requests := stallingAfter(t, &task.Torrent, content, "", -1)
+	if err := dgotorrent.NewProcess(task).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single request for the last piece, got %d", n)
+	}
+
+	res, err := tf.Verify(task.Path)
+	if err != nil || !res.OK() {
+		t.Fatalf("unexpected verify result %+v: %v", res, err)
+	}
+
+	if events := tracker.Events(); events != "started,stopped,started,completed" {
+		t.Errorf("unexpected announce events %s", events)
+	}
+}
+
+func TestSessionCloseKeepsResumeData(t *testing.T) {
+	checkGoroutines(t)
+
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(30000)},
+		{[]string{"b.bin"}, randomData(35536)},
+	})
+	tracker := newEventTracker(t, tf)
+	stalled, _ := stallingAfter(t, tf, content, "b.bin", 19152)
+
+	cfg := dgotorrent.SessionConfig{DownloadPath: t.TempDir(), DB: sessionDB(t)}
+	s, err := dgotorrent.NewSession(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := s.Add(tf, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-stalled
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := tracker.Events(); events != "started,stopped" {
+		t.Errorf("unexpected announce events %s", events)
+	}
+
+	// the pieces are resumed by the next session, the stalled piece stays
+	// missing
+	s = newSession(t, cfg)
+	restored, err := s.Task(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := restored.ResumePieces().Count(); n != 3 {
+		t.Errorf("expected 3 resume pieces, got %d", n)
+	}
+}
+
+// lateSeeder acts as a peer that has no pieces when the download connects,
+// it unchokes, announces every piece with HAVE after a while and serves them.
+func lateSeeder(t *testing.T, l net.Listener, data []byte, pieceLength int) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = answerHandshake(conn, [8]byte{}); err != nil {
+		return
+	}
+	writePeerMsg(conn, 1, nil)
+
+	// the download has to keep reading while it waits for the pieces
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i*pieceLength < len(data); i++ {
+		writePeerMsg(conn, 4, indexMsg(i))
+	}
+
+	serveBlocks(conn, data, pieceLength)
+}
+
+// peerTorrent returns a single file torrent of the data.
+func peerTorrent(t *testing.T, name string, data []byte, pieceLength int) *dgotorrent.TorrentFile {
+	raw, err := bencode.Marshal(map[string]any{
+		"info": map[string]any{
+			"name":         name,
+			"length":       int64(len(data)),
+			"piece length": int64(pieceLength),
+			"pieces":       pieceHashes(data, pieceLength),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := dgotorrent.NewTorrentFile(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tf
+}
+
+// peerProcess returns a download of the torrent to a temporary directory,
+// its only peer is the one serve runs on a local listener.
+func peerProcess(t *testing.T, tf *dgotorrent.TorrentFile, serve func(l net.Listener)) (*dgotorrent.Process, *dgotorrent.Task) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+
+	task := &dgotorrent.Task{
+		Name:    tf.Info.Name,
+		Path:    t.TempDir(),
+		PeerID:  "-TEST00-000000000001",
+		Torrent: *tf,
+	}
+
+	addr := l.Addr().(*net.TCPAddr)
+	process := dgotorrent.NewProcess(task)
+	process.Pool.Add([]dgotorrent.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, dgotorrent.PEER_SOURCE_TRACKER)
+
+	return process, task
+}
+
+func TestProcessPeerHaveLater(t *testing.T) {
+	const pieceLength = dgotorrent.BLOCKSIZE
+
+	data := randomData(3 * pieceLength)
+	tf := peerTorrent(t, "later.bin", data, pieceLength)
+	process, task := peerProcess(t, tf, func(l net.Listener) { lateSeeder(t, l, data, pieceLength) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := process.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(task.Path, task.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+}
+
+func TestProcessHybridChecksBothTrees(t *testing.T) {
+	const pieceLength = dgotorrent.BLOCKSIZE
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "hybrid.bin"), randomData(3*pieceLength), 0644)
+	raw, err := dgotorrent.CreateTorrent(dgotorrent.CreateOptions{
+		Path:        filepath.Join(dir, "hybrid.bin"),
+		Version:     dgotorrent.CREATE_HYBRID,
+		PieceLength: pieceLength,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the v1 hashes describe other data than the merkle trees
+	data := randomData(3 * pieceLength)
+	res, _ := bencode.Unmarshal(bytes.NewReader(raw))
+	meta := res.(map[string]any)
+	meta["info"].(map[string]any)["pieces"] = pieceHashes(data, pieceLength)
+	tampered, _ := bencode.Marshal(meta)
+
+	tf, err := dgotorrent.NewTorrentFile(strings.NewReader(tampered))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process, _ := peerProcess(t, tf, func(l net.Listener) { lateSeeder(t, l, data, pieceLength) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := process.Start(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the download to time out, got %v", err)
+	}
+
+	if n := process.Have().Count(); n != 0 {
+		t.Errorf("expected no piece to pass both checks, got %d", n)
+	}
+}
@@ -0,0 +1,214 @@
+package dgotorrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// header of a piece message, counted with its block when the limits include
+// the protocol overhead
+const BLOCK_MSG_OVERHEAD = 13
+
+// Clock is the time source of the rate limits, tests replace it with one
+// they control.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the real time.
+var SystemClock Clock = systemClock{}
+
+// RateLimits are rates in bytes per second, 0 is unlimited.
+type RateLimits struct {
+	Download int64
+	Upload   int64
+}
+
+// RateLimiter is a token bucket that holds up to a second of its rate, but at
+// least a block. Waits also wait for the limiters of the levels above, a
+// peer waits for its task and the task for its session. The methods of a nil
+// limiter do not limit.
+type RateLimiter struct {
+	parent *RateLimiter
+	clock  Clock
+
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+	// changed is closed when the rate changes, waiters take the new rate
+	changed chan struct{}
+}
+
+func NewRateLimiter(parent *RateLimiter, clock Clock, rate int64) *RateLimiter {
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	l := &RateLimiter{
+		parent:  parent,
+		clock:   clock,
+		rate:    rate,
+		last:    clock.Now(),
+		changed: make(chan struct{}),
+	}
+	l.tokens = l.burst()
+
+	return l
+}
+
+func (l *RateLimiter) burst() float64 {
+	return float64(max(l.rate, BLOCKSIZE))
+}
+
+// refill adds the tokens earned since the last call, the caller holds the
+// lock.
+func (l *RateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens = min(l.tokens+elapsed*float64(l.rate), l.burst())
+	}
+	l.last = now
+}
+
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// SetRate changes the rate, waiting transfers continue at the new one.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate == l.rate {
+		return
+	}
+
+	l.refill(l.clock.Now())
+	// a limiter that was unlimited starts with a full bucket
+	wasUnlimited := l.rate <= 0
+	l.rate = rate
+	l.tokens = min(l.tokens, l.burst())
+	if wasUnlimited {
+		l.tokens = l.burst()
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Wait takes n tokens, it returns once this limiter and the ones above had
+// enough of them or the context is done. Transfers larger than the bucket
+// wait for a full bucket and leave a debt that the next ones wait for.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	for ; l != nil; l = l.parent {
+		if err := l.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		l.refill(l.clock.Now())
+		need := min(float64(n), l.burst())
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((need - l.tokens) / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-l.clock.After(delay):
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Limits are the download and upload limiters of one level, a session, a
+// task or a peer.
+type Limits struct {
+	download *RateLimiter
+	upload   *RateLimiter
+}
+
+// NewLimits creates the limits of a level below parent, the top level has no
+// parent and sets the clock of all levels.
+func NewLimits(parent *Limits, clock Clock, rates RateLimits) *Limits {
+	var down, up *RateLimiter
+	if parent != nil {
+		down, up, clock = parent.download, parent.upload, parent.download.clock
+	}
+
+	return &Limits{
+		download: NewRateLimiter(down, clock, rates.Download),
+		upload:   NewRateLimiter(up, clock, rates.Upload),
+	}
+}
+
+func (l *Limits) Download() *RateLimiter {
+	if l == nil {
+		return nil
+	}
+
+	return l.download
+}
+
+func (l *Limits) Upload() *RateLimiter {
+	if l == nil {
+		return nil
+	}
+
+	return l.upload
+}
+
+func (l *Limits) Rates() RateLimits {
+	return RateLimits{Download: l.Download().Rate(), Upload: l.Upload().Rate()}
+}
+
+func (l *Limits) Set(rates RateLimits) {
+	l.download.SetRate(rates.Download)
+	l.upload.SetRate(rates.Upload)
+}
+
+// waitBlock waits until the limiter lets a block of n bytes through, with the
+// header of its message if the connection counts the overhead.
+func (c *PeerConn) waitBlock(ctx context.Context, l *RateLimiter, n int) error {
+	if c.cfg.LimitOverhead {
+		n += BLOCK_MSG_OVERHEAD
+	}
+
+	return l.Wait(ctx, n)
+}
@@ -0,0 +1,251 @@
+package dgotorrent_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+// fakeClock only moves on Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of pending timers.
+func (c *fakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+// waitTimers waits until there are n pending timers of the clock.
+func waitTimers(t *testing.T, clock *fakeClock, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d timers, got %d", n, clock.Timers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func startWait(l *dgotorrent.RateLimiter, ctx context.Context, n int) chan error {
+	done := make(chan error, 1)
+	go func() { done <- l.Wait(ctx, n) }()
+
+	return done
+}
+
+func expectBlocked(t *testing.T, done chan error) {
+	select {
+	case err := <-done:
+		t.Fatalf("expected the wait to block, it returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func expectDone(t *testing.T, done chan error, want error) {
+	select {
+	case err := <-done:
+		if !errors.Is(err, want) {
+			t.Fatalf("expected %v, got %v", want, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wait did not return")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	rate := int64(2 * dgotorrent.BLOCKSIZE)
+	l := dgotorrent.NewRateLimiter(nil, clock, rate)
+
+	// a full bucket lets a second of the rate through
+	if err := l.Wait(ctx, int(rate)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := startWait(l, ctx, dgotorrent.BLOCKSIZE)
+	waitTimers(t, clock, 1)
+	expectBlocked(t, done)
+
+	clock.Advance(time.Second / 4)
+	expectBlocked(t, done)
+
+	clock.Advance(time.Second / 4)
+	expectDone(t, done, nil)
+
+	// an unlimited limiter never waits
+	var none *dgotorrent.RateLimiter
+	if err := none.Wait(ctx, 1<<30); err != nil || none.Rate() != 0 {
+		t.Fatal("a nil limiter limited")
+	}
+}
+
+func TestRateLimiterParent(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	session := dgotorrent.NewRateLimiter(nil, clock, dgotorrent.BLOCKSIZE)
+	task := dgotorrent.NewRateLimiter(session, clock, 0)
+
+	if err := task.Wait(ctx, dgotorrent.BLOCKSIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unlimited task waits for its session
+	done := startWait(task, ctx, dgotorrent.BLOCKSIZE)
+	waitTimers(t, clock, 1)
+	expectBlocked(t, done)
+
+	clock.Advance(time.Second)
+	expectDone(t, done, nil)
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	clock := newFakeClock()
+	l := dgotorrent.NewRateLimiter(nil, clock, dgotorrent.BLOCKSIZE)
+
+	if err := l.Wait(context.Background(), dgotorrent.BLOCKSIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	// lifting the limit releases the waiting transfers
+	done := startWait(l, context.Background(), dgotorrent.BLOCKSIZE)
+	waitTimers(t, clock, 1)
+	l.SetRate(0)
+	expectDone(t, done, nil)
+
+	// a wait ends with its context
+	l.SetRate(dgotorrent.BLOCKSIZE)
+	if err := l.Wait(context.Background(), dgotorrent.BLOCKSIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done = startWait(l, ctx, dgotorrent.BLOCKSIZE)
+	waitTimers(t, clock, 2)
+	cancel()
+	expectDone(t, done, context.Canceled)
+
+	limits := dgotorrent.NewLimits(nil, clock, dgotorrent.RateLimits{Download: 100, Upload: 200})
+	limits.Set(dgotorrent.RateLimits{Upload: 300})
+	if rates := limits.Rates(); rates.Download != 0 || rates.Upload != 300 {
+		t.Errorf("unexpected rates %+v", rates)
+	}
+}
+
+func TestSessionUploadLimit(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	rate := int64(dgotorrent.BLOCKSIZE)
+	seeder := newSession(t, dgotorrent.SessionConfig{
+		ListenAddr: "127.0.0.1:0",
+		DB:         sessionDB(t),
+		Limits:     dgotorrent.RateLimits{Upload: rate},
+		Clock:      clock,
+	})
+	seeded, err := seeder.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seeder, seeded.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	addr := seeder.Addr().(*net.TCPAddr)
+	leecher := newSession(t, dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Sources:      []dgotorrent.PeerSource{staticSource{{IP: addr.IP, Port: uint16(addr.Port)}}},
+	})
+
+	peerOnly := *tf
+	peerOnly.URLList = nil
+	task, err := leecher.Add(&peerOnly, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every second of the clock lets one more block through
+	for elapsed := 0; ; elapsed++ {
+		waitTimers(t, clock, 1)
+
+		stats, err := seeder.TaskStats(seeded.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if max := rate*int64(elapsed) + rate; stats.Uploaded > max {
+			t.Fatalf("uploaded %d bytes after %d seconds, the limit allows %d", stats.Uploaded, elapsed, max)
+		}
+
+		if stats.Uploaded >= 2*rate {
+			break
+		}
+		clock.Advance(time.Second)
+	}
+
+	seeder.SetLimits(dgotorrent.RateLimits{})
+	waitState(t, leecher, task.ID, dgotorrent.TASK_STATE_SEEDING)
+}
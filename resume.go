@@ -0,0 +1,109 @@
+package dgotorrent
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+)
+
+// STATUS_PIECES holds the pieces of an unfinished download that are stored
+// on disk, as base64 encoded bitfield.
+const STATUS_PIECES = "pieces"
+
+// ResumePieces returns the pieces a stopped download left on disk, they are
+// verified and kept when the download is started again.
+func (t *Task) ResumePieces() Bitfield {
+	encoded, _ := t.Status[STATUS_PIECES].(string)
+	have, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(have) != len(NewBitfield(t.Torrent.Info.NumPieces())) {
+		return NewBitfield(t.Torrent.Info.NumPieces())
+	}
+
+	return have
+}
+
+func (t *Task) SetResumePieces(have Bitfield) {
+	if t.Status == nil {
+		t.Status = make(map[string]any)
+	}
+
+	if have.Count() == 0 {
+		delete(t.Status, STATUS_PIECES)
+		return
+	}
+
+	t.Status[STATUS_PIECES] = base64.StdEncoding.EncodeToString(have)
+}
+
+// writePiece stores a verified piece in place, the files are created
+// sparse. Pieces that overlap skipped files are kept in the parts file as
+// well, the data of the skipped files is not written.
+func (t *Task) writePiece(index int, piece []byte) error {
+	info := &t.Torrent.Info
+	files := info.FileList()
+
+	begin, end := info.PieceBounds(index)
+	for _, seg := range info.fileSegments(begin, end-begin) {
+		f := files[seg.file]
+		if seg.padding || f.IsSymlink() || t.FilePriority(seg.file) == FILE_PRIORITY_SKIP {
+			continue
+		}
+
+		if err := t.writeAt(f, piece[f.Offset+seg.offset-begin:][:seg.length], seg.offset); err != nil {
+			return err
+		}
+	}
+
+	if t.isBoundaryPiece(index) {
+		return info.writePart(t.Path, index, piece)
+	}
+
+	return nil
+}
+
+func (t *Task) writeAt(f FileEntry, data []byte, off int64) error {
+	p, err := t.Torrent.Info.FilePath(t.Path, f)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.WriteAt(data, off); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readPiece reads a piece written by writePiece.
+func (t *Task) readPiece(index int, buf []byte) error {
+	info := &t.Torrent.Info
+	begin, _ := info.PieceBounds(index)
+	if !t.isBoundaryPiece(index) {
+		_, err := info.ReadAt(t.Path, buf, begin)
+		return err
+	}
+
+	p, err := info.PartsPath(t.Path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.ReadAt(buf, begin)
+	return err
+}
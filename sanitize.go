@@ -0,0 +1,292 @@
+package dgotorrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// longest file name most file systems accept, in bytes
+const MAX_NAME_LEN = 255
+
+// UnsafePathError reports a name of a torrent that can not be stored safely.
+type UnsafePathError struct {
+	Path   []string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path %q: %s", strings.Join(e.Path, "/"), e.Reason)
+}
+
+// device names windows reserves in every directory
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// textDecoder returns a function converting names from the encoding of the
+// torrent to utf-8, names are left alone for unknown encodings.
+func textDecoder(name string) func(string) string {
+	enc, err := htmlindex.Get(name)
+	if name == "" || err != nil || strings.EqualFold(name, "utf-8") || strings.EqualFold(name, "utf8") {
+		return func(s string) string { return s }
+	}
+
+	return func(s string) string {
+		decoded, err := enc.NewDecoder().String(s)
+		if err != nil {
+			return s
+		}
+
+		return decoded
+	}
+}
+
+// sanitizeComponent turns a name into one that is safe to use as a single
+// path component. Names that can not be made safe are rejected with a reason.
+func sanitizeComponent(name string) (string, string) {
+	switch {
+	case name == "":
+		return "", "empty name"
+	case name == "." || name == "..":
+		return "", "relative path component"
+	case strings.ContainsRune(name, 0):
+		return "", "NUL byte in name"
+	case strings.ContainsAny(name, `/\`):
+		return "", "path separator in name"
+	}
+
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	// windows strips trailing dots and spaces, the name would change on disk
+	if name = strings.TrimRight(name, ". "); name == "" {
+		name = "_"
+	}
+
+	base, ext, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(base)] {
+		name = base + "_"
+		if ext != "" {
+			name += "." + ext
+		}
+	}
+
+	return truncateName(name, MAX_NAME_LEN), ""
+}
+
+// truncateName cuts an overlong name to max bytes, keeping a short extension
+// and whole utf-8 sequences.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	if max <= 0 {
+		return ""
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > 32 || len(ext) >= max {
+		ext = ""
+	}
+
+	base := name[:max-len(ext)]
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+
+	return base + ext
+}
+
+func sanitizePath(path []string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, &UnsafePathError{Path: path, Reason: "empty path"}
+	}
+
+	parts := make([]string, 0, len(path))
+	for _, p := range path {
+		part, reason := sanitizeComponent(p)
+		if reason != "" {
+			return nil, &UnsafePathError{Path: path, Reason: reason}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+// withinDir reports whether p lies below dir.
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || rel == ".." || filepath.IsAbs(rel) {
+		return false
+	}
+
+	return !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// uniqueName returns name, or name with a counter before its extension, so
+// that it is not taken in the directory yet.
+func uniqueName(name string, taken func(string) bool) string {
+	if !taken(name) {
+		return name
+	}
+
+	// a long extension or the whole name of a dot file is kept as part of
+	// the base, the counter is never cut off
+	ext := filepath.Ext(name)
+	if len(ext) > 32 || len(ext) == len(name) {
+		ext = ""
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		counter := fmt.Sprintf(" (%d)", i)
+		candidate := truncateName(base, MAX_NAME_LEN-len(counter)-len(ext)) + counter + ext
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// sanitizePaths computes the names the torrent is stored with. Names that
+// collide once sanitized get a counter, symlink targets follow the renamed
+// files and must stay within the torrent.
+func sanitizePaths(info *TorrentInfo) error {
+	name, err := info.diskName()
+	if err != nil {
+		return err
+	}
+	info.DiskName = name
+
+	// taken holds the files and directories by their joined disk path,
+	// dirs maps sanitized directories to the directory they are stored in.
+	// Both are keyed by case folded paths, names differing only in case
+	// collide on case insensitive file systems.
+	const (
+		takenFile = iota + 1
+		takenDir
+	)
+	taken := make(map[string]int)
+	dirs := make(map[string]string)
+	renamed := make(map[string][]string)
+	fold := cases.Fold()
+
+	for i := range info.Files {
+		f := &info.Files[i]
+		parts, err := sanitizePath(f.Path)
+		if err != nil {
+			return err
+		}
+
+		resolved := make([]string, 0, len(parts))
+		for k, part := range parts {
+			parent := strings.Join(resolved, "/")
+			join := func(name string) string {
+				if parent == "" {
+					return name
+				}
+
+				return parent + "/" + name
+			}
+
+			// directories only collide with files, files with anything
+			if k < len(parts)-1 {
+				key := fold.String(strings.Join(parts[:k+1], "/"))
+				dir, ok := dirs[key]
+				if !ok {
+					dir = uniqueName(part, func(n string) bool { return taken[fold.String(join(n))] == takenFile })
+					dirs[key] = dir
+					taken[fold.String(join(dir))] = takenDir
+				}
+
+				resolved = append(resolved, dir)
+				continue
+			}
+
+			file := uniqueName(part, func(n string) bool { return taken[fold.String(join(n))] != 0 })
+			taken[fold.String(join(file))] = takenFile
+			resolved = append(resolved, file)
+		}
+
+		f.DiskPath = resolved
+		renamed[strings.Join(f.Path, "\x00")] = resolved
+	}
+
+	for i := range info.Files {
+		f := &info.Files[i]
+		if !f.IsSymlink() {
+			continue
+		}
+
+		if target, ok := renamed[strings.Join(f.SymlinkPath, "\x00")]; ok {
+			f.SymlinkPath = target
+			continue
+		}
+
+		target, err := sanitizePath(f.SymlinkPath)
+		if err != nil {
+			return &UnsafePathError{Path: f.Path, Reason: "symlink target: " + err.Error()}
+		}
+
+		f.SymlinkPath = target
+	}
+
+	return nil
+}
+
+func (info *TorrentInfo) diskName() (string, error) {
+	if info.DiskName != "" {
+		return info.DiskName, nil
+	}
+
+	name, reason := sanitizeComponent(info.Name)
+	if reason != "" {
+		return "", &UnsafePathError{Path: []string{info.Name}, Reason: reason}
+	}
+
+	return name, nil
+}
+
+// FilePath returns the location of a file below the download directory, it
+// fails for paths that would leave the directory.
+func (info *TorrentInfo) FilePath(dir string, f FileEntry) (string, error) {
+	name, err := info.diskName()
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsMutiFile {
+		return filepath.Join(dir, name), nil
+	}
+
+	parts := f.DiskPath
+	if parts == nil {
+		if parts, err = sanitizePath(f.Path); err != nil {
+			return "", err
+		}
+	}
+
+	p := filepath.Join(append([]string{dir, name}, parts...)...)
+	if !withinDir(filepath.Join(dir, name), p) {
+		return "", &UnsafePathError{Path: f.Path, Reason: "outside of the download directory"}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,215 @@
+package dgotorrent_test
+
+import (
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+// pathTorrent parses a multi file torrent with one byte files, extra keys are
+// added to the top level dictionary.
+func pathTorrent(name string, files []map[string]any, extra map[string]any) (*dgotorrent.TorrentFile, error) {
+	list := make([]any, 0, len(files))
+	for _, f := range files {
+		f["length"] = int64(1)
+		list = append(list, f)
+	}
+
+	content := make([]byte, len(files))
+	sum := sha1.Sum(content)
+	meta := map[string]any{
+		"info": map[string]any{
+			"name":         name,
+			"piece length": int64(16384),
+			"pieces":       string(sum[:]),
+			"files":        list,
+		},
+	}
+
+	for k, v := range extra {
+		meta[k] = v
+	}
+
+	raw, _ := bencode.Marshal(meta)
+	return dgotorrent.NewTorrentFile(strings.NewReader(raw))
+}
+
+func TestUnsafePaths(t *testing.T) {
+	cases := []struct {
+		name  string
+		files []map[string]any
+	}{
+		{"parent", []map[string]any{{"path": []any{"..", "..", "etc", "passwd"}}}},
+		{"separator", []map[string]any{{"path": []any{"/etc/passwd"}}}},
+		{"backslash", []map[string]any{{"path": []any{`..\..\boot.ini`}}}},
+		{"nul", []map[string]any{{"path": []any{"a\x00b"}}}},
+		{"empty", []map[string]any{{"path": []any{}}}},
+		{"symlink", []map[string]any{{"path": []any{"link"}, "attr": "l", "symlink path": []any{"..", "secret"}}}},
+	}
+
+	for _, c := range cases {
+		_, err := pathTorrent("safe", c.files, nil)
+
+		var pathErr *dgotorrent.UnsafePathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("%s: expected an unsafe path error, got %v", c.name, err)
+		}
+	}
+
+	for _, name := range []string{"..", "a/b", ""} {
+		if _, err := pathTorrent(name, []map[string]any{{"path": []any{"f"}}}, nil); err == nil && name != "" {
+			t.Errorf("expected the name %q to be rejected", name)
+		}
+	}
+}
+
+func TestSanitizedPaths(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".txt"
+	tf, err := pathTorrent("files", []map[string]any{
+		{"path": []any{"what?.txt"}},
+		{"path": []any{"what_.txt"}},
+		{"path": []any{"CON.txt"}},
+		{"path": []any{"x"}},
+		{"path": []any{"x", "y"}},
+		{"path": []any{long}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"what_.txt", "what_ (1).txt", "CON_.txt", "x", "x (1)/y"}
+	for i, e := range expected {
+		if got := strings.Join(tf.Info.Files[i].DiskPath, "/"); got != e {
+			t.Errorf("expected %s, got %s", e, got)
+		}
+	}
+
+	if got := tf.Info.Files[5].DiskPath[0]; len(got) > dgotorrent.MAX_NAME_LEN || !strings.HasSuffix(got, "é.txt") {
+		t.Errorf("unexpected truncated name %s", got)
+	}
+
+	// the original names are kept for display and web seeds
+	if tf.Info.Files[0].Path[0] != "what?.txt" {
+		t.Errorf("the original path must be kept")
+	}
+
+	dir := t.TempDir()
+	if err := tf.Info.WriteContent(dir, make([]byte, tf.Info.Length)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range expected {
+		if _, err := os.Stat(filepath.Join(dir, "files", filepath.FromSlash(e))); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSanitizedPathsCase(t *testing.T) {
+	tf, err := pathTorrent("files", []map[string]any{
+		{"path": []any{"Readme.txt"}},
+		{"path": []any{"README.TXT"}},
+		{"path": []any{"Dir", "a"}},
+		{"path": []any{"dir", "A"}},
+		{"path": []any{"dir", "b"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directories differing in case are merged, files get a counter
+	expected := []string{"Readme.txt", "README (1).TXT", "Dir/a", "Dir/A (1)", "Dir/b"}
+	for i, e := range expected {
+		if got := strings.Join(tf.Info.Files[i].DiskPath, "/"); got != e {
+			t.Errorf("expected %s, got %s", e, got)
+		}
+	}
+}
+
+func TestSanitizedPathsLongCase(t *testing.T) {
+	ext := "x." + strings.Repeat("y", 10) + "." + strings.Repeat("z", 242)
+	dot := "." + strings.Repeat("a", 254)
+	tf, err := pathTorrent("files", []map[string]any{
+		{"path": []any{ext}},
+		{"path": []any{"X" + ext[1:]}},
+		{"path": []any{dot}},
+		{"path": []any{strings.ToUpper(dot)}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// long extensions and dot files are truncated, the counter is kept
+	seen := make(map[string]bool)
+	for _, f := range tf.Info.Files {
+		name := strings.ToLower(f.DiskPath[0])
+		if len(name) > dgotorrent.MAX_NAME_LEN || seen[name] {
+			t.Errorf("unexpected disk name %s", f.DiskPath[0])
+		}
+		seen[name] = true
+	}
+
+	for _, i := range []int{1, 3} {
+		if got := tf.Info.Files[i].DiskPath[0]; !strings.HasSuffix(got, " (1)") {
+			t.Errorf("expected a counter, got %s", got)
+		}
+	}
+}
+
+func TestSanitizedPathsTrailing(t *testing.T) {
+	tf, err := pathTorrent("files", []map[string]any{
+		{"path": []any{"notes. "}},
+		{"path": []any{"notes"}},
+		{"path": []any{"dir.", "a"}},
+		{"path": []any{"CON ."}},
+		{"path": []any{"..."}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// windows strips trailing dots and spaces, the stripped names collide
+	expected := []string{"notes", "notes (1)", "dir/a", "CON_", "_"}
+	for i, e := range expected {
+		if got := strings.Join(tf.Info.Files[i].DiskPath, "/"); got != e {
+			t.Errorf("expected %s, got %s", e, got)
+		}
+	}
+}
+
+func TestPathEncoding(t *testing.T) {
+	// "中文" in gbk
+	gbk := "\xd6\xd0\xce\xc4"
+
+	tf, err := pathTorrent(gbk, []map[string]any{
+		{"path": []any{gbk + ".txt"}},
+		{"path": []any{"raw"}, "path.utf-8": []any{"utf8 名"}},
+	}, map[string]any{"encoding": "GBK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.Info.Name != "中文" || tf.Info.Files[0].Path[0] != "中文.txt" {
+		t.Errorf("names were not decoded: %s %v", tf.Info.Name, tf.Info.Files[0].Path)
+	}
+
+	if tf.Info.Files[1].DiskPath[0] != "utf8 名" {
+		t.Errorf("path.utf-8 must take precedence, got %v", tf.Info.Files[1].DiskPath)
+	}
+
+	// without an encoding invalid utf-8 is replaced
+	tf, err = pathTorrent("name", []map[string]any{{"path": []any{"bad\xff"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tf.Info.Files[0].DiskPath[0]; got != "bad_" {
+		t.Errorf("expected bad_, got %q", got)
+	}
+}
@@ -0,0 +1,337 @@
+package dgotorrent
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// format of the times of the schedule rules
+const SCHEDULE_TIME_LAYOUT = "15:04"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// LimitProfile replaces the limits of a session while a rule with it is in
+// effect.
+type LimitProfile struct {
+	Limits     RateLimits
+	PeerLimits RateLimits
+}
+
+// ScheduleRule is in effect on Days, every day when it is empty, from From to
+// To after midnight. A rule with To before From runs into the next day, it
+// belongs to the day it starts on.
+type ScheduleRule struct {
+	Days        []time.Weekday
+	From        time.Duration
+	To          time.Duration
+	Profile     string
+	PauseTasks  []int
+	PauseLabels []string
+}
+
+func (r *ScheduleRule) onDay(day time.Weekday) bool {
+	return len(r.Days) == 0 || slices.Contains(r.Days, day)
+}
+
+// Active reports whether the rule is in effect at the time, in the location
+// of the time.
+func (r *ScheduleRule) Active(now time.Time) bool {
+	h, m, sec := now.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	day := now.Weekday()
+
+	if r.From < r.To {
+		return r.onDay(day) && offset >= r.From && offset < r.To
+	}
+
+	// the part before midnight belongs to today, the rest to yesterday
+	return (r.onDay(day) && offset >= r.From) || (r.onDay((day+6)%7) && offset < r.To)
+}
+
+// Schedule switches the limits of a session and pauses tasks depending on
+// the time. The first active rule with a profile decides the limits, the
+// pauses of all active rules add up.
+type Schedule struct {
+	Profiles map[string]LimitProfile
+	Rules    []ScheduleRule
+}
+
+// ScheduleState is what a schedule sets at a time, Profile is empty when the
+// limits of the session are in effect.
+type ScheduleState struct {
+	Profile     string
+	PauseTasks  []int
+	PauseLabels []string
+}
+
+// At returns the state of the schedule at the time, a nil schedule sets
+// nothing.
+func (s *Schedule) At(now time.Time) ScheduleState {
+	var state ScheduleState
+	if s == nil {
+		return state
+	}
+
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		if !r.Active(now) {
+			continue
+		}
+
+		if state.Profile == "" {
+			state.Profile = r.Profile
+		}
+		state.PauseTasks = append(state.PauseTasks, r.PauseTasks...)
+		state.PauseLabels = append(state.PauseLabels, r.PauseLabels...)
+	}
+
+	return state
+}
+
+// pauses reports whether the state pauses the task.
+func (state *ScheduleState) pauses(t *Task) bool {
+	if slices.Contains(state.PauseTasks, t.ID) {
+		return true
+	}
+
+	for _, label := range state.PauseLabels {
+		if t.HasLabel(label) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseSchedule checks the schedule of the config file, it returns nil when
+// there are no rules.
+func ParseSchedule(cfg config.Schedule) (*Schedule, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+
+	s := &Schedule{Profiles: make(map[string]LimitProfile, len(cfg.Profiles))}
+	for name, p := range cfg.Profiles {
+		s.Profiles[name] = LimitProfile{
+			Limits:     RateLimits{Download: p.Download, Upload: p.Upload},
+			PeerLimits: RateLimits{Download: p.PeerDownload, Upload: p.PeerUpload},
+		}
+	}
+
+	for i, rc := range cfg.Rules {
+		r, err := parseScheduleRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rule %d: %v", ErrInvalidSchedule, i+1, err)
+		}
+
+		if _, ok := s.Profiles[r.Profile]; r.Profile != "" && !ok {
+			return nil, fmt.Errorf("%w: rule %d: unknown profile %s", ErrInvalidSchedule, i+1, r.Profile)
+		}
+
+		s.Rules = append(s.Rules, r)
+	}
+
+	return s, nil
+}
+
+func parseScheduleRule(cfg config.ScheduleRule) (ScheduleRule, error) {
+	r := ScheduleRule{
+		Profile:     cfg.Profile,
+		PauseTasks:  cfg.PauseTasks,
+		PauseLabels: cfg.PauseLabels,
+	}
+
+	for _, name := range cfg.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return ScheduleRule{}, fmt.Errorf("unknown day %s", name)
+		}
+		r.Days = append(r.Days, day)
+	}
+
+	var err error
+	if r.From, err = parseTimeOfDay(cfg.From); err != nil {
+		return ScheduleRule{}, err
+	}
+
+	if r.To, err = parseTimeOfDay(cfg.To); err != nil {
+		return ScheduleRule{}, err
+	}
+
+	if r.From == r.To {
+		return ScheduleRule{}, errors.New("the rule ends when it starts")
+	}
+
+	return r, nil
+}
+
+// parseTimeOfDay returns the time after midnight, 24:00 is the end of the
+// day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+
+	t, err := time.Parse(SCHEDULE_TIME_LAYOUT, s)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not of the form hh:mm", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// profile returns the profile with the name, a nil schedule has none.
+func (s *Schedule) profile(name string) (LimitProfile, bool) {
+	if s == nil || name == "" {
+		return LimitProfile{}, false
+	}
+
+	p, ok := s.Profiles[name]
+	return p, ok
+}
+
+// ScheduleStatus is the effect of the schedule on a session, Profile is
+// empty when the limits of the config are in effect and Paused are the tasks
+// the schedule paused.
+type ScheduleStatus struct {
+	Profile string
+	Paused  []int
+}
+
+func (s *Session) ScheduleStatus() ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ScheduleStatus{Profile: s.profile, Paused: make([]int, 0)}
+	for id, st := range s.tasks {
+		if st.task.Held {
+			status.Paused = append(status.Paused, id)
+		}
+	}
+	slices.Sort(status.Paused)
+
+	return status
+}
+
+// setHeld marks a task as paused by the schedule or clears the mark, it is
+// stored so that the schedule resumes the task after a restart as well. The
+// caller holds the lock.
+func (s *Session) setHeld(st *sessionTask, held bool) error {
+	if st.task.Held == held {
+		return nil
+	}
+
+	if err := s.store.UpdateHeld(st.task.ID, held); err != nil {
+		return err
+	}
+	st.task.Held = held
+
+	return nil
+}
+
+// holds reports whether the schedule holds any task, the caller holds the
+// lock.
+func (s *Session) holds() bool {
+	for _, st := range s.tasks {
+		if st.task.Held {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduleLoop applies the schedule at the start of every minute of the
+// clock of the session.
+func (s *Session) scheduleLoop() {
+	defer s.wg.Done()
+
+	clock := s.cfg.Clock
+	for {
+		now := clock.Now()
+		select {
+		case now = <-clock.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-s.quit:
+			return
+		}
+
+		s.applySchedule(now)
+	}
+}
+
+// applySchedule switches to the profile of the schedule at the time. Tasks
+// are paused when a rule starts to pause them and resumed when no rule pauses
+// them anymore, unless they were paused or resumed by hand in between.
+func (s *Session) applySchedule(now time.Time) {
+	state := s.cfg.Schedule.At(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if state.Profile != s.profile {
+		dlog.Infof("schedule switched from profile %q to %q", s.profile, state.Profile)
+		s.profile = state.Profile
+		s.applyLimits()
+	}
+
+	scheduled := make(map[int]bool)
+	for id, st := range s.tasks {
+		if state.pauses(st.task) {
+			scheduled[id] = true
+		}
+	}
+
+	for id := range scheduled {
+		st := s.tasks[id]
+		if s.scheduled[id] || st.task.State == TASK_STATE_PAUSED || st.task.State == TASK_STATE_ERROR {
+			continue
+		}
+
+		err := s.pauseTask(st)
+		if err == nil {
+			err = s.setHeld(st, true)
+		}
+
+		if err != nil {
+			dlog.Errorf("failed to pause %s by the schedule with error: %v", st.task.Name, err)
+		}
+	}
+
+	for id, st := range s.tasks {
+		if !st.task.Held || scheduled[id] {
+			continue
+		}
+
+		err := s.setHeld(st, false)
+		if err == nil && st.task.State == TASK_STATE_PAUSED {
+			err = s.resumeTask(st)
+		}
+
+		if err != nil {
+			dlog.Errorf("failed to resume %s by the schedule with error: %v", st.task.Name, err)
+		}
+	}
+
+	s.scheduled = scheduled
+	s.schedule()
+}
@@ -0,0 +1,246 @@
+package dgotorrent_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/config"
+)
+
+var testSchedule = config.Schedule{
+	Profiles: map[string]config.LimitProfile{
+		"day":   {Download: 1 << 20, Upload: 1 << 19, PeerUpload: 1 << 18},
+		"night": {},
+	},
+	Rules: []config.ScheduleRule{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "08:00", To: "18:00", Profile: "day"},
+		{Days: []string{"fri"}, From: "22:00", To: "06:00", Profile: "night"},
+		{From: "08:00", To: "09:00", PauseLabels: []string{"backup"}},
+	},
+}
+
+// 2024-01-01 is a monday
+func monday(hour, min int) time.Time {
+	return time.Date(2024, 1, 1, hour, min, 0, 0, time.UTC)
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := dgotorrent.ParseSchedule(testSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at      time.Time
+		profile string
+		labels  []string
+	}{
+		{monday(7, 59), "", nil},
+		{monday(8, 0), "day", []string{"backup"}},
+		{monday(9, 0), "day", nil},
+		{monday(18, 0), "", nil},
+		// saturday
+		{monday(8, 30).AddDate(0, 0, 5), "", []string{"backup"}},
+		// friday night runs into saturday
+		{monday(23, 0).AddDate(0, 0, 4), "night", nil},
+		{monday(5, 59).AddDate(0, 0, 5), "night", nil},
+		{monday(6, 0).AddDate(0, 0, 5), "", nil},
+		{monday(5, 0).AddDate(0, 0, 4), "", nil},
+	}
+
+	for _, test := range tests {
+		state := schedule.At(test.at)
+		if state.Profile != test.profile || !slices.Equal(state.PauseLabels, test.labels) {
+			t.Errorf("%s: unexpected state %+v", test.at.Format(time.RFC1123), state)
+		}
+	}
+
+	invalid := []config.ScheduleRule{
+		{Days: []string{"someday"}, From: "08:00", To: "09:00"},
+		{From: "8am", To: "09:00"},
+		{From: "08:00", To: "08:00"},
+		{From: "08:00", To: "09:00", Profile: "missing"},
+	}
+
+	for _, rule := range invalid {
+		_, err := dgotorrent.ParseSchedule(config.Schedule{Rules: []config.ScheduleRule{rule}})
+		if !errors.Is(err, dgotorrent.ErrInvalidSchedule) {
+			t.Errorf("expected %+v to be invalid, got %v", rule, err)
+		}
+	}
+
+	if schedule, err := dgotorrent.ParseSchedule(config.Schedule{}); schedule != nil || err != nil {
+		t.Errorf("expected no schedule, got %v and %v", schedule, err)
+	}
+}
+
+func waitSchedule(t *testing.T, s *dgotorrent.Session, profile string, paused ...int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.ScheduleStatus()
+		if status.Profile == profile && slices.Equal(status.Paused, paused) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected profile %q pausing %v, got %+v", profile, paused, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionSchedule(t *testing.T) {
+	schedule, err := dgotorrent.ParseSchedule(testSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	clock.now = monday(7, 59)
+	base := dgotorrent.RateLimits{Download: 1000}
+	s := newSession(t, dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Limits:       base,
+		Clock:        clock,
+		Schedule:     schedule,
+	})
+
+	tf, _ := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(20000)},
+	})
+	stallingSeed(t, tf)
+
+	backup, err := s.Add(tf, dgotorrent.AddOptions{Labels: []string{"backup"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_DOWNLOADING)
+	waitSchedule(t, s, "")
+
+	// the office hours start
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Minute)
+	waitSchedule(t, s, "day", backup.ID)
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_PAUSED)
+
+	want := dgotorrent.RateLimits{Download: 1 << 20, Upload: 1 << 19}
+	if limits := s.Limits(); limits != want {
+		t.Errorf("expected the limits of the profile, got %+v", limits)
+	}
+
+	if limits := s.PeerLimits(); limits != (dgotorrent.RateLimits{Upload: 1 << 18}) {
+		t.Errorf("expected the peer limits of the profile, got %+v", limits)
+	}
+
+	// limits set in the meantime are used once the profile ends
+	base = dgotorrent.RateLimits{Upload: 2000}
+	s.SetLimits(base)
+	if limits := s.Limits(); limits != want {
+		t.Errorf("the profile was replaced by %+v", limits)
+	}
+
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Hour)
+	waitSchedule(t, s, "day")
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_DOWNLOADING)
+
+	waitTimers(t, clock, 1)
+	clock.Advance(9 * time.Hour)
+	waitSchedule(t, s, "")
+
+	if limits := s.Limits(); limits != base {
+		t.Errorf("expected the limits of the session, got %+v", limits)
+	}
+
+	if limits := s.PeerLimits(); limits != (dgotorrent.RateLimits{}) {
+		t.Errorf("expected no peer limits, got %+v", limits)
+	}
+
+	// a task paused by hand is not resumed by the schedule
+	waitTimers(t, clock, 1)
+	clock.Advance(14 * time.Hour)
+	waitSchedule(t, s, "day", backup.ID)
+
+	if err := s.Pause(backup.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitSchedule(t, s, "day")
+
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Hour)
+	waitTimers(t, clock, 1)
+	if task, _ := s.Task(backup.ID); task.State != dgotorrent.TASK_STATE_PAUSED {
+		t.Errorf("expected the task to stay paused, it is %s", task.State)
+	}
+}
+
+func TestSessionScheduleRestart(t *testing.T) {
+	schedule, err := dgotorrent.ParseSchedule(testSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	clock.now = monday(8, 30)
+	cfg := dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Clock:        clock,
+		Schedule:     schedule,
+	}
+	s := newSession(t, cfg)
+
+	tf, _ := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(20000)},
+	})
+	stallingSeed(t, tf)
+
+	backup, err := s.Add(tf, dgotorrent.AddOptions{Labels: []string{"backup"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Minute)
+	waitSchedule(t, s, "day", backup.ID)
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_PAUSED)
+	s.Close()
+
+	// the restarted session still holds the task and resumes it once the
+	// pause ends, every session gets a clock of its own without the timers
+	// of the closed one
+	restart := func(now time.Time) {
+		clock = newFakeClock()
+		clock.now = now
+		cfg.Clock = clock
+		s = newSession(t, cfg)
+	}
+
+	restart(monday(8, 31))
+	waitSchedule(t, s, "day", backup.ID)
+
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Hour)
+	waitSchedule(t, s, "day")
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_DOWNLOADING)
+
+	if task, _ := s.Task(backup.ID); task.Held {
+		t.Errorf("the task is still marked held")
+	}
+
+	// a task held when the session stopped is resumed on a start after the
+	// pause
+	s.Close()
+
+	restart(monday(8, 30).AddDate(0, 0, 1))
+	waitSchedule(t, s, "day", backup.ID)
+	s.Close()
+
+	restart(monday(10, 0).AddDate(0, 0, 1))
+	waitSchedule(t, s, "day")
+	waitState(t, s, backup.ID, dgotorrent.TASK_STATE_DOWNLOADING)
+}
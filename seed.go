@@ -0,0 +1,262 @@
+package dgotorrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// longest block a peer may request, larger requests drop the connection
+const MAX_REQUEST_LEN = 128 * 1024
+
+// time a seeding connection may stay silent before it is dropped
+const SEED_IDLE_TIMEOUT = 3 * time.Minute
+
+// number of pieces served last that are suggested to unchoked peers
+const SEED_SUGGESTIONS = 4
+
+var ErrInvalidRequest = errors.New("invalid block request")
+
+// servedPieces are the pieces a seeding task uploaded last, they are likely
+// still cached and suggested to the peers it unchokes (BEP 6).
+type servedPieces struct {
+	mu     sync.Mutex
+	pieces []int
+}
+
+func (s *servedPieces) add(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := slices.Index(s.pieces, index); i >= 0 {
+		s.pieces = slices.Delete(s.pieces, i, i+1)
+	} else if len(s.pieces) >= SEED_SUGGESTIONS {
+		s.pieces = s.pieces[1:]
+	}
+	s.pieces = append(s.pieces, index)
+}
+
+func (s *servedPieces) list() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.pieces)
+}
+
+// uploadSlots limits the peers a seeding task unchokes, interested peers
+// wait choked until one of the slots is free.
+type uploadSlots struct {
+	mu    sync.Mutex
+	max   int
+	taken map[*PeerConn]bool
+	// free is closed and replaced whenever a slot is released
+	free chan struct{}
+}
+
+func newUploadSlots(max int) *uploadSlots {
+	return &uploadSlots{
+		max:   max,
+		taken: make(map[*PeerConn]bool),
+		free:  make(chan struct{}),
+	}
+}
+
+// take reserves a slot for the connection, false when all are taken.
+func (s *uploadSlots) take(c *PeerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.taken[c] {
+		return true
+	}
+
+	if len(s.taken) >= s.max {
+		return false
+	}
+
+	s.taken[c] = true
+	return true
+}
+
+// release frees the slot of the connection, the waiting peers are woken.
+func (s *uploadSlots) release(c *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.taken[c] {
+		return
+	}
+
+	delete(s.taken, c)
+	close(s.free)
+	s.free = make(chan struct{})
+}
+
+// freed returns a channel that is closed once a slot is released.
+func (s *uploadSlots) freed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.free
+}
+
+func NewPieceMsg(index, begin int, block []byte) *PeerMsg {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	return &PeerMsg{
+		Type:    PEER_MSG_TYPE_PIECE,
+		Payload: payload,
+	}
+}
+
+// havePieces returns the pieces of a finished task that are stored in its
+// files, pieces that overlap skipped files are left out.
+func (t *Task) havePieces() Bitfield {
+	n := t.Torrent.Info.NumPieces()
+	have := NewBitfield(n)
+	for index := 0; index < n; index++ {
+		if t.PiecePriority(index) != FILE_PRIORITY_SKIP && !t.isBoundaryPiece(index) {
+			have.Set(index)
+		}
+	}
+
+	return have
+}
+
+// seed serves the pieces of a finished task to an inbound connection until
+// the peer leaves or stop is closed. Interested peers are unchoked as soon as
+// one of the upload slots is free and get the pieces served last suggested,
+// peers that lost interest are choked again. Peers with the fast extension
+// may download their allowed fast pieces while choked.
+func seed(conn *PeerConn, t *Task, have Bitfield, served *servedPieces, slots *uploadSlots, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+			conn.Close()
+		case <-ctx.Done():
+		}
+	}()
+	defer conn.Close()
+	defer slots.release(conn)
+
+	if conn.SupportsFast() {
+		if err := conn.SendAllowedFast(DEFAULT_ALLOWED_FAST); err != nil {
+			return
+		}
+	}
+
+	// messages are read in a routine of their own so that a waiting peer is
+	// unchoked as soon as a slot is free
+	msgs := make(chan *PeerMsg)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(SEED_IDLE_TIMEOUT))
+			msg, err := conn.ReadMsg()
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		if err := updateChoke(conn, served, slots); err != nil {
+			return
+		}
+
+		if err := serveRequests(ctx, conn, t, have, served); err != nil {
+			return
+		}
+
+		select {
+		case msg := <-msgs:
+			if err := conn.handleMsg(msg); err != nil {
+				return
+			}
+		case <-slots.freed():
+		case <-readErr:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateChoke unchokes an interested peer once it got an upload slot and
+// chokes it once it lost interest.
+func updateChoke(conn *PeerConn, served *servedPieces, slots *uploadSlots) error {
+	switch {
+	case conn.PeerInterested && conn.AmChoking:
+		if !slots.take(conn) {
+			return nil
+		}
+
+		if err := conn.Unchoke(); err != nil {
+			return err
+		}
+
+		if !conn.SupportsFast() {
+			return nil
+		}
+
+		for _, index := range served.list() {
+			if err := conn.SendSuggest(index); err != nil {
+				return err
+			}
+		}
+	case !conn.PeerInterested && !conn.AmChoking:
+		slots.release(conn)
+		return conn.Choke()
+	}
+
+	return nil
+}
+
+// serveRequests answers the queued requests of the peer with the blocks read
+// from disk, as fast as the upload limits allow.
+func serveRequests(ctx context.Context, conn *PeerConn, t *Task, have Bitfield, served *servedPieces) error {
+	info := &t.Torrent.Info
+	for len(conn.peerRequests) > 0 {
+		r := conn.peerRequests[0]
+		conn.peerRequests = conn.peerRequests[1:]
+
+		begin, end := info.PieceBounds(r.Index)
+		if !have.Test(r.Index) || r.Begin < 0 || r.Length <= 0 || r.Length > MAX_REQUEST_LEN ||
+			begin+int64(r.Begin)+int64(r.Length) > end {
+			return ErrInvalidRequest
+		}
+
+		if err := conn.waitBlock(ctx, conn.Limits.Upload(), r.Length); err != nil {
+			return err
+		}
+
+		block := make([]byte, r.Length)
+		if _, err := info.ReadAt(t.Path, block, begin+int64(r.Begin)); err != nil {
+			return err
+		}
+
+		if _, err := conn.WriteMsg(NewPieceMsg(r.Index, r.Begin, block)); err != nil {
+			return err
+		}
+		served.add(r.Index)
+	}
+
+	return nil
+}
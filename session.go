@@ -0,0 +1,1435 @@
+package dgotorrent
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/common"
+	"github.com/Dizzrt/dgo-torrent/config"
+	"github.com/Dizzrt/dgo-torrent/db"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+	"github.com/Dizzrt/dgo-torrent/utp"
+)
+
+const (
+	DEFAULT_MAX_ACTIVE_DOWNLOADS = 3
+	DEFAULT_MAX_ACTIVE_SEEDS     = 5
+	DEFAULT_MAX_INBOUND          = 200
+	DEFAULT_MAX_TASK_INBOUND     = 50
+	DEFAULT_UPLOAD_SLOTS         = 4
+)
+
+// interval the transfer totals of the active tasks are stored in
+const TOTALS_SAVE_INTERVAL = time.Minute
+
+// interval seeding tasks announce themselves at when the trackers send none
+const SEED_ANNOUNCE_INTERVAL = 30 * time.Minute
+
+// keys of the task status kept by the session
+const (
+	STATUS_COMPLETE       = "complete"
+	STATUS_ERROR          = "error"
+	STATUS_DOWNLOAD_LIMIT = "download_limit"
+	STATUS_UPLOAD_LIMIT   = "upload_limit"
+)
+
+var (
+	ErrSessionClosed = errors.New("session is closed")
+	ErrDuplicateTask = errors.New("torrent is added already")
+)
+
+type SessionConfig struct {
+	PeerID string
+	// DownloadPath is the directory of tasks added without a path.
+	DownloadPath string
+	// ListenAddr is the tcp address inbound peers connect to, the session
+	// does not listen when it is empty.
+	ListenAddr         string
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	Encryption         EncryptionMode
+	UTP                *utp.Socket
+	Sources            []PeerSource
+	// MaxInbound limits the inbound connections of the session,
+	// MaxTaskInbound the ones of every task. UploadSlots is the number of
+	// peers a seeding task uploads to at once.
+	MaxInbound     int
+	MaxTaskInbound int
+	UploadSlots    int
+	// DB holds the tasks of the session, the database of the client is used
+	// when it is nil.
+	DB *sql.DB
+	// Limits are the rate limits of all tasks together, PeerLimits the ones
+	// of every connection. LimitOverhead counts the headers of the blocks
+	// toward the limits. Clock is the time of the limits and of the
+	// announces of the seeds, the system clock when it is nil.
+	Limits        RateLimits
+	PeerLimits    RateLimits
+	LimitOverhead bool
+	Clock         Clock
+	// Schedule changes the limits and pauses tasks depending on the time of
+	// Clock.
+	Schedule *Schedule
+}
+
+// DefaultSessionConfig reads the session settings from the config file.
+func DefaultSessionConfig() (SessionConfig, error) {
+	cfg := config.Instance()
+
+	encryption, err := ParseEncryptionMode(cfg.GetEncryption())
+	if err != nil {
+		return SessionConfig{}, err
+	}
+
+	scheduleCfg, err := cfg.GetSchedule()
+	if err != nil {
+		return SessionConfig{}, err
+	}
+
+	schedule, err := ParseSchedule(scheduleCfg)
+	if err != nil {
+		return SessionConfig{}, err
+	}
+
+	return SessionConfig{
+		PeerID:             cfg.GetPeerID(),
+		DownloadPath:       cfg.GetDefaultDonwloadPath(),
+		ListenAddr:         fmt.Sprintf(":%d", cfg.GetListenPort()),
+		MaxActiveDownloads: cfg.GetMaxActiveDownloads(),
+		MaxActiveSeeds:     cfg.GetMaxActiveSeeds(),
+		MaxInbound:         cfg.GetMaxInbound(),
+		MaxTaskInbound:     cfg.GetMaxTaskInbound(),
+		UploadSlots:        cfg.GetUploadSlots(),
+		Encryption:         encryption,
+		Limits:             RateLimits{Download: cfg.GetDownloadLimit(), Upload: cfg.GetUploadLimit()},
+		PeerLimits:         RateLimits{Download: cfg.GetPeerDownloadLimit(), Upload: cfg.GetPeerUploadLimit()},
+		LimitOverhead:      cfg.GetLimitOverhead(),
+		Schedule:           schedule,
+	}, nil
+}
+
+// AddOptions are the settings of a task added to a session.
+type AddOptions struct {
+	// Path is the download directory, the one of the session is used when it
+	// is empty.
+	Path string
+	// Select and Exclude pick the files to download, see Task.SelectFiles.
+	Select  []string
+	Exclude []string
+	// Paused adds the task without queueing it.
+	Paused bool
+	Labels []string
+}
+
+type sessionTask struct {
+	task    *Task
+	process *Process
+	// cancel stops the download, done is closed once it returned
+	cancel context.CancelFunc
+	done   chan struct{}
+	// seeding is closed to drop the connections and stop the announces of a
+	// seeding task
+	seeding chan struct{}
+	have    Bitfield
+	// counter holds the transfer totals of the task, conns are the
+	// connections of the seeding
+	counter *TransferCounter
+	conns   connSet
+	limits  *Limits
+	// served are the pieces the seeding uploaded last, slots the peers it
+	// unchoked
+	served servedPieces
+	slots  *uploadSlots
+	// inbound is the number of inbound connections of the task
+	inbound int
+}
+
+func (s *Session) newSessionTask(t *Task) *sessionTask {
+	st := &sessionTask{
+		task:    t,
+		counter: NewTransferCounter(nil),
+		limits:  NewLimits(s.limits, nil, t.limits()),
+	}
+	st.counter.restore(t.Downloaded, t.Uploaded, t.Wasted)
+
+	return st
+}
+
+// limits returns the rate limits stored in the status of the task.
+func (t *Task) limits() RateLimits {
+	// numbers come back as float64 from the json encoded status
+	down, _ := t.Status[STATUS_DOWNLOAD_LIMIT].(float64)
+	up, _ := t.Status[STATUS_UPLOAD_LIMIT].(float64)
+
+	return RateLimits{Download: int64(down), Upload: int64(up)}
+}
+
+// snapshot copies the task with its current totals.
+func (st *sessionTask) snapshot() Task {
+	t := st.task.snapshot()
+	transfer := st.counter.Stats()
+	t.Downloaded, t.Uploaded, t.Wasted = transfer.Downloaded, transfer.Uploaded, transfer.Wasted
+
+	return t
+}
+
+// Session runs many tasks at once. Queued tasks are downloaded in the order
+// of the queue as long as there are fewer than MaxActiveDownloads downloads,
+// finished tasks are seeded while there are fewer than MaxActiveSeeds seeds.
+// All state changes are stored in the database so that the tasks are
+// restored when the session is created again.
+type Session struct {
+	cfg      SessionConfig
+	store    *TaskStore
+	listener net.Listener
+	events   *EventBus
+	limits   *Limits
+
+	mu     sync.Mutex
+	tasks  map[int]*sessionTask
+	queue  []int
+	closed bool
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	// trackers are the results of the last announces of the tasks by url
+	trackers     map[int]map[string]TrackerStatus
+	stopTrackers func()
+	// peerLimits are the limits of every connection in effect, the ones of
+	// the config or of the profile of the schedule
+	peerLimits RateLimits
+	// profile is the profile of the schedule in effect, scheduled the tasks
+	// its rules pause
+	profile   string
+	scheduled map[int]bool
+	// inbound is the number of inbound connections of the session
+	inbound int
+}
+
+func NewSession(cfg SessionConfig) (*Session, error) {
+	if cfg.PeerID == "" {
+		cfg.PeerID = common.GeneratePeerID()
+	}
+
+	if cfg.MaxActiveDownloads <= 0 {
+		cfg.MaxActiveDownloads = DEFAULT_MAX_ACTIVE_DOWNLOADS
+	}
+
+	if cfg.MaxActiveSeeds <= 0 {
+		cfg.MaxActiveSeeds = DEFAULT_MAX_ACTIVE_SEEDS
+	}
+
+	if cfg.MaxInbound <= 0 {
+		cfg.MaxInbound = DEFAULT_MAX_INBOUND
+	}
+
+	if cfg.MaxTaskInbound <= 0 {
+		cfg.MaxTaskInbound = DEFAULT_MAX_TASK_INBOUND
+	}
+
+	if cfg.UploadSlots <= 0 {
+		cfg.UploadSlots = DEFAULT_UPLOAD_SLOTS
+	}
+
+	if cfg.DB == nil {
+		cfg.DB = db.DB()
+		if err := db.Migrate(cfg.DB); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+
+	store, err := NewTaskStore(cfg.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		cfg:    cfg,
+		store:  store,
+		events: NewEventBus(),
+		limits: NewLimits(nil, cfg.Clock, cfg.Limits),
+		tasks:  make(map[int]*sessionTask),
+		quit:   make(chan struct{}),
+
+		trackers:   make(map[int]map[string]TrackerStatus),
+		peerLimits: cfg.PeerLimits,
+		scheduled:  make(map[int]bool),
+	}
+
+	if err = s.restore(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if cfg.ListenAddr != "" {
+		if s.listener, err = net.Listen("tcp", cfg.ListenAddr); err != nil {
+			store.Close()
+			return nil, err
+		}
+
+		go s.acceptLoop()
+	}
+
+	// the announces of the tasks started right away are recorded as well
+	s.stopTrackers = s.events.Handle(s.recordAnnounce)
+
+	s.mu.Lock()
+	s.schedule()
+	held := s.holds()
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.statsLoop()
+
+	// tasks held by a schedule that was removed since are resumed as well
+	if cfg.Schedule != nil || held {
+		s.applySchedule(cfg.Clock.Now())
+	}
+
+	if cfg.Schedule != nil {
+		s.wg.Add(1)
+		go s.scheduleLoop()
+	}
+
+	return s, nil
+}
+
+// restore loads the tasks of the database, tasks that were running when the
+// session was closed are queued again.
+func (s *Session) restore() error {
+	tasks, err := s.store.List()
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].QueuePosition < tasks[j].QueuePosition
+	})
+
+	for _, t := range tasks {
+		t.PeerID = s.cfg.PeerID
+		st := s.newSessionTask(t)
+
+		switch t.State {
+		case TASK_STATE_DOWNLOADING:
+			err = s.setState(st, TASK_STATE_QUEUED)
+		case TASK_STATE_SEEDING:
+			err = s.setState(st, TASK_STATE_COMPLETE)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.tasks[t.ID] = st
+		s.queue = append(s.queue, t.ID)
+	}
+
+	return nil
+}
+
+// Events returns the bus of the session, it gets the events of all
+// downloads and the state changes of the tasks.
+func (s *Session) Events() *EventBus {
+	return s.events
+}
+
+// Addr returns the address inbound peers connect to, nil when the session
+// does not listen.
+func (s *Session) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
+
+// Add creates a task for the torrent at the end of the queue. Data that is
+// found in the download directory already is verified, the task is seeded
+// right away when it is complete.
+func (s *Session) Add(tf *TorrentFile, opts AddOptions) (Task, error) {
+	path := opts.Path
+	if path == "" {
+		path = s.cfg.DownloadPath
+	}
+
+	t := &Task{
+		Name:      tf.Info.Name,
+		Path:      path,
+		Status:    make(map[string]any),
+		State:     TASK_STATE_QUEUED,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		PeerID:    s.cfg.PeerID,
+		Torrent:   *tf,
+		Labels:    opts.Labels,
+	}
+
+	if len(opts.Select) > 0 || len(opts.Exclude) > 0 {
+		if _, err := t.SelectFiles(opts.Select, opts.Exclude); err != nil {
+			return Task{}, err
+		}
+	}
+
+	if t.hasContent() {
+		if res, err := t.Torrent.Verify(t.Path); err == nil && res.OK() {
+			t.Status[STATUS_COMPLETE] = true
+			t.State = TASK_STATE_COMPLETE
+		}
+	}
+
+	if opts.Paused {
+		t.State = TASK_STATE_PAUSED
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return Task{}, ErrSessionClosed
+	}
+
+	for _, st := range s.tasks {
+		if st.task.Torrent.Info.Hash == tf.Info.Hash {
+			return Task{}, ErrDuplicateTask
+		}
+	}
+
+	if len(s.queue) > 0 {
+		t.QueuePosition = s.tasks[s.queue[len(s.queue)-1]].task.QueuePosition + 1
+	}
+
+	if err := s.store.Insert(t); err != nil {
+		return Task{}, err
+	}
+
+	s.tasks[t.ID] = s.newSessionTask(t)
+	s.queue = append(s.queue, t.ID)
+	s.schedule()
+
+	return t.snapshot(), nil
+}
+
+// AddMagnet fetches the torrent of the magnet link from the peers of the
+// session and adds it. The files of the link are selected unless opts select
+// others.
+func (s *Session) AddMagnet(ctx context.Context, m *Magnet, opts AddOptions) (Task, error) {
+	s.mu.Lock()
+	for _, st := range s.tasks {
+		if st.task.Torrent.Info.Hash == m.InfoHash {
+			s.mu.Unlock()
+			return Task{}, ErrDuplicateTask
+		}
+	}
+	s.mu.Unlock()
+
+	tf, err := m.Resolve(ctx, s.cfg.PeerID, s.cfg.Sources...)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if len(opts.Select) == 0 && len(m.SelectOnly) > 0 {
+		selected := m.SelectedFiles(len(tf.Info.FileList()))
+		if len(selected) == 0 {
+			return Task{}, ErrNoFilesSelected
+		}
+
+		for _, index := range selected {
+			opts.Select = append(opts.Select, strconv.Itoa(index))
+		}
+	}
+
+	return s.Add(tf, opts)
+}
+
+// hasContent reports whether any file of the task exists on disk.
+func (t *Task) hasContent() bool {
+	info := &t.Torrent.Info
+	for _, f := range info.FileList() {
+		if f.IsPadding() || f.IsSymlink() {
+			continue
+		}
+
+		if p, err := info.FilePath(t.Path, f); err == nil {
+			if _, err := os.Stat(p); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// snapshot copies the task so that it can be handed out while the session
+// keeps changing it.
+func (t *Task) snapshot() Task {
+	c := *t
+	c.Status = maps.Clone(t.Status)
+	c.FilePriorities = append([]FilePriority(nil), t.FilePriorities...)
+	c.Labels = slices.Clone(t.Labels)
+
+	return c
+}
+
+func (t *Task) isComplete() bool {
+	complete, _ := t.Status[STATUS_COMPLETE].(bool)
+	return complete
+}
+
+// Task returns a copy of the task with the id.
+func (s *Session) Task(id int) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return Task{}, ErrTaskNotFound
+	}
+
+	return st.snapshot(), nil
+}
+
+// Tasks returns copies of all tasks in the order of the queue.
+func (s *Session) Tasks() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make([]Task, 0, len(s.queue))
+	for _, id := range s.queue {
+		tasks = append(tasks, s.tasks[id].snapshot())
+	}
+
+	return tasks
+}
+
+// Pause stops the download or seeding of a task, it is not started again
+// until it is resumed.
+func (s *Session) Pause(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	// a task paused by hand stays paused when the schedule would resume it
+	if err := s.setHeld(st, false); err != nil {
+		return err
+	}
+
+	err := s.pauseTask(st)
+	s.schedule()
+
+	return err
+}
+
+// pauseTask stops a task and marks it paused, the caller holds the lock.
+func (s *Session) pauseTask(st *sessionTask) error {
+	if st.task.State == TASK_STATE_PAUSED {
+		return nil
+	}
+
+	s.stopTask(st)
+	return s.setState(st, TASK_STATE_PAUSED)
+}
+
+// Resume queues a paused or failed task again, complete tasks go back to
+// seeding.
+func (s *Session) Resume(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	// the schedule does not resume a task resumed by hand
+	if err := s.setHeld(st, false); err != nil {
+		return err
+	}
+
+	err := s.resumeTask(st)
+	s.schedule()
+
+	return err
+}
+
+// resumeTask queues a paused or failed task, the caller holds the lock.
+func (s *Session) resumeTask(st *sessionTask) error {
+	if st.task.State != TASK_STATE_PAUSED && st.task.State != TASK_STATE_ERROR {
+		return nil
+	}
+
+	if _, ok := st.task.Status[STATUS_ERROR]; ok {
+		delete(st.task.Status, STATUS_ERROR)
+		if err := s.store.UpdateStatus(st.task.ID, st.task.Status); err != nil {
+			return err
+		}
+	}
+
+	state := TASK_STATE_QUEUED
+	if st.task.isComplete() {
+		state = TASK_STATE_COMPLETE
+	}
+
+	return s.setState(st, state)
+}
+
+// Remove stops a task and deletes it from the session, its downloaded data
+// is deleted as well when deleteData is set.
+func (s *Session) Remove(id int, deleteData bool) error {
+	s.mu.Lock()
+	st, ok := s.tasks[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrTaskNotFound
+	}
+
+	s.stopTask(st)
+	delete(s.tasks, id)
+	delete(s.scheduled, id)
+	delete(s.trackers, id)
+	s.queue = removeID(s.queue, id)
+	done := st.done
+	s.schedule()
+	s.mu.Unlock()
+
+	if err := s.store.Delete(id); err != nil {
+		return err
+	}
+
+	if !deleteData {
+		return nil
+	}
+
+	// the download may still be writing its files
+	if done != nil {
+		<-done
+	}
+
+	return st.task.removeData()
+}
+
+// removeData deletes the files of the task and its parts file.
+func (t *Task) removeData() error {
+	info := &t.Torrent.Info
+	name, err := info.diskName()
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(filepath.Join(t.Path, name)); err != nil {
+		return err
+	}
+
+	parts, err := info.PartsPath(t.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(parts); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func removeID(ids []int, id int) []int {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+
+	return ids
+}
+
+// MoveQueue moves a task to the position in the queue, positions out of
+// range move it to the front or the back. Running tasks keep running, the
+// new order decides which task gets the next free slot.
+func (s *Session) MoveQueue(id, pos int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return ErrTaskNotFound
+	}
+
+	queue := removeID(s.queue, id)
+	pos = max(0, min(pos, len(queue)))
+	queue = append(queue[:pos], append([]int{id}, queue[pos:]...)...)
+
+	if err := s.store.UpdateQueue(queue); err != nil {
+		return err
+	}
+
+	s.queue = queue
+	for i, qid := range queue {
+		s.tasks[qid].task.QueuePosition = i
+	}
+
+	s.schedule()
+	return nil
+}
+
+// Close stops all tasks and the listener. The tasks keep their persisted
+// state so that they are started again by the next session.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	close(s.quit)
+	for _, st := range s.tasks {
+		s.stopTask(st)
+	}
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	s.wg.Wait()
+	s.stopTrackers()
+
+	return s.store.Close()
+}
+
+// setState changes and persists the state of a task, the caller holds the
+// lock or owns the task.
+func (s *Session) setState(st *sessionTask, state TaskState) error {
+	e := StateChangedEvent{EventHeader: newEventHeader(st.task), From: st.task.State, To: state}
+	if state == TASK_STATE_ERROR {
+		e.Error, _ = st.task.Status[STATUS_ERROR].(string)
+	}
+
+	st.task.State = state
+	st.task.UpdatedAt = time.Now()
+	s.events.Publish(e)
+
+	if err := s.store.UpdateState(st.task.ID, state); err != nil {
+		dlog.Errorf("failed to store the state of task %d: %v", st.task.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// schedule starts queued downloads and complete seeds in the order of the
+// queue while there are free slots, the caller holds the lock.
+func (s *Session) schedule() {
+	if s.closed {
+		return
+	}
+
+	downloads, seeds := 0, 0
+	for _, st := range s.tasks {
+		switch st.task.State {
+		case TASK_STATE_DOWNLOADING:
+			downloads++
+		case TASK_STATE_SEEDING:
+			seeds++
+		}
+	}
+
+	for _, id := range s.queue {
+		st := s.tasks[id]
+		switch {
+		case st.task.State == TASK_STATE_QUEUED && downloads < s.cfg.MaxActiveDownloads:
+			s.startDownload(st)
+			downloads++
+		case st.task.State == TASK_STATE_COMPLETE && seeds < s.cfg.MaxActiveSeeds:
+			s.startSeeding(st)
+			seeds++
+		}
+	}
+}
+
+func (s *Session) startDownload(st *sessionTask) {
+	p := NewProcess(st.task)
+	p.Sources = s.cfg.Sources
+	p.UTP = s.cfg.UTP
+	p.Encryption = s.cfg.Encryption
+	p.Events = s.events
+	p.Counter = st.counter
+	p.Limits = st.limits
+	p.LimitOverhead = s.cfg.LimitOverhead
+	p.Port = s.listenPort()
+	p.SetPeerLimits(s.peerLimits)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prev := st.done
+	st.process = p
+	st.cancel = cancel
+	st.done = make(chan struct{})
+	s.setState(st, TASK_STATE_DOWNLOADING)
+
+	s.wg.Add(1)
+	go func(done chan struct{}) {
+		defer s.wg.Done()
+		defer close(done)
+		defer cancel()
+
+		// a stopped download of the task first stores what it has
+		if prev != nil {
+			<-prev
+		}
+
+		err := p.Start(ctx)
+		s.finished(st, p, err)
+	}(st.done)
+}
+
+// finished records the result of a download. Downloads stopped by the
+// session only keep the pieces they have for later.
+func (s *Session) finished(st *sessionTask, p *Process, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// removed tasks have nothing to keep
+	if s.tasks[st.task.ID] != st {
+		return
+	}
+	s.saveTotals(st)
+
+	if errors.Is(err, context.Canceled) {
+		st.task.SetResumePieces(p.Have())
+		if err := s.store.UpdateStatus(st.task.ID, st.task.Status); err != nil {
+			dlog.Errorf("failed to store the resume data of task %d: %v", st.task.ID, err)
+		}
+
+		return
+	}
+
+	if st.process != p {
+		return
+	}
+	st.process = nil
+	st.cancel = nil
+
+	state := TASK_STATE_COMPLETE
+	if err != nil {
+		dlog.Errorf("task %s failed: %v", st.task.Name, err)
+		st.task.Status[STATUS_ERROR] = err.Error()
+		st.task.SetResumePieces(p.Have())
+		state = TASK_STATE_ERROR
+	} else {
+		st.task.Status[STATUS_COMPLETE] = true
+		delete(st.task.Status, STATUS_PIECES)
+	}
+
+	if err := s.store.UpdateStatus(st.task.ID, st.task.Status); err != nil {
+		dlog.Errorf("failed to store the status of task %d: %v", st.task.ID, err)
+	}
+
+	s.setState(st, state)
+	s.schedule()
+}
+
+func (s *Session) startSeeding(st *sessionTask) {
+	st.seeding = make(chan struct{})
+	st.have = st.task.havePieces()
+	st.slots = newUploadSlots(s.cfg.UploadSlots)
+	s.setState(st, TASK_STATE_SEEDING)
+
+	s.wg.Add(1)
+	go func(task *Task, counter *TransferCounter, stop chan struct{}) {
+		defer s.wg.Done()
+		s.seedAnnounces(task, counter, stop)
+	}(st.task, st.counter, st.seeding)
+}
+
+// seedAnnounces announces a seeding task to the trackers and the peer sources
+// until stop is closed, the trackers are then told that the seed stopped.
+func (s *Session) seedAnnounces(task *Task, counter *TransferCounter, stop chan struct{}) {
+	tf := &task.Torrent
+	sources := s.cfg.Sources
+	// peers of a private torrent must only be learned from its trackers
+	if tf.Info.Private {
+		sources = nil
+	}
+
+	if len(tf.Trackers()) == 0 && len(sources) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	base := counter.Stats()
+	params := func(event AnnounceEvent) AnnounceParams {
+		transfer := counter.Stats()
+		return AnnounceParams{
+			Event:      event,
+			Uploaded:   transfer.Uploaded - base.Uploaded,
+			Downloaded: transfer.Downloaded - base.Downloaded,
+			Port:       s.listenPort(),
+			PeerID:     task.PeerID,
+			Result:     announceResult(s.events, task, event),
+		}
+	}
+
+	event := ANNOUNCE_EVENT_STARTED
+	for {
+		// the sources announce the port of the session to the dht
+		if len(sources) > 0 {
+			findSourcePeers(ctx, tf, sources)
+		}
+
+		interval := SEED_ANNOUNCE_INTERVAL
+		resps, err := tf.SendAnnounce(ctx, params(event))
+		if err != nil {
+			dlog.Warnf("failed to announce seed %s: %v", tf.Info.Name, err)
+		}
+		for _, resp := range resps {
+			if resp.Interval > 0 {
+				interval = min(interval, time.Duration(resp.Interval)*time.Second)
+			}
+		}
+		event = ANNOUNCE_EVENT_NONE
+
+		select {
+		case <-stop:
+			if len(tf.Trackers()) > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), EVENT_ANNOUNCE_TIMEOUT)
+				defer cancel()
+				tf.SendAnnounce(ctx, params(ANNOUNCE_EVENT_STOPPED))
+			}
+
+			return
+		case <-s.cfg.Clock.After(interval):
+		}
+	}
+}
+
+// listenPort returns the port inbound peers connect to, 0 when the session
+// does not listen.
+func (s *Session) listenPort() int {
+	if s.listener == nil {
+		return 0
+	}
+
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// stopTask stops the download or the seeding of a task, the caller holds the
+// lock.
+func (s *Session) stopTask(st *sessionTask) {
+	if st.cancel != nil {
+		st.cancel()
+		st.process = nil
+		st.cancel = nil
+	}
+
+	if st.seeding != nil {
+		close(st.seeding)
+		st.seeding = nil
+		s.saveTotals(st)
+	}
+}
+
+// saveTotals stores the transfer totals of a task, the caller holds the lock.
+func (s *Session) saveTotals(st *sessionTask) {
+	transfer := st.counter.Stats()
+	st.task.Downloaded, st.task.Uploaded, st.task.Wasted = transfer.Downloaded, transfer.Uploaded, transfer.Wasted
+
+	if err := s.store.UpdateTotals(st.task.ID, transfer.Downloaded, transfer.Uploaded, transfer.Wasted); err != nil {
+		dlog.Errorf("failed to store the totals of task %d: %v", st.task.ID, err)
+	}
+}
+
+// statsLoop samples the rates of the seeding tasks, downloads do that
+// themselves, and stores the totals of the active tasks from time to time.
+func (s *Session) statsLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(STATS_INTERVAL)
+	defer ticker.Stop()
+
+	lastSave := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.quit:
+			return
+		}
+
+		save := now.Sub(lastSave) >= TOTALS_SAVE_INTERVAL
+		if save {
+			lastSave = now
+		}
+
+		s.mu.Lock()
+		for _, st := range s.tasks {
+			if st.seeding != nil {
+				st.counter.Tick(now)
+				st.conns.tick(now)
+				s.events.Publish(StatsEvent{EventHeader: newEventHeader(st.task), TaskStats: s.taskStats(st)})
+			}
+
+			if save && (st.seeding != nil || st.process != nil) {
+				s.saveTotals(st)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// TaskStats returns the numbers of a task, the transfer counts are the
+// totals of all runs.
+func (s *Session) TaskStats(id int) (TaskStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return TaskStats{}, ErrTaskNotFound
+	}
+
+	return s.taskStats(st), nil
+}
+
+func (s *Session) taskStats(st *sessionTask) TaskStats {
+	if st.process != nil {
+		return st.process.Stats()
+	}
+
+	stats := newTaskStats(st.counter.Stats(), st.conns.stats())
+	stats.Completed, stats.Wanted, stats.Pieces, stats.TotalPieces = st.task.progress()
+	stats.finish()
+
+	return stats
+}
+
+// SetLimits changes the rate limits of all tasks together. While a profile
+// of the schedule is in effect they are used once it ends.
+func (s *Session) SetLimits(rates RateLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg.Limits = rates
+	s.applyLimits()
+}
+
+// Limits returns the rate limits of all tasks in effect.
+func (s *Session) Limits() RateLimits {
+	return s.limits.Rates()
+}
+
+// SetPeerLimits changes the rate limits of every connection, including the
+// open ones. While a profile of the schedule is in effect they are used once
+// it ends.
+func (s *Session) SetPeerLimits(rates RateLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg.PeerLimits = rates
+	s.applyLimits()
+}
+
+// PeerLimits returns the rate limits of every connection in effect.
+func (s *Session) PeerLimits() RateLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peerLimits
+}
+
+// applyLimits puts the limits of the profile in effect or of the config to
+// use, the caller holds the lock.
+func (s *Session) applyLimits() {
+	rates, peerRates := s.cfg.Limits, s.cfg.PeerLimits
+	if p, ok := s.cfg.Schedule.profile(s.profile); ok {
+		rates, peerRates = p.Limits, p.PeerLimits
+	}
+
+	s.limits.Set(rates)
+	if peerRates == s.peerLimits {
+		return
+	}
+
+	s.peerLimits = peerRates
+	for _, st := range s.tasks {
+		if st.process != nil {
+			st.process.SetPeerLimits(peerRates)
+		}
+		st.conns.setLimits(peerRates)
+	}
+}
+
+// SetTaskLimits changes and stores the rate limits of a task.
+func (s *Session) SetTaskLimits(id int, rates RateLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	st.limits.Set(rates)
+	st.task.Status[STATUS_DOWNLOAD_LIMIT] = float64(rates.Download)
+	st.task.Status[STATUS_UPLOAD_LIMIT] = float64(rates.Upload)
+
+	return s.store.UpdateStatus(id, st.task.Status)
+}
+
+func (s *Session) TaskLimits(id int) (RateLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return RateLimits{}, ErrTaskNotFound
+	}
+
+	return st.limits.Rates(), nil
+}
+
+// SetLabels replaces and stores the labels of a task.
+func (s *Session) SetLabels(id int, labels []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	if err := s.store.UpdateLabels(id, labels); err != nil {
+		return err
+	}
+	st.task.Labels = slices.Clone(labels)
+
+	return nil
+}
+
+// SetFilePriority changes and stores the priority of a file of a task. A
+// running download starts again with the new priorities, a complete task is
+// downloaded again when a file it skipped is wanted now.
+func (s *Session) SetFilePriority(id, index int, priority FilePriority) error {
+	s.mu.Lock()
+	st, ok := s.tasks[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrTaskNotFound
+	}
+
+	if index < 0 || index >= len(st.task.Torrent.Info.FileList()) {
+		s.mu.Unlock()
+		return ErrInvalidFileIndex
+	}
+
+	// the download reads the priorities until it returned
+	s.stopTask(st)
+	done := st.done
+	s.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tasks[id] != st {
+		return ErrTaskNotFound
+	}
+
+	have := st.task.havePieces()
+	if err := st.task.SetFilePriority(index, priority); err != nil {
+		return err
+	}
+
+	if err := s.store.UpdatePriorities(id, st.task.FilePriorities); err != nil {
+		return err
+	}
+
+	state := st.task.State
+	if st.task.isComplete() && !have.Contains(st.task.havePieces()) {
+		delete(st.task.Status, STATUS_COMPLETE)
+		st.task.SetResumePieces(have)
+		if err := s.store.UpdateStatus(id, st.task.Status); err != nil {
+			return err
+		}
+
+		if state != TASK_STATE_PAUSED && state != TASK_STATE_ERROR {
+			state = TASK_STATE_QUEUED
+		}
+	}
+
+	switch state {
+	case TASK_STATE_DOWNLOADING:
+		state = TASK_STATE_QUEUED
+	case TASK_STATE_SEEDING:
+		state = TASK_STATE_COMPLETE
+	}
+
+	err := s.setState(st, state)
+	s.schedule()
+
+	return err
+}
+
+// TrackerStatus is the result of the last announce to a tracker of a task,
+// Time is zero while the tracker was not announced to.
+type TrackerStatus struct {
+	URL      string
+	Time     time.Time
+	Event    AnnounceEvent
+	Peers    int
+	Interval time.Duration
+	Error    string
+}
+
+// recordAnnounce keeps the results of the announces of the downloads, events
+// dropped by a busy bus leave the previous result in place.
+func (s *Session) recordAnnounce(e Event) {
+	announce, ok := e.(AnnounceResultEvent)
+	if !ok {
+		return
+	}
+
+	status := TrackerStatus{
+		URL:      announce.Tracker,
+		Time:     announce.Time,
+		Event:    announce.Event,
+		Peers:    announce.Peers,
+		Interval: announce.Interval,
+	}
+	if announce.Err != nil {
+		status.Error = announce.Err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[announce.TaskID]; !ok {
+		return
+	}
+
+	if s.trackers[announce.TaskID] == nil {
+		s.trackers[announce.TaskID] = make(map[string]TrackerStatus)
+	}
+	s.trackers[announce.TaskID][announce.Tracker] = status
+}
+
+// Trackers returns the trackers of a task with the results of their last
+// announces.
+func (s *Session) Trackers(id int) ([]TrackerStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	trackers := make([]TrackerStatus, 0)
+	for _, url := range st.task.Torrent.Trackers() {
+		status, ok := s.trackers[id][url]
+		if !ok {
+			status = TrackerStatus{URL: url}
+		}
+		trackers = append(trackers, status)
+	}
+
+	return trackers, nil
+}
+
+// PeerStats returns the numbers of the peers a task is connected to.
+func (s *Session) PeerStats(id int) ([]PeerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	if st.process != nil {
+		return st.process.PeerStats(), nil
+	}
+
+	return st.conns.stats(), nil
+}
+
+// progress counts the wanted pieces of a task that is not running and the
+// ones it has.
+func (t *Task) progress() (completed, wanted int64, pieces, total int) {
+	have := t.ResumePieces()
+	complete := t.isComplete()
+	for index := 0; index < t.Torrent.Info.NumPieces(); index++ {
+		if t.PiecePriority(index) == FILE_PRIORITY_SKIP {
+			continue
+		}
+
+		begin, end := t.GetPieceBounds(index)
+		wanted += int64(end - begin)
+		total++
+
+		if complete || have.Test(index) {
+			completed += int64(end - begin)
+			pieces++
+		}
+	}
+
+	return
+}
+
+// activeTask returns the task seeding or downloading the torrent, nil if
+// there is none.
+func (s *Session) activeTask(infoHash [INFO_HASH_LEN]byte) *sessionTask {
+	for _, st := range s.tasks {
+		if (st.seeding != nil || st.process != nil) && st.task.Torrent.Info.Hash == infoHash {
+			return st
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		// peers beyond the limit are dropped before the handshake
+		if s.inbound >= s.cfg.MaxInbound {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+
+		s.inbound++
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			s.inbound--
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// serveConn sets up an inbound connection for one of the seeding or
+// downloading tasks. Seeds serve the peer, downloads take pieces from it.
+func (s *Session) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	hashes := make([][INFO_HASH_LEN]byte, 0)
+	for _, st := range s.tasks {
+		if st.seeding != nil || st.process != nil {
+			hashes = append(hashes, st.task.Torrent.Info.Hash)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(hashes) == 0 {
+		conn.Close()
+		return
+	}
+
+	pc, err := AcceptConn(conn, s.cfg.PeerID, hashes, &ConnConfig{
+		Encryption: s.cfg.Encryption,
+		ForInfoHash: func(infoHash [INFO_HASH_LEN]byte) *ConnConfig {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			st := s.activeTask(infoHash)
+			if st == nil || st.inbound >= s.cfg.MaxTaskInbound {
+				return nil
+			}
+
+			if st.process != nil {
+				return st.process.connConfig()
+			}
+
+			return &ConnConfig{
+				Extensions:    NewExtensionRegistry(),
+				ListenPort:    s.listenPort(),
+				NumPieces:     st.task.Torrent.Info.NumPieces(),
+				Have:          st.have,
+				Encryption:    s.cfg.Encryption,
+				Counter:       st.counter,
+				Limits:        st.limits,
+				PeerLimits:    s.peerLimits,
+				LimitOverhead: s.cfg.LimitOverhead,
+			}
+		},
+	})
+	if err != nil {
+		dlog.Infof("refused inbound peer %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	s.mu.Lock()
+	st := s.activeTask(pc.infoHash)
+	if st == nil || st.inbound >= s.cfg.MaxTaskInbound {
+		s.mu.Unlock()
+		pc.Close()
+		return
+	}
+	st.inbound++
+	defer func() {
+		s.mu.Lock()
+		st.inbound--
+		s.mu.Unlock()
+	}()
+
+	// the peer joins the download, the connection is dropped when the
+	// download stopped in the meantime
+	if p := st.process; p != nil {
+		s.mu.Unlock()
+		if !p.AddConn(pc) {
+			pc.Close()
+		}
+
+		return
+	}
+
+	task, have, slots, stop := st.task, st.have, st.slots, st.seeding
+	st.conns.add(pc)
+	s.mu.Unlock()
+
+	s.events.Publish(PeerConnectedEvent{EventHeader: newEventHeader(task), Peer: pc.peer})
+	seed(pc, task, have, &st.served, slots, stop)
+	st.conns.remove(pc)
+	s.events.Publish(PeerDisconnectedEvent{EventHeader: newEventHeader(task), Peer: pc.peer})
+}
@@ -0,0 +1,439 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/db"
+)
+
+func sessionDB(t *testing.T) *sql.DB {
+	d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "session.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func newSession(t *testing.T, cfg dgotorrent.SessionConfig) *dgotorrent.Session {
+	s, err := dgotorrent.NewSession(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func waitState(t *testing.T, s *dgotorrent.Session, id int, state dgotorrent.TaskState) dgotorrent.Task {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		task, err := s.Task(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if task.State == state {
+			return task
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("task %d is %s, expected %s", id, task.State, state)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stallingSeed replaces the web seeds of the torrent with one that never
+// answers, downloads of the torrent keep running until they are stopped.
+func stallingSeed(t *testing.T, tf *dgotorrent.TorrentFile) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	tf.URLList = []string{server.URL + "/"}
+}
+
+type staticSource []dgotorrent.Peer
+
+func (s staticSource) Name() string {
+	return "static"
+}
+
+func (s staticSource) FindPeers(ctx context.Context, tf *dgotorrent.TorrentFile) ([]dgotorrent.Peer, error) {
+	return s, nil
+}
+
+func TestSessionDownload(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(30000)},
+		{[]string{"b.bin"}, randomData(20000)},
+	})
+
+	d := sessionDB(t)
+	cfg := dgotorrent.SessionConfig{DownloadPath: t.TempDir(), DB: d}
+	s := newSession(t, cfg)
+
+	task, err := s.Add(tf, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Add(tf, dgotorrent.AddOptions{}); !errors.Is(err, dgotorrent.ErrDuplicateTask) {
+		t.Errorf("expected a duplicate task error, got %v", err)
+	}
+
+	// finished tasks are seeded
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	got, err := os.ReadFile(filepath.Join(cfg.DownloadPath, tf.Info.DiskName, "a.bin"))
+	if err != nil || !bytes.Equal(got, content[:30000]) {
+		t.Fatalf("a.bin was not downloaded: %v", err)
+	}
+
+	s.Close()
+
+	// the task is restored and seeded again by the next session
+	s = newSession(t, cfg)
+	tasks := s.Tasks()
+	if len(tasks) != 1 || tasks[0].ID != task.ID || tasks[0].State != dgotorrent.TASK_STATE_SEEDING {
+		t.Fatalf("unexpected restored tasks %+v", tasks)
+	}
+
+	if complete, _ := tasks[0].Status[dgotorrent.STATUS_COMPLETE].(bool); !complete {
+		t.Errorf("the restored task is not complete")
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	torrents := make([]*dgotorrent.TorrentFile, 3)
+	for i := range torrents {
+		torrents[i], _ = webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{{[]string{"f"}, randomData(1000)}})
+		stallingSeed(t, torrents[i])
+	}
+
+	d := sessionDB(t)
+	cfg := dgotorrent.SessionConfig{DownloadPath: t.TempDir(), MaxActiveDownloads: 1, DB: d}
+	s := newSession(t, cfg)
+
+	ids := make([]int, 0, len(torrents))
+	for i, tf := range torrents {
+		task, err := s.Add(tf, dgotorrent.AddOptions{Path: filepath.Join(cfg.DownloadPath, string(rune('a'+i)))})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, task.ID)
+	}
+
+	waitState(t, s, ids[0], dgotorrent.TASK_STATE_DOWNLOADING)
+	waitState(t, s, ids[1], dgotorrent.TASK_STATE_QUEUED)
+
+	// the last task gets the next free slot
+	if err := s.MoveQueue(ids[2], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Pause(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	waitState(t, s, ids[0], dgotorrent.TASK_STATE_PAUSED)
+	waitState(t, s, ids[2], dgotorrent.TASK_STATE_DOWNLOADING)
+	waitState(t, s, ids[1], dgotorrent.TASK_STATE_QUEUED)
+
+	if err := s.Resume(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, ids[0], dgotorrent.TASK_STATE_QUEUED)
+
+	if err := s.Remove(ids[2], true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Task(ids[2]); !errors.Is(err, dgotorrent.ErrTaskNotFound) {
+		t.Errorf("expected the task to be removed, got %v", err)
+	}
+
+	// a resumed task keeps its place in the queue
+	waitState(t, s, ids[0], dgotorrent.TASK_STATE_DOWNLOADING)
+	waitState(t, s, ids[1], dgotorrent.TASK_STATE_QUEUED)
+
+	s.Close()
+
+	// the order and the states survive a restart
+	s = newSession(t, cfg)
+	tasks := s.Tasks()
+	if len(tasks) != 2 || tasks[0].ID != ids[0] || tasks[1].ID != ids[1] {
+		t.Fatalf("unexpected restored queue %+v", tasks)
+	}
+
+	waitState(t, s, ids[0], dgotorrent.TASK_STATE_DOWNLOADING)
+	waitState(t, s, ids[1], dgotorrent.TASK_STATE_QUEUED)
+}
+
+func TestSessionSeed(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+		{[]string{"dir", "b.bin"}, randomData(10000)},
+	})
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t)})
+	task, err := seeder.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing data is verified and seeded without downloading
+	waitState(t, seeder, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	addr := seeder.Addr().(*net.TCPAddr)
+	leecher := newSession(t, dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Sources:      []dgotorrent.PeerSource{staticSource{{IP: addr.IP, Port: uint16(addr.Port)}}},
+	})
+
+	// the pieces must come from the seeder only
+	peerOnly := *tf
+	peerOnly.URLList = nil
+	task, err = leecher.Add(&peerOnly, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task = waitState(t, leecher, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	res, err := tf.Verify(task.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestSessionSeedAnnounce(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+	tracker := newEventTracker(t, tf)
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	s := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t), Clock: clock})
+	task, err := s.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	waitAnnounces := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(tracker.Announces()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d announces, got %q", n, tracker.Events())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the seed announces again after the interval of the tracker
+	waitAnnounces(1)
+	waitTimers(t, clock, 1)
+	clock.Advance(1800 * time.Second)
+	waitAnnounces(2)
+
+	if err := s.Pause(task.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitAnnounces(3)
+
+	if events := tracker.Events(); events != "started,,stopped" {
+		t.Errorf("unexpected events %q", events)
+	}
+
+	port := strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+	for _, q := range tracker.Announces() {
+		if q.Get("left") != "0" || q.Get("port") != port {
+			t.Errorf("expected left 0 and port %s, got %v", port, q)
+		}
+	}
+}
+
+// rawPeer connects to a seeding session as a peer without extensions, the
+// connection fails when the session refuses the peer.
+func rawPeer(t *testing.T, s *dgotorrent.Session, tf *dgotorrent.TorrentFile) (net.Conn, error) {
+	conn, err := dialHandshake(t, s.Addr().String(), [8]byte{}, tf.Info.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer has none of the pieces
+	writePeerMsg(conn, 5, make([]byte, (tf.Info.NumPieces()+7)/8))
+	return conn, nil
+}
+
+func TestSessionUploadSlots(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(t, dgotorrent.SessionConfig{
+		ListenAddr:     "127.0.0.1:0",
+		DB:             sessionDB(t),
+		MaxTaskInbound: 2,
+		UploadSlots:    1,
+	})
+	task, err := s.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	a, err := rawPeer(t, s, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rawPeer(t, s, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aMsgs, bMsgs := peerMsgs(a), peerMsgs(b)
+
+	writePeerMsg(a, 2, nil)
+	if !waitMsg(aMsgs, 1, 5*time.Second) {
+		t.Fatal("expected the first interested peer to be unchoked")
+	}
+
+	// the only slot is taken until the first peer loses interest
+	writePeerMsg(b, 2, nil)
+	if waitMsg(bMsgs, 1, 300*time.Millisecond) {
+		t.Fatal("expected the second peer to wait for a slot")
+	}
+
+	// peers beyond the limit of the task are refused
+	if _, err := rawPeer(t, s, tf); err == nil {
+		t.Error("expected the third peer to be refused")
+	}
+
+	writePeerMsg(a, 3, nil)
+	if !waitMsg(bMsgs, 1, 5*time.Second) {
+		t.Error("expected the second peer to be unchoked once the slot is free")
+	}
+}
+
+func TestSessionInboundDownload(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+
+	// the download has no peers but the one connecting to it
+	tf.URLList = nil
+	s := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DownloadPath: t.TempDir(), DB: sessionDB(t)})
+	task, err := s.Add(tf, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_DOWNLOADING)
+
+	// the download may not accept peers right away
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); conn == nil; {
+		if conn, err = rawPeer(t, s, tf); err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the peer sent an empty bitfield, it announces its pieces and serves them
+	writePeerMsg(conn, 1, nil)
+	for i := 0; i < tf.Info.NumPieces(); i++ {
+		writePeerMsg(conn, 4, indexMsg(i))
+	}
+	go serveBlocks(conn, content, dgotorrent.BLOCKSIZE)
+
+	task = waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+	res, err := tf.Verify(task.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestSessionFilePriority(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(30000)},
+		{[]string{"b.bin"}, randomData(20000)},
+	})
+
+	cfg := dgotorrent.SessionConfig{DownloadPath: t.TempDir(), DB: sessionDB(t)}
+	s := newSession(t, cfg)
+
+	task, err := s.Add(tf, dgotorrent.AddOptions{Exclude: []string{"b.bin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	if err := s.SetFilePriority(task.ID, 2, dgotorrent.FILE_PRIORITY_HIGH); !errors.Is(err, dgotorrent.ErrInvalidFileIndex) {
+		t.Errorf("expected an invalid file index, got %v", err)
+	}
+
+	// the skipped file is downloaded once it is wanted
+	if err := s.SetFilePriority(task.ID, 1, dgotorrent.FILE_PRIORITY_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := s.Task(task.ID); got.State == dgotorrent.TASK_STATE_SEEDING || got.FilePriority(1) != dgotorrent.FILE_PRIORITY_NORMAL {
+		t.Fatalf("unexpected task %s %v", got.State, got.FilePriorities)
+	}
+	waitState(t, s, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	got, err := os.ReadFile(filepath.Join(cfg.DownloadPath, tf.Info.DiskName, "b.bin"))
+	if err != nil || !bytes.Equal(got, content[30000:]) {
+		t.Fatalf("b.bin was not downloaded: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package dgotorrent
+
+const (
+	_SQL_INSERT_TASK = `
+		INSERT INTO tasks ("name", "torrent", "path", "status", "state", "queue_position", "downloaded", "uploaded", "wasted", "labels", "held", "created_at", "updated_at")
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	_SQL_SELECT_TASK_COLUMNS = `SELECT "id", "name", "torrent", "path", "status", "state", "queue_position", "downloaded", "uploaded", "wasted", "labels", "held", "created_at", "updated_at" FROM tasks`
+
+	_SQL_SELECT_TASK = _SQL_SELECT_TASK_COLUMNS + ` WHERE "id" = ?;`
+
+	_SQL_SELECT_TASKS = _SQL_SELECT_TASK_COLUMNS + ` ORDER BY "id";`
+
+	_SQL_SELECT_TASKS_BY_STATE = _SQL_SELECT_TASK_COLUMNS + ` WHERE "state" = ? ORDER BY "id";`
+
+	_SQL_SELECT_TASKS_BY_NAME = _SQL_SELECT_TASK_COLUMNS + ` WHERE "name" = ? ORDER BY "id";`
+
+	_SQL_UPDATE_TASK_STATE = `UPDATE tasks SET "state" = ?, "updated_at" = ? WHERE "id" = ?;`
+
+	_SQL_UPDATE_TASK_STATUS = `UPDATE tasks SET "status" = ?, "updated_at" = ? WHERE "id" = ?;`
+
+	_SQL_UPDATE_TASK_QUEUE_POSITION = `UPDATE tasks SET "queue_position" = ? WHERE "id" = ?;`
+
+	_SQL_UPDATE_TASK_LABELS = `UPDATE tasks SET "labels" = ?, "updated_at" = ? WHERE "id" = ?;`
+
+	_SQL_UPDATE_TASK_HELD = `UPDATE tasks SET "held" = ?, "updated_at" = ? WHERE "id" = ?;`
+
+	_SQL_UPDATE_TASK_TOTALS = `UPDATE tasks SET "downloaded" = ?, "uploaded" = ?, "wasted" = ? WHERE "id" = ?;`
+
+	_SQL_DELETE_TASK = `DELETE FROM tasks WHERE "id" = ?;`
+
+	_SQL_DELETE_TASK_FILES = `DELETE FROM task_files WHERE "task_id" = ?;`
+
+	_SQL_INSERT_TASK_FILE = `INSERT INTO task_files ("task_id", "file_index", "priority") VALUES (?, ?, ?);`
+
+	_SQL_SELECT_TASK_FILES = `SELECT "priority" FROM task_files WHERE "task_id" = ? ORDER BY "file_index";`
+)
@@ -0,0 +1,262 @@
+package dgotorrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// weight of the newest sample in the moving averages of the rates
+const RATE_SMOOTHING = 0.3
+
+// bytes of the bittorrent handshake, counted as overhead of a connection
+const HANDSHAKE_LEN = 68
+
+// TransferStats are the byte counts of a connection, a download or a task.
+// Payload are the blocks of pieces, overhead is everything else sent over
+// the connections. Rates are moving averages of the payload in bytes per
+// second.
+type TransferStats struct {
+	Downloaded         int64
+	Uploaded           int64
+	DownloadedOverhead int64
+	UploadedOverhead   int64
+	// Wasted are the downloaded bytes of pieces that failed the hash check.
+	Wasted       int64
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// ShareRatio is the uploaded per downloaded byte. Tasks that did not
+// download anything use the size of their data instead, 0 if it is unknown.
+func (s TransferStats) ShareRatio(size int64) float64 {
+	downloaded := s.Downloaded
+	if downloaded == 0 {
+		downloaded = size
+	}
+
+	if downloaded == 0 {
+		return 0
+	}
+
+	return float64(s.Uploaded) / float64(downloaded)
+}
+
+// TimeLeft is the time the download of left bytes takes at the current rate, -1
+// when nothing is downloaded at the moment.
+func (s TransferStats) TimeLeft(left int64) time.Duration {
+	if left <= 0 {
+		return 0
+	}
+
+	if s.DownloadRate < 1 {
+		return -1
+	}
+
+	return time.Duration(float64(left) / s.DownloadRate * float64(time.Second)).Round(time.Second)
+}
+
+// TransferCounter counts the bytes of a connection, a download or a task.
+// Counts are passed on to the parent, so the counter of a task sums up the
+// ones of its connections. All methods may be called concurrently, the ones
+// of a nil counter do nothing.
+type TransferCounter struct {
+	parent *TransferCounter
+
+	downloaded         atomic.Int64
+	uploaded           atomic.Int64
+	downloadedOverhead atomic.Int64
+	uploadedOverhead   atomic.Int64
+	wasted             atomic.Int64
+
+	mu           sync.Mutex
+	lastTick     time.Time
+	lastDown     int64
+	lastUp       int64
+	downloadRate float64
+	uploadRate   float64
+}
+
+func NewTransferCounter(parent *TransferCounter) *TransferCounter {
+	return &TransferCounter{parent: parent}
+}
+
+func (c *TransferCounter) AddDownloaded(payload, overhead int64) {
+	for ; c != nil; c = c.parent {
+		c.downloaded.Add(payload)
+		c.downloadedOverhead.Add(overhead)
+	}
+}
+
+func (c *TransferCounter) AddUploaded(payload, overhead int64) {
+	for ; c != nil; c = c.parent {
+		c.uploaded.Add(payload)
+		c.uploadedOverhead.Add(overhead)
+	}
+}
+
+func (c *TransferCounter) AddWasted(n int64) {
+	for ; c != nil; c = c.parent {
+		c.wasted.Add(n)
+	}
+}
+
+// restore sets the totals of an earlier run, they do not count into the
+// rates.
+func (c *TransferCounter) restore(downloaded, uploaded, wasted int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.downloaded.Store(downloaded)
+	c.uploaded.Store(uploaded)
+	c.wasted.Store(wasted)
+	c.lastDown, c.lastUp = downloaded, uploaded
+}
+
+// Tick takes a sample of the rates, it is called about every STATS_INTERVAL.
+// The first tick only starts the measurement.
+func (c *TransferCounter) Tick(now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	down, up := c.downloaded.Load(), c.uploaded.Load()
+	if !c.lastTick.IsZero() {
+		elapsed := now.Sub(c.lastTick).Seconds()
+		if elapsed <= 0 {
+			return
+		}
+
+		c.downloadRate += RATE_SMOOTHING * (float64(down-c.lastDown)/elapsed - c.downloadRate)
+		c.uploadRate += RATE_SMOOTHING * (float64(up-c.lastUp)/elapsed - c.uploadRate)
+	}
+
+	c.lastTick, c.lastDown, c.lastUp = now, down, up
+}
+
+func (c *TransferCounter) Stats() TransferStats {
+	if c == nil {
+		return TransferStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return TransferStats{
+		Downloaded:         c.downloaded.Load(),
+		Uploaded:           c.uploaded.Load(),
+		DownloadedOverhead: c.downloadedOverhead.Load(),
+		UploadedOverhead:   c.uploadedOverhead.Load(),
+		Wasted:             c.wasted.Load(),
+		DownloadRate:       c.downloadRate,
+		UploadRate:         c.uploadRate,
+	}
+}
+
+// TaskStats are the numbers of a download or a seeding task.
+type TaskStats struct {
+	TransferStats
+	// Completed are the verified bytes of the Wanted ones.
+	Completed   int64
+	Wanted      int64
+	Pieces      int
+	TotalPieces int
+	Peers       int
+	Seeds       int
+	Leeches     int
+	// ETA is -1 while nothing is downloaded, see TransferStats.TimeLeft.
+	ETA   time.Duration
+	Ratio float64
+}
+
+func newTaskStats(transfer TransferStats, peers []PeerStats) TaskStats {
+	stats := TaskStats{TransferStats: transfer, Peers: len(peers)}
+	stats.Seeds, stats.Leeches = PeerCounts(peers)
+
+	return stats
+}
+
+// finish fills in the numbers that follow from the others.
+func (s *TaskStats) finish() {
+	s.ETA = s.TimeLeft(s.Wanted - s.Completed)
+	s.Ratio = s.ShareRatio(s.Completed)
+}
+
+// PeerStats are the numbers of a connected peer.
+type PeerStats struct {
+	Peer Peer
+	// Seed is set once the peer has all pieces.
+	Seed bool
+	TransferStats
+}
+
+// PeerCounts splits the connected peers into seeds and leeches.
+func PeerCounts(peers []PeerStats) (seeds, leeches int) {
+	for _, p := range peers {
+		if p.Seed {
+			seeds++
+		} else {
+			leeches++
+		}
+	}
+
+	return
+}
+
+// connSet keeps the open connections of a download or a seeding task.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*PeerConn]struct{}
+}
+
+func (s *connSet) add(c *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*PeerConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+}
+
+func (s *connSet) remove(c *PeerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
+
+// tick samples the rates of all connections.
+func (s *connSet) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Counter.Tick(now)
+	}
+}
+
+// setLimits changes the limits of all connections.
+func (s *connSet) setLimits(rates RateLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Limits.Set(rates)
+	}
+}
+
+func (s *connSet) stats() []PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]PeerStats, 0, len(s.conns))
+	for c := range s.conns {
+		stats = append(stats, PeerStats{Peer: c.peer, Seed: c.IsSeed(), TransferStats: c.Counter.Stats()})
+	}
+
+	return stats
+}
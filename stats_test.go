@@ -0,0 +1,164 @@
+package dgotorrent_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+func TestTransferCounter(t *testing.T) {
+	task := dgotorrent.NewTransferCounter(nil)
+	conn := dgotorrent.NewTransferCounter(task)
+
+	now := time.Unix(1000, 0)
+	conn.Tick(now)
+	task.Tick(now)
+
+	conn.AddDownloaded(1000, 20)
+	conn.AddUploaded(500, 10)
+	conn.AddWasted(100)
+
+	now = now.Add(time.Second)
+	conn.Tick(now)
+
+	stats := task.Stats()
+	if stats.Downloaded != 1000 || stats.DownloadedOverhead != 20 || stats.Uploaded != 500 ||
+		stats.UploadedOverhead != 10 || stats.Wasted != 100 {
+		t.Fatalf("the counts did not reach the parent: %+v", stats)
+	}
+
+	// the parent has not been sampled yet
+	if stats.DownloadRate != 0 {
+		t.Errorf("unexpected rate %f", stats.DownloadRate)
+	}
+
+	stats = conn.Stats()
+	if rate := 1000 * dgotorrent.RATE_SMOOTHING; stats.DownloadRate != rate || stats.UploadRate != rate/2 {
+		t.Errorf("unexpected rates %f and %f", stats.DownloadRate, stats.UploadRate)
+	}
+
+	// the average follows a steady rate
+	for i := 0; i < 50; i++ {
+		conn.AddDownloaded(1000, 0)
+		now = now.Add(time.Second)
+		conn.Tick(now)
+	}
+
+	stats = conn.Stats()
+	if stats.DownloadRate < 999 || stats.DownloadRate > 1001 {
+		t.Errorf("expected a rate of 1000, got %f", stats.DownloadRate)
+	}
+
+	if eta := stats.TimeLeft(10000); eta != 10*time.Second {
+		t.Errorf("unexpected eta %v", eta)
+	}
+
+	if ratio := stats.ShareRatio(0); ratio != 500.0/51000 {
+		t.Errorf("unexpected ratio %f", ratio)
+	}
+
+	if eta := (dgotorrent.TransferStats{}).TimeLeft(1); eta != -1 {
+		t.Errorf("expected an unknown eta, got %v", eta)
+	}
+}
+
+func TestSessionTransferTotals(t *testing.T) {
+	tf, content := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"a.bin"}, randomData(50000)},
+	})
+
+	// the tracker sees the payload of the download in the completed announce
+	var mu sync.Mutex
+	var completed string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("event") == "completed" {
+			mu.Lock()
+			completed = q.Get("downloaded")
+			mu.Unlock()
+		}
+
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	seedDir := t.TempDir()
+	if err := tf.Info.WriteContent(seedDir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	seederCfg := dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t)}
+	seeder := newSession(t, seederCfg)
+	seeded, err := seeder.Add(tf, dgotorrent.AddOptions{Path: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seeder, seeded.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	addr := seeder.Addr().(*net.TCPAddr)
+	leecher := newSession(t, dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Sources:      []dgotorrent.PeerSource{staticSource{{IP: addr.IP, Port: uint16(addr.Port)}}},
+	})
+
+	peerOnly := *tf
+	peerOnly.URLList = nil
+	peerOnly.Announce = tracker.URL + "/announce"
+	task, err := leecher.Add(&peerOnly, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, leecher, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	stats, err := leecher.TaskStats(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Downloaded != 50000 || stats.DownloadedOverhead == 0 || stats.Completed != 50000 ||
+		stats.Wanted != 50000 || stats.Pieces != 4 || stats.ETA != 0 {
+		t.Errorf("unexpected leecher stats %+v", stats)
+	}
+
+	mu.Lock()
+	if completed != "50000" {
+		t.Errorf("expected the completed announce to report 50000 bytes, got %q", completed)
+	}
+	mu.Unlock()
+
+	// the seeder counts a block once it is written
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if stats, err = seeder.TaskStats(seeded.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Uploaded == 50000 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats.Uploaded != 50000 || stats.UploadedOverhead == 0 || stats.Downloaded != 0 || stats.Ratio != 1 {
+		t.Errorf("unexpected seeder stats %+v", stats)
+	}
+
+	// the totals survive a restart
+	seeder.Close()
+	seeder = newSession(t, seederCfg)
+
+	restored, err := seeder.Task(seeded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Uploaded != 50000 {
+		t.Errorf("expected the uploaded total to be restored, got %d", restored.Uploaded)
+	}
+}
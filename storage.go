@@ -0,0 +1,201 @@
+package dgotorrent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrShortContent = errors.New("content does not cover the files of the torrent")
+
+// WriteContent stores the concatenated content of the torrent below dir.
+// Padding files are not written, symlinks are created once the regular files
+// exist and executable files get their mode bits.
+func (info *TorrentInfo) WriteContent(dir string, data []byte) error {
+	for _, f := range info.FileList() {
+		if f.IsPadding() || f.IsSymlink() {
+			continue
+		}
+
+		if f.Offset+f.Length > int64(len(data)) {
+			return ErrShortContent
+		}
+
+		p, err := info.FilePath(dir, f)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(p, data[f.Offset:f.Offset+f.Length], 0644); err != nil {
+			return err
+		}
+	}
+
+	return info.finishFiles(dir, func(int) bool { return false })
+}
+
+// finishFiles gives the stored files their length and mode bits, empty files
+// are created and symlinks linked once the regular files exist. Files for
+// which skip returns true are left alone.
+func (info *TorrentInfo) finishFiles(dir string, skip func(int) bool) error {
+	links := make([]FileEntry, 0)
+	for i, f := range info.FileList() {
+		if f.IsPadding() || skip(i) {
+			continue
+		}
+
+		if f.IsSymlink() {
+			links = append(links, f)
+			continue
+		}
+
+		p, err := info.FilePath(dir, f)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(0644)
+		if f.IsExecutable() {
+			mode = 0755
+		}
+
+		file, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+
+		// a file left by an earlier download may be longer
+		err = file.Truncate(f.Length)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		// OpenFile keeps the mode of an existing file
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range links {
+		if err := info.createSymlink(dir, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadAt reads the content of the torrent stored below dir at the offset,
+// padding and the gaps between the files of v2 torrents read as zeros.
+func (info *TorrentInfo) ReadAt(dir string, p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > info.Length {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	clear(p)
+	files := info.FileList()
+	for _, seg := range info.fileSegments(off, int64(len(p))) {
+		f := files[seg.file]
+		if seg.padding {
+			continue
+		}
+		dst := p[f.Offset+seg.offset-off:][:seg.length]
+
+		path, err := info.FilePath(dir, f)
+		if err != nil {
+			return 0, err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = file.ReadAt(dst, seg.offset)
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// createSymlink links the file to its target, the link is relative so that
+// the download can be moved as a whole. Targets outside of the torrent are
+// refused.
+func (info *TorrentInfo) createSymlink(dir string, f FileEntry) error {
+	p, err := info.FilePath(dir, f)
+	if err != nil {
+		return err
+	}
+
+	name, err := info.diskName()
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(dir, name)
+	target := filepath.Join(append([]string{root}, f.SymlinkPath...)...)
+	if !withinDir(root, target) {
+		return &UnsafePathError{Path: f.Path, Reason: "symlink target outside of the torrent"}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(p), target)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(p)
+	return os.Symlink(rel, p)
+}
+
+// PartsPath returns the side file holding the pieces that overlap skipped
+// files, it is hidden next to the content.
+func (info *TorrentInfo) PartsPath(dir string) (string, error) {
+	name, err := info.diskName()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "."+name+".parts"), nil
+}
+
+// writePart stores a piece in the parts file, it is kept at its offset in
+// the content so the file is sparse.
+func (info *TorrentInfo) writePart(dir string, index int, piece []byte) error {
+	p, err := info.PartsPath(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	begin, _ := info.PieceBounds(index)
+	_, err = file.WriteAt(piece, begin)
+	return err
+}
@@ -0,0 +1,120 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+// attrTorrent builds a torrent with an executable file, a padding file, a
+// file carrying its sha1 and a symlink.
+func attrTorrent(t *testing.T) (*dgotorrent.TorrentFile, []byte) {
+	const pl = 16384
+
+	exe := randomData(1000)
+	doc := randomData(5000)
+	content := append(append(append([]byte{}, exe...), make([]byte, pl-len(exe))...), doc...)
+
+	docSum := sha1.Sum(doc)
+	raw, _ := bencode.Marshal(map[string]any{
+		"info": map[string]any{
+			"name":         "attrs",
+			"piece length": int64(pl),
+			"pieces":       pieceHashes(content, pl),
+			"files": []any{
+				map[string]any{"length": int64(len(exe)), "path": []any{"bin", "run"}, "attr": "x"},
+				map[string]any{"length": int64(pl - len(exe)), "path": []any{".pad", "15384"}, "attr": "p"},
+				map[string]any{"length": int64(len(doc)), "path": []any{"doc.txt"}, "sha1": string(docSum[:])},
+				map[string]any{"length": int64(0), "path": []any{"latest"}, "attr": "l", "symlink path": []any{"bin", "run"}},
+			},
+		},
+	})
+
+	tf, err := dgotorrent.NewTorrentFile(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tf, content
+}
+
+func TestFileAttrs(t *testing.T) {
+	tf, _ := attrTorrent(t)
+
+	files := tf.Info.Files
+	if !files[0].IsExecutable() || !files[1].IsPadding() || !files[2].HasSHA1() || !files[3].IsSymlink() {
+		t.Fatalf("unexpected attributes %+v", files)
+	}
+
+	if got := strings.Join(files[3].SymlinkPath, "/"); got != "bin/run" {
+		t.Errorf("expected symlink path bin/run, got %s", got)
+	}
+
+	if tf.Info.Length != 16384+5000 {
+		t.Errorf("padding must be counted in the length, got %d", tf.Info.Length)
+	}
+
+	tmf := tf.Info.MutiFiles
+	if !tmf.Subs[".pad"].Subs["15384"].IsPadding() || !tmf.Subs["bin"].Subs["run"].IsExecutable() {
+		t.Errorf("the file tree does not carry the attributes")
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+	tf, content := attrTorrent(t)
+	dir := t.TempDir()
+
+	if err := tf.Info.WriteContent(dir, content); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "attrs")
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding files must not be written")
+	}
+
+	stat, err := os.Stat(filepath.Join(root, "bin", "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode()&0100 == 0 {
+		t.Errorf("expected an executable file, got mode %v", stat.Mode())
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != filepath.Join("bin", "run") {
+		t.Errorf("expected a relative link to bin/run, got %s", target)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(root, "latest"))
+	if !bytes.Equal(data, content[:1000]) {
+		t.Errorf("the symlink does not resolve to its target")
+	}
+
+	res, err := tf.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() {
+		t.Fatalf("unexpected verify result %+v", res)
+	}
+
+	// doc.txt only spans the last piece, its sha1 catches a change as well
+	os.WriteFile(filepath.Join(root, "doc.txt"), randomData(5000), 0644)
+	res, _ = tf.Verify(dir)
+	if len(res.BadPieces) != 1 || len(res.BadFiles) != 1 || res.BadFiles[0] != "doc.txt" {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
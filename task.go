@@ -1,6 +1,8 @@
 package dgotorrent
 
 import (
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/Dizzrt/dgo-torrent/config"
@@ -13,8 +15,31 @@ const (
 	TASK_STATE_DOWNLOADING
 	TASK_STATE_COMPLETE
 	TASK_STATE_DELETE
+	// QUEUED tasks wait for a download slot of the session, SEEDING ones
+	// serve their content to other peers.
+	TASK_STATE_QUEUED
+	TASK_STATE_SEEDING
+	TASK_STATE_ERROR
 )
 
+var taskStateNames = map[TaskState]string{
+	TASK_STATE_PAUSED:      "paused",
+	TASK_STATE_DOWNLOADING: "downloading",
+	TASK_STATE_COMPLETE:    "complete",
+	TASK_STATE_DELETE:      "delete",
+	TASK_STATE_QUEUED:      "queued",
+	TASK_STATE_SEEDING:     "seeding",
+	TASK_STATE_ERROR:       "error",
+}
+
+func (s TaskState) String() string {
+	if name, ok := taskStateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("TaskState(%d)", s)
+}
+
 type Task struct {
 	ID        int
 	Name      string
@@ -25,6 +50,27 @@ type Task struct {
 	UpdatedAt time.Time
 	PeerID    string
 	Torrent   TorrentFile
+	// FilePriorities holds the priority of every file in the order of
+	// Torrent.Info.Files, all files are downloaded when it is nil.
+	FilePriorities []FilePriority
+	// QueuePosition orders the tasks waiting for a slot of the session.
+	QueuePosition int
+	// Downloaded, Uploaded and Wasted are the payload bytes transferred by
+	// all runs of the task.
+	Downloaded int64
+	Uploaded   int64
+	Wasted     int64
+	// Labels group tasks, the schedule of a session can pause all tasks of
+	// a label.
+	Labels []string
+	// Held is set on tasks paused by the schedule of a session, they are
+	// resumed when the schedule no longer pauses them.
+	Held bool
+}
+
+// HasLabel reports whether the task has the label.
+func (t *Task) HasLabel(label string) bool {
+	return slices.Contains(t.Labels, label)
 }
 
 func NewTask(tf TorrentFile) (Task, error) {
@@ -0,0 +1,366 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// TaskStore keeps tasks in the tasks table, together with the raw torrent
+// they were created from and their file priorities.
+type TaskStore struct {
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+func NewTaskStore(db *sql.DB) (*TaskStore, error) {
+	s := &TaskStore{db: db, stmts: make(map[string]*sql.Stmt)}
+
+	queries := []string{
+		_SQL_INSERT_TASK, _SQL_SELECT_TASK, _SQL_SELECT_TASKS, _SQL_SELECT_TASKS_BY_STATE, _SQL_SELECT_TASKS_BY_NAME,
+		_SQL_UPDATE_TASK_STATE, _SQL_UPDATE_TASK_STATUS, _SQL_UPDATE_TASK_QUEUE_POSITION, _SQL_UPDATE_TASK_TOTALS,
+		_SQL_UPDATE_TASK_LABELS, _SQL_UPDATE_TASK_HELD,
+		_SQL_DELETE_TASK, _SQL_DELETE_TASK_FILES, _SQL_INSERT_TASK_FILE, _SQL_SELECT_TASK_FILES,
+	}
+
+	for _, q := range queries {
+		stmt, err := db.Prepare(q)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.stmts[q] = stmt
+	}
+
+	return s, nil
+}
+
+func (s *TaskStore) Close() error {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+
+	return nil
+}
+
+// inTx runs fn in a transaction, it is rolled back when fn fails.
+func (s *TaskStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *TaskStore) stmt(tx *sql.Tx, query string) *sql.Stmt {
+	if tx == nil {
+		return s.stmts[query]
+	}
+
+	return tx.Stmt(s.stmts[query])
+}
+
+// Insert stores a new task and sets its ID. The torrent must keep its raw
+// bytes, which is the case for parsed torrents and resolved magnet links.
+func (s *TaskStore) Insert(t *Task) error {
+	if len(t.Torrent.Raw) == 0 {
+		return ErrInvalidTorrentFile
+	}
+
+	status, err := json.Marshal(t.Status)
+	if err != nil {
+		return err
+	}
+
+	labels, err := marshalLabels(t.Labels)
+	if err != nil {
+		return err
+	}
+
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	t.UpdatedAt = t.CreatedAt
+
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := s.stmt(tx, _SQL_INSERT_TASK).Exec(t.Name, t.Torrent.Raw, t.Path, string(status), t.State,
+			t.QueuePosition, t.Downloaded, t.Uploaded, t.Wasted, labels, t.Held, t.CreatedAt.Unix(), t.UpdatedAt.Unix())
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if err = s.savePriorities(tx, int(id), t.FilePriorities); err != nil {
+			return err
+		}
+
+		t.ID = int(id)
+		return nil
+	})
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (s *TaskStore) scanTask(row rowScanner) (*Task, error) {
+	var (
+		raw       []byte
+		status    string
+		labels    string
+		createdAt int64
+		updatedAt int64
+	)
+
+	t := &Task{}
+	if err := row.Scan(&t.ID, &t.Name, &raw, &t.Path, &status, &t.State, &t.QueuePosition,
+		&t.Downloaded, &t.Uploaded, &t.Wasted, &labels, &t.Held, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+
+	tf, err := NewTorrentFile(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	t.Torrent = *tf
+
+	// numbers come back as float64 from the json encoded status
+	t.Status = make(map[string]any)
+	if err := json.Unmarshal([]byte(status), &t.Status); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(labels), &t.Labels); err != nil {
+		return nil, err
+	}
+
+	// timestamps are unix seconds
+	t.CreatedAt = time.Unix(createdAt, 0)
+	t.UpdatedAt = time.Unix(updatedAt, 0)
+	return t, nil
+}
+
+// marshalLabels encodes the labels as a json array, no labels are [] and
+// not null.
+func marshalLabels(labels []string) (string, error) {
+	if labels == nil {
+		labels = []string{}
+	}
+
+	raw, err := json.Marshal(labels)
+	return string(raw), err
+}
+
+// Get returns the task with the id, ErrTaskNotFound if there is none.
+func (s *TaskStore) Get(id int) (*Task, error) {
+	t, err := s.scanTask(s.stmts[_SQL_SELECT_TASK].QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t.FilePriorities, err = s.loadPriorities(t.ID); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (s *TaskStore) list(query string, args ...any) ([]*Task, error) {
+	rows, err := s.stmts[query].Query(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]*Task, 0)
+	for rows.Next() {
+		t, err := s.scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		tasks = append(tasks, t)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the priorities are read once the rows are released
+	for _, t := range tasks {
+		if t.FilePriorities, err = s.loadPriorities(t.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return tasks, nil
+}
+
+// List returns all tasks in the order they were added.
+func (s *TaskStore) List() ([]*Task, error) {
+	return s.list(_SQL_SELECT_TASKS)
+}
+
+func (s *TaskStore) ListByState(state TaskState) ([]*Task, error) {
+	return s.list(_SQL_SELECT_TASKS_BY_STATE, state)
+}
+
+func (s *TaskStore) ListByName(name string) ([]*Task, error) {
+	return s.list(_SQL_SELECT_TASKS_BY_NAME, name)
+}
+
+func (s *TaskStore) update(query string, id int, value any) error {
+	res, err := s.stmts[query].Exec(value, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTaskNotFound
+	}
+
+	return nil
+}
+
+func (s *TaskStore) UpdateState(id int, state TaskState) error {
+	return s.update(_SQL_UPDATE_TASK_STATE, id, state)
+}
+
+func (s *TaskStore) UpdateStatus(id int, status map[string]any) error {
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return s.update(_SQL_UPDATE_TASK_STATUS, id, string(raw))
+}
+
+func (s *TaskStore) UpdateLabels(id int, labels []string) error {
+	raw, err := marshalLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	return s.update(_SQL_UPDATE_TASK_LABELS, id, raw)
+}
+
+func (s *TaskStore) UpdateHeld(id int, held bool) error {
+	return s.update(_SQL_UPDATE_TASK_HELD, id, held)
+}
+
+// UpdateQueue stores the queue positions of the tasks, the position of a task
+// is its index in ids.
+func (s *TaskStore) UpdateQueue(ids []int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		update := s.stmt(tx, _SQL_UPDATE_TASK_QUEUE_POSITION)
+		for i, id := range ids {
+			if _, err := update.Exec(i, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// UpdateTotals stores the transfer totals of a task, see Task.Downloaded.
+func (s *TaskStore) UpdateTotals(id int, downloaded, uploaded, wasted int64) error {
+	res, err := s.stmts[_SQL_UPDATE_TASK_TOTALS].Exec(downloaded, uploaded, wasted, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTaskNotFound
+	}
+
+	return nil
+}
+
+// UpdatePriorities replaces the file priorities of a task.
+func (s *TaskStore) UpdatePriorities(id int, priorities []FilePriority) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.savePriorities(tx, id, priorities)
+	})
+}
+
+func (s *TaskStore) savePriorities(tx *sql.Tx, id int, priorities []FilePriority) error {
+	if _, err := s.stmt(tx, _SQL_DELETE_TASK_FILES).Exec(id); err != nil {
+		return err
+	}
+
+	insert := s.stmt(tx, _SQL_INSERT_TASK_FILE)
+	for i, p := range priorities {
+		if _, err := insert.Exec(id, i, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *TaskStore) loadPriorities(id int) ([]FilePriority, error) {
+	rows, err := s.stmts[_SQL_SELECT_TASK_FILES].Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var priorities []FilePriority
+	for rows.Next() {
+		var p FilePriority
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+
+		priorities = append(priorities, p)
+	}
+
+	return priorities, rows.Err()
+}
+
+// Delete removes the task and its file priorities.
+func (s *TaskStore) Delete(id int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := s.stmt(tx, _SQL_DELETE_TASK_FILES).Exec(id); err != nil {
+			return err
+		}
+
+		res, err := s.stmt(tx, _SQL_DELETE_TASK).Exec(id)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrTaskNotFound
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+// infoDict returns the bencoded info dictionary of a torrent.
+func infoDict(t *testing.T, tf *dgotorrent.TorrentFile) []byte {
+	res, err := bencode.Unmarshal(bytes.NewReader(tf.Raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := bencode.Marshal(res.(map[string]any)["info"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(raw)
+}
+
+func newTaskStore(t *testing.T) *dgotorrent.TaskStore {
+	store, err := dgotorrent.NewTaskStore(sessionDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestTaskStore(t *testing.T) {
+	store := newTaskStore(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: createContent(t), Trackers: []string{"http://tracker/announce"}})
+
+	name := "store-" + time.Now().Format(time.RFC3339Nano)
+	task := &dgotorrent.Task{
+		Name:           name,
+		Path:           t.TempDir(),
+		Status:         map[string]any{"downloaded": 42, "note": "x"},
+		State:          dgotorrent.TASK_STATE_DOWNLOADING,
+		Torrent:        *tf,
+		FilePriorities: []dgotorrent.FilePriority{dgotorrent.FILE_PRIORITY_HIGH, dgotorrent.FILE_PRIORITY_SKIP},
+		Labels:         []string{"backup"},
+	}
+
+	if err := store.Insert(task); err != nil {
+		t.Fatal(err)
+	}
+
+	if task.ID == 0 {
+		t.Fatal("insert must assign an id")
+	}
+
+	got, err := store.Get(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Name != name || got.Path != task.Path || got.State != dgotorrent.TASK_STATE_DOWNLOADING {
+		t.Errorf("unexpected task %+v", got)
+	}
+
+	if got.Torrent.Info.Hash != tf.Info.Hash || got.Torrent.Announce != "http://tracker/announce" {
+		t.Errorf("the torrent was not restored")
+	}
+
+	if got.Status["downloaded"] != float64(42) || got.Status["note"] != "x" {
+		t.Errorf("unexpected status %v", got.Status)
+	}
+
+	if len(got.FilePriorities) != 2 || got.FilePriorities[1] != dgotorrent.FILE_PRIORITY_SKIP {
+		t.Errorf("unexpected priorities %v", got.FilePriorities)
+	}
+
+	if !got.HasLabel("backup") || len(got.Labels) != 1 {
+		t.Errorf("unexpected labels %v", got.Labels)
+	}
+
+	if got.CreatedAt.Unix() != task.CreatedAt.Unix() {
+		t.Errorf("expected created at %v, got %v", task.CreatedAt, got.CreatedAt)
+	}
+
+	if err := store.UpdateState(task.ID, dgotorrent.TASK_STATE_COMPLETE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateStatus(task.ID, map[string]any{"downloaded": 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdatePriorities(task.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateLabels(task.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateHeld(task.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := store.ListByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].State != dgotorrent.TASK_STATE_COMPLETE || tasks[0].Status["downloaded"] != float64(100) || tasks[0].FilePriorities != nil ||
+		len(tasks[0].Labels) != 0 || !tasks[0].Held {
+		t.Fatalf("unexpected tasks %+v", tasks)
+	}
+
+	complete, err := store.ListByState(dgotorrent.TASK_STATE_COMPLETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, c := range complete {
+		found = found || c.ID == task.ID
+	}
+
+	if !found {
+		t.Error("the task is not listed by its state")
+	}
+
+	if err := store.Delete(task.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(task.ID); err != dgotorrent.ErrTaskNotFound {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrTaskNotFound, err)
+	}
+
+	if err := store.Delete(task.ID); err != dgotorrent.ErrTaskNotFound {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrTaskNotFound, err)
+	}
+
+	if err := store.UpdateState(task.ID, dgotorrent.TASK_STATE_PAUSED); err != dgotorrent.ErrTaskNotFound {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrTaskNotFound, err)
+	}
+}
+
+func TestTaskStoreMagnet(t *testing.T) {
+	store := newTaskStore(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: createContent(t)})
+
+	// a torrent resolved from metadata keeps raw metainfo as well
+	resolved, err := dgotorrent.NewTorrentFileFromMetadata(infoDict(t, tf), []string{"udp://a/announce", "udp://b/announce"}, []string{"http://mirror/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := &dgotorrent.Task{Name: "magnet", Torrent: *resolved, Status: map[string]any{}}
+	if err := store.Insert(task); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Delete(task.ID)
+
+	got, err := store.Get(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Torrent.Info.Hash != tf.Info.Hash || len(got.Torrent.Trackers()) != 2 ||
+		len(got.Torrent.URLList) != 1 || got.Torrent.URLList[0] != "http://mirror/" {
+		t.Errorf("unexpected torrent %+v", got.Torrent)
+	}
+}
@@ -1,10 +1,10 @@
 package dgotorrent
 
 import (
-	"crypto/sha1"
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
+	"strings"
 
 	"github.com/Dizzrt/dgo-torrent/bencode"
 	"github.com/google/uuid"
@@ -12,6 +12,7 @@ import (
 
 var (
 	ErrInvalidTorrentFile = errors.New("invalid torrent file")
+	ErrPrivateTorrent     = errors.New("trackers of a private torrent can not be changed")
 )
 
 const PIECE_LEN = 20
@@ -45,11 +46,99 @@ type TorrentMutiFile struct {
 	Length    int64
 	Subs      map[string]TorrentMutiFile
 	SubsOrder []string
+	// Index is the position of a file in TorrentInfo.Files.
+	Index int
+	FileAttrs
 }
 
 type iMutiFile struct {
 	Path   []string
 	Length int64
+	FileAttrs
+}
+
+// FileAttrs are the optional attributes of a file (BEP 47). Attr holds the
+// flags: p for padding, x for executable, h for hidden and l for symlink.
+// SymlinkPath is the target of a symlink relative to the root of the torrent,
+// SHA1 the hash of the whole file if the publisher provided one.
+type FileAttrs struct {
+	Attr        string
+	SymlinkPath []string
+	SHA1        [PIECE_LEN]byte
+}
+
+// IsPadding reports whether the file only aligns the next file to a piece
+// boundary, its content is all zero and it is not stored.
+func (a FileAttrs) IsPadding() bool {
+	return strings.ContainsRune(a.Attr, 'p')
+}
+
+func (a FileAttrs) IsExecutable() bool {
+	return strings.ContainsRune(a.Attr, 'x')
+}
+
+func (a FileAttrs) IsHidden() bool {
+	return strings.ContainsRune(a.Attr, 'h')
+}
+
+// IsSymlink reports whether the file is a link to SymlinkPath, a symlink has
+// no content of its own.
+func (a FileAttrs) IsSymlink() bool {
+	return strings.ContainsRune(a.Attr, 'l') && len(a.SymlinkPath) > 0
+}
+
+func (a FileAttrs) HasSHA1() bool {
+	return a.SHA1 != [PIECE_LEN]byte{}
+}
+
+func parseFileAttrs(dict map[string]any) (FileAttrs, error) {
+	var attrs FileAttrs
+	if v, ok := dict["attr"]; ok {
+		if value, ok := v.(string); ok {
+			attrs.Attr = value
+		}
+	}
+
+	if v, ok := dict["symlink path"]; ok {
+		value, ok := v.([]any)
+		if !ok {
+			return attrs, ErrInvalidTorrentFile
+		}
+
+		for _, _p := range value {
+			p, ok := _p.(string)
+			if !ok {
+				return attrs, ErrInvalidTorrentFile
+			}
+
+			attrs.SymlinkPath = append(attrs.SymlinkPath, p)
+		}
+	}
+
+	if v, ok := dict["sha1"]; ok {
+		value, ok := v.(string)
+		if !ok || len(value) != PIECE_LEN {
+			return attrs, ErrInvalidTorrentFile
+		}
+
+		copy(attrs.SHA1[:], value)
+	}
+
+	return attrs, nil
+}
+
+// FileEntry is a file of a torrent in the order of the info dictionary,
+// Offset is its position in the concatenated content. PiecesRoot is the root
+// of the merkle tree of the file in v2 torrents (BEP 52).
+type FileEntry struct {
+	Path       []string
+	Length     int64
+	Offset     int64
+	PiecesRoot MerkleHash
+	// DiskPath is the sanitized path of the file below the directory of the
+	// torrent, it differs from Path for unsafe or colliding names.
+	DiskPath []string
+	FileAttrs
 }
 
 type TorrentInfo struct {
@@ -57,9 +146,17 @@ type TorrentInfo struct {
 	IsMutiFile  bool
 	Length      int64
 	MutiFiles   TorrentMutiFile
+	Files       []FileEntry
 	PieceLength int64
 	PieceHashes [][PIECE_LEN]byte
 	Hash        [INFO_HASH_LEN]byte
+	Private     bool
+	// MetaVersion is 2 for v2 and hybrid torrents, HashV2 is their SHA-256
+	// info hash. Hash is the truncated v2 hash for torrents without v1 data.
+	MetaVersion int64
+	HashV2      MerkleHash
+	// DiskName is the sanitized name the torrent is stored with.
+	DiskName string
 }
 
 type TorrentFile struct {
@@ -68,7 +165,18 @@ type TorrentFile struct {
 	Comment      string
 	CreatedBy    string
 	CreatedAt    int64
-	Info         TorrentInfo
+	// URLList are the web seeds of the torrent (BEP 19), HTTPSeeds the
+	// seeds of the older http seeding protocol (BEP 17).
+	URLList   []string
+	HTTPSeeds []string
+	// PieceLayers maps the pieces root of every v2 file larger than a piece
+	// to the hashes of its pieces.
+	PieceLayers map[MerkleHash][]MerkleHash
+	// Encoding is the character set of names that are not utf-8.
+	Encoding string
+	Info     TorrentInfo
+	// Raw is the bencoded metainfo the torrent was parsed from.
+	Raw []byte `json:"-"`
 }
 
 func parseAnnounceList(announceList []any) []string {
@@ -92,8 +200,30 @@ func parseAnnounceList(announceList []any) []string {
 	return list
 }
 
+func parseURLList(v any) []string {
+	if value, ok := v.(string); ok {
+		if value == "" {
+			return nil
+		}
+
+		return []string{value}
+	}
+
+	list := make([]string, 0)
+	if value, ok := v.([]any); ok {
+		for _, u := range value {
+			if u, ok := u.(string); ok && u != "" {
+				list = append(list, u)
+			}
+		}
+	}
+
+	return list
+}
+
 func parseBase(tf *TorrentFile, tfMap map[string]any) error {
-	// announce
+	// announce, trackerless torrents find their peers through the dht or
+	// web seeds
 	if v, ok := tfMap["announce"]; ok {
 		value, ok := v.(string)
 		if !ok {
@@ -101,8 +231,6 @@ func parseBase(tf *TorrentFile, tfMap map[string]any) error {
 		}
 
 		tf.Announce = value
-	} else {
-		return ErrInvalidTorrentFile
 	}
 
 	// announce-list
@@ -145,10 +273,26 @@ func parseBase(tf *TorrentFile, tfMap map[string]any) error {
 		}
 	}
 
+	// web seeds, a single url may be given as a string
+	if v, ok := tfMap["url-list"]; ok {
+		tf.URLList = parseURLList(v)
+	}
+
+	if v, ok := tfMap["httpseeds"]; ok {
+		tf.HTTPSeeds = parseURLList(v)
+	}
+
+	// encoding of the names in the info dictionary
+	if v, ok := tfMap["encoding"]; ok {
+		if value, ok := v.(string); ok {
+			tf.Encoding = value
+		}
+	}
+
 	return nil
 }
 
-func buildIMutiFile(info *TorrentInfo, fileList []any) ([]iMutiFile, error) {
+func buildIMutiFile(info *TorrentInfo, fileList []any, decode func(string) string) ([]iMutiFile, error) {
 	filesCount := len(fileList)
 	ret := make([]iMutiFile, 0, filesCount)
 
@@ -176,9 +320,12 @@ func buildIMutiFile(info *TorrentInfo, fileList []any) ([]iMutiFile, error) {
 				path := make([]string, 0, len(value))
 				for _, _p := range value {
 					if p, ok := _p.(string); ok {
-						path = append(path, p)
+						path = append(path, decode(p))
 					}
 				}
+				if len(path) == 0 {
+					return nil, &UnsafePathError{Path: path, Reason: "empty path"}
+				}
 				imf.Path = path
 			} else {
 				return nil, ErrInvalidTorrentFile
@@ -187,13 +334,29 @@ func buildIMutiFile(info *TorrentInfo, fileList []any) ([]iMutiFile, error) {
 			return nil, ErrInvalidTorrentFile
 		}
 
+		// names in utf-8 take precedence over the ones in the encoding of
+		// the torrent
+		if v, ok := file["path.utf-8"].([]any); ok && len(v) == len(imf.Path) {
+			for i, _p := range v {
+				if p, ok := _p.(string); ok {
+					imf.Path[i] = p
+				}
+			}
+		}
+
+		attrs, err := parseFileAttrs(file)
+		if err != nil {
+			return nil, err
+		}
+		imf.FileAttrs = attrs
+
 		ret = append(ret, imf)
 	}
 
 	return ret, nil
 }
 
-func buildTorrentMutiFile(upper TorrentMutiFile, path []string, length int64) TorrentMutiFile {
+func buildTorrentMutiFile(upper TorrentMutiFile, path []string, length int64, index int, attrs FileAttrs) TorrentMutiFile {
 	if len(path) == 1 {
 		upper.Subs[path[0]] = TorrentMutiFile{
 			Type:      TMF_TYPE_FILE,
@@ -201,6 +364,8 @@ func buildTorrentMutiFile(upper TorrentMutiFile, path []string, length int64) To
 			Length:    length,
 			Subs:      nil,
 			SubsOrder: nil,
+			Index:     index,
+			FileAttrs: attrs,
 		}
 
 		upper.SubsOrder = append(upper.SubsOrder, path[0])
@@ -222,42 +387,59 @@ func buildTorrentMutiFile(upper TorrentMutiFile, path []string, length int64) To
 		upper.SubsOrder = append(upper.SubsOrder, path[0])
 	}
 
-	tmf = buildTorrentMutiFile(tmf, path[1:], length)
+	tmf = buildTorrentMutiFile(tmf, path[1:], length, index, attrs)
 	upper.Subs[path[0]] = tmf
 
 	return upper
 }
 
-func parseMutiFile(info *TorrentInfo, fileList []any) error {
-	imfs, err := buildIMutiFile(info, fileList)
+func parseMutiFile(info *TorrentInfo, fileList []any, decode func(string) string) error {
+	imfs, err := buildIMutiFile(info, fileList, decode)
 	if err != nil {
 		return err
 	}
 
+	info.Files = make([]FileEntry, 0, len(imfs))
+	info.Length = 0
+	for _, v := range imfs {
+		info.Files = append(info.Files, FileEntry{Path: v.Path, Length: v.Length, Offset: info.Length, FileAttrs: v.FileAttrs})
+		info.Length += v.Length
+	}
+
+	return nil
+}
+
+// buildMutiFiles builds the file tree from the sanitized paths, so that it
+// shows the files as they are stored.
+func buildMutiFiles(info *TorrentInfo) {
 	tmf := TorrentMutiFile{
 		Type:      TMF_TYPE_DIRECTORY,
-		Name:      info.Name,
+		Name:      info.DiskName,
 		Length:    info.Length,
 		Subs:      make(map[string]TorrentMutiFile),
 		SubsOrder: make([]string, 0),
 	}
 
-	for _, v := range imfs {
-		tmf = buildTorrentMutiFile(tmf, v.Path, v.Length)
+	for i, f := range info.Files {
+		tmf = buildTorrentMutiFile(tmf, f.DiskPath, f.Length, i, f.FileAttrs)
 	}
 
 	info.MutiFiles = tmf
-	return nil
 }
 
 func parseInfo(tf *TorrentFile, infoMap map[string]any) error {
 	info := &tf.Info
+	decode := textDecoder(tf.Encoding)
 
 	// name
-	if v, ok := infoMap["name"]; ok {
+	if v, ok := infoMap["name.utf-8"]; ok {
 		if value, ok := v.(string); ok {
 			info.Name = value
 		}
+	} else if v, ok := infoMap["name"]; ok {
+		if value, ok := v.(string); ok {
+			info.Name = decode(value)
+		}
 	}
 
 	if len(info.Name) == 0 {
@@ -270,7 +452,6 @@ func parseInfo(tf *TorrentFile, infoMap map[string]any) error {
 		if ok {
 			info.PieceLength = value
 		} else {
-			fmt.Println("piece length is required")
 			return ErrInvalidTorrentFile
 		}
 	}
@@ -292,10 +473,17 @@ func parseInfo(tf *TorrentFile, infoMap map[string]any) error {
 		}
 	}
 
+	// private (BEP 27)
+	if v, ok := infoMap["private"]; ok {
+		if value, ok := v.(int64); ok {
+			info.Private = value == 1
+		}
+	}
+
 	// files
 	if v, ok := infoMap["files"]; ok {
 		if value, ok := v.([]any); ok {
-			if err := parseMutiFile(info, value); err != nil {
+			if err := parseMutiFile(info, value, decode); err != nil {
 				return err
 			}
 		} else {
@@ -311,21 +499,45 @@ func parseInfo(tf *TorrentFile, infoMap map[string]any) error {
 			} else {
 				return ErrInvalidTorrentFile
 			}
+
+			attrs, err := parseFileAttrs(infoMap)
+			if err != nil {
+				return err
+			}
+
+			info.Files = []FileEntry{{Path: []string{info.Name}, Length: info.Length, FileAttrs: attrs}}
 		}
 
 		info.IsMutiFile = false
 	}
 
+	if err := parseInfoV2(info, infoMap); err != nil {
+		return err
+	}
+
+	if err := sanitizePaths(info); err != nil {
+		return err
+	}
+
+	if info.IsMutiFile {
+		buildMutiFiles(info)
+	}
+
 	return nil
 }
 
 func NewTorrentFile(r io.Reader) (*TorrentFile, error) {
-	res, err := bencode.Unmarshal(r)
+	raw, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	tf := &TorrentFile{}
+	res, err := bencode.Unmarshal(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &TorrentFile{Raw: raw}
 	tfMap, ok := res.(map[string]any)
 	if !ok {
 		return nil, ErrInvalidTorrentFile
@@ -345,11 +557,127 @@ func NewTorrentFile(r io.Reader) (*TorrentFile, error) {
 			if err != nil {
 				return nil, err
 			}
-			tf.Info.Hash = sha1.Sum([]byte(infoBencode))
+			tf.Info.setHashes([]byte(infoBencode))
 		}
 	} else {
 		return nil, ErrInvalidTorrentFile
 	}
 
+	if tf.Info.MetaVersion == 2 {
+		if err = parsePieceLayers(tf, tfMap["piece layers"]); err != nil {
+			return nil, err
+		}
+	}
+
 	return tf, nil
 }
+
+// FileList returns the files of the torrent, single file torrents that were
+// not parsed from metainfo get their file synthesized. File indices refer to
+// this list.
+func (info *TorrentInfo) FileList() []FileEntry {
+	if len(info.Files) == 0 && !info.IsMutiFile {
+		return []FileEntry{{Path: []string{info.Name}, Length: info.Length}}
+	}
+
+	return info.Files
+}
+
+// fileSegment is the part of a file that lies within a range of the content.
+type fileSegment struct {
+	file    int
+	offset  int64
+	length  int64
+	padding bool
+}
+
+// fileSegments maps a range of the concatenated content to the files it
+// spans.
+func (info *TorrentInfo) fileSegments(offset, length int64) []fileSegment {
+	files := info.FileList()
+	segments := make([]fileSegment, 0, 1)
+	end := offset + length
+	for i, f := range files {
+		fileEnd := f.Offset + f.Length
+		if fileEnd <= offset || f.Offset >= end || f.Length == 0 {
+			continue
+		}
+
+		begin := max(offset, f.Offset)
+		segments = append(segments, fileSegment{
+			file:    i,
+			offset:  begin - f.Offset,
+			length:  min(end, fileEnd) - begin,
+			padding: f.IsPadding(),
+		})
+	}
+
+	return segments
+}
+
+// NumPieces returns the number of pieces of the content, v2 only torrents
+// have no piece hashes to count.
+func (info *TorrentInfo) NumPieces() int {
+	if info.HasV1() || info.PieceLength <= 0 {
+		return len(info.PieceHashes)
+	}
+
+	return int((info.Length + info.PieceLength - 1) / info.PieceLength)
+}
+
+// PieceBounds returns the range of the content covered by a piece.
+func (info *TorrentInfo) PieceBounds(index int) (begin, end int64) {
+	begin = int64(index) * info.PieceLength
+	end = min(begin+info.PieceLength, info.Length)
+
+	return
+}
+
+// Trackers returns the announce urls of the torrent without duplicates. The
+// announce-list of a private torrent replaces its announce url instead of
+// being merged with it, so that only the trackers chosen by the publisher
+// are contacted (BEP 12, BEP 27).
+func (tf *TorrentFile) Trackers() []string {
+	list := append([]string{tf.Announce}, tf.AnnounceList...)
+	if tf.Info.Private && len(tf.AnnounceList) > 0 {
+		list = tf.AnnounceList
+	}
+
+	trackers := make([]string, 0, len(list))
+	seen := make(map[string]bool)
+	for _, t := range list {
+		if t == "" || seen[t] {
+			continue
+		}
+
+		seen[t] = true
+		trackers = append(trackers, t)
+	}
+
+	return trackers
+}
+
+// AddTrackers merges additional trackers, e.g. the ones of a magnet link,
+// into the announce-list. Private torrents refuse any tracker that is not
+// part of the torrent file.
+func (tf *TorrentFile) AddTrackers(trackers ...string) error {
+	if tf.Info.Private {
+		return ErrPrivateTorrent
+	}
+
+	known := make(map[string]bool)
+	for _, t := range tf.Trackers() {
+		known[t] = true
+	}
+
+	for _, t := range trackers {
+		if t == "" || known[t] {
+			continue
+		}
+
+		known[t] = true
+		tf.AnnounceList = append(tf.AnnounceList, t)
+	}
+
+	return nil
+}
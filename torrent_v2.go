@@ -0,0 +1,292 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrUnsupportedMetaVersion = errors.New("unsupported meta version")
+	ErrInvalidPieceLayers     = errors.New("invalid piece layers")
+	ErrHybridMismatch         = errors.New("v1 and v2 files of the hybrid torrent do not match")
+)
+
+// HasV1 reports whether the torrent has v1 piece hashes, HasV2 whether it
+// has a v2 file tree. Hybrid torrents have both.
+func (info *TorrentInfo) HasV1() bool {
+	return len(info.PieceHashes) > 0
+}
+
+func (info *TorrentInfo) HasV2() bool {
+	return info.MetaVersion == 2
+}
+
+func (info *TorrentInfo) IsHybrid() bool {
+	return info.HasV1() && info.HasV2()
+}
+
+// TruncatedHashV2 returns the v2 info hash cut to the length of a v1 hash,
+// it identifies v2 torrents to trackers and the dht.
+func (info *TorrentInfo) TruncatedHashV2() [INFO_HASH_LEN]byte {
+	var h [INFO_HASH_LEN]byte
+	copy(h[:], info.HashV2[:])
+
+	return h
+}
+
+// setHashes computes the info hashes from the bencoded info dictionary.
+func (info *TorrentInfo) setHashes(raw []byte) {
+	info.Hash = sha1.Sum(raw)
+	if info.HasV2() {
+		info.HashV2 = sha256.Sum256(raw)
+		if !info.HasV1() {
+			info.Hash = info.TruncatedHashV2()
+		}
+	}
+}
+
+func parseInfoV2(info *TorrentInfo, infoMap map[string]any) error {
+	v, ok := infoMap["meta version"]
+	if !ok {
+		info.MetaVersion = 1
+		return nil
+	}
+
+	version, ok := v.(int64)
+	if !ok {
+		return ErrInvalidTorrentFile
+	}
+
+	if version == 1 {
+		info.MetaVersion = 1
+		return nil
+	}
+
+	if version != 2 {
+		return ErrUnsupportedMetaVersion
+	}
+
+	info.MetaVersion = 2
+
+	// v2 pieces never span files, they are power of two multiples of the
+	// merkle block size
+	pl := info.PieceLength
+	if pl < MERKLE_BLOCK_SIZE || pl&(pl-1) != 0 {
+		return ErrInvalidTorrentFile
+	}
+
+	tree, ok := infoMap["file tree"].(map[string]any)
+	if !ok {
+		return ErrInvalidTorrentFile
+	}
+
+	files := make([]FileEntry, 0)
+	if err := parseFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return ErrInvalidTorrentFile
+	}
+
+	if info.HasV1() {
+		return matchHybridFiles(info, files)
+	}
+
+	// every file starts at a piece boundary, the content spans the gaps
+	// between the files as if they were padding
+	var offset int64
+	info.Length = 0
+	for i := range files {
+		files[i].Offset = offset
+		offset += (files[i].Length + pl - 1) / pl * pl
+		info.Length = max(info.Length, files[i].Offset+files[i].Length)
+	}
+
+	info.Files = files
+	info.IsMutiFile = len(files) > 1 || len(files[0].Path) > 1
+
+	return nil
+}
+
+// parseFileTree walks the file tree in the order of its keys, a file is a
+// dictionary with an empty key holding its length and pieces root.
+func parseFileTree(node map[string]any, path []string, files *[]FileEntry) error {
+	keys := make([]string, 0, len(node))
+	for k := range node {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child, ok := node[k].(map[string]any)
+		if !ok {
+			return ErrInvalidTorrentFile
+		}
+
+		if k != "" {
+			if err := parseFileTree(child, append(append([]string{}, path...), k), files); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if len(path) == 0 {
+			return ErrInvalidTorrentFile
+		}
+
+		length, ok := child["length"].(int64)
+		if !ok || length < 0 {
+			return ErrInvalidTorrentFile
+		}
+
+		attrs, err := parseFileAttrs(child)
+		if err != nil {
+			return err
+		}
+
+		f := FileEntry{Path: path, Length: length, FileAttrs: attrs}
+
+		if length > 0 {
+			root, ok := child["pieces root"].(string)
+			if !ok || len(root) != MERKLE_HASH_LEN {
+				return ErrInvalidTorrentFile
+			}
+
+			copy(f.PiecesRoot[:], root)
+		}
+
+		*files = append(*files, f)
+	}
+
+	return nil
+}
+
+// matchHybridFiles checks that the v1 files of a hybrid torrent describe the
+// same content as its file tree and copies the pieces roots over.
+func matchHybridFiles(info *TorrentInfo, files []FileEntry) error {
+	i := 0
+	for k := range info.Files {
+		f := &info.Files[k]
+		if f.IsPadding() {
+			continue
+		}
+
+		if i >= len(files) || files[i].Length != f.Length {
+			return ErrHybridMismatch
+		}
+
+		// the file tree of a single file torrent names the file after it
+		path := f.Path
+		if !info.IsMutiFile {
+			path = []string{info.Name}
+		}
+
+		if !equalPath(files[i].Path, path) {
+			return ErrHybridMismatch
+		}
+
+		f.PiecesRoot = files[i].PiecesRoot
+		i++
+	}
+
+	if i != len(files) {
+		return ErrHybridMismatch
+	}
+
+	return nil
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parsePieceLayers reads the piece layers of a v2 torrent and checks them
+// against the pieces roots of the files.
+func parsePieceLayers(tf *TorrentFile, v any) error {
+	tf.PieceLayers = make(map[MerkleHash][]MerkleHash)
+	if v != nil {
+		layers, ok := v.(map[string]any)
+		if !ok {
+			return ErrInvalidPieceLayers
+		}
+
+		for k, l := range layers {
+			raw, ok := l.(string)
+			if !ok || len(k) != MERKLE_HASH_LEN || len(raw)%MERKLE_HASH_LEN != 0 {
+				return ErrInvalidPieceLayers
+			}
+
+			var root MerkleHash
+			copy(root[:], k)
+
+			layer := make([]MerkleHash, len(raw)/MERKLE_HASH_LEN)
+			for i := range layer {
+				copy(layer[i][:], raw[i*MERKLE_HASH_LEN:])
+			}
+
+			tf.PieceLayers[root] = layer
+		}
+	}
+
+	pl := tf.Info.PieceLength
+	for _, f := range tf.Info.Files {
+		if f.IsPadding() || f.Length <= pl {
+			continue
+		}
+
+		layer, ok := tf.PieceLayers[f.PiecesRoot]
+		if !ok || int64(len(layer)) != (f.Length+pl-1)/pl || layerRoot(layer, pl) != f.PiecesRoot {
+			return ErrInvalidPieceLayers
+		}
+	}
+
+	return nil
+}
+
+// verifyPieceV2 checks a piece of a v2 or hybrid torrent against the piece
+// layer of its file, files of one piece against their pieces root. The gap
+// after the end of the file must be zeros.
+func (tf *TorrentFile) verifyPieceV2(index int, data []byte) bool {
+	pl := tf.Info.PieceLength
+	offset := int64(index) * pl
+	for _, f := range tf.Info.Files {
+		if f.Length == 0 || offset < f.Offset || offset >= f.Offset+f.Length {
+			continue
+		}
+
+		n := min(pl, f.Offset+f.Length-offset)
+		if int64(len(data)) < n || len(bytes.TrimLeft(data[n:], "\x00")) > 0 {
+			return false
+		}
+
+		root, layer, err := fileMerkle(bytes.NewReader(data[:n]), n, pl)
+		if err != nil {
+			return false
+		}
+
+		if f.Length <= pl {
+			return root == f.PiecesRoot
+		}
+
+		pieces := tf.PieceLayers[f.PiecesRoot]
+		i := int((offset - f.Offset) / pl)
+		return i < len(pieces) && layer[0] == pieces[i]
+	}
+
+	return false
+}
@@ -0,0 +1,276 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+// createContent writes a directory with files of different sizes, one of
+// them spans several pieces of 16 KiB.
+func createContent(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "content")
+	files := map[string]int{
+		"a.bin":         100,
+		"big/large.bin": 5*dgotorrent.MERKLE_BLOCK_SIZE + 123,
+		"big/zero":      0,
+		"z.txt":         dgotorrent.MERKLE_BLOCK_SIZE,
+	}
+
+	for name, size := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, randomData(size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func createTorrent(t *testing.T, opts dgotorrent.CreateOptions) *dgotorrent.TorrentFile {
+	raw, err := dgotorrent.CreateTorrent(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := dgotorrent.NewTorrentFile(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tf
+}
+
+func TestMerkleRoot(t *testing.T) {
+	dir := t.TempDir()
+	data := randomData(3 * dgotorrent.MERKLE_BLOCK_SIZE)
+	os.WriteFile(filepath.Join(dir, "f"), data, 0644)
+
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: filepath.Join(dir, "f"), Version: dgotorrent.CREATE_V2, PieceLength: dgotorrent.MERKLE_BLOCK_SIZE})
+
+	pair := func(a, b [32]byte) [32]byte { return sha256.Sum256(append(a[:], b[:]...)) }
+	h0 := sha256.Sum256(data[:dgotorrent.MERKLE_BLOCK_SIZE])
+	h1 := sha256.Sum256(data[dgotorrent.MERKLE_BLOCK_SIZE : 2*dgotorrent.MERKLE_BLOCK_SIZE])
+	h2 := sha256.Sum256(data[2*dgotorrent.MERKLE_BLOCK_SIZE:])
+	want := pair(pair(h0, h1), pair(h2, [32]byte{}))
+
+	if got := tf.Info.Files[0].PiecesRoot; got != dgotorrent.MerkleHash(want) {
+		t.Errorf("expected pieces root %x, got %s", want, got)
+	}
+
+	if layer := tf.PieceLayers[tf.Info.Files[0].PiecesRoot]; len(layer) != 3 || layer[2] != dgotorrent.MerkleHash(h2) {
+		t.Errorf("unexpected piece layer %v", layer)
+	}
+}
+
+func TestCreateV2(t *testing.T) {
+	dir := createContent(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: dir, Version: dgotorrent.CREATE_V2, PieceLength: 2 * dgotorrent.MERKLE_BLOCK_SIZE})
+
+	info := tf.Info
+	if !info.HasV2() || info.HasV1() || !info.IsMutiFile || info.Name != "content" {
+		t.Fatalf("unexpected v2 torrent: %+v", info)
+	}
+
+	if info.Hash != info.TruncatedHashV2() || info.HashV2.IsZero() {
+		t.Errorf("the info hash of a v2 torrent must be the truncated sha-256 hash")
+	}
+
+	paths := make([]string, 0)
+	for _, f := range info.Files {
+		paths = append(paths, strings.Join(f.Path, "/"))
+		if f.Offset%info.PieceLength != 0 {
+			t.Errorf("file %v does not start at a piece boundary", f.Path)
+		}
+	}
+
+	if got := strings.Join(paths, ","); got != "a.bin,big/large.bin,big/zero,z.txt" {
+		t.Errorf("unexpected file order %s", got)
+	}
+
+	if len(tf.PieceLayers) != 1 {
+		t.Errorf("expected one piece layer, got %d", len(tf.PieceLayers))
+	}
+
+	res, err := tf.Verify(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() || res.CheckedV1 || !res.CheckedV2 {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestSessionDownloadV2(t *testing.T) {
+	dir := createContent(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: dir, Version: dgotorrent.CREATE_V2, PieceLength: 2 * dgotorrent.MERKLE_BLOCK_SIZE})
+
+	// the content spans the gaps between the files up to the end of the last
+	last := tf.Info.Files[len(tf.Info.Files)-1]
+	if tf.Info.Length != last.Offset+last.Length || tf.Info.NumPieces() != 5 {
+		t.Fatalf("unexpected length %d of %d pieces", tf.Info.Length, tf.Info.NumPieces())
+	}
+
+	seeder := newSession(t, dgotorrent.SessionConfig{ListenAddr: "127.0.0.1:0", DB: sessionDB(t)})
+	seeded, err := seeder.Add(tf, dgotorrent.AddOptions{Path: filepath.Dir(dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seeder, seeded.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	addr := seeder.Addr().(*net.TCPAddr)
+	leecher := newSession(t, dgotorrent.SessionConfig{
+		DownloadPath: t.TempDir(),
+		DB:           sessionDB(t),
+		Sources:      []dgotorrent.PeerSource{staticSource{{IP: addr.IP, Port: uint16(addr.Port)}}},
+	})
+
+	task, err := leecher.Add(tf, dgotorrent.AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task = waitState(t, leecher, task.ID, dgotorrent.TASK_STATE_SEEDING)
+
+	res, err := tf.Verify(task.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() || !res.CheckedV2 {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestCreateHybrid(t *testing.T) {
+	dir := createContent(t)
+	tf := createTorrent(t, dgotorrent.CreateOptions{Path: dir, Version: dgotorrent.CREATE_HYBRID, PieceLength: dgotorrent.MERKLE_BLOCK_SIZE})
+
+	info := tf.Info
+	if !info.IsHybrid() {
+		t.Fatal("expected a hybrid torrent")
+	}
+
+	if info.Hash == info.TruncatedHashV2() {
+		t.Error("hybrid torrents keep their sha-1 info hash")
+	}
+
+	padding := 0
+	for _, f := range info.Files {
+		if f.IsPadding() {
+			padding++
+			continue
+		}
+
+		if f.Offset%info.PieceLength != 0 {
+			t.Errorf("file %v does not start at a piece boundary", f.Path)
+		}
+
+		if f.Length > 0 && f.PiecesRoot.IsZero() {
+			t.Errorf("file %v has no pieces root", f.Path)
+		}
+	}
+
+	if padding != 2 {
+		t.Errorf("expected 2 padding files, got %d", padding)
+	}
+
+	res, err := tf.Verify(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() || !res.CheckedV1 || !res.CheckedV2 {
+		t.Fatalf("unexpected verify result %+v", res)
+	}
+
+	// a corrupted byte is caught by both versions
+	p := filepath.Join(dir, "big", "large.bin")
+	data, _ := os.ReadFile(p)
+	data[3*dgotorrent.MERKLE_BLOCK_SIZE] ^= 0xff
+	os.WriteFile(p, data, 0644)
+
+	res, err = tf.Verify(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.BadPieces) != 1 || len(res.BadFiles) != 1 || res.BadFiles[0] != "big/large.bin" {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestCreateSingleFileHybrid(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "single.iso")
+	os.WriteFile(p, randomData(40000), 0644)
+
+	tf := createTorrent(t, dgotorrent.CreateOptions{
+		Path:     p,
+		Version:  dgotorrent.CREATE_HYBRID,
+		Trackers: []string{"http://tracker/announce"},
+		URLList:  []string{"http://mirror/"},
+	})
+
+	if !tf.Info.IsHybrid() || tf.Info.IsMutiFile || tf.Info.Length != 40000 || tf.Announce != "http://tracker/announce" {
+		t.Fatalf("unexpected torrent %+v", tf.Info)
+	}
+
+	res, err := tf.Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK() {
+		t.Errorf("unexpected verify result %+v", res)
+	}
+}
+
+func TestInvalidPieceLayers(t *testing.T) {
+	raw, err := dgotorrent.CreateTorrent(dgotorrent.CreateOptions{Path: createContent(t), Version: dgotorrent.CREATE_V2, PieceLength: dgotorrent.MERKLE_BLOCK_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := bencode.Unmarshal(bytes.NewReader(raw))
+	meta := res.(map[string]any)
+	for k, v := range meta["piece layers"].(map[string]any) {
+		layer := []byte(v.(string))
+		layer[0] ^= 0xff
+		meta["piece layers"].(map[string]any)[k] = string(layer)
+	}
+
+	tampered, _ := bencode.Marshal(meta)
+	if _, err = dgotorrent.NewTorrentFile(strings.NewReader(tampered)); err != dgotorrent.ErrInvalidPieceLayers {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrInvalidPieceLayers, err)
+	}
+
+	delete(meta, "piece layers")
+	tampered, _ = bencode.Marshal(meta)
+	if _, err = dgotorrent.NewTorrentFile(strings.NewReader(tampered)); err != dgotorrent.ErrInvalidPieceLayers {
+		t.Errorf("expected %v without piece layers, got %v", dgotorrent.ErrInvalidPieceLayers, err)
+	}
+}
+
+func TestUnsupportedMetaVersion(t *testing.T) {
+	raw, _ := bencode.Marshal(map[string]any{
+		"info": map[string]any{
+			"name":         "v3",
+			"piece length": int64(16384),
+			"meta version": int64(3),
+			"file tree":    map[string]any{},
+		},
+	})
+
+	if _, err := dgotorrent.NewTorrentFile(strings.NewReader(raw)); err != dgotorrent.ErrUnsupportedMetaVersion {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrUnsupportedMetaVersion, err)
+	}
+}
@@ -1,8 +1,10 @@
 package dgotorrent
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
@@ -18,8 +20,157 @@ import (
 
 var (
 	ErrInvalidTrackerResp = errors.New("invalid tracker resp")
+	ErrTrackerFailure     = errors.New("tracker failure")
 )
 
+// actions of the udp tracker protocol (BEP 15)
+const (
+	UDP_ACTION_CONNECT  = 0
+	UDP_ACTION_ANNOUNCE = 1
+	UDP_ACTION_ERROR    = 3
+)
+
+// port announced when the announce does not name one
+const DEFAULT_ANNOUNCE_PORT = 6666
+
+// AnnounceEvent tells the trackers why we announce, the values are the ones
+// of the udp tracker protocol.
+type AnnounceEvent uint32
+
+const (
+	ANNOUNCE_EVENT_NONE AnnounceEvent = iota
+	ANNOUNCE_EVENT_COMPLETED
+	ANNOUNCE_EVENT_STARTED
+	ANNOUNCE_EVENT_STOPPED
+)
+
+func (e AnnounceEvent) String() string {
+	switch e {
+	case ANNOUNCE_EVENT_COMPLETED:
+		return "completed"
+	case ANNOUNCE_EVENT_STARTED:
+		return "started"
+	case ANNOUNCE_EVENT_STOPPED:
+		return "stopped"
+	}
+
+	return ""
+}
+
+// AnnounceParams are the numbers reported to the trackers.
+type AnnounceParams struct {
+	Event      AnnounceEvent
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	// Port defaults to DEFAULT_ANNOUNCE_PORT, PeerID to the one of the config.
+	Port   int
+	PeerID string
+	// Result is called with the outcome of every tracker, concurrently. resp
+	// is nil when the announce failed.
+	Result func(tracker string, resp *TrackerResp, err error)
+}
+
+func (p AnnounceParams) port() int {
+	if p.Port == 0 {
+		return DEFAULT_ANNOUNCE_PORT
+	}
+
+	return p.Port
+}
+
+func (p AnnounceParams) peerID() string {
+	if p.PeerID == "" {
+		return config.Instance().GetPeerID()
+	}
+
+	return p.PeerID
+}
+
+func (p AnnounceParams) report(tracker string, resp *TrackerResp, err error) {
+	if p.Result != nil {
+		p.Result(tracker, resp, err)
+	}
+}
+
+// announceKey is sent as the "key" parameter of every announce, it stays the
+// same for the lifetime of the process so that trackers can recognize us
+// when our ip address changes.
+var announceKey = rand.Uint32()
+
+// trackerIDs remembers the "tracker id" issued by each tracker, it has to be
+// sent back on the following announces.
+var trackerIDs = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func trackerIDKey(tracker string, infoHash [INFO_HASH_LEN]byte) string {
+	return tracker + "#" + string(infoHash[:])
+}
+
+func getTrackerID(tracker string, infoHash [INFO_HASH_LEN]byte) string {
+	trackerIDs.Lock()
+	defer trackerIDs.Unlock()
+
+	return trackerIDs.m[trackerIDKey(tracker, infoHash)]
+}
+
+func setTrackerID(tracker string, infoHash [INFO_HASH_LEN]byte, id string) {
+	trackerIDs.Lock()
+	defer trackerIDs.Unlock()
+
+	trackerIDs.m[trackerIDKey(tracker, infoHash)] = id
+}
+
+// externalIP is our address as seen by the trackers.
+var externalIP = struct {
+	sync.Mutex
+	ip net.IP
+}{}
+
+// ExternalIP returns our address as reported by the last tracker that told
+// it, nil while unknown.
+func ExternalIP() net.IP {
+	externalIP.Lock()
+	defer externalIP.Unlock()
+
+	return externalIP.ip
+}
+
+func setExternalIP(ip net.IP) {
+	externalIP.Lock()
+	defer externalIP.Unlock()
+
+	externalIP.ip = ip
+}
+
+// publicAddrs returns the first public ipv4 and ipv6 address of the local
+// interfaces.
+func publicAddrs() (ipv4 net.IP, ipv6 net.IP) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if ipv4 == nil {
+				ipv4 = ip4
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+
+	return ipv4, ipv6
+}
+
 type TrackerResp struct {
 	Complete    int64  `bencode:"complete"`
 	Downloaded  int64  `bencode:"downloaded"`
@@ -27,11 +178,44 @@ type TrackerResp struct {
 	Interval    int64  `bencode:"interval"`
 	MinInterval int64  `bencode:"min interval"`
 	Peers       []byte `bencode:"peers"`
+	Peers6      []byte `bencode:"peers6"`
+	TrackerID   string `bencode:"tracker id"`
+	ExternalIP  net.IP `bencode:"external ip"`
+}
+
+// dictPeers converts a non compact peer list into the compact forms of both
+// address families.
+func dictPeers(list []any) (peers []byte, peers6 []byte) {
+	for _, v := range list {
+		value, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		host, _ := value["ip"].(string)
+		port, _ := value["port"].(int64)
+		ip := net.ParseIP(host)
+		if ip == nil || port <= 0 || port > 0xffff {
+			continue
+		}
+
+		peer := []Peer{{IP: ip, Port: uint16(port)}}
+		peers = append(peers, encodeCompactPeers(peer)...)
+		peers6 = append(peers6, encodeCompactPeers6(peer)...)
+	}
+
+	return
 }
 
 func parseTrackerResp(resp map[string]any) (TrackerResp, error) {
 	ret := TrackerResp{}
 
+	// the tracker rejected the announce
+	if v, ok := resp["failure reason"]; ok {
+		reason, _ := v.(string)
+		return ret, fmt.Errorf("%w: %s", ErrTrackerFailure, reason)
+	}
+
 	if v, ok := resp["complete"]; ok {
 		value, ok := v.(int64)
 		if ok {
@@ -77,40 +261,82 @@ func parseTrackerResp(resp map[string]any) (TrackerResp, error) {
 		ret.MinInterval = 0
 	}
 
-	if v, ok := resp["peers"]; ok {
+	if v, ok := resp["tracker id"]; ok {
 		value, ok := v.(string)
 		if ok {
+			ret.TrackerID = value
+		}
+	}
+
+	if v, ok := resp["peers"]; ok {
+		switch value := v.(type) {
+		case string:
 			ret.Peers = []byte(value)
+		case []any:
+			ret.Peers, ret.Peers6 = dictPeers(value)
 		}
 	} else {
 		ret.Peers = nil
 	}
 
+	if v, ok := resp["peers6"]; ok {
+		value, ok := v.(string)
+		if ok {
+			ret.Peers6 = append(ret.Peers6, value...)
+		}
+	}
+
+	if v, ok := resp["external ip"]; ok {
+		value, ok := v.(string)
+		if ok && (len(value) == IP_LEN || len(value) == IPV6_LEN) {
+			ret.ExternalIP = net.IP(value)
+		}
+	}
+
 	return ret, nil
 }
 
-func (tf *TorrentFile) buildHttpTrackerUrl(tracker string) (string, error) {
+func (tf *TorrentFile) buildHttpTrackerUrl(tracker string, announce AnnounceParams) (string, error) {
 	base, err := url.Parse(tracker)
 	if err != nil {
 		return "", err
 	}
 
-	peerID := config.Instance().GetPeerID()
 	params := url.Values{
 		"info_hash":  []string{string(tf.Info.Hash[:])},
-		"peer_id":    []string{peerID},
-		"port":       []string{strconv.Itoa(6666)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{announce.peerID()},
+		"port":       []string{strconv.Itoa(announce.port())},
+		"uploaded":   []string{strconv.FormatInt(announce.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(announce.Downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(tf.Info.Length))},
+		"left":       []string{strconv.FormatInt(announce.Left, 10)},
+		"key":        []string{fmt.Sprintf("%08x", announceKey)},
+	}
+
+	if announce.Event != ANNOUNCE_EVENT_NONE {
+		params.Set("event", announce.Event.String())
+	}
+
+	if id := getTrackerID(tracker, tf.Info.Hash); id != "" {
+		params.Set("trackerid", id)
+	}
+
+	// let the tracker know the address of the other family (BEP 7)
+	ipv4, ipv6 := publicAddrs()
+	if ipv4 != nil {
+		params.Set("ipv4", ipv4.String())
+	}
+
+	if ipv6 != nil {
+		params.Set("ipv6", ipv6.String())
 	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (tf *TorrentFile) requestHttpTrackers(httpTrackers []string) ([]TrackerResp, error) {
+func (tf *TorrentFile) requestHttpTrackers(ctx context.Context, httpTrackers []string, announce AnnounceParams) ([]TrackerResp, error) {
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 	respList := make([]TrackerResp, 0)
 	for _, tracker := range httpTrackers {
@@ -118,35 +344,15 @@ func (tf *TorrentFile) requestHttpTrackers(httpTrackers []string) ([]TrackerResp
 		go func(tracker string) {
 			defer wg.Done()
 
-			client := &http.Client{Timeout: 15 * time.Second}
-			url, err := tf.buildHttpTrackerUrl(tracker)
-			if err != nil {
-				dlog.Errorf("Failed to build http tracker url with error: %v", err)
-				return
-			}
-
-			clientResp, err := client.Get(url)
-			if err != nil {
-				dlog.Errorf("Failed to request http tracker with error: %v", err)
-				return
-			}
-			defer clientResp.Body.Close()
-
-			res, err := bencode.Unmarshal(clientResp.Body)
-			if err != nil {
-				dlog.Errorf("Failed to unmarshal http tracker res with error: %v", err)
+			resp, err := tf.requestHttpTracker(ctx, tracker, announce)
+			announce.report(tracker, resp, err)
+			if resp == nil {
 				return
 			}
 
-			if v, ok := res.(map[string]any); ok {
-				resp, err := parseTrackerResp(v)
-				if err != nil {
-					dlog.Errorf("Failed to parse http tracker resp with error: %v", err)
-					return
-				}
-
-				respList = append(respList, resp)
-			}
+			mu.Lock()
+			respList = append(respList, *resp)
+			mu.Unlock()
 		}(tracker)
 	}
 
@@ -154,6 +360,55 @@ func (tf *TorrentFile) requestHttpTrackers(httpTrackers []string) ([]TrackerResp
 	return respList, nil
 }
 
+func (tf *TorrentFile) requestHttpTracker(ctx context.Context, tracker string, announce AnnounceParams) (*TrackerResp, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	url, err := tf.buildHttpTrackerUrl(tracker, announce)
+	if err != nil {
+		dlog.Errorf("Failed to build http tracker url with error: %v", err)
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		dlog.Errorf("Failed to build http tracker request with error: %v", err)
+		return nil, err
+	}
+
+	clientResp, err := client.Do(req)
+	if err != nil {
+		dlog.Errorf("Failed to request http tracker with error: %v", err)
+		return nil, err
+	}
+	defer clientResp.Body.Close()
+
+	res, err := bencode.Unmarshal(clientResp.Body)
+	if err != nil {
+		dlog.Errorf("Failed to unmarshal http tracker res with error: %v", err)
+		return nil, err
+	}
+
+	v, ok := res.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidTrackerResp
+	}
+
+	resp, err := parseTrackerResp(v)
+	if err != nil {
+		dlog.Errorf("Failed to parse http tracker resp with error: %v", err)
+		return nil, err
+	}
+
+	if resp.TrackerID != "" {
+		setTrackerID(tracker, tf.Info.Hash, resp.TrackerID)
+	}
+
+	if resp.ExternalIP != nil {
+		setExternalIP(resp.ExternalIP)
+	}
+
+	return &resp, nil
+}
+
 func resolveUDPTracker(tracker string) (*net.UDPAddr, error) {
 	parsedUrl, err := url.Parse(tracker)
 	if err != nil {
@@ -174,7 +429,7 @@ func resolveUDPTracker(tracker string) (*net.UDPAddr, error) {
 func connectUDPTracker(conn *net.UDPConn, transactionID uint32) (uint64, error) {
 	data := make([]byte, 16)
 	binary.BigEndian.PutUint64(data[0:8], 0x41727101980) // protocol_id - magic number
-	binary.BigEndian.PutUint32(data[8:12], 0)            // action 0: connect
+	binary.BigEndian.PutUint32(data[8:12], UDP_ACTION_CONNECT)
 	binary.BigEndian.PutUint32(data[12:16], transactionID)
 
 	_, err := conn.Write(data)
@@ -184,41 +439,64 @@ func connectUDPTracker(conn *net.UDPConn, transactionID uint32) (uint64, error)
 	}
 
 	conn.SetDeadline(time.Now().Add(15 * time.Second))
-	buf := make([]byte, 16)
-	_, err = conn.Read(buf)
+	buf := make([]byte, 1024)
+	n, err := readUDPReply(conn, buf, UDP_ACTION_CONNECT, transactionID)
 	if err != nil {
-		dlog.Errorf("Faile to read udp message, error: %v", err)
 		return 0, err
 	}
 
-	// action := binary.BigEndian.Uint32(buf[0:4])
-	// transaction_id := binary.BigEndian.Uint32(buf[4:8])
+	if n < 16 {
+		return 0, ErrInvalidTrackerResp
+	}
+
 	connectionID := binary.BigEndian.Uint64(buf[8:16])
 	return connectionID, nil
 }
 
-func (tf *TorrentFile) buildUDPTrackerPackage(connectionID uint64, transactionID uint32) []byte {
+// readUDPReply reads the reply of the tracker to the request with the
+// transaction id, error replies return the message of the tracker.
+func readUDPReply(conn *net.UDPConn, buf []byte, action, transactionID uint32) (int, error) {
+	n, err := conn.Read(buf)
+	if err != nil {
+		dlog.Errorf("Failed to read udp message, error: %v", err)
+		return 0, err
+	}
+
+	if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+		return 0, ErrInvalidTrackerResp
+	}
+
+	switch binary.BigEndian.Uint32(buf[0:4]) {
+	case action:
+		return n, nil
+	case UDP_ACTION_ERROR:
+		return 0, fmt.Errorf("%w: %s", ErrTrackerFailure, buf[8:n])
+	default:
+		return 0, ErrInvalidTrackerResp
+	}
+}
+
+func (tf *TorrentFile) buildUDPTrackerPackage(connectionID uint64, transactionID uint32, announce AnnounceParams) []byte {
 	data := make([]byte, 98)
 	binary.BigEndian.PutUint64(data[0:8], connectionID)
-	binary.BigEndian.PutUint32(data[8:12], 1)
+	binary.BigEndian.PutUint32(data[8:12], UDP_ACTION_ANNOUNCE)
 	binary.BigEndian.PutUint32(data[12:16], transactionID)
 	copy(data[16:36], tf.Info.Hash[:])
-	copy(data[36:56], config.Instance().GetPeerID())
-	binary.BigEndian.PutUint64(data[56:64], 0)
-	binary.BigEndian.PutUint64(data[64:72], uint64(tf.Info.Length))
-	binary.BigEndian.PutUint64(data[72:80], 0)
-	binary.BigEndian.PutUint32(data[80:84], 2)
+	copy(data[36:56], announce.peerID())
+	binary.BigEndian.PutUint64(data[56:64], uint64(announce.Downloaded))
+	binary.BigEndian.PutUint64(data[64:72], uint64(announce.Left))
+	binary.BigEndian.PutUint64(data[72:80], uint64(announce.Uploaded))
+	binary.BigEndian.PutUint32(data[80:84], uint32(announce.Event))
 	binary.BigEndian.PutUint32(data[84:88], 0)
-	binary.BigEndian.PutUint32(data[88:92], 0)
+	binary.BigEndian.PutUint32(data[88:92], announceKey)
 	binary.BigEndian.PutUint32(data[92:96], 0xffffffff)
-	binary.BigEndian.PutUint16(data[96:98], 6666)
+	binary.BigEndian.PutUint16(data[96:98], uint16(announce.port()))
 
 	return data
 }
 
-func (tf *TorrentFile) requestUdpTrackers(udpTrackers []string) ([]TrackerResp, error) {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-
+func (tf *TorrentFile) requestUdpTrackers(ctx context.Context, udpTrackers []string, announce AnnounceParams) ([]TrackerResp, error) {
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 	respList := make([]TrackerResp, 0)
 	for _, tracker := range udpTrackers {
@@ -226,68 +504,95 @@ func (tf *TorrentFile) requestUdpTrackers(udpTrackers []string) ([]TrackerResp,
 		go func(tracker string) {
 			defer wg.Done()
 
-			addr, err := resolveUDPTracker(tracker)
-			if err != nil {
+			resp, err := tf.requestUdpTracker(ctx, tracker, announce)
+			announce.report(tracker, resp, err)
+			if resp == nil {
 				return
 			}
 
-			conn, err := net.DialUDP("udp", nil, addr)
-			if err != nil {
-				dlog.Errorf("Failed to dial udp, error: %v", err)
-				return
-			}
-			defer conn.Close()
+			mu.Lock()
+			respList = append(respList, *resp)
+			mu.Unlock()
+		}(tracker)
+	}
 
-			cid, err := connectUDPTracker(conn, r.Uint32())
-			if err != nil {
-				return
-			}
+	wg.Wait()
+	return respList, nil
+}
 
-			data := tf.buildUDPTrackerPackage(cid, r.Uint32())
-			_, err = conn.Write(data)
-			if err != nil {
-				dlog.Errorf("Failed to request peers, error: %v", err)
-				return
-			}
-			conn.SetDeadline(time.Now().Add(15 * time.Second))
+func (tf *TorrentFile) requestUdpTracker(ctx context.Context, tracker string, announce AnnounceParams) (*TrackerResp, error) {
+	addr, err := resolveUDPTracker(tracker)
+	if err != nil {
+		return nil, err
+	}
 
-			buf := make([]byte, 3092)
-			oob := make([]byte, 1024)
-			n, _, flags, _, err := conn.ReadMsgUDP(buf, oob)
-			if err != nil {
-				dlog.Errorf("Failed to read peers, error: %v", err)
-				return
-			}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		dlog.Errorf("Failed to dial udp, error: %v", err)
+		return nil, err
+	}
+	defer conn.Close()
 
-			dlog.Info(flags)
-			// if flags&syscall.MSG_TRUNC != 0 {
-			// 	dlog.Warn("Truncated peers")
-			// }
+	// reads are unblocked by closing the socket
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
-			x := (n - 20) / 6 * 6
-			if x <= 0 {
-				return
-			}
+	cid, err := connectUDPTracker(conn, rand.Uint32())
+	if err != nil {
+		return nil, err
+	}
 
-			resp := TrackerResp{
-				Peers: buf[20 : 20+x],
-			}
-			respList = append(respList, resp)
-		}(tracker)
+	transactionID := rand.Uint32()
+	data := tf.buildUDPTrackerPackage(cid, transactionID, announce)
+	_, err = conn.Write(data)
+	if err != nil {
+		dlog.Errorf("Failed to request peers, error: %v", err)
+		return nil, err
 	}
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
 
-	wg.Wait()
-	return respList, nil
+	buf := make([]byte, 3092)
+	n, err := readUDPReply(conn, buf, UDP_ACTION_ANNOUNCE, transactionID)
+	if err != nil {
+		dlog.Errorf("Failed to read peers, error: %v", err)
+		return nil, err
+	}
+
+	if n < 20 {
+		return nil, ErrInvalidTrackerResp
+	}
+
+	// announces over ipv6 are answered with ipv6 peers
+	peerLen := PEER_LEN
+	if addr.IP.To4() == nil {
+		peerLen = PEER6_LEN
+	}
+
+	x := (n - 20) / peerLen * peerLen
+	resp := &TrackerResp{Interval: int64(binary.BigEndian.Uint32(buf[8:12]))}
+
+	if peerLen == PEER_LEN {
+		resp.Peers = buf[20 : 20+x]
+	} else {
+		resp.Peers6 = buf[20 : 20+x]
+	}
+
+	return resp, nil
 }
 
-func (tf *TorrentFile) RequestTrackers() ([]TrackerResp, error) {
+// RequestTrackers announces the start of a download to the trackers of the
+// torrent.
+func (tf *TorrentFile) RequestTrackers(ctx context.Context) ([]TrackerResp, error) {
+	return tf.SendAnnounce(ctx, AnnounceParams{Event: ANNOUNCE_EVENT_STARTED, Left: tf.Info.Length})
+}
+
+// SendAnnounce sends an announce to every tracker of the torrent, trackers that
+// fail are left out of the result.
+func (tf *TorrentFile) SendAnnounce(ctx context.Context, announce AnnounceParams) ([]TrackerResp, error) {
 	udpTrackers := make([]string, 0)
 	httpTrackers := make([]string, 0)
 
-	announceList := tf.AnnounceList
-	announceList = append(announceList, tf.Announce)
-
-	for _, t := range announceList {
+	for _, t := range tf.Trackers() {
 		parsedURL, err := url.Parse(t)
 		if err != nil {
 			dlog.Warnf("Failed to Parse tracker: %s, error: %v", t, err)
@@ -308,7 +613,7 @@ func (tf *TorrentFile) RequestTrackers() ([]TrackerResp, error) {
 
 	respList := make([]TrackerResp, 0)
 	if len(httpTrackers) > 0 {
-		httpRespList, err := tf.requestHttpTrackers(httpTrackers)
+		httpRespList, err := tf.requestHttpTrackers(ctx, httpTrackers, announce)
 		if err != nil {
 			return nil, err
 		}
@@ -317,7 +622,7 @@ func (tf *TorrentFile) RequestTrackers() ([]TrackerResp, error) {
 	}
 
 	if len(udpTrackers) > 0 {
-		udpRespList, err := tf.requestUdpTrackers(udpTrackers)
+		udpRespList, err := tf.requestUdpTrackers(ctx, udpTrackers, announce)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,248 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		s.handleAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		s.handleScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeBencode(w http.ResponseWriter, v map[string]any) {
+	res, err := bencode.Marshal(v)
+	if err != nil {
+		dlog.Errorf("failed to marshal tracker response with error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(res))
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]any{
+		"failure reason": reason,
+	})
+}
+
+func parseInt64Param(query map[string][]string, key string, def int64) (int64, error) {
+	values, ok := query[key]
+	if !ok || len(values) == 0 || values[0] == "" {
+		return def, nil
+	}
+
+	return strconv.ParseInt(values[0], 10, 64)
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// externalIP encodes the address the request came from in the compact form
+// of the "external ip" key (BEP 24).
+func externalIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+
+	return string(ip.To16())
+}
+
+func (s *Server) parseHTTPAnnounce(r *http.Request) (announceReq, error) {
+	query := r.URL.Query()
+	req := announceReq{}
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != INFO_HASH_LEN {
+		return req, ErrInvalidInfoHash
+	}
+	copy(req.InfoHash[:], infoHash)
+
+	req.PeerID = query.Get("peer_id")
+	req.Event = query.Get("event")
+	req.Key = query.Get("key")
+	req.TrackerID = query.Get("trackerid")
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return req, ErrInvalidPort
+	}
+	req.Port = uint16(port)
+
+	if req.Uploaded, err = parseInt64Param(query, "uploaded", 0); err != nil {
+		return req, err
+	}
+
+	if req.Downloaded, err = parseInt64Param(query, "downloaded", 0); err != nil {
+		return req, err
+	}
+
+	if req.Left, err = parseInt64Param(query, "left", 0); err != nil {
+		return req, err
+	}
+
+	numWant, err := parseInt64Param(query, "numwant", -1)
+	if err != nil {
+		return req, err
+	}
+	req.NumWant = int(numWant)
+
+	req.setIP(remoteIP(r))
+	if s.cfg.TrustIPParam {
+		req.setIP(net.ParseIP(query.Get("ip")))
+	}
+
+	// a dual stack client tells the address of its other family (BEP 7)
+	if ip := net.ParseIP(query.Get("ipv4")); ip != nil && ip.To4() != nil {
+		req.IP = ip.To4()
+	}
+
+	if ip := net.ParseIP(query.Get("ipv6")); ip != nil && ip.To4() == nil {
+		req.IPv6 = ip
+	}
+
+	return req, nil
+}
+
+func compactPeers(peers []PeerInfo) string {
+	buf := make([]byte, 0, len(peers)*6)
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+
+	return string(buf)
+}
+
+func compactPeers6(peers []PeerInfo) string {
+	buf := make([]byte, 0, len(peers)*18)
+	for _, p := range peers {
+		if p.IPv6 == nil {
+			continue
+		}
+
+		buf = append(buf, p.IPv6.To16()...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+
+	return string(buf)
+}
+
+// dictPeers lists every address of the peers, a dual stack peer shows up once
+// per address family.
+func dictPeers(peers []PeerInfo, noPeerID bool) []any {
+	list := make([]any, 0, len(peers))
+	for _, p := range peers {
+		for _, ip := range []net.IP{p.IP, p.IPv6} {
+			if ip == nil {
+				continue
+			}
+
+			peer := map[string]any{
+				"ip":   ip.String(),
+				"port": int64(p.Port),
+			}
+
+			if !noPeerID {
+				peer["peer id"] = p.PeerID
+			}
+
+			list = append(list, peer)
+		}
+	}
+
+	return list
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := s.parseHTTPAnnounce(r)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	resp, err := s.announce(req)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	ret := map[string]any{
+		"external ip":  externalIP(remoteIP(r)),
+		"interval":     int64(s.cfg.Interval.Seconds()),
+		"min interval": int64(s.cfg.MinInterval.Seconds()),
+		"complete":     resp.Stats.Complete,
+		"incomplete":   resp.Stats.Incomplete,
+		"downloaded":   resp.Stats.Downloaded,
+		"tracker id":   resp.TrackerID,
+	}
+
+	query := r.URL.Query()
+	if query.Get("compact") == "0" {
+		ret["peers"] = dictPeers(resp.Peers, query.Get("no_peer_id") == "1")
+	} else {
+		ret["peers"] = compactPeers(resp.Peers)
+		ret["peers6"] = compactPeers6(resp.Peers)
+	}
+
+	writeBencode(w, ret)
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	hashes := r.URL.Query()["info_hash"]
+	files := make(map[string]any)
+
+	for _, h := range hashes {
+		if len(h) != INFO_HASH_LEN {
+			writeFailure(w, ErrInvalidInfoHash.Error())
+			return
+		}
+
+		var infoHash [INFO_HASH_LEN]byte
+		copy(infoHash[:], h)
+		if !s.isAllowed(infoHash) {
+			continue
+		}
+
+		stats, err := s.store.Stats(infoHash)
+		if err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+
+		files[h] = map[string]any{
+			"complete":   stats.Complete,
+			"downloaded": stats.Downloaded,
+			"incomplete": stats.Incomplete,
+		}
+	}
+
+	writeBencode(w, map[string]any{
+		"files": files,
+	})
+}
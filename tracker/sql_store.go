@@ -0,0 +1,130 @@
+package tracker
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/db"
+)
+
+// SQLStore keeps the swarm state in a sqlite database so that it survives
+// restarts of the tracker.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore migrates the database, its tables are versioned with the ones
+// of the client.
+func NewSQLStore(d *sql.DB) (*SQLStore, error) {
+	if err := db.Migrate(d); err != nil {
+		return nil, err
+	}
+
+	return &SQLStore{db: d}, nil
+}
+
+func (s *SQLStore) Put(infoHash [INFO_HASH_LEN]byte, peer PeerInfo) error {
+	_, err := s.db.Exec(_SQL_UPSERT_TRACKER_PEER,
+		infoHash[:], []byte(peer.PeerID), ipString(peer.IP), ipString(peer.IPv6), peer.Port,
+		peer.Left, peer.Uploaded, peer.Downloaded, peer.UpdatedAt.Unix(), peer.Key, peer.TrackerID)
+
+	return err
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPeer(row rowScanner) (PeerInfo, error) {
+	var (
+		peerID    []byte
+		ip        string
+		ipv6      string
+		updatedAt int64
+	)
+
+	p := PeerInfo{}
+	err := row.Scan(&peerID, &ip, &ipv6, &p.Port, &p.Left, &p.Uploaded, &p.Downloaded, &updatedAt, &p.Key, &p.TrackerID)
+	if err != nil {
+		return p, err
+	}
+
+	p.PeerID = string(peerID)
+	p.IP = net.ParseIP(ip)
+	p.IPv6 = net.ParseIP(ipv6)
+	p.UpdatedAt = time.Unix(updatedAt, 0)
+	return p, nil
+}
+
+func (s *SQLStore) Peer(infoHash [INFO_HASH_LEN]byte, peerID string) (PeerInfo, bool, error) {
+	p, err := scanPeer(s.db.QueryRow(_SQL_SELECT_TRACKER_PEER, infoHash[:], []byte(peerID)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, false, nil
+	}
+
+	if err != nil {
+		return p, false, err
+	}
+
+	return p, true, nil
+}
+
+func (s *SQLStore) Remove(infoHash [INFO_HASH_LEN]byte, peerID string) error {
+	_, err := s.db.Exec(_SQL_DELETE_TRACKER_PEER, infoHash[:], []byte(peerID))
+	return err
+}
+
+func (s *SQLStore) Peers(infoHash [INFO_HASH_LEN]byte, exclude string, limit int) ([]PeerInfo, error) {
+	rows, err := s.db.Query(_SQL_SELECT_TRACKER_PEERS, infoHash[:], []byte(exclude), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := make([]PeerInfo, 0)
+	for rows.Next() {
+		p, err := scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, rows.Err()
+}
+
+func (s *SQLStore) Stats(infoHash [INFO_HASH_LEN]byte) (SwarmStats, error) {
+	stats := SwarmStats{}
+	err := s.db.QueryRow(_SQL_SELECT_TRACKER_STATS, infoHash[:]).Scan(&stats.Complete, &stats.Incomplete)
+	if err != nil {
+		return stats, err
+	}
+
+	err = s.db.QueryRow(_SQL_SELECT_TRACKER_DOWNLOADED, infoHash[:]).Scan(&stats.Downloaded)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func (s *SQLStore) Completed(infoHash [INFO_HASH_LEN]byte) error {
+	_, err := s.db.Exec(_SQL_INCREASE_TRACKER_DOWNLOADED, infoHash[:])
+	return err
+}
+
+func (s *SQLStore) Expire(before time.Time) error {
+	_, err := s.db.Exec(_SQL_EXPIRE_TRACKER_PEERS, before.Unix())
+	return err
+}
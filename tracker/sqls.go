@@ -0,0 +1,51 @@
+package tracker
+
+const (
+	_SQL_UPSERT_TRACKER_PEER = `
+		INSERT INTO tracker_peers ("info_hash", "peer_id", "ip", "ipv6", "port", "left", "uploaded", "downloaded", "updated_at", "key", "tracker_id")
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT ("info_hash", "peer_id") DO UPDATE SET
+			"ip" = excluded."ip",
+			"ipv6" = excluded."ipv6",
+			"port" = excluded."port",
+			"left" = excluded."left",
+			"uploaded" = excluded."uploaded",
+			"downloaded" = excluded."downloaded",
+			"updated_at" = excluded."updated_at",
+			"key" = excluded."key",
+			"tracker_id" = excluded."tracker_id";
+	`
+
+	_SQL_DELETE_TRACKER_PEER = `DELETE FROM tracker_peers WHERE "info_hash" = ? AND "peer_id" = ?;`
+
+	_SQL_SELECT_TRACKER_PEER = `
+		SELECT "peer_id", "ip", "ipv6", "port", "left", "uploaded", "downloaded", "updated_at", "key", "tracker_id"
+		FROM tracker_peers
+		WHERE "info_hash" = ? AND "peer_id" = ?;
+	`
+
+	_SQL_SELECT_TRACKER_PEERS = `
+		SELECT "peer_id", "ip", "ipv6", "port", "left", "uploaded", "downloaded", "updated_at", "key", "tracker_id"
+		FROM tracker_peers
+		WHERE "info_hash" = ? AND "peer_id" != ?
+		ORDER BY RANDOM()
+		LIMIT ?;
+	`
+
+	_SQL_SELECT_TRACKER_STATS = `
+		SELECT
+			COALESCE(SUM(CASE WHEN "left" = 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN "left" != 0 THEN 1 ELSE 0 END), 0)
+		FROM tracker_peers
+		WHERE "info_hash" = ?;
+	`
+
+	_SQL_SELECT_TRACKER_DOWNLOADED = `SELECT "downloaded" FROM tracker_swarms WHERE "info_hash" = ?;`
+
+	_SQL_INCREASE_TRACKER_DOWNLOADED = `
+		INSERT INTO tracker_swarms ("info_hash", "downloaded") VALUES (?, 1)
+		ON CONFLICT ("info_hash") DO UPDATE SET "downloaded" = "downloaded" + 1;
+	`
+
+	_SQL_EXPIRE_TRACKER_PEERS = `DELETE FROM tracker_peers WHERE "updated_at" < ?;`
+)
@@ -0,0 +1,197 @@
+package tracker
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type PeerInfo struct {
+	PeerID string
+	// IP is the ipv4 address of the peer and IPv6 its ipv6 address, a dual
+	// stack peer may announce both (BEP 7).
+	IP         net.IP
+	IPv6       net.IP
+	Port       uint16
+	Left       int64
+	Uploaded   int64
+	Downloaded int64
+	UpdatedAt  time.Time
+
+	// Key is the "key" announce parameter of the peer, it proves the identity
+	// of the peer when its ip address changes.
+	Key string
+	// TrackerID is the "tracker id" issued to the peer by the tracker.
+	TrackerID string
+}
+
+func (p PeerInfo) IsSeed() bool {
+	return p.Left == 0
+}
+
+type SwarmStats struct {
+	Complete   int64
+	Incomplete int64
+	Downloaded int64
+}
+
+// Store keeps the swarm state of every torrent known to the tracker.
+type Store interface {
+	Put(infoHash [INFO_HASH_LEN]byte, peer PeerInfo) error
+	Peer(infoHash [INFO_HASH_LEN]byte, peerID string) (PeerInfo, bool, error)
+	Remove(infoHash [INFO_HASH_LEN]byte, peerID string) error
+	Peers(infoHash [INFO_HASH_LEN]byte, exclude string, limit int) ([]PeerInfo, error)
+	Stats(infoHash [INFO_HASH_LEN]byte) (SwarmStats, error)
+	Completed(infoHash [INFO_HASH_LEN]byte) error
+	Expire(before time.Time) error
+}
+
+type swarm struct {
+	peers      map[string]PeerInfo
+	downloaded int64
+}
+
+type MemoryStore struct {
+	mu     sync.RWMutex
+	swarms map[[INFO_HASH_LEN]byte]*swarm
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		swarms: make(map[[INFO_HASH_LEN]byte]*swarm),
+	}
+}
+
+func (s *MemoryStore) swarm(infoHash [INFO_HASH_LEN]byte) *swarm {
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[string]PeerInfo)}
+		s.swarms[infoHash] = sw
+	}
+
+	return sw
+}
+
+func (s *MemoryStore) Put(infoHash [INFO_HASH_LEN]byte, peer PeerInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.swarm(infoHash).peers[peer.PeerID] = peer
+	return nil
+}
+
+func (s *MemoryStore) Peer(infoHash [INFO_HASH_LEN]byte, peerID string) (PeerInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return PeerInfo{}, false, nil
+	}
+
+	p, ok := sw.peers[peerID]
+	return p, ok, nil
+}
+
+func (s *MemoryStore) Remove(infoHash [INFO_HASH_LEN]byte, peerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sw, ok := s.swarms[infoHash]; ok {
+		delete(sw.peers, peerID)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Peers(infoHash [INFO_HASH_LEN]byte, exclude string, limit int) ([]PeerInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return nil, nil
+	}
+
+	peers := make([]PeerInfo, 0, len(sw.peers))
+	for id, p := range sw.peers {
+		if id == exclude {
+			continue
+		}
+
+		peers = append(peers, p)
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	if limit >= 0 && len(peers) > limit {
+		peers = peers[:limit]
+	}
+
+	return peers, nil
+}
+
+func (s *MemoryStore) Stats(infoHash [INFO_HASH_LEN]byte) (SwarmStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := SwarmStats{}
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return stats, nil
+	}
+
+	for _, p := range sw.peers {
+		if p.IsSeed() {
+			stats.Complete++
+		} else {
+			stats.Incomplete++
+		}
+	}
+
+	stats.Downloaded = sw.downloaded
+	return stats, nil
+}
+
+func (s *MemoryStore) Completed(infoHash [INFO_HASH_LEN]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.swarm(infoHash).downloaded++
+	return nil
+}
+
+// Expire drops the peers that did not announce since before, swarms without
+// peers are dropped with them.
+func (s *MemoryStore) Expire(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, sw := range s.swarms {
+		for id, p := range sw.peers {
+			if p.UpdatedAt.Before(before) {
+				delete(sw.peers, id)
+			}
+		}
+
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of swarms with peers.
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.swarms)
+}
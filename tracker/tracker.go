@@ -0,0 +1,410 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var (
+	ErrInfoHashNotAllowed = errors.New("info hash not allowed")
+	ErrInvalidInfoHash    = errors.New("invalid info hash")
+	ErrInvalidPeerID      = errors.New("invalid peer id")
+	ErrInvalidPort        = errors.New("invalid port")
+	ErrInvalidIP          = errors.New("invalid ip")
+	ErrMissingKey         = errors.New("missing key")
+	ErrKeyMismatch        = errors.New("key mismatch")
+	ErrInvalidTrackerID   = errors.New("invalid tracker id")
+)
+
+const INFO_HASH_LEN = 20
+const PEER_ID_LEN = 20
+
+const (
+	DEFAULT_INTERVAL     = 30 * time.Minute
+	DEFAULT_MIN_INTERVAL = 5 * time.Minute
+	DEFAULT_PEER_TTL     = 45 * time.Minute
+	DEFAULT_NUM_WANT     = 50
+	DEFAULT_MAX_NUM_WANT = 200
+)
+
+// SWARM_LOCKS is the number of locks the announces to the swarms are
+// serialized with, swarms share a lock by the first byte of their info hash.
+const SWARM_LOCKS = 64
+
+type Config struct {
+	// HTTPAddr and UDPAddr are the listen addresses, an empty value disables
+	// the corresponding protocol.
+	HTTPAddr string
+	UDPAddr  string
+
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration
+	MaxNumWant  int
+
+	// Allowlist restricts the tracker to the given info hashes, every torrent
+	// is accepted when it is empty.
+	Allowlist [][INFO_HASH_LEN]byte
+
+	// TrustIPParam makes the tracker use the "ip" announce parameter instead
+	// of the remote address of the request.
+	TrustIPParam bool
+
+	// Private enables the stricter rules of private trackers, every announce
+	// must carry a key so that the identity of a peer can not be taken over.
+	Private bool
+}
+
+type Server struct {
+	cfg       Config
+	store     Store
+	allowlist map[[INFO_HASH_LEN]byte]struct{}
+
+	httpListener net.Listener
+	httpServer   *http.Server
+	udpConn      *net.UDPConn
+	udpConns     *udpConnIDs
+	swarmLocks   [SWARM_LOCKS]sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+func init() {
+	dlog.Init()
+}
+
+func NewServer(cfg Config, store Store) *Server {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_INTERVAL
+	}
+
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = DEFAULT_MIN_INTERVAL
+	}
+
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = DEFAULT_PEER_TTL
+	}
+
+	if cfg.MaxNumWant <= 0 {
+		cfg.MaxNumWant = DEFAULT_MAX_NUM_WANT
+	}
+
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		store:     store,
+		allowlist: make(map[[INFO_HASH_LEN]byte]struct{}),
+		udpConns:  newUDPConnIDs(),
+		closed:    make(chan struct{}),
+	}
+
+	for _, hash := range cfg.Allowlist {
+		s.allowlist[hash] = struct{}{}
+	}
+
+	return s
+}
+
+// ParseInfoHash parses a hex encoded info hash, it is mainly used to build the
+// allowlist from the command line or a file.
+func ParseInfoHash(s string) ([INFO_HASH_LEN]byte, error) {
+	var hash [INFO_HASH_LEN]byte
+
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != INFO_HASH_LEN {
+		return hash, ErrInvalidInfoHash
+	}
+
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+func (s *Server) isAllowed(infoHash [INFO_HASH_LEN]byte) bool {
+	if len(s.allowlist) == 0 {
+		return true
+	}
+
+	_, ok := s.allowlist[infoHash]
+	return ok
+}
+
+// Start listens on the configured addresses and serves requests in the
+// background until Close is called.
+func (s *Server) Start() error {
+	if s.cfg.HTTPAddr != "" {
+		l, err := net.Listen("tcp", s.cfg.HTTPAddr)
+		if err != nil {
+			return err
+		}
+
+		s.httpListener = l
+		s.httpServer = &http.Server{Handler: s}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			err := s.httpServer.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				dlog.Errorf("tracker http server stopped with error: %v", err)
+			}
+		}()
+	}
+
+	if s.cfg.UDPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", s.cfg.UDPAddr)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		s.udpConn = conn
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveUDP()
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.expireRoutine()
+	}()
+
+	return nil
+}
+
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpListener == nil {
+		return nil
+	}
+
+	return s.httpListener.Addr()
+}
+
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+
+	return s.udpConn.LocalAddr()
+}
+
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		if s.httpServer != nil {
+			err = s.httpServer.Close()
+		}
+
+		if s.udpConn != nil {
+			if e := s.udpConn.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+func (s *Server) expireRoutine() {
+	ticker := time.NewTicker(s.cfg.PeerTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			if err := s.store.Expire(now.Add(-s.cfg.PeerTTL)); err != nil {
+				dlog.Errorf("failed to expire tracker peers with error: %v", err)
+			}
+		}
+	}
+}
+
+type announceReq struct {
+	InfoHash   [INFO_HASH_LEN]byte
+	PeerID     string
+	IP         net.IP
+	IPv6       net.IP
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	NumWant    int
+	Key        string
+	TrackerID  string
+}
+
+// setIP assigns an address to the field of its family.
+func (req *announceReq) setIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		req.IP = ip4
+	} else {
+		req.IPv6 = ip
+	}
+}
+
+type announceResp struct {
+	Stats     SwarmStats
+	Peers     []PeerInfo
+	TrackerID string
+}
+
+func newTrackerID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// checkIdentity verifies that an announce comes from the same client that
+// announced the peer id before, a known peer must present the same key and
+// tracker id it used on its previous announces.
+func (s *Server) checkIdentity(req announceReq, prev PeerInfo, exists bool) error {
+	if s.cfg.Private && req.Key == "" {
+		return ErrMissingKey
+	}
+
+	if !exists {
+		return nil
+	}
+
+	if prev.Key != "" && prev.Key != req.Key {
+		return ErrKeyMismatch
+	}
+
+	if req.TrackerID != "" && prev.TrackerID != "" && prev.TrackerID != req.TrackerID {
+		return ErrInvalidTrackerID
+	}
+
+	return nil
+}
+
+// updatePeer checks the identity of the announcing peer and applies its
+// event to the swarm, returning the tracker id of the peer. Both happen under
+// the lock of the swarm, so that concurrent announces of a peer can not both
+// pass the check before either of them is written.
+func (s *Server) updatePeer(req announceReq) (string, error) {
+	lock := &s.swarmLocks[int(req.InfoHash[0])%SWARM_LOCKS]
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev, exists, err := s.store.Peer(req.InfoHash, req.PeerID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.checkIdentity(req, prev, exists); err != nil {
+		return "", err
+	}
+
+	trackerID := prev.TrackerID
+	if trackerID == "" {
+		trackerID = newTrackerID()
+	}
+
+	switch req.Event {
+	case "stopped":
+		err = s.store.Remove(req.InfoHash, req.PeerID)
+	case "completed":
+		// repeated completed events of a seed are counted once
+		if !exists || !prev.IsSeed() {
+			if err = s.store.Completed(req.InfoHash); err != nil {
+				break
+			}
+		}
+		fallthrough
+	default:
+		err = s.store.Put(req.InfoHash, PeerInfo{
+			PeerID:     req.PeerID,
+			IP:         req.IP,
+			IPv6:       req.IPv6,
+			Port:       req.Port,
+			Left:       req.Left,
+			Uploaded:   req.Uploaded,
+			Downloaded: req.Downloaded,
+			UpdatedAt:  time.Now(),
+			Key:        req.Key,
+			TrackerID:  trackerID,
+		})
+	}
+
+	return trackerID, err
+}
+
+// announce applies an announce to the swarm and selects the peers returned to
+// the client, it is shared by the http and udp front ends.
+func (s *Server) announce(req announceReq) (announceResp, error) {
+	resp := announceResp{}
+	if !s.isAllowed(req.InfoHash) {
+		return resp, ErrInfoHashNotAllowed
+	}
+
+	if len(req.PeerID) != PEER_ID_LEN {
+		return resp, ErrInvalidPeerID
+	}
+
+	if req.Port == 0 {
+		return resp, ErrInvalidPort
+	}
+
+	if req.IP == nil && req.IPv6 == nil {
+		return resp, ErrInvalidIP
+	}
+
+	trackerID, err := s.updatePeer(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.TrackerID = trackerID
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = DEFAULT_NUM_WANT
+	}
+
+	if numWant > s.cfg.MaxNumWant {
+		numWant = s.cfg.MaxNumWant
+	}
+
+	if req.Event != "stopped" {
+		resp.Peers, err = s.store.Peers(req.InfoHash, req.PeerID, numWant)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	resp.Stats, err = s.store.Stats(req.InfoHash)
+	return resp, err
+}
@@ -0,0 +1,582 @@
+package tracker_test
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/bencode"
+	"github.com/Dizzrt/dgo-torrent/db"
+	"github.com/Dizzrt/dgo-torrent/tracker"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testInfoHash = [tracker.INFO_HASH_LEN]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+func startServer(t *testing.T, cfg tracker.Config, store tracker.Store) *tracker.Server {
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.UDPAddr = "127.0.0.1:0"
+
+	server := tracker.NewServer(cfg, store)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+func peerID(i int) string {
+	return fmt.Sprintf("-TEST00-%012d", i)
+}
+
+func httpAnnounce(t *testing.T, server *tracker.Server, params url.Values) map[string]any {
+	u := fmt.Sprintf("http://%s/announce?%s", server.HTTPAddr(), params.Encode())
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	res, err := bencode.Unmarshal(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, ok := res.(map[string]any)
+	if !ok {
+		t.Fatalf("unexpected announce response: %v", res)
+	}
+
+	return ret
+}
+
+func announceParams(id string, port int, left int64) url.Values {
+	return url.Values{
+		"info_hash":  []string{string(testInfoHash[:])},
+		"peer_id":    []string{id},
+		"port":       []string{fmt.Sprint(port)},
+		"uploaded":   []string{"0"},
+		"downloaded": []string{"0"},
+		"left":       []string{fmt.Sprint(left)},
+		"compact":    []string{"1"},
+	}
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+
+	httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+	res := httpAnnounce(t, server, announceParams(peerID(2), 6882, 100))
+
+	if _, ok := res["failure reason"]; ok {
+		t.Fatalf("announce failed: %v", res["failure reason"])
+	}
+
+	peers, _ := res["peers"].(string)
+	if len(peers) != 6 {
+		t.Fatalf("expected one compact peer, got %d bytes", len(peers))
+	}
+
+	if port := binary.BigEndian.Uint16([]byte(peers[4:6])); port != 6881 {
+		t.Errorf("expected port 6881, got %d", port)
+	}
+
+	if res["complete"] != int64(1) || res["incomplete"] != int64(1) {
+		t.Errorf("unexpected swarm stats: complete=%v incomplete=%v", res["complete"], res["incomplete"])
+	}
+}
+
+func TestHTTPAnnounceDict(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+
+	httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+
+	params := announceParams(peerID(2), 6882, 100)
+	params.Set("compact", "0")
+	res := httpAnnounce(t, server, params)
+
+	peers, ok := res["peers"].([]any)
+	if !ok || len(peers) != 1 {
+		t.Fatalf("expected one dictionary peer, got %v", res["peers"])
+	}
+
+	peer := peers[0].(map[string]any)
+	if peer["peer id"] != peerID(1) || peer["ip"] != "127.0.0.1" || peer["port"] != int64(6881) {
+		t.Errorf("unexpected peer: %v", peer)
+	}
+}
+
+func TestHTTPAnnounceStopped(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+
+	httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+
+	params := announceParams(peerID(1), 6881, 0)
+	params.Set("event", "stopped")
+	httpAnnounce(t, server, params)
+
+	res := httpAnnounce(t, server, announceParams(peerID(2), 6882, 100))
+	if peers, _ := res["peers"].(string); len(peers) != 0 {
+		t.Errorf("stopped peer is still returned")
+	}
+}
+
+func TestTrackerID(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+
+	res := httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+	id, _ := res["tracker id"].(string)
+	if id == "" {
+		t.Fatalf("expected a tracker id, got %v", res)
+	}
+
+	params := announceParams(peerID(1), 6881, 0)
+	params.Set("trackerid", id)
+	if res = httpAnnounce(t, server, params); res["tracker id"] != id {
+		t.Errorf("expected tracker id %s to be kept, got %v", id, res["tracker id"])
+	}
+
+	params.Set("trackerid", "forged")
+	if res = httpAnnounce(t, server, params); res["failure reason"] != tracker.ErrInvalidTrackerID.Error() {
+		t.Errorf("expected forged tracker id to be rejected, got %v", res)
+	}
+}
+
+func TestPrivateTrackerKey(t *testing.T) {
+	server := startServer(t, tracker.Config{Private: true}, nil)
+
+	res := httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+	if res["failure reason"] != tracker.ErrMissingKey.Error() {
+		t.Fatalf("expected announce without key to be rejected, got %v", res)
+	}
+
+	params := announceParams(peerID(1), 6881, 0)
+	params.Set("key", "0badcafe")
+	if res = httpAnnounce(t, server, params); res["failure reason"] != nil {
+		t.Fatalf("announce failed: %v", res["failure reason"])
+	}
+
+	// another client must not be able to take over or stop the peer
+	params.Set("key", "deadbeef")
+	params.Set("event", "stopped")
+	if res = httpAnnounce(t, server, params); res["failure reason"] != tracker.ErrKeyMismatch.Error() {
+		t.Errorf("expected key mismatch, got %v", res)
+	}
+
+	params.Set("key", "0badcafe")
+	if res = httpAnnounce(t, server, params); res["failure reason"] != nil {
+		t.Errorf("stopped announce with the right key failed: %v", res["failure reason"])
+	}
+}
+
+// slowStore widens the window between looking up a peer and writing it.
+type slowStore struct {
+	*tracker.MemoryStore
+}
+
+func (s slowStore) Peer(infoHash [tracker.INFO_HASH_LEN]byte, peerID string) (tracker.PeerInfo, bool, error) {
+	time.Sleep(20 * time.Millisecond)
+	return s.MemoryStore.Peer(infoHash, peerID)
+}
+
+func TestConcurrentAnnounceKey(t *testing.T) {
+	server := startServer(t, tracker.Config{Private: true}, slowStore{tracker.NewMemoryStore()})
+
+	// only the first of the clients announcing a peer id gets to own it
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			params := announceParams(peerID(1), 6881, 0)
+			params.Set("key", fmt.Sprintf("key%d", i))
+			if res := httpAnnounce(t, server, params); res["failure reason"] == nil {
+				accepted.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected one client to own the peer, %d did", n)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	server := startServer(t, tracker.Config{
+		Allowlist: [][tracker.INFO_HASH_LEN]byte{{0xff}},
+	}, nil)
+
+	res := httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+	if res["failure reason"] != tracker.ErrInfoHashNotAllowed.Error() {
+		t.Errorf("expected failure for info hash outside the allowlist, got %v", res)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+	httpAnnounce(t, server, announceParams(peerID(1), 6881, 100))
+
+	// a repeated completed event of the seed is not another download
+	params := announceParams(peerID(1), 6881, 0)
+	params.Set("event", "completed")
+	httpAnnounce(t, server, params)
+	httpAnnounce(t, server, params)
+
+	u := fmt.Sprintf("http://%s/scrape?info_hash=%s", server.HTTPAddr(), url.QueryEscape(string(testInfoHash[:])))
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	res, err := bencode.Unmarshal(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := res.(map[string]any)["files"].(map[string]any)
+	file, ok := files[string(testInfoHash[:])].(map[string]any)
+	if !ok {
+		t.Fatalf("missing scrape entry: %v", files)
+	}
+
+	if file["complete"] != int64(1) || file["downloaded"] != int64(1) || file["incomplete"] != int64(0) {
+		t.Errorf("unexpected scrape entry: %v", file)
+	}
+}
+
+func udpRoundTrip(t *testing.T, conn net.Conn, req []byte) []byte {
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf[:n]
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+	httpAnnounce(t, server, announceParams(peerID(1), 6881, 0))
+
+	conn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], tracker.UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_CONNECT)
+	binary.BigEndian.PutUint32(req[12:16], 42)
+
+	resp := udpRoundTrip(t, conn, req)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[4:8]) != 42 {
+		t.Fatalf("unexpected connect response: %x", resp)
+	}
+	cid := binary.BigEndian.Uint64(resp[8:16])
+
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], cid)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_ANNOUNCE)
+	binary.BigEndian.PutUint32(req[12:16], 43)
+	copy(req[16:36], testInfoHash[:])
+	copy(req[36:56], peerID(2))
+	binary.BigEndian.PutUint64(req[64:72], 100)
+	binary.BigEndian.PutUint32(req[80:84], 2)
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+	binary.BigEndian.PutUint16(req[96:98], 6882)
+
+	binary.BigEndian.PutUint32(req[88:92], 0x0badcafe)
+
+	resp = udpRoundTrip(t, conn, req)
+	if binary.BigEndian.Uint32(resp[0:4]) != tracker.UDP_ACTION_ANNOUNCE {
+		t.Fatalf("announce failed: %s", resp[8:])
+	}
+
+	// the udp key is shared with http announces of the same client
+	params := announceParams(peerID(2), 6882, 100)
+	params.Set("key", "deadbeef")
+	if res := httpAnnounce(t, server, params); res["failure reason"] != tracker.ErrKeyMismatch.Error() {
+		t.Errorf("expected key mismatch, got %v", res)
+	}
+
+	if len(resp) != 26 || binary.BigEndian.Uint16(resp[24:26]) != 6881 {
+		t.Errorf("unexpected announce response: %x", resp)
+	}
+
+	req = make([]byte, 36)
+	binary.BigEndian.PutUint64(req[0:8], cid)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_SCRAPE)
+	binary.BigEndian.PutUint32(req[12:16], 44)
+	copy(req[16:36], testInfoHash[:])
+
+	resp = udpRoundTrip(t, conn, req)
+	if len(resp) != 20 {
+		t.Fatalf("unexpected scrape response: %x", resp)
+	}
+
+	if seeders := binary.BigEndian.Uint32(resp[8:12]); seeders != 1 {
+		t.Errorf("expected 1 seeder, got %d", seeders)
+	}
+
+	if leechers := binary.BigEndian.Uint32(resp[16:20]); leechers != 1 {
+		t.Errorf("expected 1 leecher, got %d", leechers)
+	}
+}
+
+func TestUDPInvalidConnectionID(t *testing.T) {
+	server := startServer(t, tracker.Config{}, nil)
+
+	conn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], 12345)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_ANNOUNCE)
+
+	resp := udpRoundTrip(t, conn, req)
+	if binary.BigEndian.Uint32(resp[0:4]) != tracker.UDP_ACTION_ERROR {
+		t.Errorf("expected error action, got %x", resp)
+	}
+}
+
+func TestUDPAnnounceIPParam(t *testing.T) {
+	store := tracker.NewMemoryStore()
+	server := startServer(t, tracker.Config{TrustIPParam: true}, store)
+
+	conn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], tracker.UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_CONNECT)
+	cid := binary.BigEndian.Uint64(udpRoundTrip(t, conn, req)[8:16])
+
+	// the ip of a peer must not change with the packets of other peers
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		req = make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], cid)
+		binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_ANNOUNCE)
+		copy(req[16:36], testInfoHash[:])
+		copy(req[36:56], peerID(i+1))
+		copy(req[84:88], net.ParseIP(ip).To4())
+		binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+		binary.BigEndian.PutUint16(req[96:98], 6881)
+
+		if resp := udpRoundTrip(t, conn, req); binary.BigEndian.Uint32(resp[0:4]) != tracker.UDP_ACTION_ANNOUNCE {
+			t.Fatalf("announce failed: %s", resp[8:])
+		}
+	}
+
+	peer, ok, err := store.Peer(testInfoHash, peerID(1))
+	if err != nil || !ok || !peer.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("unexpected peer %+v %v %v", peer, ok, err)
+	}
+}
+
+func testStore(t *testing.T, store tracker.Store) {
+	now := time.Now()
+	seed := tracker.PeerInfo{PeerID: peerID(1), IP: net.ParseIP("10.0.0.1"), Port: 1, UpdatedAt: now.Add(-time.Hour)}
+	leech := tracker.PeerInfo{PeerID: peerID(2), IPv6: net.ParseIP("2001:db8::2"), Port: 2, Left: 10, UpdatedAt: now}
+
+	for _, p := range []tracker.PeerInfo{seed, leech} {
+		if err := store.Put(testInfoHash, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seed.Key, seed.TrackerID = "0badcafe", "0123456789abcdef"
+	if err := store.Put(testInfoHash, seed); err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok, err := store.Peer(testInfoHash, peerID(1))
+	if err != nil || !ok || p.Key != seed.Key || p.TrackerID != seed.TrackerID {
+		t.Errorf("unexpected peer: %+v, %v, %v", p, ok, err)
+	}
+
+	if _, ok, _ = store.Peer(testInfoHash, peerID(3)); ok {
+		t.Error("unknown peer is reported as present")
+	}
+
+	if err = store.Completed(testInfoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Stats(testInfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (tracker.SwarmStats{Complete: 1, Incomplete: 1, Downloaded: 1}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	peers, err := store.Peers(testInfoHash, peerID(2), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 1 || peers[0].PeerID != peerID(1) || !peers[0].IP.Equal(seed.IP) {
+		t.Errorf("unexpected peers: %+v", peers)
+	}
+
+	if err = store.Expire(now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, _ = store.Peers(testInfoHash, "", 10)
+	if len(peers) != 1 || peers[0].PeerID != peerID(2) {
+		t.Errorf("expired peer is still present: %+v", peers)
+	}
+
+	if len(peers) == 1 && (peers[0].IP != nil || !peers[0].IPv6.Equal(leech.IPv6)) {
+		t.Errorf("unexpected addresses of an ipv6 only peer: %+v", peers[0])
+	}
+
+	if err = store.Remove(testInfoHash, peerID(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, _ = store.Peers(testInfoHash, "", 10)
+	if len(peers) != 0 {
+		t.Errorf("removed peer is still present: %+v", peers)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := tracker.NewMemoryStore()
+	testStore(t, store)
+
+	// the swarm went away with its last peer
+	if store.Len() != 0 {
+		t.Errorf("expected no swarms, got %d", store.Len())
+	}
+
+	other := [tracker.INFO_HASH_LEN]byte{1}
+	store.Put(other, tracker.PeerInfo{PeerID: peerID(1), Port: 1, UpdatedAt: time.Now().Add(-time.Hour)})
+	if err := store.Expire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 0 {
+		t.Errorf("expected the expired swarm to be dropped, got %d swarms", store.Len())
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "tracker.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	store, err := tracker.NewSQLStore(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tables are created by the migrations of the database
+	var version int
+	if err := d.QueryRow("PRAGMA user_version;").Scan(&version); err != nil || version != db.SchemaVersion() {
+		t.Errorf("expected schema version %d, got %d %v", db.SchemaVersion(), version, err)
+	}
+
+	testStore(t, store)
+}
+
+func TestIPv6Announce(t *testing.T) {
+	server := tracker.NewServer(tracker.Config{HTTPAddr: "[::1]:0", UDPAddr: "[::1]:0"}, nil)
+	if err := server.Start(); err != nil {
+		t.Skipf("ipv6 loopback is not available: %v", err)
+	}
+	defer server.Close()
+
+	params := announceParams(peerID(1), 6881, 0)
+	params.Set("ipv4", "10.0.0.1")
+	httpAnnounce(t, server, params)
+
+	res := httpAnnounce(t, server, announceParams(peerID(2), 6882, 100))
+	if _, ok := res["failure reason"]; ok {
+		t.Fatalf("announce failed: %v", res["failure reason"])
+	}
+
+	if ip, _ := res["external ip"].(string); !net.IP(ip).Equal(net.IPv6loopback) {
+		t.Errorf("expected external ip ::1, got %x", ip)
+	}
+
+	peers, _ := res["peers"].(string)
+	if len(peers) != 6 || !net.IP(peers[0:4]).Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the ipv4 address of the dual stack peer, got %x", peers)
+	}
+
+	peers6, _ := res["peers6"].(string)
+	if len(peers6) != 18 || !net.IP(peers6[0:16]).Equal(net.IPv6loopback) {
+		t.Fatalf("expected one compact ipv6 peer, got %x", peers6)
+	}
+
+	if port := binary.BigEndian.Uint16([]byte(peers6[16:18])); port != 6881 {
+		t.Errorf("expected port 6881, got %d", port)
+	}
+
+	params = announceParams(peerID(2), 6882, 100)
+	params.Set("compact", "0")
+	res = httpAnnounce(t, server, params)
+	if list, _ := res["peers"].([]any); len(list) != 2 {
+		t.Errorf("expected one dictionary peer per address, got %v", res["peers"])
+	}
+
+	conn, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], tracker.UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_CONNECT)
+	cid := binary.BigEndian.Uint64(udpRoundTrip(t, conn, req)[8:16])
+
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], cid)
+	binary.BigEndian.PutUint32(req[8:12], tracker.UDP_ACTION_ANNOUNCE)
+	copy(req[16:36], testInfoHash[:])
+	copy(req[36:56], peerID(3))
+	binary.BigEndian.PutUint64(req[64:72], 100)
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+	binary.BigEndian.PutUint16(req[96:98], 6883)
+
+	resp := udpRoundTrip(t, conn, req)
+	if binary.BigEndian.Uint32(resp[0:4]) != tracker.UDP_ACTION_ANNOUNCE {
+		t.Fatalf("announce failed: %s", resp[8:])
+	}
+
+	// both other peers have an ipv6 address
+	if len(resp) != 20+2*18 {
+		t.Errorf("expected two 18 byte peers, got %x", resp[20:])
+	}
+}
@@ -0,0 +1,224 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+const UDP_PROTOCOL_ID = 0x41727101980
+
+const (
+	UDP_ACTION_CONNECT uint32 = iota
+	UDP_ACTION_ANNOUNCE
+	UDP_ACTION_SCRAPE
+	UDP_ACTION_ERROR
+)
+
+const (
+	udpConnIDTTL      = 2 * time.Minute
+	udpMaxPacketSize  = 2048
+	udpAnnounceLen    = 98
+	udpScrapeMaxCount = 74
+)
+
+var udpEvents = []string{"", "completed", "started", "stopped"}
+
+var ErrInvalidConnectionID = errors.New("invalid connection id")
+
+type udpConnIDs struct {
+	mu  sync.Mutex
+	ids map[uint64]time.Time
+}
+
+func newUDPConnIDs() *udpConnIDs {
+	return &udpConnIDs{
+		ids: make(map[uint64]time.Time),
+	}
+}
+
+func (c *udpConnIDs) issue() uint64 {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	id := binary.BigEndian.Uint64(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.ids {
+		if now.Sub(v) > udpConnIDTTL {
+			delete(c.ids, k)
+		}
+	}
+
+	c.ids[id] = now
+	return id
+}
+
+func (c *udpConnIDs) valid(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	issued, ok := c.ids[id]
+	return ok && time.Since(issued) <= udpConnIDTTL
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			dlog.Errorf("failed to read udp tracker packet with error: %v", err)
+			continue
+		}
+
+		resp := s.handleUDPPacket(buf[:n], addr)
+		if resp == nil {
+			continue
+		}
+
+		if _, err = s.udpConn.WriteToUDP(resp, addr); err != nil {
+			dlog.Errorf("failed to write udp tracker packet with error: %v", err)
+		}
+	}
+}
+
+func udpError(transactionID uint32, reason string) []byte {
+	buf := make([]byte, 8, 8+len(reason))
+	binary.BigEndian.PutUint32(buf[0:4], UDP_ACTION_ERROR)
+	binary.BigEndian.PutUint32(buf[4:8], transactionID)
+
+	return append(buf, reason...)
+}
+
+func (s *Server) handleUDPPacket(packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == UDP_ACTION_CONNECT {
+		if connectionID != UDP_PROTOCOL_ID {
+			return nil
+		}
+
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], UDP_ACTION_CONNECT)
+		binary.BigEndian.PutUint32(resp[4:8], transactionID)
+		binary.BigEndian.PutUint64(resp[8:16], s.udpConns.issue())
+		return resp
+	}
+
+	if !s.udpConns.valid(connectionID) {
+		return udpError(transactionID, ErrInvalidConnectionID.Error())
+	}
+
+	switch action {
+	case UDP_ACTION_ANNOUNCE:
+		return s.handleUDPAnnounce(packet, addr, transactionID)
+	case UDP_ACTION_SCRAPE:
+		return s.handleUDPScrape(packet, transactionID)
+	default:
+		return udpError(transactionID, "unknown action")
+	}
+}
+
+func (s *Server) handleUDPAnnounce(packet []byte, addr *net.UDPAddr, transactionID uint32) []byte {
+	if len(packet) < udpAnnounceLen {
+		return udpError(transactionID, "malformed announce")
+	}
+
+	req := announceReq{}
+	copy(req.InfoHash[:], packet[16:36])
+	req.PeerID = string(packet[36:56])
+	req.Downloaded = int64(binary.BigEndian.Uint64(packet[56:64]))
+	req.Left = int64(binary.BigEndian.Uint64(packet[64:72]))
+	req.Uploaded = int64(binary.BigEndian.Uint64(packet[72:80]))
+
+	event := binary.BigEndian.Uint32(packet[80:84])
+	if int(event) < len(udpEvents) {
+		req.Event = udpEvents[event]
+	}
+
+	req.setIP(addr.IP)
+	if ip := binary.BigEndian.Uint32(packet[84:88]); ip != 0 && s.cfg.TrustIPParam {
+		// the packet buffer is reused for the next packet, the store keeps the ip
+		req.IP = net.IP(append([]byte(nil), packet[84:88]...))
+	}
+
+	// the key is formatted the same way as http clients send it, so that a
+	// client may use both protocols with the same identity
+	if key := binary.BigEndian.Uint32(packet[88:92]); key != 0 {
+		req.Key = fmt.Sprintf("%08x", key)
+	}
+
+	req.NumWant = int(int32(binary.BigEndian.Uint32(packet[92:96])))
+	req.Port = binary.BigEndian.Uint16(packet[96:98])
+
+	resp, err := s.announce(req)
+	if err != nil {
+		return udpError(transactionID, err.Error())
+	}
+
+	// announces over ipv6 get ipv6 peers (BEP 15)
+	peers := compactPeers(resp.Peers)
+	if addr.IP.To4() == nil {
+		peers = compactPeers6(resp.Peers)
+	}
+
+	buf := make([]byte, 20, 20+len(peers))
+	binary.BigEndian.PutUint32(buf[0:4], UDP_ACTION_ANNOUNCE)
+	binary.BigEndian.PutUint32(buf[4:8], transactionID)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(s.cfg.Interval.Seconds()))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(resp.Stats.Incomplete))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(resp.Stats.Complete))
+
+	return append(buf, peers...)
+}
+
+func (s *Server) handleUDPScrape(packet []byte, transactionID uint32) []byte {
+	count := (len(packet) - 16) / INFO_HASH_LEN
+	if count > udpScrapeMaxCount {
+		count = udpScrapeMaxCount
+	}
+
+	buf := make([]byte, 8, 8+count*12)
+	binary.BigEndian.PutUint32(buf[0:4], UDP_ACTION_SCRAPE)
+	binary.BigEndian.PutUint32(buf[4:8], transactionID)
+
+	for i := 0; i < count; i++ {
+		var infoHash [INFO_HASH_LEN]byte
+		offset := 16 + i*INFO_HASH_LEN
+		copy(infoHash[:], packet[offset:offset+INFO_HASH_LEN])
+
+		stats := SwarmStats{}
+		if s.isAllowed(infoHash) {
+			var err error
+			if stats, err = s.store.Stats(infoHash); err != nil {
+				return udpError(transactionID, err.Error())
+			}
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(stats.Complete))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(stats.Downloaded))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(stats.Incomplete))
+	}
+
+	return buf
+}
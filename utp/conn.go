@@ -0,0 +1,620 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnReset = errors.New("utp connection reset by peer")
+	ErrTimeout   = errors.New("utp connection timed out")
+)
+
+const (
+	// payload of a data packet, small enough to avoid ip fragmentation
+	MAX_PAYLOAD = 1400 - HEADER_LEN
+
+	// receive buffer we advertise to the remote peer
+	RECV_WINDOW = 1 << 20
+
+	MIN_RTO     = 500 * time.Millisecond
+	MAX_RTO     = 60 * time.Second
+	INITIAL_RTO = time.Second
+
+	// a packet that was sent that many times without being acked kills the
+	// connection, SYN packets give up earlier
+	MAX_TRANSMISSIONS     = 8
+	MAX_SYN_TRANSMISSIONS = 3
+
+	// time a closed connection keeps retransmitting its FIN
+	LINGER_TIMEOUT = 10 * time.Second
+
+	// duplicate acks that trigger a fast retransmit
+	DUP_ACK_THRESHOLD = 3
+)
+
+type connState uint8
+
+const (
+	CS_SYN_SENT connState = iota
+	CS_CONNECTED
+	CS_CLOSED
+)
+
+type outPacket struct {
+	p             *packet
+	size          int
+	sentAt        time.Time
+	transmissions int
+	inFlight      bool
+	needResend    bool
+}
+
+// Stats are counters of a connection, mainly useful for tests and debugging.
+type Stats struct {
+	Window      int
+	RTT         time.Duration
+	OurDelay    time.Duration
+	Retransmits int
+}
+
+// Conn is a utp connection, it implements net.Conn.
+type Conn struct {
+	socket *Socket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state connState
+	err   error
+
+	seqNr uint16
+	ackNr uint16
+
+	// send side
+	outbuf    []*outPacket
+	curWindow int
+	peerWnd   int
+	cc        *ledbat
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	lastAck   uint16
+	dupAcks   int
+	stats     Stats
+
+	// receive side
+	readBuf    bytes.Buffer
+	reorder    map[uint16][]byte
+	replyMicro uint32
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+
+	closing  bool
+	closedAt time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:  s,
+		raddr:   raddr,
+		recvID:  recvID,
+		sendID:  sendID,
+		peerWnd: RECV_WINDOW,
+		cc:      newLedbat(time.Now()),
+		rto:     INITIAL_RTO,
+		reorder: make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Window = c.cc.window()
+	stats.RTT = c.rtt
+	stats.OurDelay = c.cc.ourDelay
+	return stats
+}
+
+func (c *Conn) recvWindow() uint32 {
+	used := c.readBuf.Len()
+	for _, b := range c.reorder {
+		used += len(b)
+	}
+
+	if used >= RECV_WINDOW {
+		return 0
+	}
+
+	return uint32(RECV_WINDOW - used)
+}
+
+// send stamps and writes a packet, it must be called with c.mu held.
+func (c *Conn) send(p *packet) {
+	// the SYN announces the id we receive on
+	p.connID = c.sendID
+	if p.typ == ST_SYN {
+		p.connID = c.recvID
+	}
+
+	p.timestamp = c.socket.nowMicro()
+	p.timestampDiff = c.replyMicro
+	p.wndSize = c.recvWindow()
+	p.ackNr = c.ackNr
+
+	if p.typ != ST_SYN {
+		p.sack = c.selectiveAck()
+	}
+
+	c.socket.writeTo(p.marshal(), c.raddr)
+}
+
+// selectiveAck builds the bitmask of the packets received out of order.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	var mask []byte
+	for seq := range c.reorder {
+		bit := int(seq - c.ackNr - 2)
+		if bit < 0 || bit >= 32*8 {
+			continue
+		}
+
+		for len(mask) <= bit/8 {
+			mask = append(mask, 0, 0, 0, 0)
+		}
+
+		mask[bit/8] |= 1 << (bit % 8)
+	}
+
+	return mask
+}
+
+func (c *Conn) sendState() {
+	c.send(&packet{header: header{typ: ST_STATE, seqNr: c.seqNr}})
+}
+
+// queue sends a packet that consumes a sequence number and keeps it until it
+// is acked.
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &packet{header: header{typ: typ, seqNr: c.seqNr}, payload: payload}
+	c.seqNr++
+
+	op := &outPacket{p: p, size: HEADER_LEN + len(payload)}
+	c.outbuf = append(c.outbuf, op)
+	c.transmit(op, time.Now())
+}
+
+func (c *Conn) transmit(op *outPacket, now time.Time) {
+	if op.transmissions > 0 {
+		c.stats.Retransmits++
+	}
+
+	op.sentAt = now
+	op.transmissions++
+	op.needResend = false
+	if !op.inFlight {
+		op.inFlight = true
+		c.curWindow += op.size
+	}
+
+	c.send(op.p)
+}
+
+func (c *Conn) sendWindow() int {
+	window := c.cc.window()
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+
+	return window
+}
+
+// canSend reports whether a packet of the given size fits into the window,
+// a single packet is always allowed so that a zero window is probed.
+func (c *Conn) canSend(size int) bool {
+	return c.curWindow == 0 || c.curWindow+size <= c.sendWindow()
+}
+
+// flush resends the packets that were lost as far as the window allows.
+func (c *Conn) flush(now time.Time) {
+	for _, op := range c.outbuf {
+		if !op.needResend {
+			continue
+		}
+
+		if !c.canSend(op.size) {
+			return
+		}
+
+		c.transmit(op, now)
+	}
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.state = CS_CLOSED
+	c.cond.Broadcast()
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < MIN_RTO {
+		c.rto = MIN_RTO
+	}
+}
+
+func (c *Conn) ackPacket(op *outPacket, now time.Time) int {
+	if op.inFlight {
+		c.curWindow -= op.size
+		op.inFlight = false
+	}
+
+	// only packets sent once give a meaningful round trip (Karn)
+	if op.transmissions == 1 {
+		c.updateRTT(now.Sub(op.sentAt))
+	}
+
+	return op.size
+}
+
+// processAck removes the packets acknowledged by p from the send buffer.
+func (c *Conn) processAck(p *packet, now time.Time) {
+	acked := 0
+	for len(c.outbuf) > 0 && !seqLess(p.ackNr, c.outbuf[0].p.seqNr) {
+		acked += c.ackPacket(c.outbuf[0], now)
+		c.outbuf = c.outbuf[1:]
+	}
+
+	// packets acked selectively are dropped from the window, a packet
+	// missing while several later ones arrived is considered lost
+	sacked := 0
+	for i := len(c.outbuf) - 1; i >= 0 && p.sack != nil; i-- {
+		op := c.outbuf[i]
+		bit := int(op.p.seqNr - p.ackNr - 2)
+		if bit < 0 || bit/8 >= len(p.sack) || p.sack[bit/8]&(1<<(bit%8)) == 0 {
+			if sacked >= DUP_ACK_THRESHOLD && op.inFlight {
+				op.needResend = true
+				c.cc.onLoss(now, c.rtt)
+			}
+
+			continue
+		}
+
+		sacked++
+		acked += c.ackPacket(op, now)
+		c.outbuf = append(c.outbuf[:i], c.outbuf[i+1:]...)
+	}
+
+	if acked == 0 && p.typ == ST_STATE && p.ackNr == c.lastAck && len(c.outbuf) > 0 {
+		c.dupAcks++
+		if c.dupAcks == DUP_ACK_THRESHOLD {
+			c.outbuf[0].needResend = true
+			c.cc.onLoss(now, c.rtt)
+		}
+	} else if acked > 0 {
+		c.dupAcks = 0
+	}
+
+	c.lastAck = p.ackNr
+
+	if p.timestampDiff != 0 {
+		c.cc.addDelaySample(p.timestampDiff, now)
+	}
+
+	c.cc.onAck(acked)
+}
+
+func (c *Conn) handlePacket(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.replyMicro = c.socket.nowMicro() - p.timestamp
+	c.peerWnd = int(p.wndSize)
+
+	if p.typ == ST_RESET {
+		c.fail(ErrConnReset)
+		return
+	}
+
+	if c.state == CS_SYN_SENT {
+		if p.typ != ST_STATE {
+			return
+		}
+
+		c.state = CS_CONNECTED
+		c.ackNr = p.seqNr - 1
+	}
+
+	c.processAck(p, now)
+
+	if p.typ == ST_DATA || p.typ == ST_FIN {
+		c.receive(p)
+	}
+
+	c.flush(now)
+	c.cond.Broadcast()
+}
+
+// receive delivers the payload of data packets in order and acks them.
+func (c *Conn) receive(p *packet) {
+	if p.typ == ST_FIN && !c.gotFin {
+		c.gotFin = true
+		c.finSeq = p.seqNr
+	}
+
+	switch {
+	case p.seqNr == c.ackNr+1:
+		c.readBuf.Write(p.payload)
+		c.ackNr++
+
+		for {
+			payload, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+
+			delete(c.reorder, c.ackNr+1)
+			c.readBuf.Write(payload)
+			c.ackNr++
+		}
+	case seqLess(c.ackNr, p.seqNr) && int(p.seqNr-c.ackNr) < 32*8:
+		c.reorder[p.seqNr] = p.payload
+	}
+
+	if c.gotFin && c.ackNr == c.finSeq {
+		c.eof = true
+	}
+
+	c.sendState()
+}
+
+// tick retransmits timed out packets, it returns false once the connection
+// can be forgotten by the socket.
+func (c *Conn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CS_CLOSED {
+		return false
+	}
+
+	if c.closing && (len(c.outbuf) == 0 || now.Sub(c.closedAt) > LINGER_TIMEOUT) {
+		c.state = CS_CLOSED
+		return false
+	}
+
+	if len(c.outbuf) == 0 {
+		return true
+	}
+
+	first := c.outbuf[0]
+	if first.inFlight && now.Sub(first.sentAt) < c.rto {
+		c.flush(now)
+		return true
+	}
+
+	if !first.inFlight && !first.needResend {
+		return true
+	}
+
+	maxTransmissions := MAX_TRANSMISSIONS
+	if first.p.typ == ST_SYN {
+		maxTransmissions = MAX_SYN_TRANSMISSIONS
+	}
+
+	if first.transmissions >= maxTransmissions {
+		c.fail(ErrTimeout)
+		return false
+	}
+
+	// everything in flight is considered lost, the window restarts with a
+	// single packet
+	if first.inFlight {
+		c.cc.onTimeout(now)
+		c.rto *= 2
+		if c.rto > MAX_RTO {
+			c.rto = MAX_RTO
+		}
+
+		for _, op := range c.outbuf {
+			if op.inFlight {
+				op.inFlight = false
+				op.needResend = true
+				c.curWindow -= op.size
+			}
+		}
+	}
+
+	c.flush(now)
+	return true
+}
+
+func (c *Conn) setTimer(timer **time.Timer, deadline time.Time) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+
+	if deadline.IsZero() {
+		return
+	}
+
+	*timer = time.AfterFunc(time.Until(deadline), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.cond.Broadcast()
+	})
+}
+
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.readBuf.Len() > 0 {
+			wasFull := c.recvWindow() < MAX_PAYLOAD
+			n, _ := c.readBuf.Read(b)
+
+			// tell the peer that the window opened again
+			if wasFull && c.state == CS_CONNECTED {
+				c.sendState()
+			}
+
+			return n, nil
+		}
+
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if c.closing {
+			return 0, net.ErrClosed
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		if deadlinePassed(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.closing {
+			return written, net.ErrClosed
+		}
+
+		if c.err != nil {
+			return written, c.err
+		}
+
+		if deadlinePassed(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		size := len(b) - written
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+
+		if c.state != CS_CONNECTED || !c.canSend(HEADER_LEN+size) {
+			c.cond.Wait()
+			continue
+		}
+
+		payload := append([]byte{}, b[written:written+size]...)
+		c.queue(ST_DATA, payload)
+		written += size
+	}
+
+	return written, nil
+}
+
+// Close sends a FIN, the socket keeps retransmitting unacked data in the
+// background for a while.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return net.ErrClosed
+	}
+
+	c.closing = true
+	c.closedAt = time.Now()
+	if c.state == CS_CONNECTED {
+		c.queue(ST_FIN, nil)
+	} else {
+		c.state = CS_CLOSED
+	}
+
+	c.setTimer(&c.readTimer, time.Time{})
+	c.setTimer(&c.writeTimer, time.Time{})
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.setTimer(&c.readTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.setTimer(&c.writeTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
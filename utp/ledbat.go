@@ -0,0 +1,122 @@
+package utp
+
+import (
+	"math"
+	"time"
+)
+
+// LEDBAT congestion control (BEP 29): the window grows while the one way
+// delay of our packets stays below the target and shrinks as soon as we
+// start to fill the queues of the uplink, so that other traffic on the same
+// link keeps a low latency.
+const (
+	CCONTROL_TARGET                 = 100 * time.Millisecond
+	MAX_CWND_INCREASE_BYTES_PER_RTT = 3000
+	MIN_WINDOW                      = MAX_PAYLOAD
+	INITIAL_WINDOW                  = 3 * MAX_PAYLOAD
+
+	// the base delay is the minimum delay seen during the last few minutes
+	baseDelayHistory  = 3
+	baseDelayInterval = time.Minute
+)
+
+type ledbat struct {
+	maxWindow  float64
+	slowStart  bool
+	ssthresh   float64
+	ourDelay   time.Duration
+	baseDelays [baseDelayHistory]uint32
+	baseIdx    int
+	rolledAt   time.Time
+	lastCut    time.Time
+}
+
+func newLedbat(now time.Time) *ledbat {
+	l := &ledbat{
+		maxWindow: INITIAL_WINDOW,
+		slowStart: true,
+		ssthresh:  math.MaxFloat64,
+		rolledAt:  now,
+	}
+
+	for i := range l.baseDelays {
+		l.baseDelays[i] = math.MaxUint32
+	}
+
+	return l
+}
+
+func (l *ledbat) window() int {
+	return int(l.maxWindow)
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	base := uint32(math.MaxUint32)
+	for _, d := range l.baseDelays {
+		if d < base {
+			base = d
+		}
+	}
+
+	return base
+}
+
+// addDelaySample records the one way delay the remote peer measured for one
+// of our packets.
+func (l *ledbat) addDelaySample(sample uint32, now time.Time) {
+	if now.Sub(l.rolledAt) >= baseDelayInterval {
+		l.rolledAt = now
+		l.baseIdx = (l.baseIdx + 1) % baseDelayHistory
+		l.baseDelays[l.baseIdx] = math.MaxUint32
+	}
+
+	if sample < l.baseDelays[l.baseIdx] {
+		l.baseDelays[l.baseIdx] = sample
+	}
+
+	l.ourDelay = time.Duration(sample-l.baseDelay()) * time.Microsecond
+}
+
+// onAck adjusts the window after bytesAcked bytes were acknowledged.
+func (l *ledbat) onAck(bytesAcked int) {
+	if bytesAcked <= 0 {
+		return
+	}
+
+	offTarget := float64(CCONTROL_TARGET - l.ourDelay)
+	delayFactor := offTarget / float64(CCONTROL_TARGET)
+	windowFactor := math.Min(float64(bytesAcked), l.maxWindow) / math.Max(l.maxWindow, float64(bytesAcked))
+	gain := MAX_CWND_INCREASE_BYTES_PER_RTT * windowFactor * delayFactor
+
+	// slow start doubles the window every round trip until the delay or a
+	// loss tells that the link is full
+	if l.slowStart {
+		if delayFactor <= 0.5 || l.maxWindow >= l.ssthresh {
+			l.slowStart = false
+		} else if ss := float64(bytesAcked); ss > gain {
+			gain = ss
+		}
+	}
+
+	l.maxWindow = math.Max(l.maxWindow+gain, MIN_WINDOW)
+}
+
+// onLoss halves the window, at most once per round trip.
+func (l *ledbat) onLoss(now time.Time, rtt time.Duration) {
+	if now.Sub(l.lastCut) < rtt {
+		return
+	}
+
+	l.lastCut = now
+	l.slowStart = false
+	l.maxWindow = math.Max(l.maxWindow/2, MIN_WINDOW)
+	l.ssthresh = l.maxWindow
+}
+
+// onTimeout collapses the window to a single packet.
+func (l *ledbat) onTimeout(now time.Time) {
+	l.lastCut = now
+	l.slowStart = false
+	l.ssthresh = math.Max(l.maxWindow/2, MIN_WINDOW)
+	l.maxWindow = MIN_WINDOW
+}
@@ -0,0 +1,129 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrInvalidPacket = errors.New("invalid utp packet")
+)
+
+// packet types (BEP 29)
+const (
+	ST_DATA uint8 = iota
+	ST_FIN
+	ST_STATE
+	ST_RESET
+	ST_SYN
+)
+
+const VERSION = 1
+
+const HEADER_LEN = 20
+
+// extension types
+const (
+	EXT_NONE          = 0
+	EXT_SELECTIVE_ACK = 1
+)
+
+type header struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+type packet struct {
+	header
+	// sack is the bitmask of the selective ack extension, bit 0 stands for
+	// ack_nr + 2. It is nil when the extension is absent.
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	size := HEADER_LEN + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+
+	buf := make([]byte, HEADER_LEN, size)
+	buf[0] = p.typ<<4 | VERSION
+	if p.sack != nil {
+		buf[1] = EXT_SELECTIVE_ACK
+	}
+
+	binary.BigEndian.PutUint16(buf[2:4], p.connID)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], p.ackNr)
+
+	if p.sack != nil {
+		buf = append(buf, EXT_NONE, byte(len(p.sack)))
+		buf = append(buf, p.sack...)
+	}
+
+	return append(buf, p.payload...)
+}
+
+func unmarshalPacket(b []byte) (*packet, error) {
+	if !isPacket(b) {
+		return nil, ErrInvalidPacket
+	}
+
+	p := &packet{}
+	p.typ = b[0] >> 4
+	p.connID = binary.BigEndian.Uint16(b[2:4])
+	p.timestamp = binary.BigEndian.Uint32(b[4:8])
+	p.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	p.wndSize = binary.BigEndian.Uint32(b[12:16])
+	p.seqNr = binary.BigEndian.Uint16(b[16:18])
+	p.ackNr = binary.BigEndian.Uint16(b[18:20])
+
+	// walk the extension chain, unknown extensions are skipped
+	ext := b[1]
+	offset := HEADER_LEN
+	for ext != EXT_NONE {
+		if offset+2 > len(b) {
+			return nil, ErrInvalidPacket
+		}
+
+		next, length := b[offset], int(b[offset+1])
+		offset += 2
+		if offset+length > len(b) {
+			return nil, ErrInvalidPacket
+		}
+
+		if ext == EXT_SELECTIVE_ACK {
+			if length == 0 || length%4 != 0 {
+				return nil, ErrInvalidPacket
+			}
+
+			p.sack = append([]byte{}, b[offset:offset+length]...)
+		}
+
+		ext = next
+		offset += length
+	}
+
+	p.payload = append([]byte{}, b[offset:]...)
+	return p, nil
+}
+
+// isPacket tells utp packets apart from other protocols sharing the socket,
+// e.g. the bencoded messages of the dht always start with 'd'.
+func isPacket(b []byte) bool {
+	return len(b) >= HEADER_LEN && b[0]&0x0f == VERSION && b[0]>>4 <= ST_SYN
+}
+
+// seqLess compares sequence numbers with wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,354 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dlog"
+)
+
+var (
+	ErrSocketClosed = errors.New("utp socket closed")
+)
+
+const (
+	DEFAULT_DIAL_TIMEOUT = 10 * time.Second
+
+	TICK_INTERVAL = 50 * time.Millisecond
+
+	// inbound connections waiting to be accepted
+	ACCEPT_BACKLOG = 64
+
+	maxPacketSize = 2048
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes utp connections over a single udp socket. Packets that
+// are not utp are handed to the fallback handler so that the socket can be
+// shared with the dht.
+type Socket struct {
+	conn    net.PacketConn
+	started time.Time
+
+	mu       sync.Mutex
+	conns    map[connKey]*Conn
+	fallback func([]byte, *net.UDPAddr)
+
+	accept    chan *Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+func init() {
+	dlog.Init()
+}
+
+// Listen opens a udp socket and serves utp on it.
+func Listen(network, addr string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSocket(conn), nil
+}
+
+// NewSocket serves utp on an existing packet conn, the socket takes
+// ownership of it.
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:    conn,
+		started: time.Now(),
+		conns:   make(map[connKey]*Conn),
+		accept:  make(chan *Conn, ACCEPT_BACKLOG),
+		closed:  make(chan struct{}),
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.readRoutine()
+	}()
+
+	go func() {
+		defer s.wg.Done()
+		s.tickRoutine()
+	}()
+
+	return s
+}
+
+// SetFallback registers the handler of the packets that are not utp.
+func (s *Socket) SetFallback(handler func([]byte, *net.UDPAddr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fallback = handler
+}
+
+// PacketConn returns the underlying socket, other protocols write their
+// packets directly to it.
+func (s *Socket) PacketConn() net.PacketConn {
+	return s.conn
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) nowMicro() uint32 {
+	return uint32(time.Since(s.started).Microseconds())
+}
+
+func (s *Socket) writeTo(b []byte, addr *net.UDPAddr) {
+	if _, err := s.conn.WriteTo(b, addr); err != nil {
+		dlog.Warnf("failed to write utp packet to %s with error: %v", addr, err)
+	}
+}
+
+func (s *Socket) Dial(addr string) (*Conn, error) {
+	return s.DialTimeout(addr, DEFAULT_DIAL_TIMEOUT)
+}
+
+// DialTimeout connects to a remote utp socket, it fails when the SYN is not
+// acknowledged within the timeout.
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, ErrSocketClosed
+	default:
+	}
+
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Uint32())
+		if _, ok := s.conns[connKey{raddr.String(), recvID}]; !ok {
+			break
+		}
+	}
+
+	c := newConn(s, raddr, recvID, recvID+1)
+	s.conns[connKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+
+	c.mu.Lock()
+	c.seqNr = 1
+	c.queue(ST_SYN, nil)
+	c.setTimer(&c.readTimer, deadline)
+	for c.state == CS_SYN_SENT && !deadlinePassed(deadline) {
+		c.cond.Wait()
+	}
+
+	c.setTimer(&c.readTimer, time.Time{})
+	state, err := c.state, c.err
+	if state != CS_CONNECTED {
+		c.state = CS_CLOSED
+		if err == nil {
+			err = ErrTimeout
+		}
+	}
+	c.mu.Unlock()
+
+	if state != CS_CONNECTED {
+		s.remove(c)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Accept waits for the next inbound connection, together with Addr and Close
+// the socket implements net.Listener.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrSocketClosed
+	}
+}
+
+// Close resets all connections and closes the underlying socket.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			if c.state != CS_CLOSED {
+				c.send(&packet{header: header{typ: ST_RESET, seqNr: c.seqNr}})
+			}
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+
+		err = s.conn.Close()
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) readRoutine() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		cnt, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			dlog.Errorf("failed to read utp packet with error: %v", err)
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if !isPacket(buf[:cnt]) {
+			s.mu.Lock()
+			fallback := s.fallback
+			s.mu.Unlock()
+
+			if fallback != nil {
+				fallback(append([]byte{}, buf[:cnt]...), udpAddr)
+			}
+
+			continue
+		}
+
+		p, err := unmarshalPacket(buf[:cnt])
+		if err != nil {
+			continue
+		}
+
+		s.handlePacket(p, udpAddr)
+	}
+}
+
+func (s *Socket) handlePacket(p *packet, addr *net.UDPAddr) {
+	s.mu.Lock()
+	c, ok := s.conns[connKey{addr.String(), p.connID}]
+	s.mu.Unlock()
+
+	if ok {
+		c.handlePacket(p)
+		return
+	}
+
+	switch p.typ {
+	case ST_SYN:
+		s.handleSyn(p, addr)
+	case ST_RESET:
+	default:
+		s.writeTo((&packet{header: header{
+			typ:       ST_RESET,
+			connID:    p.connID,
+			timestamp: s.nowMicro(),
+			seqNr:     uint16(rand.Uint32()),
+			ackNr:     p.seqNr,
+		}}).marshal(), addr)
+	}
+}
+
+func (s *Socket) handleSyn(p *packet, addr *net.UDPAddr) {
+	key := connKey{addr.String(), p.connID + 1}
+
+	s.mu.Lock()
+	if c, ok := s.conns[key]; ok {
+		s.mu.Unlock()
+
+		// our reply got lost, the SYN is retransmitted
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		return
+	}
+
+	c := newConn(s, addr, p.connID+1, p.connID)
+	c.state = CS_CONNECTED
+	c.seqNr = uint16(rand.Uint32())
+	c.ackNr = p.seqNr
+	c.peerWnd = int(p.wndSize)
+
+	select {
+	case s.accept <- c:
+	default:
+		s.mu.Unlock()
+		dlog.Warnf("utp accept backlog is full, dropping connection from %s", addr)
+		return
+	}
+
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.replyMicro = s.nowMicro() - p.timestamp
+	c.sendState()
+	c.mu.Unlock()
+}
+
+func (s *Socket) tickRoutine() {
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				if !c.tick(now) {
+					s.remove(c)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package utp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dizzrt/dgo-torrent/dht"
+	"github.com/Dizzrt/dgo-torrent/utp"
+)
+
+func listen(t *testing.T) *utp.Socket {
+	s, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// lossyConn drops and reorders outgoing packets.
+type lossyConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	count   int
+	delayed []byte
+	addr    net.Addr
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count++
+	switch {
+	case c.count%7 == 0:
+		return len(b), nil
+	case c.count%5 == 0 && c.delayed == nil:
+		c.delayed, c.addr = append([]byte{}, b...), addr
+		return len(b), nil
+	}
+
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if c.delayed != nil {
+		c.PacketConn.WriteTo(c.delayed, c.addr)
+		c.delayed = nil
+	}
+
+	return n, err
+}
+
+func transfer(t *testing.T, server, client *utp.Socket, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+		got, _ := io.ReadAll(conn)
+		received <- got
+	}()
+
+	conn, err := client.DialTimeout(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes not matching the %d bytes sent", len(got), len(data))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, listen(t), listen(t), 1<<20)
+}
+
+func TestTransferLossy(t *testing.T) {
+	newLossy := func() *utp.Socket {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := utp.NewSocket(&lossyConn{PacketConn: conn})
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	transfer(t, newLossy(), newLossy(), 256<<10)
+}
+
+func TestEcho(t *testing.T) {
+	server, client := listen(t), listen(t)
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong", "hello utp"} {
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != msg {
+			t.Errorf("expected %q, got %q", msg, buf)
+		}
+	}
+
+	if stats := conn.Stats(); stats.RTT <= 0 || stats.Window <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	server, client := listen(t), listen(t)
+
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			time.Sleep(time.Second)
+			conn.Close()
+		}
+	}()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestDialTimeout(t *testing.T) {
+	// a plain udp socket never answers the SYN
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err = listen(t).DialTimeout(conn.LocalAddr().String(), 300*time.Millisecond); err != utp.ErrTimeout {
+		t.Errorf("expected %v, got %v", utp.ErrTimeout, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial took %v", elapsed)
+	}
+}
+
+func TestDialClosedPort(t *testing.T) {
+	// a utp socket without the connection answers with a RESET
+	server, client := listen(t), listen(t)
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("data"))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected an error once the remote socket is gone")
+	}
+}
+
+func TestSharedSocket(t *testing.T) {
+	s := listen(t)
+
+	node, err := dht.NewNode(dht.Config{Conn: s.PacketConn(), QueryTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	s.SetFallback(node.HandlePacket)
+	node.Start()
+
+	other, err := dht.NewNode(dht.Config{Addr: "127.0.0.1:0", QueryTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Start()
+
+	id, err := other.Ping(s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != node.ID() {
+		t.Errorf("expected id %s, got %s", node.ID(), id)
+	}
+
+	// utp keeps working on the same socket
+	transfer(t, s, listen(t), 64<<10)
+}
@@ -0,0 +1,148 @@
+package dgotorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"strings"
+)
+
+// VerifyResult lists the data on disk that does not match the torrent. V1
+// pieces are checked against their SHA-1 hashes, v2 files against their
+// merkle trees, hybrid torrents are checked both ways. Files carrying a sha1
+// attribute are checked against it as well.
+type VerifyResult struct {
+	CheckedV1 bool
+	CheckedV2 bool
+	BadPieces []int
+	BadFiles  []string
+}
+
+func (r *VerifyResult) OK() bool {
+	return len(r.BadPieces) == 0 && len(r.BadFiles) == 0
+}
+
+// zeroReader yields zeros, it stands in for padding files, symlinks and
+// missing files.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// openContent returns the concatenated content of the files, the returned
+// closer releases the opened files.
+func (info *TorrentInfo) openContent(dir string) (io.Reader, func()) {
+	files := info.FileList()
+	readers := make([]io.Reader, 0, len(files))
+	opened := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		var r io.Reader = zeroReader{}
+		if !f.IsPadding() && !f.IsSymlink() {
+			if p, err := info.FilePath(dir, f); err == nil {
+				if file, err := os.Open(p); err == nil {
+					opened = append(opened, file)
+					r = io.MultiReader(file, zeroReader{})
+				}
+			}
+		}
+
+		readers = append(readers, io.LimitReader(r, f.Length))
+	}
+
+	return io.MultiReader(readers...), func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}
+}
+
+// Verify checks the downloaded data of the torrent below dir.
+func (tf *TorrentFile) Verify(dir string) (*VerifyResult, error) {
+	info := &tf.Info
+	res := &VerifyResult{}
+
+	if info.HasV1() {
+		res.CheckedV1 = true
+
+		r, closeFn := info.openContent(dir)
+		defer closeFn()
+
+		buf := make([]byte, info.PieceLength)
+		for i, hash := range info.PieceHashes {
+			begin, end := info.PieceBounds(i)
+			piece := buf[:end-begin]
+			if _, err := io.ReadFull(r, piece); err != nil {
+				return nil, err
+			}
+
+			if sum := sha1.Sum(piece); !bytes.Equal(sum[:], hash[:]) {
+				res.BadPieces = append(res.BadPieces, i)
+			}
+		}
+	}
+
+	res.CheckedV2 = info.HasV2()
+	for _, f := range info.FileList() {
+		if f.IsPadding() || f.IsSymlink() {
+			continue
+		}
+
+		ok := true
+		if res.CheckedV2 && f.Length > 0 {
+			ok = tf.verifyFileV2(dir, f)
+		}
+
+		if ok && f.HasSHA1() {
+			ok = info.verifyFileSHA1(dir, f)
+		}
+
+		if !ok {
+			res.BadFiles = append(res.BadFiles, strings.Join(f.Path, "/"))
+		}
+	}
+
+	return res, nil
+}
+
+func (tf *TorrentFile) verifyFileV2(dir string, f FileEntry) bool {
+	p, err := tf.Info.FilePath(dir, f)
+	if err != nil {
+		return false
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	if stat, err := file.Stat(); err != nil || stat.Size() != f.Length {
+		return false
+	}
+
+	root, _, err := fileMerkle(file, f.Length, tf.Info.PieceLength)
+	return err == nil && root == f.PiecesRoot
+}
+
+func (info *TorrentInfo) verifyFileSHA1(dir string, f FileEntry) bool {
+	p, err := info.FilePath(dir, f)
+	if err != nil {
+		return false
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	if n, err := io.Copy(h, file); err != nil || n != f.Length {
+		return false
+	}
+
+	return bytes.Equal(h.Sum(nil), f.SHA1[:])
+}
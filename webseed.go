@@ -0,0 +1,130 @@
+package dgotorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidWebSeed = errors.New("invalid web seed url")
+)
+
+const (
+	WEBSEED_TIMEOUT = 30 * time.Second
+
+	// a web seed is given up after that many failures in a row, the delay
+	// between attempts grows with every failure
+	WEBSEED_MAX_FAILURES = 5
+	WEBSEED_RETRY_DELAY  = 2 * time.Second
+)
+
+// WebSeed downloads pieces from a http server that hosts the content of a
+// torrent (BEP 19). Pieces spanning several files are fetched with one range
+// request per file.
+type WebSeed struct {
+	URL    string
+	Client *http.Client
+	info   *TorrentInfo
+}
+
+func NewWebSeed(rawURL string, info *TorrentInfo) (*WebSeed, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, ErrInvalidWebSeed
+	}
+
+	return &WebSeed{
+		URL:    rawURL,
+		Client: &http.Client{Timeout: WEBSEED_TIMEOUT},
+		info:   info,
+	}, nil
+}
+
+// fileURL returns the url of a file. The name of the torrent is appended to
+// urls ending with a slash, multi file torrents always use it as directory.
+func (w *WebSeed) fileURL(file int) string {
+	if !w.info.IsMutiFile {
+		if strings.HasSuffix(w.URL, "/") {
+			return w.URL + url.PathEscape(w.info.Name)
+		}
+
+		return w.URL
+	}
+
+	parts := []string{url.PathEscape(w.info.Name)}
+	for _, p := range w.info.Files[file].Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+
+	base := w.URL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	return base + strings.Join(parts, "/")
+}
+
+// FetchPiece downloads a piece, it is not verified.
+func (w *WebSeed) FetchPiece(ctx context.Context, index int) ([]byte, error) {
+	begin, end := w.info.PieceBounds(index)
+	if index < 0 || begin >= end {
+		return nil, fmt.Errorf("piece index out of range: %d", index)
+	}
+
+	data := make([]byte, end-begin)
+	files := w.info.FileList()
+	for _, seg := range w.info.fileSegments(begin, end-begin) {
+		// padding and the gaps between the files of v2 torrents are all zero
+		// and not served by the seed (BEP 47)
+		if seg.padding {
+			continue
+		}
+
+		buf, err := w.fetchRange(ctx, w.fileURL(seg.file), seg.offset, seg.length)
+		if err != nil {
+			return nil, err
+		}
+
+		copy(data[files[seg.file].Offset+seg.offset-begin:], buf)
+	}
+
+	return data, nil
+}
+
+func (w *WebSeed) fetchRange(ctx context.Context, fileURL string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range and sends the whole file
+		if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("web seed %s responded with %s", fileURL, resp.Status)
+	}
+
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(resp.Body, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
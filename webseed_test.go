@@ -0,0 +1,217 @@
+package dgotorrent_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+	"github.com/Dizzrt/dgo-torrent/bencode"
+)
+
+type webSeedFile struct {
+	path []string
+	data []byte
+}
+
+// webSeedTorrent builds a multi file torrent of the given files and a server
+// hosting them below /seed/<name>/.
+func webSeedTorrent(t *testing.T, pieceLength int, files []webSeedFile) (*dgotorrent.TorrentFile, []byte) {
+	root := t.TempDir()
+
+	var content []byte
+	list := make([]any, 0, len(files))
+	for _, f := range files {
+		p := filepath.Join(append([]string{root, "seed", "web seed"}, f.path...)...)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		path := make([]any, 0, len(f.path))
+		for _, s := range f.path {
+			path = append(path, s)
+		}
+
+		list = append(list, map[string]any{"length": int64(len(f.data)), "path": path})
+		content = append(content, f.data...)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	t.Cleanup(server.Close)
+
+	raw, err := bencode.Marshal(map[string]any{
+		"announce": "",
+		"url-list": []any{server.URL + "/seed/"},
+		"info": map[string]any{
+			"name":         "web seed",
+			"piece length": int64(pieceLength),
+			"pieces":       pieceHashes(content, pieceLength),
+			"files":        list,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := dgotorrent.NewTorrentFile(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tf, content
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+
+	return data
+}
+
+// pieceHashes returns the concatenated SHA-1 hashes of the pieces of the
+// content, the pieces key of a v1 torrent.
+func pieceHashes(content []byte, pieceLength int) string {
+	var pieces strings.Builder
+	for i := 0; i < len(content); i += pieceLength {
+		hash := sha1.Sum(content[i:min(i+pieceLength, len(content))])
+		pieces.Write(hash[:])
+	}
+
+	return pieces.String()
+}
+
+func TestParseURLList(t *testing.T) {
+	raw, _ := bencode.Marshal(map[string]any{
+		"announce":  "http://tracker/announce",
+		"url-list":  "http://mirror/file.iso",
+		"httpseeds": []any{"http://seed/a", "http://seed/b"},
+		"info": map[string]any{
+			"name":         "file.iso",
+			"length":       int64(10),
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	tf, err := dgotorrent.NewTorrentFile(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tf.URLList) != 1 || tf.URLList[0] != "http://mirror/file.iso" {
+		t.Errorf("unexpected url-list %v", tf.URLList)
+	}
+
+	if len(tf.HTTPSeeds) != 2 {
+		t.Errorf("unexpected httpseeds %v", tf.HTTPSeeds)
+	}
+}
+
+func TestWebSeedFetchPiece(t *testing.T) {
+	tf, content := webSeedTorrent(t, 1000, []webSeedFile{
+		{[]string{"a.txt"}, randomData(700)},
+		{[]string{"dir", "b c.bin"}, randomData(1500)},
+		{[]string{"empty"}, nil},
+		{[]string{"d"}, randomData(5)},
+	})
+
+	if tf.Info.Length != int64(len(content)) || len(tf.Info.Files) != 4 || tf.Info.Files[3].Offset != 2200 {
+		t.Fatalf("unexpected file layout: %d %+v", tf.Info.Length, tf.Info.Files)
+	}
+
+	seed, err := dgotorrent.NewWebSeed(tf.URLList[0], &tf.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range tf.Info.PieceHashes {
+		data, err := seed.FetchPiece(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		begin, end := tf.Info.PieceBounds(i)
+		if !bytes.Equal(data, content[begin:end]) {
+			t.Errorf("piece %d does not match", i)
+		}
+	}
+
+	if _, err = seed.FetchPiece(context.Background(), len(tf.Info.PieceHashes)); err == nil {
+		t.Error("expected an error for a piece out of range")
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	data := randomData(3000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/single.bin" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeContent(w, r, "single.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	info := &dgotorrent.TorrentInfo{Name: "single.bin", Length: int64(len(data)), PieceLength: 1024}
+	for _, u := range []string{server.URL + "/files/", server.URL + "/files/single.bin"} {
+		seed, err := dgotorrent.NewWebSeed(u, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		piece, err := seed.FetchPiece(context.Background(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(piece, data[2048:]) {
+			t.Errorf("last piece fetched from %s does not match", u)
+		}
+	}
+
+	if _, err := dgotorrent.NewWebSeed("ftp://mirror/file", info); err != dgotorrent.ErrInvalidWebSeed {
+		t.Errorf("expected %v, got %v", dgotorrent.ErrInvalidWebSeed, err)
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	second := randomData(30000)
+	tf, _ := webSeedTorrent(t, dgotorrent.BLOCKSIZE, []webSeedFile{
+		{[]string{"first.bin"}, randomData(20000)},
+		{[]string{"sub", "second.bin"}, second},
+	})
+
+	task := &dgotorrent.Task{
+		Name:    tf.Info.Name,
+		Path:    t.TempDir(),
+		PeerID:  "-TEST00-000000000001",
+		Torrent: *tf,
+	}
+
+	if err := dgotorrent.NewProcess(task).Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(task.Path, task.Name, "sub", "second.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, second) {
+		t.Error("downloaded data does not match")
+	}
+
+	if res, err := tf.Verify(task.Path); err != nil || !res.OK() {
+		t.Errorf("unexpected verify result %+v: %v", res, err)
+	}
+}
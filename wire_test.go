@@ -0,0 +1,165 @@
+package dgotorrent_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	dgotorrent "github.com/Dizzrt/dgo-torrent"
+)
+
+// the peer id of the fake peers of the tests
+const fakePeerID = "-FAKE00-000000000000"
+
+// handshakeMsg returns the handshake of a fake peer for the info hash, the
+// reserved bytes announce its extensions.
+func handshakeMsg(reserved [8]byte, infoHash []byte) []byte {
+	hs := append([]byte{19}, "BitTorrent protocol"...)
+	hs = append(hs, reserved[:]...)
+	hs = append(hs, infoHash...)
+
+	return append(hs, fakePeerID...)
+}
+
+// answerHandshake reads the handshake of a connecting peer and answers it, it
+// returns the handshake that was read.
+func answerHandshake(conn net.Conn, reserved [8]byte) ([]byte, error) {
+	hs := make([]byte, 68)
+	if _, err := io.ReadFull(conn, hs); err != nil {
+		return nil, err
+	}
+
+	_, err := conn.Write(handshakeMsg(reserved, hs[28:48]))
+	return hs, err
+}
+
+// dialHandshake connects to a listening peer and exchanges the handshakes of
+// the info hash with it.
+func dialHandshake(t *testing.T, addr string, reserved [8]byte, infoHash [dgotorrent.INFO_HASH_LEN]byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	conn.Write(handshakeMsg(reserved, infoHash[:]))
+	if _, err = io.ReadFull(conn, make([]byte, 68)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func writePeerMsg(w io.Writer, id byte, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = id
+	copy(buf[5:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readPeerMsg reads the next message, keep-alives have the id 0xff.
+func readPeerMsg(r io.Reader) (byte, []byte, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return 0, nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+
+	if len(buf) == 0 {
+		return 0xff, nil, nil
+	}
+
+	return buf[0], buf[1:], nil
+}
+
+func blockMsg(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return payload
+}
+
+// parseBlockMsg returns the block of a request, cancel or reject message.
+func parseBlockMsg(payload []byte) (index, begin, length int) {
+	index = int(binary.BigEndian.Uint32(payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(payload[4:8]))
+	length = int(binary.BigEndian.Uint32(payload[8:12]))
+
+	return index, begin, length
+}
+
+// pieceMsg returns the payload of a piece message of the block.
+func pieceMsg(index, begin int, block []byte) []byte {
+	return append(blockMsg(index, begin, 0)[:8], block...)
+}
+
+func indexMsg(index int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(index))
+}
+
+// serveBlocks answers the block requests of the peer until the connection
+// fails.
+func serveBlocks(conn net.Conn, data []byte, pieceLength int) {
+	for {
+		id, payload, err := readPeerMsg(conn)
+		if err != nil {
+			return
+		}
+
+		if id != 6 {
+			continue
+		}
+
+		index, begin, length := parseBlockMsg(payload)
+		offset := index*pieceLength + begin
+		writePeerMsg(conn, 7, pieceMsg(index, begin, data[offset:offset+length]))
+	}
+}
+
+// peerMsgs reads the message ids of a connection until it fails.
+func peerMsgs(conn net.Conn) chan byte {
+	ids := make(chan byte, 16)
+	go func() {
+		defer close(ids)
+		for {
+			id, _, err := readPeerMsg(conn)
+			if err != nil {
+				return
+			}
+			ids <- id
+		}
+	}()
+
+	return ids
+}
+
+// waitMsg reports whether a message with the id arrives within d.
+func waitMsg(ids chan byte, id byte, d time.Duration) bool {
+	timeout := time.After(d)
+	for {
+		select {
+		case got, ok := <-ids:
+			if !ok {
+				return false
+			}
+
+			if got == id {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}